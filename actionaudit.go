@@ -0,0 +1,163 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Users complain about being deleted or banned, so admins need to see what the bot did and why.
+// Every action of the bot (see logAction), e.g. a warning sent, a message deleted, a user banned
+// or muted or a chat left, is also appended to the audit log area "actions" with its time, chat,
+// user, trigger and outcome, stored with the state and shown by /audit actions. The log is written
+// to by the logger, which may be called with data.lock held, so the entries are passed on through
+// a queue.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// actionAuditQueueLength is the number of actions waiting to be recorded beyond which actions
+// are dropped.
+const actionAuditQueueLength = 1000
+
+var metricActionAuditsDropped = newCounter("scamwarnbot_action_audits_dropped_total",
+	"Actions not recorded in the audit log because the queue was full.")
+
+var (
+	actionAudits = make(chan *AuditEntry, actionAuditQueueLength)
+	// Set while recordActionAudits takes entries from actionAudits.
+	actionAuditsRecorded atomic.Bool
+)
+
+// actionAuditHandler passes all records to the handler of the regular logs and additionally
+// queues the actions of the bot for the audit log, regardless of the log level.
+type actionAuditHandler struct {
+	base slog.Handler
+	// Attributes added with WithAttrs, keys prefixed with their groups.
+	attrs  []slog.Attr
+	prefix string
+}
+
+// withActionAudit returns a handler additionally recording the actions of the bot in the audit
+// log once recordActionAudits runs.
+func withActionAudit(base slog.Handler) slog.Handler {
+	return &actionAuditHandler{base: base}
+}
+
+func (h *actionAuditHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	// Actions are logged at info level or above.
+	return level >= slog.LevelInfo || h.base.Enabled(ctx, level)
+}
+
+func (h *actionAuditHandler) Handle(ctx context.Context, record slog.Record) error {
+	if actionAuditsRecorded.Load() {
+		if entry := actionAuditEntry(h.attrs, h.prefix, record); entry != nil {
+			select {
+			case actionAudits <- entry:
+			default:
+				metricActionAuditsDropped.inc()
+			}
+		}
+	}
+	if !h.base.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.base.Handle(ctx, record)
+}
+
+func (h *actionAuditHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := append([]slog.Attr{}, h.attrs...)
+	for _, attr := range attrs {
+		prefixed = append(prefixed, slog.Attr{Key: h.prefix + attr.Key, Value: attr.Value})
+	}
+	return &actionAuditHandler{base: h.base.WithAttrs(attrs), attrs: prefixed, prefix: h.prefix}
+}
+
+func (h *actionAuditHandler) WithGroup(name string) slog.Handler {
+	return &actionAuditHandler{base: h.base.WithGroup(name), attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+// actionAuditEntry returns the audit entry of a logged action, or nil if the record is not about
+// an action. The change reads e.g. "ban: ok (chat_id=-100123 user_id=42 reason=blocklist)".
+func actionAuditEntry(attrs []slog.Attr, prefix string, record slog.Record) *AuditEntry {
+	fields := map[string]string{}
+	for _, attr := range attrs {
+		fields[attr.Key] = attr.Value.String()
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		fields[prefix+attr.Key] = attr.Value.String()
+		return true
+	})
+	action, ok := fields["action"]
+	if !ok {
+		return nil
+	}
+	outcome := fields["outcome"]
+	delete(fields, "action")
+	delete(fields, "outcome")
+	var details []string
+	// The chat and the user first, then the trigger and the error.
+	for _, key := range []string{"chat_id", "user_id"} {
+		if value, ok := fields[key]; ok {
+			details = append(details, key+"="+value)
+			delete(fields, key)
+		}
+	}
+	keys := sortedKeys(fields)
+	sort.SliceStable(keys, func(i, j int) bool { return keys[j] == "err" && keys[i] != "err" })
+	for _, key := range keys {
+		details = append(details, fmt.Sprintf("%s=%q", key, fields[key]))
+	}
+	return &AuditEntry{
+		At:     record.Time,
+		Actor:  "bot",
+		Change: fmt.Sprintf("%s: %s (%s)", action, outcome, strings.Join(details, " ")),
+	}
+}
+
+// chatActionAudits returns the entries of the actions of the bot in a chat.
+func chatActionAudits(entries []*AuditEntry, chatID ChatID) []*AuditEntry {
+	prefix := fmt.Sprintf("(chat_id=%d ", chatID)
+	var filtered []*AuditEntry
+	for _, entry := range entries {
+		if strings.Contains(entry.Change, prefix) || strings.HasSuffix(entry.Change, fmt.Sprintf("(chat_id=%d)", chatID)) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// recordActionAudits appends the queued actions to the audit log until ctx is cancelled.
+func recordActionAudits(ctx context.Context, data *Data) {
+	actionAuditsRecorded.Store(true)
+	defer actionAuditsRecorded.Store(false)
+	for {
+		select {
+		case entry := <-actionAudits:
+			data.appendAudit(auditAreaActions, entry)
+		case <-ctx.Done():
+			for {
+				select {
+				case entry := <-actionAudits:
+					data.appendAudit(auditAreaActions, entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// What the bot does about a suspicious message is a pipeline of actions chosen by the outcome of
+// the detection: the highest threshold the score reached ("flag", "delete" or "ban"), optionally
+// refined by the category of the findings, e.g. "delete.giveaway". The pipelines can be
+// configured globally and per chat with Actions. Without configuration, flagged messages are
+// reported, messages reaching DeleteScore are deleted and reported, and those reaching BanScore
+// are deleted (if deletion is enabled), their authors banned and reported.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Detection outcomes.
+const (
+	outcomeFlag   = "flag"
+	outcomeDelete = "delete"
+	outcomeBan    = "ban"
+)
+
+// Actions of the pipelines.
+const (
+	// Reply to the message, warning the chat about it.
+	actionWarn = "warn"
+	// Delete the message, explain the deletion and add a strike.
+	actionDelete = "delete"
+	// Mute the author for RestrictDuration.
+	actionMute = "mute"
+	// Ban the author for BanDuration.
+	actionBan = "ban"
+	// Report the message to the admins, or start a vote if no other action was taken.
+	actionNotify = "notify"
+)
+
+var knownActions = map[string]bool{actionWarn: true, actionDelete: true, actionMute: true, actionBan: true, actionNotify: true}
+
+// compileActions validates pipelines of actions by outcome.
+func compileActions(actions map[string][]string) error {
+	for _, key := range sortedKeys(actions) {
+		outcome, _, _ := strings.Cut(key, ".")
+		if outcome != outcomeFlag && outcome != outcomeDelete && outcome != outcomeBan {
+			return fieldErrorf(key, "outcome must be %q, %q or %q, optionally followed by .<category>",
+				outcomeFlag, outcomeDelete, outcomeBan)
+		}
+		for i, action := range actions[key] {
+			if !knownActions[action] {
+				names := sortedKeys(knownActions)
+				return fieldErrorf(fmt.Sprintf("%s[%d]", key, i), "action must be one of %s", strings.Join(names, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+// outcome returns the highest threshold the score reached, given the threshold factor.
+func (s *Settings) outcome(score, factor float64) string {
+	switch {
+	case s.BanScore > 0 && score >= s.BanScore*factor:
+		return outcomeBan
+	case s.DeleteScore > 0 && score >= s.DeleteScore*factor:
+		return outcomeDelete
+	}
+	return outcomeFlag
+}
+
+// actionPipeline returns the actions taken for an outcome in a chat. The pipelines of the chat
+// take precedence over the global ones, and those of the category over those of the outcome.
+func (s *Settings) actionPipeline(chatID ChatID, outcome, category string, score, factor float64) []string {
+	var sources []map[string][]string
+	if group := s.group(chatID); group != nil && group.Actions != nil {
+		sources = append(sources, group.Actions)
+	}
+	sources = append(sources, s.Actions)
+	for _, key := range []string{outcome + "." + category, outcome} {
+		for _, actions := range sources {
+			if pipeline, ok := actions[key]; ok {
+				return pipeline
+			}
+		}
+	}
+
+	var pipeline []string
+	if s.DeleteScore > 0 && score >= s.DeleteScore*factor {
+		pipeline = append(pipeline, actionDelete)
+	}
+	if outcome == outcomeBan {
+		pipeline = append(pipeline, actionBan)
+	}
+	return append(pipeline, actionNotify)
+}
+
+// runActions runs a pipeline for a suspicious message, describing what was done in reason.
+// Returns the actions which were carried out, and whether the admins are to be notified.
+func runActions(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, pipeline []string,
+	findings []Finding, score float64, reason *strings.Builder) ([]string, bool) {
+	chatID, userID := ChatID(msg.Chat.ID), UserID(msg.From.ID)
+	logger := messageLogger(msg)
+	var actions []string
+	notify := false
+	for _, action := range pipeline {
+		var err error
+		switch action {
+		case actionWarn:
+			lang := config.chatLanguage(chatID)
+			reply := tgbotapi.NewMessage(int64(chatID), config.translate(lang, "Careful, this message was flagged: %s.",
+				config.message(lang, categoryKeyPrefix+category(findings))))
+			reply.ReplyToMessageID = msg.MessageID
+			_, err = bot.Send(reply)
+			if err != nil {
+				metricTelegramErrors.inc("sendMessage")
+			} else {
+				reason.WriteString("The chat was warned.\n")
+			}
+		case actionDelete:
+			_, err = bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(chatID), MessageID: msg.MessageID})
+			if err != nil {
+				metricTelegramErrors.inc("deleteMessage")
+				break
+			}
+			metricDeleted.inc()
+			reason.WriteString("The message was deleted.\n")
+			explainDeletion(config, bot, msg, findings)
+			if policy := config.strikePolicy(chatID); policy != nil && policy.DeletionWeight > 0 {
+				result := addStrike(config, data, bot, chatID, userID, policy.DeletionWeight, "deleted message")
+				reason.WriteString(result + "\n")
+			}
+		case actionMute:
+			state := &UserState{Kind: stateRestricted, ChatID: chatID, Reason: fmt.Sprintf("score %.2f", score)}
+			if config.RestrictDuration.Duration > 0 {
+				state.Until = time.Now().Add(config.RestrictDuration.Duration)
+			}
+			if err = applyState(bot, userID, state, true); err != nil {
+				metricTelegramErrors.inc("restrictChatMember")
+				break
+			}
+			data.lock.Lock()
+			data.setState(userID, state)
+			data.lock.Unlock()
+			fmt.Fprintf(reason, "The user was muted %s.\n", state.describeUntil(&config.Settings, defaultLanguage))
+		case actionBan:
+			err = banUser(data, bot, chatID, userID, config.BanDuration.Duration, 0, fmt.Sprintf("score %.2f", score))
+			if err != nil {
+				metricTelegramErrors.inc("banChatMember")
+			} else if config.BanDuration.Duration > 0 {
+				fmt.Fprintf(reason, "The user was banned for %s.\n", config.BanDuration.Duration)
+			} else {
+				reason.WriteString("The user was banned permanently.\n")
+			}
+		case actionNotify:
+			notify = true
+			continue
+		}
+		logAction(logger, action, err, "score", score)
+		if err == nil {
+			observeLatency(action, chatID, msg.MessageID)
+			actions = append(actions, action)
+		}
+	}
+	return actions, notify
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Operators who just want a greppable history of what the bot did, without setting up a log
+// pipeline or querying the state, can write the actions of the bot (see logAction) to an activity
+// log with -activity-log: one JSON object per line, independent of -log-level and -log-json. The
+// file is rotated once it exceeds -activity-log-max-size or is older than -activity-log-max-age;
+// rotated files are gzipped and the oldest are removed beyond -activity-log-keep.
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatingFile is a file which is rotated by size and age. Rotated files are named
+// <name>.<time>.gz.
+type rotatingFile struct {
+	name    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(name string, maxSize int64, maxAge time.Duration, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file for appending. The age of an existing file counts from its creation, which
+// is approximated by its modification time.
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size, r.openedAt = file, info.Size(), time.Now()
+	if info.Size() > 0 {
+		r.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.size > 0 && (r.size+int64(len(p)) > r.maxSize || (r.maxAge > 0 && time.Since(r.openedAt) > r.maxAge)) {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than losing the entry.
+			slog.Error("could not rotate the activity log", "err", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file, opens a new one and compresses the old one in the background. Must be
+// called with r.lock held.
+func (r *rotatingFile) rotate() error {
+	rotated := fmt.Sprintf("%s.%s", r.name, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(r.name, rotated); err != nil {
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		slog.Error("could not close the activity log", "err", err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	go func() {
+		if err := compressFile(rotated); err != nil {
+			slog.Error("could not compress the activity log", "file", rotated, "err", err)
+			return
+		}
+		r.prune()
+	}()
+	return nil
+}
+
+// prune removes the oldest rotated files beyond r.keep.
+func (r *rotatingFile) prune() {
+	rotated, err := filepath.Glob(r.name + ".*.gz")
+	if err != nil || len(rotated) <= r.keep {
+		return
+	}
+	// The names sort by time.
+	sort.Strings(rotated)
+	for _, name := range rotated[:len(rotated)-r.keep] {
+		if err := os.Remove(name); err != nil {
+			slog.Error("could not remove an old activity log", "file", name, "err", err)
+		}
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Close()
+}
+
+// compressFile gzips a file to <name>.gz and removes it.
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(dst)
+	if _, err := io.Copy(writer, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// activityHandler passes all records to the handler of the regular logs and additionally writes
+// the actions of the bot to the activity log, regardless of the log level.
+type activityHandler struct {
+	base     slog.Handler
+	activity slog.Handler
+}
+
+func (h *activityHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	// Actions are logged at info level or above.
+	return level >= slog.LevelInfo || h.base.Enabled(ctx, level)
+}
+
+func (h *activityHandler) Handle(ctx context.Context, record slog.Record) error {
+	var isAction bool
+	record.Attrs(func(attr slog.Attr) bool {
+		isAction = attr.Key == "action"
+		return !isAction
+	})
+	if isAction {
+		if err := h.activity.Handle(ctx, record); err != nil {
+			metricActivityLogErrors.inc()
+		}
+	}
+	if !h.base.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.base.Handle(ctx, record)
+}
+
+func (h *activityHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &activityHandler{base: h.base.WithAttrs(attrs), activity: h.activity.WithAttrs(attrs)}
+}
+
+func (h *activityHandler) WithGroup(name string) slog.Handler {
+	return &activityHandler{base: h.base.WithGroup(name), activity: h.activity.WithGroup(name)}
+}
+
+var metricActivityLogErrors = newCounter("scamwarnbot_activity_log_errors_total",
+	"Actions which could not be written to the activity log.")
+
+// activityLog is the activity log, nil if disabled.
+var activityLog *rotatingFile
+
+// withActivityLog returns a handler additionally writing the actions of the bot to the activity
+// log given by -activity-log, or base if it is disabled.
+func withActivityLog(base slog.Handler) (slog.Handler, error) {
+	if *activityLogFilename == "" {
+		return base, nil
+	}
+	if *activityLogMaxSize <= 0 {
+		return nil, fmt.Errorf("-activity-log-max-size must be positive")
+	}
+	var err error
+	activityLog, err = openRotatingFile(*activityLogFilename, int64(*activityLogMaxSize)<<20,
+		*activityLogMaxAge, *activityLogKeep)
+	if err != nil {
+		return nil, fmt.Errorf("-activity-log: %w", err)
+	}
+	activity := slog.NewJSONHandler(activityLog, &slog.HandlerOptions{Level: slog.LevelInfo})
+	return &activityHandler{base: base, activity: activity}, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// A warning for every user returning after a month is noise in a chat with hundreds of messages a
+// day, where the regulars come and go all the time, but too rare in a quiet chat, where a scammer
+// strikes when the few returning users are least attentive. With AdaptiveWarnAfter, the WarnAfter
+// of each chat scales with its traffic: with the square root of its messages per day, counted in
+// the daily samples of the chat (see RiskSample), relative to a reference rate at which WarnAfter
+// applies as it is.
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	adaptiveWarnDaysDefault              = 7
+	adaptiveWarnReferenceMessagesDefault = 100
+)
+
+// AdaptiveWarnAfter adapts WarnAfter to the traffic of each chat.
+type AdaptiveWarnAfter struct {
+	// Number of days over which the messages per day are averaged. Default 7.
+	Days int
+	// Messages per day at which WarnAfter applies as it is. Default 100.
+	ReferenceMessages float64
+	// Bounds of the adapted interval. Default a quarter of WarnAfter and four times WarnAfter, at
+	// most UserRetention.
+	Min jsonDuration
+	Max jsonDuration
+}
+
+func (a *AdaptiveWarnAfter) setDefaults(warnAfter, userRetention time.Duration) {
+	if a.Days == 0 {
+		a.Days = adaptiveWarnDaysDefault
+	}
+	if a.ReferenceMessages == 0 {
+		a.ReferenceMessages = adaptiveWarnReferenceMessagesDefault
+	}
+	if a.Min.Duration == 0 {
+		a.Min.Duration = warnAfter / 4
+	}
+	if a.Max.Duration == 0 {
+		a.Max.Duration = min(4*warnAfter, userRetention)
+	}
+}
+
+// compile validates the bounds.
+func (a *AdaptiveWarnAfter) compile(userRetention time.Duration) error {
+	if a.Days < 0 || a.ReferenceMessages < 0 || a.Min.Duration < 0 {
+		return errors.New("must not be negative")
+	}
+	if a.Max.Duration < a.Min.Duration {
+		return fieldErrorf("Max", "must not be shorter than Min")
+	}
+	if a.Max.Duration > userRetention {
+		return fieldErrorf("Max", "must not be longer than UserRetention")
+	}
+	return nil
+}
+
+// messagesPerDay returns the mean messages per day of a chat over the given number of days
+// before today, and false if the chat was not seen for that long yet.
+func (c *ChatData) messagesPerDay(days int, now time.Time) (float64, bool) {
+	if c.FirstSeenAt.IsZero() || now.Sub(c.FirstSeenAt) < time.Duration(days)*24*time.Hour {
+		return 0, false
+	}
+	// Today is left out, as it is not over yet.
+	today := now.UTC().Format("2006-01-02")
+	since := now.UTC().AddDate(0, 0, -days).Format("2006-01-02")
+	messages := 0
+	for _, sample := range c.Risk {
+		if sample.Day >= since && sample.Day < today {
+			messages += sample.Messages
+		}
+	}
+	return float64(messages) / float64(days), true
+}
+
+// effectiveWarnAfter returns after how long without a message users of a chat are warned again,
+// adapted to the traffic of the chat with AdaptiveWarnAfter. Must be called with data.lock held.
+func (s *Settings) effectiveWarnAfter(chatID ChatID, chatData *ChatData, now time.Time) time.Duration {
+	warnAfter := s.warnAfter(chatID)
+	adaptive := s.AdaptiveWarnAfter
+	if adaptive == nil {
+		return warnAfter
+	}
+	rate, ok := chatData.messagesPerDay(adaptive.Days, now)
+	if !ok {
+		return warnAfter
+	}
+	scaled := time.Duration(float64(warnAfter) * math.Sqrt(rate/adaptive.ReferenceMessages))
+	return min(max(scaled, adaptive.Min.Duration), adaptive.Max.Duration)
+}
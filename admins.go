@@ -0,0 +1,89 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// How long the list of admins of a chat is cached before it is fetched again.
+const adminCacheTTL = 10 * time.Minute
+
+type adminCacheEntry struct {
+	fetchedAt time.Time
+	admins    map[UserID]bool
+	users     []tgbotapi.User
+}
+
+// adminCache caches the admins of each chat, as fetching them on every command would hit the
+// Telegram API rate limits.
+type adminCache struct {
+	entries map[ChatID]adminCacheEntry
+	lock    sync.Mutex
+}
+
+var chatAdmins = &adminCache{entries: map[ChatID]adminCacheEntry{}}
+
+// get returns the admins of a chat, fetching them if the cached list is missing or outdated.
+func (c *adminCache) get(bot *tgbotapi.BotAPI, chatID ChatID) (map[UserID]bool, error) {
+	entry, err := c.entry(bot, chatID)
+	return entry.admins, err
+}
+
+// users returns the admins of a chat with their names.
+func (c *adminCache) users(bot *tgbotapi.BotAPI, chatID ChatID) ([]tgbotapi.User, error) {
+	entry, err := c.entry(bot, chatID)
+	return entry.users, err
+}
+
+func (c *adminCache) entry(bot *tgbotapi.BotAPI, chatID ChatID) (adminCacheEntry, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[chatID]; ok && time.Since(entry.fetchedAt) < adminCacheTTL {
+		return entry, nil
+	}
+	members, err := bot.GetChatAdministrators(tgbotapi.ChatConfig{ChatID: int64(chatID)})
+	if err != nil {
+		return adminCacheEntry{}, err
+	}
+	entry := adminCacheEntry{fetchedAt: time.Now(), admins: map[UserID]bool{}}
+	for _, member := range members {
+		if member.User == nil {
+			continue
+		}
+		entry.admins[UserID(member.User.ID)] = true
+		entry.users = append(entry.users, *member.User)
+	}
+	c.entries[chatID] = entry
+	return entry, nil
+}
+
+// isChatAdmin returns true if the user is an admin of the chat. Every member of the admin chat is
+// considered an admin.
+func isChatAdmin(config *Config, bot *tgbotapi.BotAPI, chatID ChatID, userID UserID) bool {
+	if config.AdminChatID != 0 && int64(chatID) == config.AdminChatID {
+		return true
+	}
+	admins, err := chatAdmins.get(bot, chatID)
+	if err != nil {
+		chatLogger(chatID, 0).Error("could not fetch chat admins", "err", err)
+		return false
+	}
+	return admins[userID]
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const maxUpdateSilenceDefault = 6 * time.Hour
+
+// AlertConfig contains the thresholds of the generated Prometheus alert rules.
+type AlertConfig struct {
+	// Alert if no update was received for this long.
+	MaxUpdateSilence jsonDuration
+	// Alert if more Telegram API calls fail per hour. Disabled if zero.
+	MaxTelegramErrorsPerHour int
+	// Alert if more messages are flagged per hour, which indicates a raid. Disabled if zero.
+	MaxFlaggedPerHour int
+	// Alert if the ActionLatencyPercentile (default 95) of the time from receiving an update to
+	// completing the resulting action exceeds this. Disabled if zero.
+	MaxActionLatency        jsonDuration
+	ActionLatencyPercentile float64
+	// The bearer token the Alertmanager webhook must be called with. The webhook rejects all
+	// requests if not set, as it posts to the admin chat.
+	WebhookToken string
+}
+
+// alertRules renders the Prometheus alert rules derived from the configured thresholds.
+func alertRules(config *Config) string {
+	alerts := config.Alerts
+	var rules strings.Builder
+	rules.WriteString("groups:\n- name: scamwarnbot\n  rules:\n")
+	rule := func(name, expr, duration, summary string) {
+		fmt.Fprintf(&rules, "  - alert: %s\n    expr: %s\n    for: %s\n"+
+			"    labels:\n      severity: warning\n    annotations:\n      summary: %q\n",
+			name, expr, duration, summary)
+	}
+	rule("ScamwarnbotNoUpdates",
+		fmt.Sprintf("time() - scamwarnbot_last_update_timestamp_seconds > %d", int(alerts.MaxUpdateSilence.Seconds())),
+		"5m", fmt.Sprintf("scamwarnbot received no updates for more than %s", alerts.MaxUpdateSilence.Duration))
+	rule("ScamwarnbotDown", `up{job="scamwarnbot"} == 0`, "5m", "scamwarnbot is down")
+	if alerts.MaxTelegramErrorsPerHour > 0 {
+		rule("ScamwarnbotTelegramErrors",
+			fmt.Sprintf("sum(increase(scamwarnbot_telegram_errors_total[1h])) > %d", alerts.MaxTelegramErrorsPerHour),
+			"0m", "Telegram API calls of scamwarnbot are failing")
+	}
+	if alerts.MaxFlaggedPerHour > 0 {
+		rule("ScamwarnbotRaid",
+			fmt.Sprintf("increase(scamwarnbot_flagged_messages_total[1h]) > %d", alerts.MaxFlaggedPerHour),
+			"0m", "Unusually many messages are flagged, the groups may be under attack")
+	}
+	if alerts.MaxActionLatency.Duration > 0 {
+		rule("ScamwarnbotSlowActions",
+			fmt.Sprintf("histogram_quantile(%v, sum by (le, action) (rate(scamwarnbot_action_latency_seconds_bucket[10m]))) > %v",
+				alerts.ActionLatencyPercentile/100, alerts.MaxActionLatency.Seconds()),
+			"10m", fmt.Sprintf("More than %v%% of the actions of scamwarnbot take longer than %s", 100-alerts.ActionLatencyPercentile, alerts.MaxActionLatency.Duration))
+	}
+	return rules.String()
+}
+
+// runAlertRules prints the Prometheus alert rules for the config file.
+func runAlertRules(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: alert-rules")
+	}
+	config, err := loadConfig(*configFilename)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(os.Stdout, alertRules(config))
+	return err
+}
+
+// alertmanagerPayload is the part of the Alertmanager webhook payload we relay.
+type alertmanagerPayload struct {
+	Status string `json:"status"`
+	Alerts []struct {
+		Status      string            `json:"status"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		StartsAt    time.Time         `json:"startsAt"`
+	} `json:"alerts"`
+}
+
+// alertmanagerHandler is an Alertmanager webhook receiver relaying alerts to the admin chat, so
+// alerts about e.g. the host also reach the moderators. It is disabled unless WebhookToken is set.
+func alertmanagerHandler(bot *tgbotapi.BotAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := config.Alerts.WebhookToken
+		if token == "" {
+			http.Error(w, "the Alertmanager webhook is disabled; set Alerts.WebhookToken", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var payload alertmanagerPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, alert := range payload.Alerts {
+			summary := alert.Annotations["summary"]
+			if summary == "" {
+				summary = alert.Annotations["description"]
+			}
+			text := fmt.Sprintf("[%s] %s: %s (since %s)", strings.ToUpper(alert.Status),
+				alert.Labels["alertname"], summary, alert.StartsAt.Format(time.RFC1123))
+			notifyAdmins(config, bot, text)
+			metricRelayedAlerts.inc()
+		}
+		slog.Info("relayed alerts from alertmanager", "alerts", len(payload.Alerts))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// ChatStats are the statistics of a single chat.
+type ChatStats struct {
+	ChatID       ChatID
+	Title        string
+	Dormant      bool
+	Users        int
+	NewUsers30d  int
+	Active30d    int
+	LastMessage  time.Time
+	Messages30d  int
+	Warnings30d  int
+	Deletions30d int
+	Bans30d      int
+}
+
+// Stats are aggregate statistics over the whole state, served by /api/stats.
+type Stats struct {
+	Chats          []ChatStats
+	Users          int
+	UserStates     map[UserStateKind]int
+	Blocklist      int
+	ReportedNames  int
+	ActionsPerDay  map[string]int
+	SettingsChange time.Time
+}
+
+// computeStats aggregates the statistics. Must be called with d.lock held.
+func (d *Data) computeStats(now time.Time) *Stats {
+	month := now.Add(-30 * 24 * time.Hour)
+	stats := &Stats{
+		Users:         len(d.Users),
+		UserStates:    map[UserStateKind]int{},
+		Blocklist:     len(d.Blocklist),
+		ReportedNames: len(d.ReportedNames),
+		ActionsPerDay: map[string]int{},
+	}
+	chats := map[ChatID]*ChatStats{}
+	for _, chatID := range sortedKeys(d.ChatData) {
+		chatData := d.ChatData[chatID]
+		chat := &ChatStats{
+			ChatID:      chatID,
+			Title:       chatData.Title,
+			Dormant:     chatData.Dormant,
+			Users:       len(chatData.UserData),
+			LastMessage: chatData.LastMessageAt,
+		}
+		chat.Messages30d, chat.Warnings30d = sumSamples(chatData.Risk, month)
+		for _, userData := range chatData.UserData {
+			if userData.FirstSeenAt.After(month) {
+				chat.NewUsers30d++
+			}
+			if userData.LastMessageAt.After(month) {
+				chat.Active30d++
+			}
+		}
+		stats.Chats = append(stats.Chats, *chat)
+		chats[chatID] = &stats.Chats[len(stats.Chats)-1]
+	}
+	for _, states := range d.UserStates {
+		for _, state := range states {
+			if !state.expired(now) {
+				stats.UserStates[state.Kind]++
+			}
+		}
+	}
+	for _, record := range d.Actions {
+		stats.ActionsPerDay[record.At.UTC().Format("2006-01-02")]++
+		chat, ok := chats[record.ChatID]
+		if !ok || record.At.Before(month) {
+			continue
+		}
+		for _, action := range record.Actions {
+			switch action {
+			case "delete":
+				chat.Deletions30d++
+			case "ban":
+				chat.Bans30d++
+			}
+		}
+	}
+	if entries := d.AuditLog[auditAreaSettings]; len(entries) > 0 {
+		stats.SettingsChange = entries[len(entries)-1].At
+	}
+	return stats
+}
+
+// statsAPIHandler serves aggregate statistics of the state.
+func statsAPIHandler(data *Data) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data.lock.Lock()
+		stats := data.computeStats(time.Now())
+		data.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+}
+
+const publishedMinCountDefault = 10
+
+// PublicStatsConfig configures the statistics published without an API token, e.g. for a public
+// dashboard.
+type PublicStatsConfig struct {
+	// Counts below this are withheld, so the published statistics do not reveal the activity of
+	// individual users. Defaults to 10.
+	MinCount int `json:",omitempty"`
+}
+
+// PublishedChatStats are the statistics of a single chat fit for publishing. Counts below the
+// threshold are omitted.
+type PublishedChatStats struct {
+	Title        string
+	Users        *int `json:",omitempty"`
+	NewUsers30d  *int `json:",omitempty"`
+	Active30d    *int `json:",omitempty"`
+	Deletions30d *int `json:",omitempty"`
+	Bans30d      *int `json:",omitempty"`
+}
+
+// PublishedStats are the statistics fit for publishing, served by /public/stats. They contain only
+// counts of at least MinCount and no timestamps or IDs, so they never expose what an individual
+// user did. Actions are counted per week rather than per day for the same reason.
+type PublishedStats struct {
+	MinCount       int
+	Chats          []PublishedChatStats
+	Users          *int           `json:",omitempty"`
+	Blocklist      *int           `json:",omitempty"`
+	ActionsPerWeek map[string]int `json:",omitempty"`
+}
+
+// publish aggregates the statistics for publishing. Chats with fewer than minCount users are left
+// out entirely.
+func (s *Stats) publish(minCount int) *PublishedStats {
+	count := func(n int) *int {
+		if n < minCount {
+			return nil
+		}
+		return &n
+	}
+	published := &PublishedStats{
+		MinCount:       minCount,
+		Users:          count(s.Users),
+		Blocklist:      count(s.Blocklist),
+		ActionsPerWeek: map[string]int{},
+	}
+	for _, chat := range s.Chats {
+		if chat.Dormant || chat.Users < minCount {
+			continue
+		}
+		published.Chats = append(published.Chats, PublishedChatStats{
+			Title:        chat.Title,
+			Users:        count(chat.Users),
+			NewUsers30d:  count(chat.NewUsers30d),
+			Active30d:    count(chat.Active30d),
+			Deletions30d: count(chat.Deletions30d),
+			Bans30d:      count(chat.Bans30d),
+		})
+	}
+	perWeek := map[string]int{}
+	for day, n := range s.ActionsPerDay {
+		t, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			continue
+		}
+		year, week := t.ISOWeek()
+		perWeek[fmt.Sprintf("%d-W%02d", year, week)] += n
+	}
+	for week, n := range perWeek {
+		if n >= minCount {
+			published.ActionsPerWeek[week] = n
+		}
+	}
+	return published
+}
+
+// publicStatsHandler serves the published statistics if PublicStats is configured.
+func publicStatsHandler(data *Data) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfig()
+		if config.PublicStats == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data.lock.Lock()
+		stats := data.computeStats(time.Now())
+		data.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.publish(config.PublicStats.MinCount))
+	})
+}
+
+// chatActivity counts what happened in a chat during a period.
+type chatActivity struct {
+	Messages, Warnings, Flagged, NewUsers, Deletions, Bans int
+}
+
+// chatActivity counts what happened in a chat from since on. Must be called with d.lock held.
+func (d *Data) chatActivity(chatID ChatID, since time.Time) chatActivity {
+	var activity chatActivity
+	chatData, ok := d.ChatData[chatID]
+	if !ok {
+		return activity
+	}
+	day := since.UTC().Format("2006-01-02")
+	for _, sample := range chatData.Risk {
+		if sample.Day >= day {
+			activity.Messages += sample.Messages
+			activity.Warnings += sample.Warnings
+			activity.Flagged += sample.Flagged
+		}
+	}
+	for _, userData := range chatData.UserData {
+		if userData.FirstSeenAt.After(since) {
+			activity.NewUsers++
+		}
+	}
+	for _, record := range d.Actions {
+		if record.ChatID != chatID || record.At.Before(since) {
+			continue
+		}
+		for _, action := range record.Actions {
+			switch action {
+			case "delete":
+				activity.Deletions++
+			case "ban":
+				activity.Bans++
+			}
+		}
+	}
+	return activity
+}
+
+// cmdStats shows what happened in the chat during the last 7 and 30 days, and how the warning
+// variants fared: `/stats`. In the admin chat, it covers all chats which are not dormant.
+func cmdStats(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	now := time.Now()
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	chatIDs := []ChatID{ChatID(msg.Chat.ID)}
+	if msg.Chat.ID == config.AdminChatID {
+		chatIDs = data.activeChats()
+		sort.Slice(chatIDs, func(i, j int) bool { return chatIDs[i] < chatIDs[j] })
+	}
+	var text strings.Builder
+	for _, chatID := range chatIDs {
+		text.WriteString(data.chatTitle(chatID) + "\n")
+		for _, days := range []int{7, 30} {
+			a := data.chatActivity(chatID, now.AddDate(0, 0, -days))
+			text.WriteString(tr(config, msg, "Last %d days: %d messages, %d warnings, %d flagged, %d new users, %d deleted, %d bans\n",
+				days, a.Messages, a.Warnings, a.Flagged, a.NewUsers, a.Deletions, a.Bans))
+		}
+		text.WriteString(data.variantReport(config, chatID, config.chatLanguage(ChatID(msg.Chat.ID))))
+	}
+	if text.Len() == 0 {
+		return tr(config, msg, "No chats.")
+	}
+	return text.String()
+}
@@ -0,0 +1,212 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// An expired bot token once went unnoticed for a day: every request to Telegram failed, and the
+// only trace were log lines. With APIErrorBudget, consecutive failed requests to send, delete and
+// leave are counted, and once they exceed the budget the operators are notified in their chat and
+// the failure is logged as error, which also reaches the error reporting (see ErrorReporting), as
+// a bot with an invalid token cannot notify anyone via Telegram. Optionally, enforcement is paused
+// until a request succeeds again, so deletions, bans and mutes are not applied half-way.
+//
+// Only failures which do not depend on the request count: network errors, rejected tokens and
+// server errors. Bad requests (e.g. deleting a message which is already gone), forbidden requests
+// (e.g. private messages to users who never started the bot) and rate limiting are part of
+// normal operation.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const maxConsecutiveFailuresDefault = 10
+
+// APIErrorBudget configures the alerting on failing requests to Telegram.
+type APIErrorBudget struct {
+	// Number of consecutive failed requests after which the operators are notified. Defaults to
+	// 10.
+	MaxConsecutiveFailures int
+	// The chat notified. Defaults to AdminChatID.
+	OperatorChatID int64 `json:",omitempty"`
+	// If set, deleting messages, banning, muting and leaving chats are paused while the budget
+	// is exceeded.
+	PauseEnforcement bool `json:",omitempty"`
+}
+
+func (b *APIErrorBudget) setDefaults() {
+	if b.MaxConsecutiveFailures == 0 {
+		b.MaxConsecutiveFailures = maxConsecutiveFailuresDefault
+	}
+}
+
+// budgetMethods are the Telegram methods counted against the budget, mapped to whether they are
+// enforcement actions.
+var budgetMethods = map[string]bool{
+	"sendMessage":        false,
+	"sendPhoto":          false,
+	"sendSticker":        false,
+	"deleteMessage":      true,
+	"banChatMember":      true,
+	"kickChatMember":     true,
+	"restrictChatMember": true,
+	"leaveChat":          true,
+}
+
+var (
+	metricAPIConsecutiveFailures = newGauge("scamwarnbot_api_consecutive_failures", "Consecutive failed requests to Telegram counted against APIErrorBudget.")
+	metricEnforcementPaused      = newCounter("scamwarnbot_enforcement_paused_requests_total", "Enforcement requests skipped while APIErrorBudget is exceeded, by method.", "method")
+)
+
+// apiBudget tracks the consecutive failures.
+var apiBudget struct {
+	lock     sync.Mutex
+	bot      *tgbotapi.BotAPI
+	failures int
+	// When the budget was exceeded, zero if it is not.
+	exceededAt time.Time
+	lastError  string
+}
+
+// budgetTransport counts the failed requests to Telegram and skips enforcement requests while the
+// budget is exceeded and PauseEnforcement is set.
+type budgetTransport struct {
+	base http.RoundTripper
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	config := currentConfig()
+	if config == nil || config.APIErrorBudget == nil {
+		return t.base.RoundTrip(req)
+	}
+	method := path.Base(req.URL.Path)
+	enforcement, counted := budgetMethods[method]
+	if !counted {
+		return t.base.RoundTrip(req)
+	}
+	if enforcement && config.APIErrorBudget.PauseEnforcement && budgetExceeded() {
+		metricEnforcementPaused.inc(method)
+		return pausedResponse(req)
+	}
+	resp, err := t.base.RoundTrip(req)
+	switch {
+	case err != nil:
+		recordAPIFailure(config, method, err.Error())
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound ||
+		resp.StatusCode >= http.StatusInternalServerError:
+		recordAPIFailure(config, method, resp.Status)
+	default:
+		recordAPISuccess(config)
+	}
+	return resp, err
+}
+
+func budgetExceeded() bool {
+	apiBudget.lock.Lock()
+	defer apiBudget.lock.Unlock()
+	return !apiBudget.exceededAt.IsZero()
+}
+
+// pausedResponse answers a skipped request with an error, which is not retried.
+func pausedResponse(req *http.Request) (*http.Response, error) {
+	response, err := json.Marshal(map[string]interface{}{
+		"ok":          false,
+		"error_code":  http.StatusServiceUnavailable,
+		"description": "enforcement paused: too many failed requests to Telegram (APIErrorBudget)",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "503 Service Unavailable",
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(response)),
+		ContentLength: int64(len(response)),
+		Request:       req,
+	}, nil
+}
+
+func recordAPIFailure(config *Config, method string, reason string) {
+	apiBudget.lock.Lock()
+	apiBudget.failures++
+	apiBudget.lastError = method + ": " + reason
+	failures := apiBudget.failures
+	exceeded := failures == config.APIErrorBudget.MaxConsecutiveFailures
+	if exceeded {
+		apiBudget.exceededAt = time.Now()
+	}
+	apiBudget.lock.Unlock()
+	metricAPIConsecutiveFailures.set(float64(failures))
+	if !exceeded {
+		return
+	}
+	slog.Error("Telegram API error budget exceeded", "failures", failures, "last_error", method+": "+reason)
+	text := fmt.Sprintf("%d consecutive requests to Telegram failed, last: %s: %s.", failures, method, reason)
+	if config.APIErrorBudget.PauseEnforcement {
+		text += " Deleting, banning and muting are paused until a request succeeds."
+	}
+	notifyOperators(config, text)
+}
+
+func recordAPISuccess(config *Config) {
+	apiBudget.lock.Lock()
+	failures, exceededAt, lastError := apiBudget.failures, apiBudget.exceededAt, apiBudget.lastError
+	apiBudget.failures = 0
+	apiBudget.exceededAt = time.Time{}
+	apiBudget.lock.Unlock()
+	if failures == 0 {
+		return
+	}
+	metricAPIConsecutiveFailures.set(0)
+	if exceededAt.IsZero() {
+		return
+	}
+	outage := time.Since(exceededAt).Round(time.Second)
+	slog.Info("Telegram API requests succeed again", "failures", failures, "exceeded_for", outage)
+	notifyOperators(config, fmt.Sprintf("Requests to Telegram succeed again after %d failures over %s (last: %s).",
+		failures, outage, lastError))
+}
+
+// notifyOperators sends a message to the chat of the operators.
+func notifyOperators(config *Config, text string) {
+	chatID := config.APIErrorBudget.OperatorChatID
+	if chatID == 0 {
+		chatID = config.AdminChatID
+	}
+	apiBudget.lock.Lock()
+	bot := apiBudget.bot
+	apiBudget.lock.Unlock()
+	if chatID == 0 || bot == nil {
+		return
+	}
+	notification := tgbotapi.NewMessage(chatID, text)
+	enqueueSend(bot, ChatID(chatID), notification, func(_ tgbotapi.Message, err error) {
+		if err != nil {
+			slog.Error("could not notify the operators", "err", err)
+		}
+	})
+}
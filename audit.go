@@ -0,0 +1,118 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Number of audit entries kept per area.
+const auditLogSize = 1000
+
+// Number of audit entries shown by /audit by default.
+const auditShowDefault = 20
+
+const (
+	auditAreaSettings = "settings"
+	auditAreaRoles    = "roles"
+	// The actions of the bot, see actionaudit.go.
+	auditAreaActions = "actions"
+)
+
+// AuditEntry records a change made by a moderator or an API client, or an action of the bot.
+type AuditEntry struct {
+	At time.Time
+	// The Telegram user or API token holder who made the change.
+	Actor  string
+	Change string
+	// The settings version resulting from the change, if applicable.
+	Version int `json:",omitempty"`
+}
+
+// telegramActor identifies a Telegram user in the audit log.
+func telegramActor(user *tgbotapi.User) string {
+	return fmt.Sprintf("%s (%d)", user.String(), user.ID)
+}
+
+// apiActor identifies an API token holder in the audit log.
+func apiActor(holder string) string {
+	return "API token of " + holder
+}
+
+// audit records a change in the audit log of an area.
+func (d *Data) audit(area string, actor string, version int, change string) {
+	d.appendAudit(area, &AuditEntry{
+		At:      time.Now(),
+		Actor:   actor,
+		Change:  change,
+		Version: version,
+	})
+}
+
+// appendAudit appends an entry to the audit log of an area, dropping the oldest entries beyond
+// auditLogSize.
+func (d *Data) appendAudit(area string, entry *AuditEntry) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	entries := append(d.AuditLog[area], entry)
+	if len(entries) > auditLogSize {
+		entries = entries[len(entries)-auditLogSize:]
+	}
+	d.AuditLog[area] = entries
+	d.markChanged()
+}
+
+// cmdAudit shows the most recent entries of an audit log: `/audit <area> [<count>]`. Outside of
+// the admin chat, the actions of the bot are limited to those in the chat.
+func cmdAudit(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 || len(args) > 2 || (args[0] != auditAreaSettings && args[0] != auditAreaRoles && args[0] != auditAreaActions) {
+		return tr(config, msg, "Usage: /audit settings|roles|actions [<count>]")
+	}
+	count := auditShowDefault
+	if len(args) == 2 {
+		var err error
+		if count, err = strconv.Atoi(args[1]); err != nil || count <= 0 {
+			return tr(config, msg, "Invalid count %q", args[1])
+		}
+	}
+
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	entries := data.AuditLog[args[0]]
+	if args[0] == auditAreaActions && msg.Chat.ID != config.AdminChatID {
+		entries = chatActionAudits(entries, ChatID(msg.Chat.ID))
+	}
+	if len(entries) == 0 {
+		return tr(config, msg, "No changes recorded.")
+	}
+	if len(entries) > count {
+		entries = entries[len(entries)-count:]
+	}
+	var text strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&text, "%s %s: %s", entry.At.UTC().Format("2006-01-02 15:04"), entry.Actor, entry.Change)
+		if entry.Version != 0 {
+			text.WriteString(tr(config, msg, " (version %d)", entry.Version))
+		}
+		text.WriteString("\n")
+	}
+	return text.String()
+}
@@ -0,0 +1,144 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// How often automated bans due for review are looked for.
+const banReviewCheckInterval = time.Hour
+
+// reviewBans posts the automated bans older than BanReviewAfter which were not reviewed yet to the
+// admin chat, with buttons to approve or lift them. Each ban is posted once.
+func reviewBans(config *Config, data *Data, bot *tgbotapi.BotAPI) {
+	if config.BanReviewAfter.Duration == 0 || config.AdminChatID == 0 {
+		return
+	}
+	type dueBan struct {
+		userID      UserID
+		state       *UserState
+		description string
+		chat        string
+	}
+	var due []dueBan
+	now := time.Now()
+	data.lock.Lock()
+	for userID, states := range data.UserStates {
+		for _, state := range states {
+			// States recorded before Since was introduced have a zero Since and are due.
+			if state.Kind != stateBanned || state.AddedBy != 0 || state.Reviewed ||
+				!state.ReviewRequestedAt.IsZero() || now.Sub(state.Since) < config.BanReviewAfter.Duration {
+				continue
+			}
+			due = append(due, dueBan{userID, state, data.describeUser(userID), data.chatTitle(state.ChatID)})
+		}
+	}
+	data.lock.Unlock()
+
+	for _, ban := range due {
+		since := "an unknown time"
+		if !ban.state.Since.IsZero() {
+			since = ban.state.Since.UTC().Format("2006-01-02")
+		}
+		text := fmt.Sprintf("Review automated ban of %s in %s (since %s, %s): %s",
+			ban.description, ban.chat, since, ban.state.describeRemaining(&config.Settings, defaultLanguage), ban.state.Reason)
+		userID, chatID := strconv.Itoa(int(ban.userID)), strconv.FormatInt(int64(ban.state.ChatID), 10)
+		message := tgbotapi.NewMessage(config.AdminChatID, text)
+		message.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Approve", callbackData("review", "approve", userID, chatID)),
+			tgbotapi.NewInlineKeyboardButtonData("Lift", callbackData("review", "lift", userID, chatID)),
+		))
+		if _, err := send(bot, ChatID(config.AdminChatID), message); err != nil {
+			slog.Error("could not post ban for review", "err", err)
+			metricTelegramErrors.inc("sendMessage")
+			continue
+		}
+		data.lock.Lock()
+		ban.state.ReviewRequestedAt = now
+		data.markChanged()
+		data.lock.Unlock()
+	}
+}
+
+func periodicBanReview(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for {
+		if !sleepContext(ctx, banReviewCheckInterval) {
+			return
+		}
+		reviewBans(currentConfig(), data, bot)
+	}
+}
+
+// reviewCallback handles the approve and lift buttons of a ban review: `review:<approve|lift>:
+// <user ID>:<chat ID>`. Lifting an automated ban also removes the user from the blocklist, as the
+// ban was a false positive.
+func reviewCallback(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args []string) string {
+	if len(args) != 3 {
+		return "Invalid review."
+	}
+	userIDInt, err1 := strconv.Atoi(args[1])
+	chatIDInt, err2 := strconv.ParseInt(args[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return "Invalid review."
+	}
+	userID, chatID := UserID(userIDInt), ChatID(chatIDInt)
+
+	var result string
+	switch args[0] {
+	case "approve":
+		data.lock.Lock()
+		found := false
+		for _, state := range data.UserStates[userID] {
+			if state.Kind == stateBanned && state.ChatID == chatID {
+				state.Reviewed = true
+				data.markChanged()
+				found = true
+			}
+		}
+		data.lock.Unlock()
+		if !found {
+			result = "The ban does not exist anymore."
+		} else {
+			result = "Ban approved"
+		}
+	case "lift":
+		if err := applyState(bot, userID, &UserState{Kind: stateBanned, ChatID: chatID}, false); err != nil {
+			return fmt.Sprintf("Error: %v", err)
+		}
+		data.lock.Lock()
+		data.removeState(userID, stateBanned, chatID)
+		delete(data.Blocklist, userID)
+		data.markChanged()
+		data.lock.Unlock()
+		result = "Ban lifted"
+	default:
+		return "Invalid review."
+	}
+	chatLogger(chatID, userID).Info("ban reviewed", "action", "review "+args[0], "by", query.From.ID)
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+		fmt.Sprintf("%s\n\n%s by %s.", query.Message.Text, result, query.From.String()))
+	if _, err := send(bot, ChatID(query.Message.Chat.ID), edit); err != nil {
+		slog.Error("could not update ban review", "err", err)
+	}
+	return result + "."
+}
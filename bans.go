@@ -0,0 +1,81 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// banUser bans a user from a chat for the given duration (forever if zero) and records the ban.
+// addedBy is zero for automated bans.
+func banUser(data *Data, bot *tgbotapi.BotAPI, chatID ChatID, userID UserID, duration time.Duration, addedBy UserID, reason string) error {
+	state := &UserState{Kind: stateBanned, ChatID: chatID, AddedBy: addedBy, Reason: reason}
+	if duration > 0 {
+		state.Until = time.Now().Add(duration)
+	}
+	if err := applyState(bot, userID, state, true); err != nil {
+		return err
+	}
+	metricBans.inc()
+	if duration == 0 {
+		postBanEvent(currentConfig(), data, BanEvent{Type: banEventBan, UserID: userID, ChatID: chatID, Reason: reason, BannedBy: addedBy})
+	}
+	data.lock.Lock()
+	data.setState(userID, state)
+	data.lock.Unlock()
+	if duration == 0 {
+		go shareBan(currentConfig(), data, bot, chatID, userID, addedBy, reason, "bot")
+	}
+	return nil
+}
+
+// banCommand returns the handler for `/ban @user [reason]` or, if timed, `/tban @user <duration>
+// [reason]`.
+func banCommand(timed bool) commandHandler {
+	return func(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+		if int64(msg.Chat.ID) == config.AdminChatID {
+			return tr(config, msg, "This command must be used in the group.")
+		}
+		userID, args, err := resolveTarget(data, msg)
+		if err != nil {
+			return err.Error()
+		}
+		var duration time.Duration
+		if timed {
+			if len(args) == 0 {
+				return tr(config, msg, "Usage: /tban @user <duration> [reason]")
+			}
+			duration, err = parseDuration(args[0])
+			if err != nil {
+				return err.Error()
+			}
+			args = args[1:]
+		}
+		err = banUser(data, bot, ChatID(msg.Chat.ID), userID, duration, UserID(msg.From.ID), strings.Join(args, " "))
+		if err != nil {
+			return tr(config, msg, "Error: %v", err)
+		}
+
+		data.lock.Lock()
+		defer data.lock.Unlock()
+		if duration == 0 {
+			return tr(config, msg, "%s is banned permanently.", data.describeUser(userID))
+		}
+		return tr(config, msg, "%s is banned for %s.", data.describeUser(userID), duration)
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Many communities run other moderation bots next to this one, e.g. Rose with its federations.
+// To keep the ban state consistent, permanent bans and unbans are posted as JSON events to the
+// configured webhooks, and bans are received as such events on /api/bans and from the log
+// channels of federations, in which Rose and similar bots announce federation bans. Received bans
+// are added to the blocklist. Bans of users blocklisted from elsewhere, e.g. received or imported,
+// are not posted, so bans do not echo between bots, and a user banned in all chats with /gban or a
+// shared ban is posted once.
+//
+// Bots cannot see messages of other bots in groups, so only log channels with the bot as admin
+// work as a source.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const banSyncSourceDefault = "scamwarnbot"
+
+// Types of ban events.
+const (
+	banEventBan   = "ban"
+	banEventUnban = "unban"
+)
+
+// BanSyncConfig configures the exchange of bans with other moderation bots.
+type BanSyncConfig struct {
+	// URLs the ban events are posted to.
+	WebhookURLs []string `json:",omitempty"`
+	// Channels in which federation bots log their bans, e.g. the log channel of a Rose federation.
+	FederationLogChats []int64 `json:",omitempty"`
+	// Identifies this bot in the events it posts. Defaults to "scamwarnbot".
+	Source string `json:",omitempty"`
+}
+
+// BanEvent is a ban or unban exchanged with other bots. The user_id and reason fields match the ban
+// list exports of common moderation bots, so the events can also be imported with import-bans.
+type BanEvent struct {
+	Type   string `json:"type"`
+	UserID UserID `json:"user_id"`
+	ChatID ChatID `json:"chat_id,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// The admin who banned the user, or zero for automated bans.
+	BannedBy UserID    `json:"banned_by,omitempty"`
+	Source   string    `json:"source"`
+	Time     time.Time `json:"time"`
+}
+
+var banSyncBreaker = newCircuitBreaker("bansync")
+
+var metricBanEvents = newCounter("scamwarnbot_ban_events_total", "Ban events exchanged with other bots by direction (sent, received) and type.", "direction", "type")
+
+// localBlockSources are the sources of blocklist entries made by this bot, whose bans are posted.
+var localBlockSources = map[string]bool{
+	blockSourceGlobalBan: true,
+	blockSourceSharedBan: true,
+	blockSourceCommand:   true,
+}
+
+// postBanEvent posts a ban event to the webhooks of the ban sync in the background. Bans of users
+// blocklisted from elsewhere and bans posted already for a blocklisted user are skipped.
+func postBanEvent(config *Config, data *Data, event BanEvent) {
+	banSync := config.BanSync
+	if banSync == nil || len(banSync.WebhookURLs) == 0 || *dryRun {
+		return
+	}
+	if !data.banEventDue(event) {
+		return
+	}
+	event.Source = banSync.Source
+	event.Time = time.Now().UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("could not encode ban event", "err", err)
+		return
+	}
+	for _, url := range banSync.WebhookURLs {
+		go func(url string) {
+			err := banSyncBreaker.call(func(ctx context.Context) error {
+				req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+				if err != nil {
+					return err
+				}
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode/100 != 2 {
+					return fmt.Errorf("unexpected status %s", resp.Status)
+				}
+				return nil
+			})
+			logAction(chatLogger(event.ChatID, event.UserID), "post "+event.Type+" event", err, "url", url)
+			if err == nil {
+				metricBanEvents.inc("sent", event.Type)
+			}
+		}(url)
+	}
+}
+
+// banEventDue returns true if a ban event is to be posted, marking the blocklist entry of a
+// banned user as synced.
+func (d *Data) banEventDue(event BanEvent) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	entry, ok := d.Blocklist[event.UserID]
+	if !ok {
+		return true
+	}
+	if event.Type == banEventUnban {
+		// Banned again later, the user is posted again.
+		entry.Synced = false
+		d.markChanged()
+		return true
+	}
+	if !localBlockSources[entry.Source] || entry.Synced {
+		return false
+	}
+	entry.Synced = true
+	d.markChanged()
+	return true
+}
+
+// receiveBanEvent applies a ban event received from another bot to the blocklist. Unbans only lift
+// entries received from the same source. Returns true if the blocklist changed.
+func receiveBanEvent(data *Data, event BanEvent) bool {
+	if event.UserID == 0 || event.Source == "" {
+		return false
+	}
+	source := "sync:" + event.Source
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	entry, ok := data.Blocklist[event.UserID]
+	switch event.Type {
+	case banEventBan:
+		if ok {
+			return false
+		}
+		data.Blocklist[event.UserID] = &BlockEntry{Reason: event.Reason, Source: source, AddedAt: time.Now()}
+	case banEventUnban:
+		if !ok || entry.Source != source {
+			return false
+		}
+		delete(data.Blocklist, event.UserID)
+	default:
+		return false
+	}
+	data.markChanged()
+	metricBanEvents.inc("received", event.Type)
+	slog.Info("received ban event", "user_id", event.UserID, "type", event.Type, "source", event.Source)
+	return true
+}
+
+// banEventsAPIHandler receives ban events: a single event, an array of events or one event per
+// line.
+func banEventsAPIHandler(data *Data) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isLiveBot() {
+			http.Error(w, "not the live bot; send ban events to the live bot", http.StatusForbidden)
+			return
+		}
+		content, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var events []BanEvent
+		if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(trimmed, &events)
+		} else {
+			decoder := json.NewDecoder(bytes.NewReader(content))
+			for err == nil {
+				var event BanEvent
+				if err = decoder.Decode(&event); err == nil {
+					events = append(events, event)
+				}
+			}
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		holder, _ := apiTokenHolder(r)
+		applied := 0
+		for _, event := range events {
+			if event.Source == "" {
+				event.Source = holder
+			}
+			if receiveBanEvent(data, event) {
+				applied++
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ Received, Applied int }{len(events), applied})
+	})
+}
+
+var (
+	// Federation bans as logged by Rose and similar bots, e.g. "New FedBan\nFed: ...\nUser ID:
+	// 123\nReason: ...".
+	fedBanPattern    = regexp.MustCompile(`(?i)\b(new )?fed ?ban\b`)
+	fedUnbanPattern  = regexp.MustCompile(`(?i)\bun-?fed ?ban\b`)
+	fedUserPattern   = regexp.MustCompile(`(?im)^\s*user ?id:\s*(\d+)`)
+	fedReasonPattern = regexp.MustCompile(`(?im)^\s*reason:\s*(.+)$`)
+	fedNamePattern   = regexp.MustCompile(`(?im)^\s*fed(eration)?:\s*(.+)$`)
+)
+
+// parseFederationLog parses a ban or unban logged by a federation bot. Returns false if the
+// message is neither.
+func parseFederationLog(text string) (BanEvent, bool) {
+	user := fedUserPattern.FindStringSubmatch(text)
+	if user == nil {
+		return BanEvent{}, false
+	}
+	userID, err := strconv.Atoi(user[1])
+	if err != nil {
+		return BanEvent{}, false
+	}
+	event := BanEvent{UserID: UserID(userID), Source: "federation"}
+	switch {
+	case fedUnbanPattern.MatchString(text):
+		event.Type = banEventUnban
+	case fedBanPattern.MatchString(text):
+		event.Type = banEventBan
+	default:
+		return BanEvent{}, false
+	}
+	if reason := fedReasonPattern.FindStringSubmatch(text); reason != nil {
+		event.Reason = strings.TrimSpace(reason[1])
+	}
+	if name := fedNamePattern.FindStringSubmatch(text); name != nil {
+		event.Source = "federation " + strings.TrimSpace(name[2])
+	}
+	return event, true
+}
+
+// handleChannelPost receives the bans logged in the log channels of federations.
+func handleChannelPost(config *Config, data *Data, post *tgbotapi.Message) {
+	if config.BanSync == nil || post.Chat == nil {
+		return
+	}
+	for _, chatID := range config.BanSync.FederationLogChats {
+		if chatID != post.Chat.ID {
+			continue
+		}
+		if event, ok := parseFederationLog(messageText(post)); ok {
+			event.ChatID = ChatID(post.Chat.ID)
+			receiveBanEvent(data, event)
+		}
+		return
+	}
+}
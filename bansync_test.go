@@ -0,0 +1,94 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// banSyncReceiver records the ban events posted to it.
+type banSyncReceiver struct {
+	lock   sync.Mutex
+	events []BanEvent
+}
+
+func newBanSyncReceiver(tb testing.TB, config *Config) *banSyncReceiver {
+	receiver := &banSyncReceiver{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event BanEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			tb.Error(err)
+			return
+		}
+		receiver.lock.Lock()
+		receiver.events = append(receiver.events, event)
+		receiver.lock.Unlock()
+	}))
+	tb.Cleanup(server.Close)
+	config.BanSync = &BanSyncConfig{WebhookURLs: []string{server.URL}, Source: banSyncSourceDefault}
+	return receiver
+}
+
+// eventsAfter returns the events posted until the given time.
+func (r *banSyncReceiver) eventsAfter(wait time.Duration) []BanEvent {
+	time.Sleep(wait)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]BanEvent{}, r.events...)
+}
+
+func TestGlobalBanPostsOneEvent(t *testing.T) {
+	quietLog(t)
+	bot, _ := newFakeTelegram(t)
+	config := newLoadConfig(t)
+	config.Groups = append(config.Groups, &GroupConfig{ChatID: loadChatID - 1}, &GroupConfig{ChatID: loadChatID - 2})
+	receiver := newBanSyncReceiver(t, config)
+	data := newLoadData(t)
+
+	if failed := globalBan(config, data, bot, 42, 1, "scam"); len(failed) != 0 {
+		t.Fatalf("global ban failed: %v", failed)
+	}
+	events := receiver.eventsAfter(500 * time.Millisecond)
+	if len(events) != 1 {
+		t.Fatalf("got %d ban events, want 1", len(events))
+	}
+	if event := events[0]; event.Type != banEventBan || event.UserID != 42 || event.Reason != "scam" {
+		t.Errorf("got ban event %+v", event)
+	}
+}
+
+func TestReceivedBanNotPostedBack(t *testing.T) {
+	quietLog(t)
+	bot, _ := newFakeTelegram(t)
+	config := newLoadConfig(t)
+	receiver := newBanSyncReceiver(t, config)
+	data := newLoadData(t)
+
+	if !receiveBanEvent(data, BanEvent{Type: banEventBan, UserID: 43, Reason: "spam", Source: "rose"}) {
+		t.Fatal("ban event not applied")
+	}
+	// The user is banned as soon as they post.
+	if err := banUser(data, bot, loadChatID, 43, 0, 0, "blocklist: spam"); err != nil {
+		t.Fatal(err)
+	}
+	if events := receiver.eventsAfter(500 * time.Millisecond); len(events) != 0 {
+		t.Errorf("got %d ban events, want none: %+v", len(events), events)
+	}
+}
@@ -0,0 +1,435 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// BlockEntry is a user banned from all chats as soon as they post.
+type BlockEntry struct {
+	Reason string `json:",omitempty"`
+	// Where the entry came from, e.g. the bot a ban list was imported from.
+	Source  string `json:",omitempty"`
+	AddedAt time.Time
+	// Set once the ban of the user was posted to the ban sync, so the bans in the other chats are
+	// not posted again.
+	Synced bool `json:",omitempty"`
+}
+
+// enforceBlocklist bans blocklisted users and deletes their message. Returns true if the user was
+// blocklisted.
+func enforceBlocklist(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	userID := UserID(msg.From.ID)
+	data.lock.Lock()
+	entry, ok := data.Blocklist[userID]
+	data.lock.Unlock()
+	if !ok {
+		return false
+	}
+
+	_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: msg.Chat.ID, MessageID: msg.MessageID})
+	logAction(messageLogger(msg), "delete", err, "reason", "blocklist")
+	reason := "blocklist"
+	if entry.Reason != "" {
+		reason += ": " + entry.Reason
+	}
+	err = banUser(data, bot, ChatID(msg.Chat.ID), userID, 0, 0, reason)
+	logAction(messageLogger(msg), "ban", err, "reason", reason)
+	if err != nil {
+		return true
+	}
+	reportToAdmins(config, data, bot, msg, fmt.Sprintf("Banned blocklisted user (%s, source: %s).", reason, entry.Source))
+	return true
+}
+
+// importedBan is a ban list entry from another bot.
+type importedBan struct {
+	userID UserID
+	reason string
+}
+
+// parseBanList parses ban list exports. Supported are CSV files with a header row containing an
+// id or user_id column (as exported by Rose's /fedexport csv and Combot), JSON arrays and JSON
+// lines of objects with an id or user_id field (Rose's /fedexport json).
+func parseBanList(content []byte) ([]importedBan, error) {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 {
+		return nil, errors.New("empty ban list")
+	}
+	if trimmed[0] == '[' || trimmed[0] == '{' {
+		return parseBanListJSON(trimmed)
+	}
+	return parseBanListCSV(trimmed)
+}
+
+func parseBanListCSV(content []byte) ([]importedBan, error) {
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	idColumn, reasonColumn := -1, -1
+	for i, name := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "id", "user_id", "userid":
+			idColumn = i
+		case "reason":
+			reasonColumn = i
+		}
+	}
+	if idColumn == -1 {
+		return nil, errors.New("CSV header has no id or user_id column")
+	}
+	var bans []importedBan
+	for line, record := range records[1:] {
+		id, err := strconv.Atoi(strings.TrimSpace(record[idColumn]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid user ID %q", line+2, record[idColumn])
+		}
+		ban := importedBan{userID: UserID(id)}
+		if reasonColumn != -1 {
+			ban.reason = strings.TrimSpace(record[reasonColumn])
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+func parseBanListJSON(content []byte) ([]importedBan, error) {
+	type entry struct {
+		ID     json.Number `json:"id"`
+		UserID json.Number `json:"user_id"`
+		Reason string      `json:"reason"`
+	}
+	var entries []entry
+	if content[0] == '[' {
+		if err := json.Unmarshal(content, &entries); err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		for {
+			var e entry
+			if err := decoder.Decode(&e); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		}
+	}
+	var bans []importedBan
+	for i, e := range entries {
+		idString := e.UserID
+		if idString == "" {
+			idString = e.ID
+		}
+		id, err := strconv.Atoi(idString.String())
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: invalid user ID %q", i+1, idString)
+		}
+		bans = append(bans, importedBan{userID: UserID(id), reason: e.Reason})
+	}
+	return bans, nil
+}
+
+// runImportBans adds the users of a ban list export to the blocklist in the cache file.
+func runImportBans(args []string) error {
+	flags := flag.NewFlagSet("import-bans", flag.ExitOnError)
+	source := flags.String("source", "import", "Name of the bot the ban list was exported from")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: import-bans [-source name] <file>")
+	}
+	content, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	bans, err := parseBanList(content)
+	if err != nil {
+		return err
+	}
+
+	data := loadData()
+	added := 0
+	for _, ban := range bans {
+		if _, ok := data.Blocklist[ban.userID]; ok {
+			continue
+		}
+		data.Blocklist[ban.userID] = &BlockEntry{Reason: ban.reason, Source: *source, AddedAt: time.Now()}
+		added++
+	}
+	data.markChanged()
+	data.save()
+	slog.Info("imported bans", "added", added, "bans", len(bans), "already_blocklisted", len(bans)-added)
+	return nil
+}
+
+const (
+	blockSourceCommand = "/block"
+	// The rule holding the keywords blocked with /block.
+	blockedKeywordsRule = "blocklist"
+	blocklistPageSize   = 30
+)
+
+// blockUsage is the reply to malformed /block and /unblock commands.
+const blockUsage = "Usage: /%s keyword <keyword>, /%s domain <domain> or /%s user <@user or ID> [reason]"
+
+// errNoChange is returned by a settings change which would not change anything.
+var errNoChange = errors.New("nothing to change")
+
+// blockKeyword adds a keyword to the blocklist rule, creating it if needed. Returns false if the
+// keyword was blocked already.
+func blockKeyword(settings *Settings, keyword string) bool {
+	for _, rule := range settings.Rules {
+		if rule.Name != blockedKeywordsRule {
+			continue
+		}
+		for _, blocked := range rule.Keywords {
+			if strings.EqualFold(blocked, keyword) {
+				return false
+			}
+		}
+		rule.Keywords = append(rule.Keywords, keyword)
+		return true
+	}
+	score := settings.DeleteScore
+	if score == 0 {
+		score = settings.FlagScore
+	}
+	settings.Rules = append(settings.Rules, &Rule{Name: blockedKeywordsRule, Keywords: []string{keyword}, Score: score})
+	return true
+}
+
+// unblockKeyword removes a keyword from the blocklist rule, and the rule once it is empty.
+// Returns false if the keyword was not blocked.
+func unblockKeyword(settings *Settings, keyword string) bool {
+	for i, rule := range settings.Rules {
+		if rule.Name != blockedKeywordsRule {
+			continue
+		}
+		for j, blocked := range rule.Keywords {
+			if !strings.EqualFold(blocked, keyword) {
+				continue
+			}
+			rule.Keywords = append(rule.Keywords[:j], rule.Keywords[j+1:]...)
+			if len(rule.Keywords) == 0 {
+				settings.Rules = append(settings.Rules[:i], settings.Rules[i+1:]...)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// blockDomain adds a domain to LinkScanner.BlockedDomains, enabling the link scanner if needed.
+// Returns false if the domain was blocked already.
+func blockDomain(settings *Settings, domain string) bool {
+	if settings.LinkScanner == nil {
+		settings.LinkScanner = &LinkScanner{}
+	}
+	for _, blocked := range settings.LinkScanner.BlockedDomains {
+		if strings.EqualFold(blocked, domain) {
+			return false
+		}
+	}
+	settings.LinkScanner.BlockedDomains = append(settings.LinkScanner.BlockedDomains, domain)
+	return true
+}
+
+// unblockDomain removes a domain from LinkScanner.BlockedDomains. Returns false if the domain was
+// not blocked.
+func unblockDomain(settings *Settings, domain string) bool {
+	if settings.LinkScanner == nil {
+		return false
+	}
+	for i, blocked := range settings.LinkScanner.BlockedDomains {
+		if strings.EqualFold(blocked, domain) {
+			settings.LinkScanner.BlockedDomains = append(settings.LinkScanner.BlockedDomains[:i],
+				settings.LinkScanner.BlockedDomains[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// parseBlockTarget parses the argument of /block and /unblock: a keyword, a domain or a user.
+func parseBlockTarget(data *Data, kind string, arg string) (string, UserID, error) {
+	switch kind {
+	case "keyword":
+		return arg, 0, nil
+	case "domain":
+		domain := linkHost(arg)
+		if !strings.Contains(domain, ".") {
+			return "", 0, fmt.Errorf("invalid domain %q", arg)
+		}
+		return domain, 0, nil
+	default:
+		if id, err := strconv.Atoi(arg); err == nil {
+			return "", UserID(id), nil
+		}
+		data.lock.Lock()
+		defer data.lock.Unlock()
+		if userID, ok := data.userByName(arg); ok {
+			return "", userID, nil
+		}
+		return "", 0, errors.New("unknown user " + arg)
+	}
+}
+
+// blockCommand adds to or removes from the blocklists: `/block keyword <keyword>`, `/block domain
+// <domain>`, `/block user <@user or ID> [reason]` and the same with `/unblock`. Keywords and
+// domains are stored in the settings, users in the blocklist of banned users.
+func blockCommand(block bool) commandHandler {
+	return func(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+		name := msg.Command()
+		args := strings.Fields(msg.CommandArguments())
+		if len(args) < 2 || args[0] != "keyword" && args[0] != "domain" && args[0] != "user" ||
+			args[0] == "domain" && len(args) > 2 {
+			return tr(config, msg, blockUsage, name, name, name)
+		}
+		kind := args[0]
+		arg := strings.Join(args[1:], " ")
+		if kind == "user" {
+			arg = args[1]
+		}
+		value, userID, err := parseBlockTarget(data, kind, arg)
+		if err != nil {
+			return tr(config, msg, "Error: %v", err)
+		}
+
+		if kind == "user" {
+			data.lock.Lock()
+			defer data.lock.Unlock()
+			_, blocked := data.Blocklist[userID]
+			description := data.describeUser(userID)
+			switch {
+			case block && blocked:
+				return tr(config, msg, "%s is blocklisted already.", description)
+			case !block && !blocked:
+				return tr(config, msg, "%s is not blocklisted.", description)
+			case block:
+				data.Blocklist[userID] = &BlockEntry{Reason: strings.Join(args[2:], " "), Source: blockSourceCommand, AddedAt: time.Now()}
+			default:
+				delete(data.Blocklist, userID)
+			}
+			data.markChanged()
+			logAction(messageLogger(msg), name, nil, "target_user_id", userID)
+			if block {
+				return tr(config, msg, "%s is blocklisted and banned as soon as they post.", description)
+			}
+			return tr(config, msg, "%s is no longer blocklisted.", description)
+		}
+
+		version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+			var changed bool
+			switch {
+			case kind == "keyword" && block:
+				changed = blockKeyword(settings, value)
+			case kind == "keyword":
+				changed = unblockKeyword(settings, value)
+			case block:
+				changed = blockDomain(settings, value)
+			default:
+				changed = unblockDomain(settings, value)
+			}
+			if !changed {
+				return errNoChange
+			}
+			return nil
+		})
+		switch {
+		case errors.Is(err, errNoChange) && block:
+			return tr(config, msg, "%s is blocked already.", value)
+		case errors.Is(err, errNoChange):
+			return tr(config, msg, "%s is not blocked.", value)
+		case err != nil:
+			return tr(config, msg, "Error: %v", err)
+		}
+		messageLogger(msg).Info("blocklist changed", "command", name, "kind", kind)
+		data.audit(auditAreaSettings, telegramActor(msg.From), version, fmt.Sprintf("%s %s %s", name, kind, value))
+		if block {
+			return tr(config, msg, "Blocked %s %s. Settings version %d.", kind, value, version)
+		}
+		return tr(config, msg, "Unblocked %s %s. Settings version %d.", kind, value, version)
+	}
+}
+
+// cmdBlocklist lists the blocked keywords, domains and users: `/blocklist [page]`.
+func cmdBlocklist(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	page := 1
+	if arg := strings.TrimSpace(msg.CommandArguments()); arg != "" {
+		var err error
+		if page, err = strconv.Atoi(arg); err != nil || page < 1 {
+			return tr(config, msg, "Usage: /blocklist [page]")
+		}
+	}
+
+	var entries []string
+	for _, rule := range config.Rules {
+		if rule.Name == blockedKeywordsRule {
+			for _, keyword := range rule.Keywords {
+				entries = append(entries, tr(config, msg, "keyword: %s", keyword))
+			}
+		}
+	}
+	if config.LinkScanner != nil {
+		for _, domain := range config.LinkScanner.BlockedDomains {
+			entries = append(entries, tr(config, msg, "domain: %s", domain))
+		}
+	}
+	data.lock.Lock()
+	userIDs := sortedKeys(data.Blocklist)
+	for _, userID := range userIDs {
+		entry := data.Blocklist[userID]
+		line := tr(config, msg, "user: %s, source: %s", data.describeUser(userID), entry.Source)
+		if entry.Reason != "" {
+			line += " (" + entry.Reason + ")"
+		}
+		entries = append(entries, line)
+	}
+	data.lock.Unlock()
+
+	if len(entries) == 0 {
+		return tr(config, msg, "The blocklist is empty.")
+	}
+	pages := (len(entries) + blocklistPageSize - 1) / blocklistPageSize
+	if page > pages {
+		return tr(config, msg, "There are only %d pages.", pages)
+	}
+	end := page * blocklistPageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+	var text strings.Builder
+	text.WriteString(tr(config, msg, "Blocklist, page %d of %d:\n", page, pages))
+	for _, entry := range entries[(page-1)*blocklistPageSize : end] {
+		text.WriteString(entry + "\n")
+	}
+	return text.String()
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// If the bot misbehaves in a chat, e.g. because a rule hits legitimate messages, the moderators of
+// the chat can switch it off with /bot off without waiting for the operators. While it is off, the
+// bot still records activity and answers commands, so it can be switched on again, but it neither
+// warns, greets, verifies nor acts on messages in the chat. Other chats are not affected.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// BotOff records who switched the bot off in a chat.
+type BotOff struct {
+	Since time.Time
+	By    string
+}
+
+// botOff returns true if the bot is switched off in the chat.
+func (s *Settings) botOff(chatID ChatID) bool {
+	group := s.group(chatID)
+	return group != nil && group.BotOff != nil
+}
+
+// liftPendingVerifications lifts the restrictions of the new members of a chat who did not verify
+// yet, so they are not kicked while the bot is off.
+func liftPendingVerifications(data *Data, bot *tgbotapi.BotAPI, chatID ChatID) {
+	var pending []UserID
+	data.lock.Lock()
+	for _, verification := range data.PendingVerifications {
+		if verification.ChatID == chatID {
+			pending = append(pending, verification.UserID)
+		}
+	}
+	data.lock.Unlock()
+	for _, userID := range pending {
+		_, err := liftRestriction(data, bot, chatID, userID, verificationReason)
+		logAction(chatLogger(chatID, userID), "lift verification", err)
+		if err != nil {
+			continue
+		}
+		data.lock.Lock()
+		data.removePendingVerification(chatID, userID)
+		data.lock.Unlock()
+	}
+}
+
+// cmdBot shows whether the bot is switched on in the chat, or switches it off or on:
+// `/bot [off|on]`.
+func cmdBot(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	chatID := ChatID(msg.Chat.ID)
+	if int64(chatID) == config.AdminChatID {
+		return tr(config, msg, "The bot is switched off per chat. Use this command in the group.")
+	}
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		if group := config.group(chatID); group != nil && group.BotOff != nil {
+			return tr(config, msg, "The bot was switched off in this chat by %s on %s.",
+				group.BotOff.By, group.BotOff.Since.UTC().Format("2006-01-02 15:04 UTC"))
+		}
+		return tr(config, msg, "The bot is on in this chat.")
+	}
+	if len(args) != 1 || (args[0] != "off" && args[0] != "on") {
+		return tr(config, msg, "Usage: /bot [off|on]")
+	}
+	off := args[0] == "off"
+	if off == config.botOff(chatID) {
+		if off {
+			return tr(config, msg, "The bot is already off in this chat.")
+		}
+		return tr(config, msg, "The bot is on in this chat.")
+	}
+
+	version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+		group := settings.group(chatID)
+		if group == nil {
+			group = &GroupConfig{ChatID: chatID}
+			settings.Groups = append(settings.Groups, group)
+		}
+		if off {
+			group.BotOff = &BotOff{Since: time.Now(), By: msg.From.String()}
+		} else {
+			group.BotOff = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+	if off {
+		liftPendingVerifications(data, bot, chatID)
+	}
+
+	data.lock.Lock()
+	title := data.chatTitle(chatID)
+	data.lock.Unlock()
+	change := "switched the bot on in"
+	if off {
+		change = "switched the bot off in"
+	}
+	data.audit(auditAreaSettings, telegramActor(msg.From), version, fmt.Sprintf("%s %s", change, title))
+	messageLogger(msg).Info(change, "chat_title", title)
+	notifyAdmins(config, bot, fmt.Sprintf("%s %s %s.", msg.From.String(), change, title))
+	if off {
+		return tr(config, msg, "The bot is off in this chat. Use /bot on to switch it on again.")
+	}
+	return tr(config, msg, "The bot is on in this chat.")
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Defaults of the circuit breakers around external services.
+const (
+	breakerFailureThreshold = 5
+	breakerOpenDuration     = time.Minute
+	breakerTimeout          = 10 * time.Second
+)
+
+// States of a circuit breaker, exported as metric values.
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+var errBreakerOpen = errors.New("service unavailable (circuit breaker open)")
+
+var (
+	metricBreakerState    = newGauge("scamwarnbot_breaker_state", "State of the circuit breaker of an external service: 0 closed, 1 half-open, 2 open.", "service")
+	metricBreakerCalls    = newCounter("scamwarnbot_breaker_calls_total", "Calls to an external service by result (ok, error, timeout, rejected).", "service", "result")
+	metricBreakerDuration = newCounter("scamwarnbot_breaker_call_seconds_total", "Time spent calling an external service.", "service")
+)
+
+// circuitBreaker protects the bot from slow or failing external services. After
+// failureThreshold consecutive failures, calls are rejected immediately for openDuration. Then a
+// single trial call is let through, closing the breaker again if it succeeds.
+type circuitBreaker struct {
+	service          string
+	failureThreshold int
+	openDuration     time.Duration
+	timeout          time.Duration
+
+	lock      sync.Mutex
+	state     int
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(service string) *circuitBreaker {
+	metricBreakerState.set(breakerClosed, service)
+	return &circuitBreaker{
+		service:          service,
+		failureThreshold: breakerFailureThreshold,
+		openDuration:     breakerOpenDuration,
+		timeout:          breakerTimeout,
+	}
+}
+
+// allow returns true if a call may be made now.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// A trial call is in flight.
+		return false
+	}
+	return true
+}
+
+// record updates the state with the result of a call.
+func (b *circuitBreaker) record(err error, now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.failureThreshold {
+		b.openUntil = now.Add(b.openDuration)
+		if b.state != breakerOpen {
+			slog.Warn("circuit breaker opened", "service", b.service, "failures", b.failures, "err", err)
+		}
+		b.setState(breakerOpen)
+	}
+}
+
+// setState must be called with b.lock held.
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	metricBreakerState.set(float64(state), b.service)
+}
+
+// call runs fn unless the breaker is open, cancelling its context after the timeout. Returns
+// errBreakerOpen if the call was rejected.
+func (b *circuitBreaker) call(fn func(ctx context.Context) error) error {
+	start := time.Now()
+	if !b.allow(start) {
+		metricBreakerCalls.inc(b.service, "rejected")
+		return errBreakerOpen
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	err := fn(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timeout after %s: %w", b.timeout, err)
+		metricBreakerCalls.inc(b.service, "timeout")
+	} else if err != nil {
+		metricBreakerCalls.inc(b.service, "error")
+	} else {
+		metricBreakerCalls.inc(b.service, "ok")
+	}
+	metricBreakerDuration.add(time.Since(start).Seconds(), b.service)
+	b.record(err, time.Now())
+	return err
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// cmdBroadcast sends a message to all chats the bot is active in, skipping dormant chats:
+// `/broadcast <text>`.
+func cmdBroadcast(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	text := strings.TrimSpace(msg.CommandArguments())
+	if text == "" {
+		return tr(config, msg, "Usage: /broadcast <text>")
+	}
+	data.lock.Lock()
+	chatIDs := data.activeChats()
+	data.lock.Unlock()
+
+	sent := 0
+	for _, chatID := range chatIDs {
+		if _, err := send(bot, chatID, tgbotapi.NewMessage(int64(chatID), text)); err != nil {
+			chatLogger(chatID, 0).Error("could not broadcast", "err", err)
+			metricTelegramErrors.inc("sendMessage")
+			continue
+		}
+		sent++
+	}
+	slog.Info("broadcast a message", "by", msg.From.ID, "chats", sent)
+	return tr(config, msg, "Sent to %d of %d chats.", sent, len(chatIDs))
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// callbackHandler handles a press of an inline keyboard button. args are the colon separated parts
+// of the callback data following the callback name. The returned text is shown to the user.
+type callbackHandler func(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args []string) string
+
+type callback struct {
+	// The role required to press the button.
+	role    Role
+	handler callbackHandler
+}
+
+var callbacks = map[string]callback{
+	"review":     {role: roleModerator, handler: reviewCallback},
+	"vote":       {role: roleModerator, handler: voteCallback},
+	"quarantine": {role: roleModerator, handler: quarantineCallback},
+	"report":     {role: roleModerator, handler: reportCallback},
+	"chat":       {role: roleAdmin, handler: chatApprovalCallback},
+	"captcha":    {handler: captchaCallback},
+	"gotit":      {handler: gotItCallback},
+	"verify":     {handler: verifyCallback},
+}
+
+// callbackData builds the data of an inline keyboard button handled by the named callback.
+func callbackData(name string, args ...string) string {
+	return strings.Join(append([]string{name}, args...), ":")
+}
+
+// handleCallback handles a press of an inline keyboard button of one of the bot's messages.
+func handleCallback(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
+	if query.Message == nil || query.Message.Chat == nil || query.From == nil {
+		return
+	}
+	parts := strings.Split(query.Data, ":")
+	cb, ok := callbacks[parts[0]]
+	if !ok {
+		slog.Warn("unknown callback", "data", query.Data)
+		return
+	}
+	var answer string
+	if userRole(config, data, bot, ChatID(query.Message.Chat.ID), UserID(query.From.ID)) < cb.role {
+		answer = "You are not allowed to do this."
+	} else {
+		chatLogger(ChatID(query.Message.Chat.ID), UserID(query.From.ID)).Info("callback", "data", query.Data)
+		answer = cb.handler(config, data, bot, query, parts[1:])
+	}
+	if _, err := bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, answer)); err != nil {
+		slog.Error("could not answer callback", "err", err)
+	}
+}
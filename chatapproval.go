@@ -0,0 +1,142 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The bot leaves all chats which are not in Groups right away, so every chat had to be added to
+// the config before the bot could be tried in it. With UnknownChats "ask", the bot stays in
+// unknown chats without acting in them and asks the admin chat instead: Approve adds the chat to
+// Groups, which persists it like any other change of the settings, and Leave makes the bot leave.
+// The admins are asked once per chat; the pending requests are persisted, so a restart does not ask
+// again.
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// What the bot does in unknown chats.
+const (
+	unknownChatsLeave = "leave"
+	unknownChatsAsk   = "ask"
+)
+
+// PendingChat is an unknown chat the admins were asked to approve.
+type PendingChat struct {
+	Title       string
+	RequestedAt time.Time
+}
+
+// leaveUnknownChat leaves a chat which is not in Groups, or asks the admins whether to stay with
+// UnknownChats "ask".
+func leaveUnknownChat(config *Config, data *Data, bot *tgbotapi.BotAPI, chat *tgbotapi.Chat) {
+	chatID := ChatID(chat.ID)
+	if config.UnknownChats == unknownChatsAsk && config.AdminChatID != 0 {
+		requestChatApproval(config, data, bot, chat)
+		return
+	}
+	_, err := bot.LeaveChat(tgbotapi.ChatConfig{ChatID: chat.ID})
+	logAction(chatLogger(chatID, 0), "leave chat", err, "chat_title", chat.Title)
+}
+
+// requestChatApproval asks the admins whether the bot may stay in an unknown chat, unless they
+// were asked already.
+func requestChatApproval(config *Config, data *Data, bot *tgbotapi.BotAPI, chat *tgbotapi.Chat) {
+	chatID := ChatID(chat.ID)
+	data.lock.Lock()
+	_, asked := data.PendingChats[chatID]
+	if !asked {
+		if data.PendingChats == nil {
+			data.PendingChats = map[ChatID]*PendingChat{}
+		}
+		data.PendingChats[chatID] = &PendingChat{Title: chat.Title, RequestedAt: time.Now()}
+		data.markChanged()
+	}
+	data.lock.Unlock()
+	if asked {
+		return
+	}
+	id := strconv.FormatInt(int64(chatID), 10)
+	request := tgbotapi.NewMessage(config.AdminChatID, fmt.Sprintf(
+		"The bot was added to the unknown chat %s (%d). It does not act there until it is approved.", chat.Title, chatID))
+	request.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Approve", callbackData("chat", "approve", id)),
+		tgbotapi.NewInlineKeyboardButtonData("Leave", callbackData("chat", "leave", id)),
+	))
+	enqueueSend(bot, ChatID(config.AdminChatID), request, func(_ tgbotapi.Message, err error) {
+		logAction(chatLogger(chatID, 0), "request chat approval", err, "chat_title", chat.Title)
+		if err != nil {
+			metricTelegramErrors.inc("sendMessage")
+		}
+	})
+}
+
+// chatApprovalCallback approves an unknown chat or leaves it: `chat:approve|leave:<chat ID>`.
+func chatApprovalCallback(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args []string) string {
+	if len(args) != 2 {
+		return "Invalid request."
+	}
+	chatIDInt, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "Invalid request."
+	}
+	chatID := ChatID(chatIDInt)
+	data.lock.Lock()
+	pending, ok := data.PendingChats[chatID]
+	data.lock.Unlock()
+	if !ok {
+		return "The request was decided already."
+	}
+
+	var result string
+	switch args[0] {
+	case "approve":
+		version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+			if settings.group(chatID) == nil {
+				settings.Groups = append(settings.Groups, &GroupConfig{ChatID: chatID, Title: pending.Title})
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Sprintf("Error: %v", err)
+		}
+		data.audit(auditAreaSettings, telegramActor(query.From), version,
+			fmt.Sprintf("approved chat %s (%d)", pending.Title, chatID))
+		result = "Chat approved"
+	case "leave":
+		_, err := bot.LeaveChat(tgbotapi.ChatConfig{ChatID: int64(chatID)})
+		logAction(chatLogger(chatID, 0), "leave chat", err, "chat_title", pending.Title)
+		if err != nil {
+			return fmt.Sprintf("Error: %v", err)
+		}
+		result = "Chat left"
+	default:
+		return "Invalid request."
+	}
+	data.lock.Lock()
+	delete(data.PendingChats, chatID)
+	data.markChanged()
+	data.lock.Unlock()
+	chatLogger(chatID, 0).Info("chat approval decided", "action", "chat "+args[0], "by", query.From.ID)
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+		fmt.Sprintf("%s\n\n%s by %s.", query.Message.Text, result, query.From.String()))
+	if _, err := send(bot, ChatID(query.Message.Chat.ID), edit); err != nil {
+		chatLogger(chatID, 0).Error("could not update chat approval request", "err", err)
+	}
+	return result + "."
+}
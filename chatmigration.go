@@ -0,0 +1,131 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// When a group is upgraded to a supergroup, its chat ID changes. Without following the change,
+// the bot would leave the supergroup as a chat it is not allowed in, or, if it is allowed by
+// title, warn everyone again as all tracked users belong to the old ID. Telegram announces the
+// upgrade with a service message in both chats: MigrateToChatID in the old group and
+// MigrateFromChatID in the new supergroup. Whichever arrives first moves the settings and the
+// state of the old chat to the new ID; the other finds nothing left to move.
+
+import (
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// handleChatMigration moves the settings and the state of a group upgraded to a supergroup to the
+// new chat ID. Returns false if the message does not announce an upgrade.
+func handleChatMigration(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	var from, to ChatID
+	switch {
+	case msg.MigrateToChatID != 0:
+		from, to = ChatID(msg.Chat.ID), ChatID(msg.MigrateToChatID)
+	case msg.MigrateFromChatID != 0:
+		from, to = ChatID(msg.MigrateFromChatID), ChatID(msg.Chat.ID)
+	default:
+		return false
+	}
+	logger := chatLogger(from, 0).With("new_chat_id", to, "chat_title", msg.Chat.Title)
+	if config.group(from) == nil && config.allowedGroup(msg.Chat) == nil {
+		logger.Info("ignoring the upgrade of a chat the bot is not allowed in")
+		return true
+	}
+
+	if config.group(from) != nil {
+		version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+			if group := settings.group(from); group != nil {
+				group.ChatID = to
+			}
+			return nil
+		})
+		logAction(logger, "move settings to supergroup", err)
+		if err == nil {
+			data.audit(auditAreaSettings, "bot", version,
+				fmt.Sprintf("moved the settings of %s to its new chat ID %d after the upgrade to a supergroup", msg.Chat.Title, to))
+		}
+	}
+
+	data.lock.Lock()
+	moved := data.migrateChat(from, to)
+	data.lock.Unlock()
+	if moved {
+		logger.Info("moved the state of the chat to the supergroup")
+		notifyAdmins(config, bot, fmt.Sprintf("%s was upgraded to a supergroup; its chat ID changed from %d to %d.",
+			msg.Chat.Title, from, to))
+	}
+	return true
+}
+
+// migrateChat moves the state of a chat to a new chat ID, merging it with what is already tracked
+// under the new ID. Returns false if there is nothing to move. Must be called with d.lock held.
+func (d *Data) migrateChat(from, to ChatID) bool {
+	old, ok := d.ChatData[from]
+	if !ok {
+		return false
+	}
+	delete(d.ChatData, from)
+	if current, ok := d.ChatData[to]; ok {
+		// Messages of the supergroup arrived before the upgrade was announced.
+		for userID, userData := range current.UserData {
+			old.UserData[userID] = userData
+		}
+		for userID, at := range current.AdminActivity {
+			if old.AdminActivity == nil {
+				old.AdminActivity = map[UserID]time.Time{}
+			}
+			old.AdminActivity[userID] = at
+		}
+		old.Title = current.Title
+		old.LastMessageAt = current.LastMessageAt
+		old.Dormant = current.Dormant
+	}
+	// Message IDs are not kept by the upgrade.
+	old.RecentMessageIDs = nil
+	if old.Reminder != nil {
+		old.Reminder.MessageID = 0
+	}
+	d.ChatData[to] = old
+
+	for _, states := range d.UserStates {
+		for _, state := range states {
+			if state.ChatID == from {
+				state.ChatID = to
+			}
+		}
+	}
+	for _, verification := range d.PendingVerifications {
+		if verification.ChatID == from {
+			verification.ChatID = to
+		}
+	}
+	for _, record := range d.Actions {
+		if record.ChatID == from {
+			record.ChatID = to
+		}
+	}
+	// The messages of the old group cannot be deleted anymore.
+	deletions := d.PendingDeletions[:0]
+	for _, deletion := range d.PendingDeletions {
+		if deletion.ChatID != from {
+			deletions = append(deletions, deletion)
+		}
+	}
+	d.PendingDeletions = deletions
+	d.markChanged()
+	return true
+}
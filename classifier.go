@@ -0,0 +1,198 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// An external classifier scores messages with a model the bot does not embed, e.g. an ML spam
+// model under evaluation. The text of each message is POSTed to the classifier as JSON:
+//
+//	{"text": "...", "chat_id": -100123, "user_id": 123}
+//
+// and it answers with a score between 0 (harmless) and 1 (certainly spam or scam), optionally a
+// category of the rules (e.g. "spam") and a reason:
+//
+//	{"score": 0.93, "category": "spam", "reason": "crypto giveaway"}
+//
+// The score is multiplied by Weight and added to the findings of the other detectors. Answers are
+// cached by text, so a text repeated during a raid is only classified once. Messages are scored
+// without the classifier if it fails or does not answer in time, and after repeated failures it is
+// not asked for a while (see circuitBreaker). New classifiers are best tried in shadow mode
+// (detector "classifier", see ShadowDetectors).
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	classifierTimeoutDefault       = time.Second
+	classifierCacheForDefault      = time.Hour
+	classifierMinScoreDefault      = 0.5
+	classifierMinTextLengthDefault = 20
+)
+
+var classifierBreaker = newCircuitBreaker("classifier")
+
+// ExternalClassifier configures the external classifier.
+type ExternalClassifier struct {
+	// URL the messages are POSTed to.
+	URL string
+	// Messages are scored without the classifier if it does not answer within this time.
+	// Updates are processed one after the other, so keep it short. Defaults to 1s.
+	Timeout jsonDuration
+	// How long answers are cached. Defaults to 1h.
+	CacheFor jsonDuration
+	// Messages with shorter texts are not classified. Defaults to 20.
+	MinTextLength int
+	// Scores of the classifier below this are ignored. Defaults to 0.5.
+	MinScore float64
+	// The score of the classifier is multiplied by this. Defaults to DeleteScore, or FlagScore if
+	// deletion is disabled.
+	Weight float64
+}
+
+func (c *ExternalClassifier) setDefaults(flagScore, deleteScore float64) {
+	if c.Timeout.Duration == 0 {
+		c.Timeout.Duration = classifierTimeoutDefault
+	}
+	if c.CacheFor.Duration == 0 {
+		c.CacheFor.Duration = classifierCacheForDefault
+	}
+	if c.MinTextLength == 0 {
+		c.MinTextLength = classifierMinTextLengthDefault
+	}
+	if c.MinScore == 0 {
+		c.MinScore = classifierMinScoreDefault
+	}
+	if c.Weight == 0 {
+		c.Weight = deleteScore
+	}
+	if c.Weight == 0 {
+		c.Weight = flagScore
+	}
+}
+
+func (c *ExternalClassifier) compile() error {
+	if !isHTTPURL(c.URL) {
+		return fieldErrorf("URL", "must be an http(s) URL")
+	}
+	if c.Timeout.Duration < 0 {
+		return fieldErrorf("Timeout", "must not be negative")
+	}
+	if c.CacheFor.Duration < 0 {
+		return fieldErrorf("CacheFor", "must not be negative")
+	}
+	if c.MinScore < 0 || c.MinScore > 1 {
+		return fieldErrorf("MinScore", "must be between 0 and 1")
+	}
+	if c.Weight < 0 {
+		return fieldErrorf("Weight", "must not be negative")
+	}
+	if c.MinTextLength < 0 {
+		return fieldErrorf("MinTextLength", "must not be negative")
+	}
+	return nil
+}
+
+type classifierRequest struct {
+	Text   string `json:"text"`
+	ChatID ChatID `json:"chat_id"`
+	UserID UserID `json:"user_id"`
+}
+
+// Classification is the answer of the external classifier.
+type Classification struct {
+	Score    float64 `json:"score"`
+	Category string  `json:"category,omitempty"`
+	Reason   string  `json:"reason,omitempty"`
+}
+
+var metricClassifications = newCounter("scamwarnbot_classifications_total",
+	"Messages classified by the external classifier, by result: scored, ignored or error.", "result")
+
+// classify asks the external classifier to score a text.
+func classify(classifier *ExternalClassifier, request classifierRequest) (Classification, error) {
+	var result Classification
+	body, err := json.Marshal(request)
+	if err != nil {
+		return result, err
+	}
+	err = classifierBreaker.call(func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, classifier.Timeout.Duration)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, classifier.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(&result)
+	})
+	if err == nil && (result.Score < 0 || result.Score > 1) {
+		err = fmt.Errorf("score %v out of range", result.Score)
+	}
+	return result, err
+}
+
+// detectClassified scores a message with the external classifier.
+func detectClassified(config *Config, data *Data, msg *tgbotapi.Message) []Finding {
+	classifier := config.ExternalClassifier
+	text := messageText(msg)
+	if classifier == nil || len([]rune(text)) < classifier.MinTextLength {
+		return nil
+	}
+	chatID := ChatID(msg.Chat.ID)
+	key := lookupKey("classifier", classifier.URL, text)
+	result, err := cachedLookup(data, "classifier", key, classifier.CacheFor.Duration, false, func() (Classification, error) {
+		return classify(classifier, classifierRequest{Text: text, ChatID: chatID, UserID: UserID(msg.From.ID)})
+	})
+	if err != nil {
+		metricClassifications.inc("error")
+		messageLogger(msg).Warn("could not classify message", "err", err)
+		return nil
+	}
+	if result.Score < classifier.MinScore {
+		metricClassifications.inc("ignored")
+		return nil
+	}
+	metricClassifications.inc("scored")
+	category := result.Category
+	if category == "" {
+		category = "spam"
+	}
+	reason := fmt.Sprintf("external classifier score %.2f", result.Score)
+	if result.Reason != "" {
+		reason += ": " + result.Reason
+	}
+	return []Finding{{
+		Detector: "classifier",
+		Score:    result.Score * classifier.Weight,
+		Reason:   reason,
+		Category: category,
+		Shadow:   config.isShadow(chatID, "classifier"),
+	}}
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+)
+
+type subcommand struct {
+	usage string
+	run   func(args []string) error
+}
+
+// Subcommands operate on the cache file and must not be run while the bot is running, as the bot
+// would overwrite the changes.
+var subcommands = map[string]subcommand{
+	"import-bans": {
+		usage: "import-bans [-source name] <file>: import a Rose/Combot ban list export (CSV or JSON)",
+		run:   runImportBans,
+	},
+	"import-history": {
+		usage: "import-history [-chat <chat ID>] <result.json>: backfill when members were active from a Telegram Desktop chat export (JSON)",
+		run:   runImportHistory,
+	},
+	"snapshot": {
+		usage: "snapshot save <file> | snapshot diff [-all] <old.json> <new.json>: save the cache as a deterministic snapshot, or compare two snapshots (users, chats, bans, settings)",
+		run:   runSnapshot,
+	},
+	"migrate": {
+		usage: "migrate -from <backend:location> -to <backend:location> [-force] [-dry-run]: validate the state and copy it between storage backends, verifying the copy",
+		run:   runMigrate,
+	},
+	"export": {
+		usage: "export [-format json|csv] [-user <user ID>] [-o <file>]: export the state, or everything stored about a user",
+		run:   runExport,
+	},
+	"import": {
+		usage: "import [-format json|csv] [-force] <file>: restore a JSON export, replacing the state, or merge the chat members of a CSV export into it",
+		run:   runImport,
+	},
+	"alert-rules": {
+		usage: "alert-rules: print Prometheus alert rules derived from the config file",
+		run:   runAlertRules,
+	},
+}
+
+func printSubcommandUsage() {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(flag.CommandLine.Output(), "Subcommands:")
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s\n", subcommands[name].usage)
+	}
+}
+
+func runSubcommand(args []string) error {
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+	return cmd.run(args[1:])
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+type commandHandler func(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string
+
+type command struct {
+	// The role required to run the command.
+	role Role
+	// The handler returns the text to reply with.
+	handler commandHandler
+}
+
+var commands = map[string]command{
+	"watch": {role: roleModerator, handler: stateCommand(stateWatched, false,
+		func(config *Config) time.Duration { return config.WatchDuration.Duration })},
+	"unwatch": {role: roleModerator, handler: removeStateCommand(stateWatched, false)},
+	"trust": {role: roleModerator, handler: stateCommand(stateTrusted, false,
+		func(config *Config) time.Duration { return config.TrustDuration.Duration })},
+	"untrust": {role: roleModerator, handler: removeStateCommand(stateTrusted, false)},
+	"restrict": {role: roleModerator, handler: stateCommand(stateRestricted, true,
+		func(config *Config) time.Duration { return config.RestrictDuration.Duration })},
+	"unrestrict":  {role: roleModerator, handler: removeStateCommand(stateRestricted, true)},
+	"ban":         {role: roleModerator, handler: banCommand(false)},
+	"tban":        {role: roleModerator, handler: banCommand(true)},
+	"unban":       {role: roleModerator, handler: removeStateCommand(stateBanned, true)},
+	"whois":       {role: roleViewer, handler: cmdWhois},
+	"strike":      {role: roleModerator, handler: cmdStrike},
+	"presence":    {role: roleModerator, handler: cmdPresence},
+	"gotdm":       {handler: cmdGotDM},
+	"report":      {handler: cmdReport},
+	"settings":    {role: roleViewer, handler: cmdSettings},
+	"rules":       {role: roleViewer, handler: cmdRules},
+	"rulepacks":   {role: roleViewer, handler: cmdRulePacks},
+	"audit":       {role: roleViewer, handler: cmdAudit},
+	"stats":       {role: roleViewer, handler: cmdStats},
+	"why":         {role: roleViewer, handler: cmdWhy},
+	"shadow":      {role: roleViewer, handler: cmdShadow},
+	"feedback":    {role: roleViewer, handler: cmdFeedback},
+	"protect":     {role: roleModerator, handler: cmdProtect},
+	"lockdown":    {role: roleModerator, handler: cmdLockdown},
+	"incident":    {role: roleModerator, handler: cmdIncident},
+	"bot":         {role: roleModerator, handler: cmdBot},
+	"warnsticker": {role: roleModerator, handler: cmdWarnSticker},
+	"role":        {role: roleAdmin, handler: cmdRole},
+	"purge":       {role: roleAdmin, handler: cmdPurge},
+	"forget":      {role: roleAdmin, handler: cmdForget},
+	"broadcast":   {role: roleAdmin, handler: cmdBroadcast},
+	"gban":        {role: roleAdmin, handler: cmdGlobalBan},
+	"block":       {role: roleAdmin, handler: blockCommand(true)},
+	"unblock":     {role: roleAdmin, handler: blockCommand(false)},
+	"blocklist":   {role: roleViewer, handler: cmdBlocklist},
+	"bancheck":    {role: roleModerator, handler: cmdBanCheck},
+	"status":      {role: roleModerator, handler: cmdStatus},
+	"simulate":    {role: roleAdmin, handler: cmdSimulate},
+	"setwarn":     {role: roleModerator, handler: cmdSetWarn},
+	"reload":      {role: roleAdmin, handler: cmdReload},
+}
+
+// handleCommand runs the bot command contained in the message, if any. Returns true if the
+// message was a command of this bot.
+func handleCommand(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	if !msg.IsCommand() {
+		return false
+	}
+	if at := msg.CommandWithAt(); at != msg.Command() && at != msg.Command()+"@"+bot.Self.UserName {
+		// Command addressed to another bot.
+		return false
+	}
+	cmd, ok := commands[msg.Command()]
+	if !ok {
+		return false
+	}
+	if cmd.role > roleNone && !hasRole(config, data, bot, msg, cmd.role) {
+		messageLogger(msg).Info("ignoring command from user without role", "command", msg.Command(), "role", cmd.role)
+		return true
+	}
+	messageLogger(msg).Info("command", "command", msg.Command())
+	if text := cmd.handler(config, data, bot, msg); text != "" {
+		reply := tgbotapi.NewMessage(msg.Chat.ID, text)
+		reply.ReplyToMessageID = msg.MessageID
+		if _, err := send(bot, ChatID(msg.Chat.ID), reply); err != nil {
+			messageLogger(msg).Error("could not reply to command", "err", err)
+		}
+	}
+	return true
+}
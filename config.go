@@ -0,0 +1,737 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const warnMessageDefaultEn = "Do not respond to any direct messages or calls."
+const warnMessageDefaultDe = "Antworte nicht auf private Nachrichten oder Anrufe. Betrüger am Werk."
+const warnAfterDefault = 14 * 24 * time.Hour
+
+type jsonDuration struct {
+	time.Duration
+}
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	d.Duration, err = parseConfigDuration(s)
+	return err
+}
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// parseDuration is like time.ParseDuration, but additionally accepts whole days such as "14d".
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Config is the content of the config file. Besides the secrets and the deployment specific
+// settings, it contains the initial Settings, which are stored in the cache on the first start.
+type Config struct {
+	BotToken string
+	// Chat to which reports about suspicious activity are sent. Reporting is disabled if zero.
+	AdminChatID int64
+
+	// Thresholds of the generated Prometheus alert rules.
+	Alerts AlertConfig
+
+	// Operators of the bot, notified in private messages about new releases. They need to have
+	// started a private chat with the bot.
+	Owners      []UserID
+	UpdateCheck UpdateCheckConfig
+
+	// Role of Telegram admins of a chat (and of members of the admin chat) in that chat, unless they
+	// were assigned a higher role. Defaults to "moderator"; set to "none" to only grant the roles
+	// assigned via /role.
+	TelegramAdminRole *Role `json:",omitempty"`
+	telegramAdminRole Role
+
+	// Language and time zone of the admin chat, in which dates, week boundaries and numbers are
+	// rendered.
+	AdminLocale Locale
+	// Send a summary of the past week to the admin chat at the start of every week.
+	WeeklyDigest bool
+
+	// Secret token Telegram sends with every webhook request, if -webhook-url is used. Generated on
+	// every start if empty.
+	WebhookSecret string `json:",omitempty"`
+	// If no updates could be polled for this long, the bot polls anew. Defaults to 5m.
+	UpdatesStallAfter jsonDuration `json:",omitempty"`
+
+	// Tokens granting access to the admin API, mapped to a name identifying the token holder.
+	APITokens map[string]string
+
+	// Exchange of bans with other moderation bots. Disabled if unset.
+	BanSync *BanSyncConfig `json:",omitempty"`
+	// Statistics served without a token on /public/stats. Disabled if unset.
+	PublicStats *PublicStatsConfig `json:",omitempty"`
+	// Limits of the label cardinality of the metrics.
+	Metrics *MetricsConfig `json:",omitempty"`
+	// Where errors are reported to besides the logs. Disabled if unset.
+	ErrorReporting *ErrorReportingConfig `json:",omitempty"`
+	// API token of the live bot a standby (-standby) authenticates with to follow its state.
+	StandbyToken string `json:",omitempty"`
+	// Web UI for operators at /dashboard on -listen. Disabled if unset.
+	Dashboard *DashboardConfig `json:",omitempty"`
+
+	Settings
+}
+
+// Settings are the settings which can be changed at runtime via /settings, /rules and the admin
+// API. The config file only bootstraps them: once stored in the cache, the stored settings are
+// the single source of truth.
+type Settings struct {
+	// Incremented on every change, to detect concurrent edits.
+	Version int
+
+	// The warnings are templates, see WarningData.
+	WarnMessageEn string
+	WarnMessageDe string
+	// Warn users in the language of their Telegram app instead of the chat language if there is a
+	// warning in it (message key "warning"), e.g. Spanish speakers in an English chat.
+	WarnInUserLanguage bool `json:",omitempty"`
+	// If a user posts a message for the first time after this amount of time, we send a message
+	// replying to them that warns them of scammers.
+	WarnAfter jsonDuration
+	// If set, WarnAfter is adapted to the traffic of each chat.
+	AdaptiveWarnAfter *AdaptiveWarnAfter `json:",omitempty"`
+	// Which messages get the warning: "top-level" (the default) for messages which are not
+	// replies, "always", "first-message" for the first message of each user, or "question".
+	WarnPolicy string `json:",omitempty"`
+	// How users who posted in another chat within WarnAfter are warned and greeted: "full" (the
+	// default), "short" (message key "warning.short") or "skip".
+	KnownUserWarning string `json:",omitempty"`
+	// How users who were warned before in a chat are warned again. All warnings are full if not set.
+	RepeatWarnings *RepeatWarnings `json:",omitempty"`
+	// If set, users warned for the first time ever also get detailed guidance in a private message
+	// (message key "warning.dm"), and the warning in the chat is the short one ("warning.short").
+	GuidanceDM bool `json:",omitempty"`
+	// For this long after the bot first sees a chat, it only records who is active and does not
+	// warn, so the regulars of an established community are not all warned on rollout. Disabled
+	// if zero.
+	LearningPeriod jsonDuration `json:",omitempty"`
+	// If set, at most one warning is sent per chat within this long, so a busy chat is not drowned
+	// in warnings. Skipped warnings are logged.
+	WarningCooldown jsonDuration `json:",omitempty"`
+	// If set, warnings are deleted after this long to keep the chat readable. Telegram does not
+	// allow bots to delete messages older than 48 hours.
+	WarningDeleteAfter jsonDuration `json:",omitempty"`
+	// If set, warnings get buttons linking to the official support page and an explainer of how
+	// scammers operate, and a "Got it" button to dismiss them.
+	WarningButtons *WarningButtons `json:",omitempty"`
+	// If set, the official accounts are published on a page which the warnings link to.
+	VerificationPage *VerificationPage `json:",omitempty"`
+	// Formatting, image and pinned message button of the warnings. Plain text if not set.
+	WarningFormat *WarningFormat `json:",omitempty"`
+	// Number of preceding messages linked in admin reports for context.
+	ReportContextMessages int
+
+	// Rules scoring suspicious messages. Messages reaching FlagScore are reported to the admins,
+	// messages reaching DeleteScore are deleted as well and their authors are banned if they
+	// reach BanScore (both disabled if zero).
+	Rules       []*Rule
+	FlagScore   float64
+	DeleteScore float64
+	BanScore    float64
+	// Actions taken on suspicious messages by detection outcome, "flag", "delete" or "ban",
+	// optionally for a category, e.g. {"delete.giveaway": ["delete", "mute", "notify"]}. Known
+	// actions are "warn", "delete", "mute", "ban" and "notify". Outcomes without actions get the
+	// default actions, see actionPipeline.
+	Actions map[string][]string `json:",omitempty"`
+	// Where to explain to users why their message was deleted: "chat", "private" or "" to not
+	// explain deletions.
+	ExplainDeletions string `json:",omitempty"`
+	// Duration of automated bans. Bans are permanent if zero.
+	BanDuration jsonDuration
+	// Share permanent bans between the groups: a user banned in one group, by the bot or by an
+	// admin, is blocklisted and banned in all other groups.
+	ShareBans bool `json:",omitempty"`
+
+	// Automated bans older than this are posted to the admin chat for review. Disabled if zero.
+	BanReviewAfter jsonDuration
+	// Enforcement during the protection windows of the chats.
+	Protection ProtectionPolicy
+	// During a lockdown, users who are not trusted can post once per this duration.
+	LockdownSlowMode jsonDuration
+
+	// Moderators vote on messages reaching FlagScore but not DeleteScore, and the decision is
+	// carried out. Disabled if not set.
+	Voting *VotingPolicy `json:",omitempty"`
+
+	// Default time users stay on the watchlist.
+	WatchDuration jsonDuration
+	// Detection thresholds are multiplied by this factor for watched users.
+	WatchThresholdFactor float64
+	// Default time users stay trusted. Trust is permanent if zero.
+	TrustDuration jsonDuration
+	// Default time users are muted by /restrict.
+	RestrictDuration jsonDuration
+
+	// Score of messages mentioning handles or phone numbers reported via /gotdm or found in
+	// deleted scam messages.
+	ReportedContactScore float64
+
+	// Detector of emoji floods and formatting abuse. Disabled if not set.
+	Formatting *FormattingDetector `json:",omitempty"`
+	// Detector of new users mimicking the names of admins. Disabled if not set.
+	Impersonation *ImpersonationDetector `json:",omitempty"`
+	// Detector of mentions of accounts mimicking official accounts. Disabled if not set.
+	Mentions *MentionDetector `json:",omitempty"`
+	// Detector of invoices and requests for Telegram Stars. Disabled if not set.
+	PaymentRequests *PaymentRequestDetector `json:",omitempty"`
+	// Scanner of links to blocked and lookalike domains. Disabled if not set.
+	LinkScanner *LinkScanner `json:",omitempty"`
+	// Detector of forwards from known scam channels and photos of new users. Disabled if not set.
+	Forwards *ForwardDetector `json:",omitempty"`
+	// Detector of replies of new accounts offering support to the questions of others. Disabled
+	// if not set.
+	ReplyScams *ReplyScamDetector `json:",omitempty"`
+	// Detector of bursts of messages, which mutes flooding users. Disabled if not set.
+	Flood *FloodDetector `json:",omitempty"`
+	// Detector of the same text posted repeatedly, in one or several chats, which deletes the
+	// copies. Disabled if not set.
+	Duplicates *DuplicateDetector `json:",omitempty"`
+	// Protection of users targeted by repeated flagged replies. Disabled if not set.
+	VictimProtection *VictimProtection `json:",omitempty"`
+	// Detector of established members renaming to admin-like names. Disabled if not set.
+	NameChanges *NameChangeDetector `json:",omitempty"`
+	// External service scoring the messages, e.g. an ML spam model. Disabled if not set.
+	ExternalClassifier *ExternalClassifier `json:",omitempty"`
+	// Scoring of the profiles of users posting their first message in a chat. Disabled if not
+	// set.
+	ProfileRisk *ProfileRisk `json:",omitempty"`
+	// If set, private messages to the bot matching the rules with at least FlagScore are
+	// forwarded to the admin chat.
+	ForwardScamDMs bool `json:",omitempty"`
+
+	// Strike policy for all chats. Strikes are disabled if not set.
+	Strikes *StrikePolicy
+
+	// A chat is considered unattended if no admin was active in it or in the admin chat for this
+	// long.
+	UnattendedAfter jsonDuration
+
+	// Messages mentioning the bot or replying to it are forwarded to the admins at most once per
+	// this interval per user.
+	MentionForwardInterval jsonDuration
+	// Each user can report a message with /report at most once per this interval.
+	ReportInterval jsonDuration
+
+	// Canned answers to common questions. Each entry is answered at most once per FAQCooldown per
+	// chat.
+	FAQ         []*FAQEntry
+	FAQCooldown jsonDuration
+
+	// Note appended to the warning when a first-time poster asks a question.
+	FirstQuestionNoteEn string
+	FirstQuestionNoteDe string
+	// If set, replies of new members to questions of first-time posters are deleted for this long,
+	// so scammers cannot answer first. Users are new for NewMemberAge after their first message.
+	ProtectFirstQuestions jsonDuration
+	NewMemberAge          jsonDuration
+
+	// Greet new members with a warning as soon as they join. The greeting is deleted after
+	// WelcomeDeleteAfter.
+	WelcomeNewMembers  bool
+	WelcomeMessageEn   string
+	WelcomeMessageDe   string
+	WelcomeDeleteAfter jsonDuration
+
+	// Overrides and additions to the built-in user-facing messages, by language and message key,
+	// e.g. names of custom rule categories: {"en": {"category.phishing": "phishing"}}.
+	Messages map[string]map[string]string `json:",omitempty"`
+	// Languages whose messages are used for missing messages of a language, in order, e.g.
+	// {"de-CH": ["de"]}. Without entry, a regional language falls back to its base language
+	// ("de-CH" to "de"). All languages finally fall back to English.
+	LanguageFallbacks map[string][]string `json:",omitempty"`
+
+	// If the bot was offline for longer than DowntimeThreshold, the thresholds for users seen for
+	// the first time after the restart are multiplied by DowntimeThresholdFactor for
+	// DowntimeGracePeriod, as their joins may have been missed.
+	DowntimeThreshold       jsonDuration
+	DowntimeGracePeriod     jsonDuration
+	DowntimeThresholdFactor float64
+
+	// Chats without messages for this long are considered dormant.
+	DormantAfter jsonDuration
+
+	// If set, the operators are notified when requests to Telegram keep failing.
+	APIErrorBudget *APIErrorBudget `json:",omitempty"`
+
+	// Chat members without messages for this long are evicted from the state, and from chats with
+	// more than MaxChatMembers members (unless zero), the least recently active ones. Must not be
+	// shorter than WarnAfter and NewMemberAge, as returning users are treated like new ones.
+	UserRetention  jsonDuration
+	MaxChatMembers int `json:",omitempty"`
+
+	// What the bot does in chats which are not in Groups: "leave" (the default) or "ask" the
+	// admin chat whether to stay.
+	UnknownChats string `json:",omitempty"`
+	// The chats the bot is allowed in, with their settings overriding the global settings above.
+	// The bot leaves all other groups, see UnknownChats.
+	Groups []*GroupConfig
+}
+
+// GroupConfig contains the settings of a single chat.
+type GroupConfig struct {
+	// The chat is identified by its ID. Entries without ID match a chat by its title instead, and
+	// are bound to the ID of the chat when the first message is posted in it.
+	ChatID ChatID `json:",omitempty"`
+	Title  string `json:",omitempty"`
+	// Language of the warning and of the bot's replies. Defaults to "en".
+	Language string `json:",omitempty"`
+	// Overrides the warning in the chat language (WarnMessageEn/WarnMessageDe).
+	WarnMessage string `json:",omitempty"`
+	// Variants of the warning in the chat language, assigned to users at random to compare them.
+	// Take precedence over WarnMessage.
+	WarnVariants []*WarnVariant `json:",omitempty"`
+	// Overrides WarningButtons.SupportURL, e.g. to link the support page of a product.
+	SupportURL string `json:",omitempty"`
+	// Overrides WarnAfter.
+	WarnAfter jsonDuration `json:",omitempty"`
+	// Overrides WarnPolicy.
+	WarnPolicy string `json:",omitempty"`
+	// Overrides WarningCooldown.
+	WarningCooldown jsonDuration `json:",omitempty"`
+	// Users who are never warned in the chat, e.g. known community helpers. Their messages are
+	// still scanned.
+	ExemptUsers []UserID `json:",omitempty"`
+	// If set, the admins of the chat and users with at least the moderator role are never warned.
+	ExemptAdmins bool `json:",omitempty"`
+	// Overrides the greeting of new members in the chat language (WelcomeMessageEn/WelcomeMessageDe).
+	WelcomeMessage string `json:",omitempty"`
+
+	Strikes   *StrikePolicy `json:",omitempty"`
+	NightMode *NightMode    `json:",omitempty"`
+	// If set, no warnings are posted to the chat during these hours.
+	QuietHours *QuietHours `json:",omitempty"`
+	// Names of the built-in rule packs enabled in the chat.
+	RulePacks []string `json:",omitempty"`
+	// Warn with a sticker instead of the text warning, see /warnsticker.
+	WarningSticker *WarningSticker `json:",omitempty"`
+	// If set, a reminder is posted to the chat on a schedule.
+	Reminder *Reminder `json:",omitempty"`
+	// If set, an anti-scam notice is kept pinned in the chat.
+	PinnedNotice *PinnedNotice `json:",omitempty"`
+	// Overrides Actions per outcome.
+	Actions map[string][]string `json:",omitempty"`
+	// Detectors whose findings are only counted but not scored in the chat, e.g. "rule:foo" or
+	// "pack:giveaway".
+	ShadowDetectors []string `json:",omitempty"`
+	// Periods of stricter enforcement, scheduled with /protect.
+	ProtectionWindows []*ProtectionWindow `json:",omitempty"`
+	// Set while the chat is locked down with /lockdown.
+	Lockdown *Lockdown `json:",omitempty"`
+	// If set, new members are muted until they verify that they are human.
+	Verification *Verification `json:",omitempty"`
+	// If set, new members are restricted for a while after joining.
+	Probation *Probation `json:",omitempty"`
+	// If set, the first message of a user is held until a moderator approves it.
+	QuarantineFirstMessage bool `json:",omitempty"`
+	// Set while the bot is switched off in the chat with /bot off.
+	BotOff *BotOff `json:",omitempty"`
+	// Settings of the topics of a forum supergroup.
+	Topics []*TopicConfig `json:",omitempty"`
+}
+
+// group returns the settings of a chat, or nil if the chat has no settings of its own.
+func (s *Settings) group(chatID ChatID) *GroupConfig {
+	for _, group := range s.Groups {
+		if group.ChatID == chatID {
+			return group
+		}
+	}
+	return nil
+}
+
+// setDefaults fills in the defaults of unset settings.
+func (s *Settings) setDefaults() {
+	if s.WarnMessageEn == "" {
+		s.WarnMessageEn = warnMessageDefaultEn
+	}
+	if s.WarnMessageDe == "" {
+		s.WarnMessageDe = warnMessageDefaultDe
+	}
+	if s.WarnAfter.Duration == 0 {
+		s.WarnAfter.Duration = warnAfterDefault
+	}
+	if s.FirstQuestionNoteEn == "" {
+		s.FirstQuestionNoteEn = firstQuestionNoteDefaultEn
+	}
+	if s.FirstQuestionNoteDe == "" {
+		s.FirstQuestionNoteDe = firstQuestionNoteDefaultDe
+	}
+	if s.WelcomeMessageEn == "" {
+		s.WelcomeMessageEn = welcomeMessageDefaultEn
+	}
+	if s.WelcomeMessageDe == "" {
+		s.WelcomeMessageDe = welcomeMessageDefaultDe
+	}
+	if s.WelcomeDeleteAfter.Duration == 0 {
+		s.WelcomeDeleteAfter.Duration = welcomeDeleteAfterDefault
+	}
+	if s.DowntimeThreshold.Duration == 0 {
+		s.DowntimeThreshold.Duration = downtimeThresholdDefault
+	}
+	if s.DowntimeGracePeriod.Duration == 0 {
+		s.DowntimeGracePeriod.Duration = downtimeGracePeriodDefault
+	}
+	if s.DowntimeThresholdFactor == 0 {
+		s.DowntimeThresholdFactor = downtimeThresholdFactorDefault
+	}
+	if s.NewMemberAge.Duration == 0 {
+		s.NewMemberAge.Duration = newMemberAgeDefault
+	}
+	if s.ReportContextMessages == 0 {
+		s.ReportContextMessages = reportContextMessagesDefault
+	}
+	if s.FlagScore == 0 {
+		s.FlagScore = flagScoreDefault
+	}
+	if s.WatchDuration.Duration == 0 {
+		s.WatchDuration.Duration = watchDurationDefault
+	}
+	if s.WatchThresholdFactor == 0 {
+		s.WatchThresholdFactor = watchThresholdFactorDefault
+	}
+	if s.UnattendedAfter.Duration == 0 {
+		s.UnattendedAfter.Duration = unattendedAfterDefault
+	}
+	if s.MentionForwardInterval.Duration == 0 {
+		s.MentionForwardInterval.Duration = mentionForwardIntervalDefault
+	}
+	if s.ReportInterval.Duration == 0 {
+		s.ReportInterval.Duration = reportIntervalDefault
+	}
+	if s.FAQCooldown.Duration == 0 {
+		s.FAQCooldown.Duration = faqCooldownDefault
+	}
+	if s.DormantAfter.Duration == 0 {
+		s.DormantAfter.Duration = dormantAfterDefault
+	}
+	if s.UserRetention.Duration == 0 {
+		s.UserRetention.Duration = userRetentionDefault
+	}
+	if s.ReportedContactScore == 0 {
+		s.ReportedContactScore = reportedContactScoreDefault
+	}
+	if s.Formatting != nil {
+		s.Formatting.setDefaults()
+	}
+	if s.Impersonation != nil {
+		s.Impersonation.setDefaults(s.NewMemberAge.Duration)
+	}
+	if s.Mentions != nil {
+		s.Mentions.setDefaults(s.FlagScore, s.DeleteScore)
+	}
+	if s.ExternalClassifier != nil {
+		s.ExternalClassifier.setDefaults(s.FlagScore, s.DeleteScore)
+	}
+	if s.APIErrorBudget != nil {
+		s.APIErrorBudget.setDefaults()
+	}
+	if s.ProfileRisk != nil {
+		s.ProfileRisk.setDefaults()
+	}
+	if s.Voting != nil {
+		s.Voting.setDefaults()
+	}
+	s.Protection.setDefaults()
+	if s.LockdownSlowMode.Duration == 0 {
+		s.LockdownSlowMode.Duration = lockdownSlowModeDefault
+	}
+	if s.PaymentRequests != nil {
+		s.PaymentRequests.setDefaults(s.FlagScore, s.DeleteScore)
+	}
+	if s.LinkScanner != nil {
+		s.LinkScanner.setDefaults(s.FlagScore, s.DeleteScore)
+	}
+	if s.Forwards != nil {
+		s.Forwards.setDefaults(s.FlagScore, s.DeleteScore)
+	}
+	if s.ReplyScams != nil {
+		s.ReplyScams.setDefaults(s.NewMemberAge.Duration, s.FlagScore, s.DeleteScore)
+	}
+	if s.Flood != nil {
+		s.Flood.setDefaults()
+	}
+	if s.Duplicates != nil {
+		s.Duplicates.setDefaults()
+	}
+	if s.AdaptiveWarnAfter != nil {
+		s.AdaptiveWarnAfter.setDefaults(s.WarnAfter.Duration, s.UserRetention.Duration)
+	}
+	if s.VictimProtection != nil {
+		s.VictimProtection.setDefaults()
+	}
+	if s.NameChanges != nil {
+		s.NameChanges.setDefaults(s.NewMemberAge.Duration)
+	}
+	if s.RepeatWarnings != nil {
+		s.RepeatWarnings.setDefaults()
+	}
+	if s.RestrictDuration.Duration == 0 {
+		s.RestrictDuration.Duration = restrictDurationDefault
+	}
+}
+
+// compile validates the settings and prepares them for use.
+func (s *Settings) compile() error {
+	switch s.ExplainDeletions {
+	case "", explainInChat, explainPrivately:
+	default:
+		return fieldErrorf("ExplainDeletions", "must be %q, %q or empty", explainInChat, explainPrivately)
+	}
+	if _, ok := warnPolicies[s.WarnPolicy]; s.WarnPolicy != "" && !ok {
+		return fieldErrorf("WarnPolicy", "must be one of %s", strings.Join(warnPolicyNames(), ", "))
+	}
+	switch s.UnknownChats {
+	case "", unknownChatsLeave, unknownChatsAsk:
+	default:
+		return fieldErrorf("UnknownChats", "must be %q or %q", unknownChatsLeave, unknownChatsAsk)
+	}
+	switch s.KnownUserWarning {
+	case "", knownUserWarningFull, knownUserWarningShort, knownUserWarningSkip:
+	default:
+		return fieldErrorf("KnownUserWarning", "must be %q, %q or %q", knownUserWarningFull, knownUserWarningShort, knownUserWarningSkip)
+	}
+	if s.RepeatWarnings != nil {
+		if err := s.RepeatWarnings.compile(); err != nil {
+			return inField("RepeatWarnings", err)
+		}
+	}
+	if s.UserRetention.Duration < s.WarnAfter.Duration || s.UserRetention.Duration < s.NewMemberAge.Duration {
+		return fieldErrorf("UserRetention", "must not be shorter than WarnAfter and NewMemberAge")
+	}
+	if s.AdaptiveWarnAfter != nil {
+		if err := s.AdaptiveWarnAfter.compile(s.UserRetention.Duration); err != nil {
+			return inField("AdaptiveWarnAfter", err)
+		}
+	}
+	if err := s.checkRanges(); err != nil {
+		return err
+	}
+	if err := compileActions(s.Actions); err != nil {
+		return inField("Actions", err)
+	}
+	for lang, fallbacks := range s.LanguageFallbacks {
+		for _, fallback := range fallbacks {
+			if builtinMessages[fallback] == nil && s.Messages[fallback] == nil {
+				return fieldErrorf("LanguageFallbacks."+lang, "no messages in language %q", fallback)
+			}
+		}
+	}
+	if s.WarningButtons != nil {
+		if err := s.WarningButtons.compile(); err != nil {
+			return inField("WarningButtons", err)
+		}
+	}
+	if s.VerificationPage != nil {
+		if err := s.VerificationPage.compile(); err != nil {
+			return inField("VerificationPage", err)
+		}
+	}
+	if s.WarningFormat != nil {
+		if err := s.WarningFormat.compile(); err != nil {
+			return inField("WarningFormat", err)
+		}
+	}
+	if s.ExternalClassifier != nil {
+		if err := s.ExternalClassifier.compile(); err != nil {
+			return inField("ExternalClassifier", err)
+		}
+	}
+	if s.ProfileRisk != nil {
+		if err := s.ProfileRisk.compile(); err != nil {
+			return inField("ProfileRisk", err)
+		}
+	}
+	if err := s.compileWarningTemplates(); err != nil {
+		return err
+	}
+	if err := s.compileRules(); err != nil {
+		return err
+	}
+	if err := s.compileGroups(); err != nil {
+		return err
+	}
+	return s.compileFAQ()
+}
+
+// loadConfig reads the config file, fills in defaults and validates it.
+func loadConfig(filename string) (*Config, error) {
+	configBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := decodeConfig(filename, configBytes, &config); err != nil {
+		return nil, err
+	}
+	if config.Alerts.MaxUpdateSilence.Duration == 0 {
+		config.Alerts.MaxUpdateSilence.Duration = maxUpdateSilenceDefault
+	}
+	if config.Alerts.ActionLatencyPercentile == 0 {
+		config.Alerts.ActionLatencyPercentile = actionLatencyPercentileDefault
+	}
+	if p := config.Alerts.ActionLatencyPercentile; p <= 0 || p >= 100 {
+		return nil, locateConfigError(filename, configBytes, fieldErrorf("Alerts.ActionLatencyPercentile", "must be between 0 and 100"))
+	}
+	if config.UpdateCheck.Repository == "" {
+		config.UpdateCheck.Repository = updateCheckRepositoryDefault
+	}
+	if config.UpdateCheck.Interval.Duration == 0 {
+		config.UpdateCheck.Interval.Duration = updateCheckIntervalDefault
+	}
+	if config.BanSync != nil && config.BanSync.Source == "" {
+		config.BanSync.Source = banSyncSourceDefault
+	}
+	if config.UpdatesStallAfter.Duration == 0 {
+		config.UpdatesStallAfter.Duration = updatesStallAfterDefault
+	}
+	if config.PublicStats != nil && config.PublicStats.MinCount == 0 {
+		config.PublicStats.MinCount = publishedMinCountDefault
+	}
+	if config.PublicStats != nil && config.PublicStats.MinCount < 0 {
+		return nil, locateConfigError(filename, configBytes, fieldErrorf("PublicStats.MinCount", "must not be negative"))
+	}
+	config.telegramAdminRole = roleModerator
+	if config.TelegramAdminRole != nil {
+		config.telegramAdminRole = *config.TelegramAdminRole
+	}
+	config.setDefaults()
+	if err := config.AdminLocale.compile(); err != nil {
+		return nil, locateConfigError(filename, configBytes, inField("AdminLocale", err))
+	}
+	if err := config.compile(); err != nil {
+		return nil, locateConfigError(filename, configBytes, err)
+	}
+	return &config, nil
+}
+
+// liveConfig is the config currently in effect. A Config is never modified once it is live;
+// changes swap in a modified copy, so readers can use the config they loaded without locking.
+var liveConfig atomic.Pointer[Config]
+
+// settingsUpdateLock serializes changes to the settings.
+var settingsUpdateLock sync.Mutex
+
+// currentConfig returns the config currently in effect.
+func currentConfig() *Config {
+	return liveConfig.Load()
+}
+
+// cloneSettings returns a deep copy of the settings.
+func cloneSettings(settings *Settings) (*Settings, error) {
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	var clone Settings
+	if err := json.Unmarshal(settingsJSON, &clone); err != nil {
+		return nil, err
+	}
+	return &clone, nil
+}
+
+// activateSettings makes the settings stored in the cache the live settings. On the first start,
+// the settings of the config file are stored instead.
+func activateSettings(config *Config, data *Data) error {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	if data.Settings == nil {
+		slog.Info("storing settings of the config file in the cache")
+		data.Settings = &config.Settings
+		data.markChanged()
+	} else {
+		slog.Info("using the settings stored in the cache; settings in the config file are ignored")
+		settings, err := cloneSettings(data.Settings)
+		if err != nil {
+			return err
+		}
+		settings.setDefaults()
+		if err := settings.compile(); err != nil {
+			return err
+		}
+		config.Settings = *settings
+		data.Settings = &config.Settings
+	}
+	liveConfig.Store(config)
+	return nil
+}
+
+// anyVersion makes updateSettings apply a change regardless of the current version. This is safe
+// for changes that only modify a part of the settings, as they are applied to the latest settings.
+const anyVersion = -1
+
+var errSettingsConflict = errors.New("the settings were changed by someone else in the meantime; reload them and retry")
+
+// updateSettings applies a change to a copy of the live settings, validates the result, makes it
+// live and stores it in the cache, returning the new version. If baseVersion is not anyVersion,
+// the change is rejected with errSettingsConflict unless the live settings still have that
+// version, so that concurrent edits of the whole settings cannot silently overwrite each other.
+func updateSettings(data *Data, baseVersion int, change func(settings *Settings) error) (int, error) {
+	settingsUpdateLock.Lock()
+	defer settingsUpdateLock.Unlock()
+
+	config := *currentConfig()
+	if baseVersion != anyVersion && baseVersion != config.Version {
+		return 0, errSettingsConflict
+	}
+	settings, err := cloneSettings(&config.Settings)
+	if err != nil {
+		return 0, err
+	}
+	if err := change(settings); err != nil {
+		return 0, err
+	}
+	settings.Version = config.Version + 1
+	settings.setDefaults()
+	if err := settings.compile(); err != nil {
+		return 0, err
+	}
+	config.Settings = *settings
+
+	data.lock.Lock()
+	data.Settings = &config.Settings
+	data.markChanged()
+	data.lock.Unlock()
+	liveConfig.Store(&config)
+	return settings.Version, nil
+}
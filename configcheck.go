@@ -0,0 +1,264 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The config has grown large, with many per-chat options, so mistakes in it must be easy to find.
+// Unknown keys are rejected instead of silently ignored, as they are usually typos or options
+// which were renamed. Invalid values are reported as fieldErrors naming the path of the offending
+// key, e.g. "Groups[1].WarnAfter", and errors in the config file additionally point to its line.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// fieldError is an invalid value of the field at path, e.g. "Groups[1].WarnAfter".
+type fieldError struct {
+	path string
+	err  error
+}
+
+func (e *fieldError) Error() string {
+	return e.path + ": " + e.err.Error()
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.err
+}
+
+// fieldErrorf returns a fieldError for the field at path.
+func fieldErrorf(path string, format string, args ...interface{}) error {
+	return &fieldError{path: path, err: fmt.Errorf(format, args...)}
+}
+
+// inField attributes an error of a nested value to the field at path. The paths of fieldErrors
+// are prefixed with it.
+func inField(path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var nested *fieldError
+	if errors.As(err, &nested) && nested == err {
+		if strings.HasPrefix(nested.path, "[") {
+			return &fieldError{path: path + nested.path, err: nested.err}
+		}
+		return &fieldError{path: path + "." + nested.path, err: nested.err}
+	}
+	return &fieldError{path: path, err: err}
+}
+
+// durationError is an invalid duration in the config, kept to find it in the config file.
+type durationError struct {
+	value string
+	err   error
+}
+
+func (e *durationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *durationError) Unwrap() error {
+	return e.err
+}
+
+// checkRanges checks that the durations, scores and counts of the settings are in range.
+func (s *Settings) checkRanges() error {
+	// A negative duration is never meaningful; zero disables or selects the default.
+	value := reflect.ValueOf(s).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if duration, ok := value.Field(i).Interface().(jsonDuration); ok && duration.Duration < 0 {
+			return fieldErrorf(value.Type().Field(i).Name, "must not be negative")
+		}
+	}
+	for name, score := range map[string]float64{
+		"FlagScore": s.FlagScore, "DeleteScore": s.DeleteScore, "BanScore": s.BanScore, "ReportedContactScore": s.ReportedContactScore,
+	} {
+		if score < 0 {
+			return fieldErrorf(name, "must not be negative")
+		}
+	}
+	for name, factor := range map[string]float64{
+		"WatchThresholdFactor": s.WatchThresholdFactor, "DowntimeThresholdFactor": s.DowntimeThresholdFactor,
+	} {
+		if factor <= 0 {
+			return fieldErrorf(name, "must be positive")
+		}
+	}
+	if s.ReportContextMessages < 0 {
+		return fieldErrorf("ReportContextMessages", "must not be negative")
+	}
+	if s.MaxChatMembers < 0 {
+		return fieldErrorf("MaxChatMembers", "must not be negative")
+	}
+	if s.Flood != nil {
+		for name, value := range map[string]int{
+			"Messages": s.Flood.Messages, "CrossChats": s.Flood.CrossChats, "MinTextLength": s.Flood.MinTextLength,
+		} {
+			if value < 0 {
+				return fieldErrorf("Flood."+name, "must not be negative")
+			}
+		}
+		if s.Flood.Window.Duration < 0 || s.Flood.CrossChatWindow.Duration < 0 || s.Flood.MuteDuration.Duration < 0 {
+			return fieldErrorf("Flood", "durations must not be negative")
+		}
+	}
+	if s.APIErrorBudget != nil && s.APIErrorBudget.MaxConsecutiveFailures < 0 {
+		return fieldErrorf("APIErrorBudget.MaxConsecutiveFailures", "must not be negative")
+	}
+	if s.Mentions != nil && s.Mentions.Score < 0 {
+		return fieldErrorf("Mentions.Score", "must not be negative")
+	}
+	if d := s.Duplicates; d != nil && (d.Window.Duration < 0 || d.MinTextLength < 0 || d.MaxCopies < 0) {
+		return fieldErrorf("Duplicates", "must not be negative")
+	}
+	if r := s.ReplyScams; r != nil && (r.PhraseScore < 0 || r.LinkScore < 0 || r.MaxAccountAge.Duration < 0) {
+		return fieldErrorf("ReplyScams", "must not be negative")
+	}
+	if p := s.VictimProtection; p != nil && (p.Replies < 0 || p.Window.Duration < 0 || p.Duration.Duration < 0) {
+		return fieldErrorf("VictimProtection", "must not be negative")
+	}
+	return nil
+}
+
+// decodeConfig decodes a config file, rejecting unknown keys. Errors point to the line of the
+// offending key or value.
+func decodeConfig(filename string, content []byte, config *Config) error {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return locateConfigError(filename, content, err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("%s: unexpected content after the config", filename)
+	}
+	return nil
+}
+
+// locateConfigError prefixes an error in the config file with the position of the offending key
+// or value, if it can be found.
+func locateConfigError(filename string, content []byte, err error) error {
+	offset := int64(-1)
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	var field *fieldError
+	var duration *durationError
+	switch {
+	// Both point just after the offending character or value.
+	case errors.As(err, &syntaxError):
+		offset = syntaxError.Offset - 1
+	case errors.As(err, &typeError):
+		offset = typeError.Offset - 1
+	case errors.As(err, &field):
+		offset = findInJSON(content, func(path string, value json.Token) bool {
+			return value == nil && strings.EqualFold(path, field.path)
+		})
+	case errors.As(err, &duration):
+		offset = findInJSON(content, func(path string, value json.Token) bool {
+			return value == duration.value
+		})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		var name string
+		fmt.Sscanf(strings.TrimPrefix(err.Error(), "json: unknown field "), "%q", &name)
+		path := ""
+		offset = findInJSON(content, func(candidate string, value json.Token) bool {
+			if value == nil && (candidate == name || strings.HasSuffix(candidate, "."+name)) {
+				path = candidate
+				return true
+			}
+			return false
+		})
+		if path != "" {
+			err = fieldErrorf(path, "unknown key")
+		}
+	}
+	if offset < 0 {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	line, column := lineAndColumn(content, offset)
+	return fmt.Errorf("%s:%d:%d: %w", filename, line, column, err)
+}
+
+// findInJSON returns the offset of the first key or array element for which match returns true,
+// or -1. match is called with the path of every key and array element, e.g. "Groups[1].Title",
+// and value nil, and with every scalar value.
+func findInJSON(content []byte, match func(path string, value json.Token) bool) int64 {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	found := int64(-1)
+	var walk func(path string) error
+	walk = func(path string) error {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := token.(json.Delim)
+		if !ok {
+			if found < 0 && token != nil && match(path, token) {
+				found = offset
+			}
+			return nil
+		}
+		for i := 0; decoder.More(); i++ {
+			child := fmt.Sprintf("%s[%d]", path, i)
+			offset := decoder.InputOffset()
+			if delim == '{' {
+				key, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				child = strings.TrimPrefix(path+"."+key.(string), ".")
+			}
+			if found < 0 && match(child, nil) {
+				found = offset
+			}
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+		return err
+	}
+	walk("")
+	return found
+}
+
+// lineAndColumn returns the 1-based line and column of the first token at or after offset.
+func lineAndColumn(content []byte, offset int64) (int, int) {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	for offset < int64(len(content)) && strings.ContainsRune(" \t\r\n,:", rune(content[offset])) {
+		offset++
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// parseConfigDuration parses a duration of the config, see parseDuration.
+func parseConfigDuration(s string) (time.Duration, error) {
+	duration, err := parseDuration(s)
+	if err != nil {
+		return 0, &durationError{value: s, err: err}
+	}
+	return duration, nil
+}
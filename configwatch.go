@@ -0,0 +1,126 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The config file is reloaded when it changes or the bot receives SIGHUP, in addition to /reload.
+// The settings in the cache take precedence over those in the config file, as they are changed at
+// runtime. But an operator editing, say, the rules in the config file expects the edit to take
+// effect, so the settings which changed in the file since it was last loaded are applied to the
+// live settings, and all others are kept. The new config is validated before anything is swapped
+// in.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// How often the config file is checked for changes.
+const configWatchInterval = 5 * time.Second
+
+// fileSettings are the settings of the config file as last loaded, to find out which settings the
+// next version of the file changes. Guarded by settingsUpdateLock.
+var fileSettings *Settings
+
+// rememberFileSettings records the settings of the config file as loaded.
+func rememberFileSettings(settings *Settings) error {
+	clone, err := cloneSettings(settings)
+	if err != nil {
+		return err
+	}
+	settingsUpdateLock.Lock()
+	defer settingsUpdateLock.Unlock()
+	fileSettings = clone
+	return nil
+}
+
+// applyFileSettings applies the settings which changed in the config file since it was last
+// loaded to the live settings. Returns the names of the applied settings.
+func applyFileSettings(data *Data, settings *Settings) ([]string, error) {
+	settingsUpdateLock.Lock()
+	previous := fileSettings
+	settingsUpdateLock.Unlock()
+	if previous == nil {
+		return nil, rememberFileSettings(settings)
+	}
+	changed := changedFields(previous, settings)
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	version, err := updateSettings(data, anyVersion, func(live *Settings) error {
+		for _, name := range changed {
+			reflect.ValueOf(live).Elem().FieldByName(name).Set(reflect.ValueOf(settings).Elem().FieldByName(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	data.audit(auditAreaSettings, "config file", version, "changed "+strings.Join(changed, ", "))
+	return changed, rememberFileSettings(settings)
+}
+
+// configFileVersion identifies the version of the config file by its modification time and size.
+func configFileVersion() (string, error) {
+	info, err := os.Stat(*configFilename)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// watchConfig reloads the config when the file changes or the bot receives SIGHUP, until ctx is
+// cancelled. The admins are notified of the outcome.
+func watchConfig(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	signals := make(chan os.Signal, 1)
+	if reloadSignal != nil {
+		signal.Notify(signals, reloadSignal)
+		defer signal.Stop(signals)
+	}
+	lastVersion, _ := configFileVersion()
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+	for {
+		trigger := "signal"
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		case <-ticker.C:
+			version, err := configFileVersion()
+			if err != nil || version == lastVersion {
+				continue
+			}
+			lastVersion = version
+			trigger = "file change"
+		}
+		changed, err := reloadConfig(data)
+		logAction(slog.Default(), "reload config", err, "trigger", trigger, "changed_settings", changed)
+		config := currentConfig()
+		switch {
+		case err != nil:
+			notifyAdmins(config, bot, fmt.Sprintf("Could not reload the config after a %s, keeping the current one: %v", trigger, err))
+		case len(changed) > 0:
+			notifyAdmins(config, bot, fmt.Sprintf("Config reloaded after a %s. Settings changed in the file: %s.", trigger, strings.Join(changed, ", ")))
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scam messages usually direct victims to another account ("contact @fake_support") or phone
+// number. These contacts are extracted from deleted messages, so the referenced accounts are
+// watched as soon as they appear and messages advertising them are scored.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const reportedContactScoreDefault = 1.0
+
+// Telegram usernames have 5 to 32 characters.
+var handlePattern = regexp.MustCompile(`(?i)(?:@|\bt\.me/|\btelegram\.me/)([a-z][a-z0-9_]{4,31})\b`)
+
+var phonePattern = regexp.MustCompile(`\+?\d[\d \-().]{6,}\d`)
+
+// extractHandles returns the lowercased usernames mentioned in a text.
+func extractHandles(text string) []string {
+	var handles []string
+	for _, match := range handlePattern.FindAllStringSubmatch(text, -1) {
+		handles = append(handles, strings.ToLower(match[1]))
+	}
+	return handles
+}
+
+// normalizePhone returns the digits of a phone number with a leading "+" if it had one, or an
+// empty string if it has not the 8 to 15 digits of a phone number.
+func normalizePhone(s string) string {
+	var digits strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	if digits.Len() < 8 || digits.Len() > 15 {
+		return ""
+	}
+	if strings.HasPrefix(strings.TrimSpace(s), "+") {
+		return "+" + digits.String()
+	}
+	return digits.String()
+}
+
+// extractPhones returns the normalized phone numbers mentioned in a text.
+func extractPhones(text string) []string {
+	var phones []string
+	for _, match := range phonePattern.FindAllString(text, -1) {
+		if phone := normalizePhone(match); phone != "" {
+			phones = append(phones, phone)
+		}
+	}
+	return phones
+}
+
+// propagateContacts records the handles and phone numbers mentioned in a deleted scam message.
+// Users with a recorded handle are watched once they appear (see watchReportedName), known users
+// right away. Handles of moderators and the bot itself are ignored, as scam messages sometimes
+// name them to appear legitimate. Returns a description of the recorded contacts for the admin
+// report.
+func propagateContacts(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, actionID string) string {
+	text := messageText(msg)
+	if msg.Contact != nil {
+		text += "\n" + msg.Contact.PhoneNumber
+	}
+	var recorded []string
+	now := time.Now()
+	for _, handle := range extractHandles(text) {
+		if strings.EqualFold(handle, bot.Self.UserName) || strings.EqualFold(handle, msg.From.UserName) {
+			continue
+		}
+		data.lock.Lock()
+		userID, known := data.userByName(handle)
+		data.lock.Unlock()
+		if known && userRole(config, data, bot, ChatID(msg.Chat.ID), userID) >= roleViewer {
+			continue
+		}
+		data.lock.Lock()
+		if _, ok := data.ReportedNames[handle]; !ok {
+			data.ReportedNames[handle] = &ReportedName{ReportedAt: now, Source: "action " + actionID}
+			data.markChanged()
+			recorded = append(recorded, "@"+handle)
+		}
+		if known && !data.hasStateLocked(userID, stateWatched, 0) {
+			data.setState(userID, &UserState{
+				Kind:   stateWatched,
+				Until:  now.Add(config.WatchDuration.Duration),
+				Reason: fmt.Sprintf("mentioned in scam message (action %s)", actionID),
+			})
+		}
+		data.lock.Unlock()
+	}
+	for _, phone := range extractPhones(text) {
+		data.lock.Lock()
+		if _, ok := data.ReportedPhones[phone]; !ok {
+			data.ReportedPhones[phone] = &ReportedName{ReportedAt: now, Source: "action " + actionID}
+			data.markChanged()
+			recorded = append(recorded, phone)
+		}
+		data.lock.Unlock()
+	}
+	if len(recorded) == 0 {
+		return ""
+	}
+	return "Watching contacts mentioned in the message: " + strings.Join(recorded, ", ")
+}
+
+// detectReportedContacts scores messages mentioning handles or phone numbers recorded from scam
+// messages or reported via /gotdm.
+func detectReportedContacts(config *Config, data *Data, msg *tgbotapi.Message) []Finding {
+	text := messageText(msg)
+	if msg.Contact != nil {
+		text += "\n" + msg.Contact.PhoneNumber
+	}
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	var findings []Finding
+	for _, handle := range extractHandles(text) {
+		if _, ok := data.ReportedNames[handle]; ok {
+			findings = append(findings, Finding{
+				Detector: "contact:handle",
+				Score:    config.ReportedContactScore,
+				Reason:   fmt.Sprintf("mentions reported account @%s", handle),
+				Category: "scam",
+			})
+		}
+	}
+	for _, phone := range extractPhones(text) {
+		if _, ok := data.ReportedPhones[phone]; ok {
+			findings = append(findings, Finding{
+				Detector: "contact:phone",
+				Score:    config.ReportedContactScore,
+				Reason:   fmt.Sprintf("mentions reported phone number %s", phone),
+				Category: "scam",
+			})
+		}
+	}
+	return findings
+}
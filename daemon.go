@@ -0,0 +1,200 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// With -daemon, the bot cooperates with systemd instead of leaving it to guess whether the process
+// is fine:
+//
+//   - It notifies systemd once it is ready to process updates (Type=notify), and when it stops.
+//   - With WatchdogSec, it pings the watchdog of systemd as long as it receives updates. If polling
+//     stalls and the poller watchdog cannot recover it, the pings stop and systemd restarts the bot.
+//   - It writes its PID to -pid-file and its health, as served on /healthz, to -status-file every
+//     few seconds, for tools outside of systemd. Both files are removed on exit.
+//
+// With socket activation (a .socket unit), the HTTP server is served on the socket passed by
+// systemd instead of listening on -listen itself.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// How often the status file is written.
+const statusFileInterval = 10 * time.Second
+
+// The first file descriptor passed by systemd with socket activation.
+const listenFDsStart = 3
+
+// StatusFile is the content of -status-file.
+type StatusFile struct {
+	PID       int
+	StartedAt time.Time
+	UpdatedAt time.Time
+	HealthStatus
+}
+
+// sdNotify sends a state, e.g. "READY=1", to systemd. Does nothing if the bot was not started by
+// systemd with a notify socket.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract sockets start with "@".
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval of the watchdog of systemd, or zero if it is disabled.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// activatedListener returns the socket passed by systemd with socket activation, or nil.
+func activatedListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	if fds > 1 {
+		slog.Warn("socket activation: only serving on the first of the passed sockets", "sockets", fds)
+	}
+	file := os.NewFile(listenFDsStart, "systemd-socket")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	}
+	return listener, nil
+}
+
+// writeStatusFile writes the health of the bot to -status-file.
+func writeStatusFile() error {
+	now := time.Now()
+	status, err := json.MarshalIndent(StatusFile{
+		PID:          os.Getpid(),
+		StartedAt:    startedAt,
+		UpdatedAt:    now,
+		HealthStatus: currentHealth(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Written to a temporary file first, so readers never see a partial status.
+	tmp := *statusFilename + ".tmp"
+	if err := os.WriteFile(tmp, append(status, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *statusFilename)
+}
+
+// daemon is the part of the bot cooperating with systemd, a no-op unless -daemon is set.
+type daemon struct{}
+
+// startDaemon writes the PID file. Does nothing unless -daemon is set.
+func startDaemon() (*daemon, error) {
+	if !*daemonMode {
+		return nil, nil
+	}
+	if *pidFilename != "" {
+		if err := os.WriteFile(*pidFilename, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			return nil, fmt.Errorf("could not write the PID file: %w", err)
+		}
+	}
+	return &daemon{}, nil
+}
+
+// ready notifies systemd that the bot is ready and pings its watchdog and writes the status file
+// until ctx is cancelled.
+func (d *daemon) ready(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	if err := sdNotify("READY=1\nSTATUS=Processing updates"); err != nil {
+		slog.Error("could not notify systemd", "err", err)
+	}
+	interval := statusFileInterval
+	watchdog := watchdogInterval()
+	if watchdog > 0 {
+		// Pinged twice per interval, as recommended by systemd.
+		interval = min(interval, watchdog/2)
+		slog.Info("pinging the systemd watchdog", "interval", interval)
+	}
+	for {
+		health := currentHealth()
+		if watchdog > 0 && health.Updates == "ok" {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Error("could not ping the systemd watchdog", "err", err)
+			}
+		}
+		if *statusFilename != "" {
+			if err := writeStatusFile(); err != nil {
+				slog.Error("could not write the status file", "err", err)
+			}
+		}
+		if !sleepContext(ctx, interval) {
+			return
+		}
+	}
+}
+
+// stopping notifies systemd that the bot is shutting down.
+func (d *daemon) stopping() {
+	if d == nil {
+		return
+	}
+	if err := sdNotify("STOPPING=1"); err != nil {
+		slog.Error("could not notify systemd", "err", err)
+	}
+}
+
+// close removes the PID and status files.
+func (d *daemon) close() {
+	if d == nil {
+		return
+	}
+	for _, filename := range []string{*pidFilename, *statusFilename} {
+		if filename == "" {
+			continue
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			slog.Error("could not remove file", "file", filename, "err", err)
+		}
+	}
+}
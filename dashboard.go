@@ -0,0 +1,285 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Operators get a small web UI at /dashboard instead of grepping the logs and reading the stored
+// state: the tracked chats, the most recent warnings, detection hits and bans, and a form to change
+// the settings of a chat like /settings does. It is served on -listen behind HTTP basic auth with
+// the accounts in Dashboard.Users, and disabled if there are none.
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dashboardListLength is the number of entries shown in each list of the dashboard.
+const dashboardListLength = 30
+
+// DashboardConfig configures the operator dashboard.
+type DashboardConfig struct {
+	// Passwords of the operators, by username.
+	Users map[string]string
+}
+
+// dashboardUser returns the operator logging in with the basic auth of the request, or false if
+// the credentials are missing or invalid.
+func dashboardUser(r *http.Request) (string, bool) {
+	dashboard := currentConfig().Dashboard
+	name, password, ok := r.BasicAuth()
+	if dashboard == nil || !ok {
+		return "", false
+	}
+	expected, ok := dashboard.Users[name]
+	if !ok || expected == "" || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return "", false
+	}
+	return name, true
+}
+
+// dashboardActor identifies an operator in the audit log.
+func dashboardActor(name string) string {
+	return "dashboard user " + name
+}
+
+// requireDashboardLogin only passes requests of operators to the handler. Changes must come from
+// the dashboard itself, as browsers send the credentials along with requests of other sites too.
+func requireDashboardLogin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentConfig().Dashboard == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if _, ok := dashboardUser(r); !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="scamwarnbot", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			if origin, err := url.Parse(r.Header.Get("Origin")); r.Header.Get("Origin") != "" && (err != nil || origin.Host != r.Host) {
+				http.Error(w, "cross-origin request", http.StatusForbidden)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// dashboardEntry is a line in a list of the dashboard.
+type dashboardEntry struct {
+	At      time.Time
+	Chat    string
+	User    string
+	Details string
+}
+
+// dashboardGroup is a chat with settings, shown with the form to change them.
+type dashboardGroup struct {
+	ChatID   ChatID
+	Title    string
+	Settings string
+}
+
+// dashboardPage is what the dashboard shows.
+type dashboardPage struct {
+	User       string
+	Message    string
+	Live       bool
+	Chats      []ChatStats
+	Warnings   []dashboardEntry
+	Detections []dashboardEntry
+	Bans       []dashboardEntry
+	Groups     []dashboardGroup
+}
+
+// newest sorts entries from the newest to the oldest and keeps the first dashboardListLength.
+func newest(entries []dashboardEntry) []dashboardEntry {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].At.After(entries[j].At) })
+	if len(entries) > dashboardListLength {
+		entries = entries[:dashboardListLength]
+	}
+	return entries
+}
+
+// dashboardPage collects what the dashboard shows. Must be called with d.lock held.
+func (d *Data) dashboardPage(config *Config, now time.Time) *dashboardPage {
+	page := &dashboardPage{Chats: d.computeStats(now).Chats, Live: isLiveBot()}
+	for chatID, chatData := range d.ChatData {
+		for userID, userData := range chatData.UserData {
+			for _, at := range userData.WarnedAt {
+				page.Warnings = append(page.Warnings, dashboardEntry{
+					At: at, Chat: d.chatTitle(chatID), User: d.describeUser(userID)})
+			}
+		}
+	}
+	for _, record := range d.Actions {
+		var findings []string
+		for _, finding := range record.Findings {
+			findings = append(findings, finding.Detector+": "+finding.Reason)
+		}
+		page.Detections = append(page.Detections, dashboardEntry{
+			At: record.At, Chat: d.chatTitle(record.ChatID), User: d.describeUser(record.UserID),
+			Details: fmt.Sprintf("%s: score %.2f, %s (%s)", record.ID, record.Score,
+				strings.Join(record.Actions, ", "), strings.Join(findings, "; ")),
+		})
+	}
+	for userID, states := range d.UserStates {
+		for _, state := range states {
+			if state.Kind != stateBanned {
+				continue
+			}
+			chat := "all chats"
+			if state.ChatID != 0 {
+				chat = d.chatTitle(state.ChatID)
+			}
+			details := state.Reason
+			if state.AddedBy != 0 {
+				details = strings.TrimSpace(details + " by " + d.describeUser(state.AddedBy))
+			}
+			page.Bans = append(page.Bans, dashboardEntry{At: state.Since, Chat: chat, User: d.describeUser(userID), Details: details})
+		}
+	}
+	page.Warnings, page.Detections, page.Bans = newest(page.Warnings), newest(page.Detections), newest(page.Bans)
+	for _, group := range config.Groups {
+		if group.ChatID != 0 {
+			page.Groups = append(page.Groups, dashboardGroup{ChatID: group.ChatID, Title: d.chatTitle(group.ChatID), Settings: formatJSON(group)})
+		}
+	}
+	return page
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.UTC().Format("2006-01-02 15:04")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>scamwarnbot</title>
+<style>body{font-family:sans-serif;margin:2em}table{border-collapse:collapse;margin-bottom:2em}td,th{border:1px solid #ccc;padding:.2em .5em;text-align:left;vertical-align:top}pre{margin:0;max-height:20em;overflow:auto}.message{background:#eef;padding:.5em}</style>
+</head>
+<body>
+<h1>scamwarnbot</h1>
+<p>Logged in as {{.User}}.{{if not .Live}} This is not the live bot: the settings cannot be changed here.{{end}}</p>
+{{if .Message}}<p class="message">{{.Message}}</p>{{end}}
+<h2>Chats</h2>
+<table>
+<tr><th>Chat</th><th>Users</th><th>Active (30d)</th><th>New (30d)</th><th>Messages (30d)</th><th>Warnings (30d)</th><th>Deleted (30d)</th><th>Bans (30d)</th><th>Last message</th></tr>
+{{range .Chats}}<tr><td>{{.Title}} ({{.ChatID}}){{if .Dormant}}, dormant{{end}}</td><td>{{.Users}}</td><td>{{.Active30d}}</td><td>{{.NewUsers30d}}</td><td>{{.Messages30d}}</td><td>{{.Warnings30d}}</td><td>{{.Deletions30d}}</td><td>{{.Bans30d}}</td><td>{{time .LastMessage}}</td></tr>
+{{end}}</table>
+{{define "entries"}}<table>
+<tr><th>Time (UTC)</th><th>Chat</th><th>User</th><th>Details</th></tr>
+{{range .}}<tr><td>{{time .At}}</td><td>{{.Chat}}</td><td>{{.User}}</td><td>{{.Details}}</td></tr>
+{{else}}<tr><td colspan="4">None.</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Recent warnings</h2>
+{{template "entries" .Warnings}}
+<h2>Recent detection hits</h2>
+{{template "entries" .Detections}}
+<h2>Recent bans</h2>
+{{template "entries" .Bans}}
+<h2>Settings of the chats</h2>
+{{range .Groups}}<h3>{{.Title}} ({{.ChatID}})</h3>
+<table><tr><td><pre>{{.Settings}}</pre></td><td>
+{{if $.Live}}<form method="post" action="/dashboard/settings">
+<input type="hidden" name="chat_id" value="{{.ChatID}}">
+<p><label>Setting <input name="key" required></label></p>
+<p><label>Value <input name="value" required></label></p>
+<p><button>Change</button></p>
+</form>{{end}}
+</td></tr></table>
+{{else}}<p>No chats are configured by ID.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// dashboardHandler serves the dashboard.
+func dashboardHandler(data *Data) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data.lock.Lock()
+		page := data.dashboardPage(currentConfig(), time.Now())
+		data.lock.Unlock()
+		page.User, _ = dashboardUser(r)
+		page.Message = r.URL.Query().Get("message")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := dashboardTemplate.Execute(w, page); err != nil {
+			slog.Error("could not serve the dashboard", "err", err)
+		}
+	})
+}
+
+// dashboardSettingsHandler changes a setting of a chat, like /settings <key> <value> in the chat,
+// and redirects back to the dashboard.
+func dashboardSettingsHandler(data *Data) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isLiveBot() {
+			http.Error(w, "not the live bot; change the settings on the live bot", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid chat_id", http.StatusBadRequest)
+			return
+		}
+		chatID := ChatID(id)
+		key, value := strings.TrimSpace(r.FormValue("key")), strings.TrimSpace(r.FormValue("value"))
+		var previous string
+		version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+			group := settings.group(chatID)
+			if group == nil {
+				return fmt.Errorf("chat %d has no settings", chatID)
+			}
+			if strings.EqualFold(key, "ChatID") {
+				return fmt.Errorf("the chat ID cannot be changed")
+			}
+			previous = fieldJSON(group, key)
+			return setField(group, key, value)
+		})
+		var message string
+		if err != nil {
+			message = fmt.Sprintf("Error: %v", err)
+		} else {
+			user, _ := dashboardUser(r)
+			slog.Info("setting changed via dashboard", "by", user, "chat_id", chatID, "setting", key)
+			data.audit(auditAreaSettings, dashboardActor(user), version,
+				fmt.Sprintf("set %s (chat %d) from %s to %s", key, chatID, previous, value))
+			message = fmt.Sprintf("%s set to %s (previously %s). Settings version %d.", key, value, previous, version)
+		}
+		http.Redirect(w, r, "/dashboard?message="+url.QueryEscape(message), http.StatusSeeOther)
+	})
+}
@@ -0,0 +1,202 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The bot keeps protecting the chats when the storage is unavailable, working from the state in
+// memory:
+//
+//   - Loading fails at startup: the bot starts with an empty state and suspends saving, as saving
+//     would overwrite the stored state. Loading is retried on every save interval; once it
+//     succeeds, the stored state is adopted and merged with the state gathered in the meantime.
+//   - Saving fails: the state stays marked as changed, so the complete state is written once the
+//     storage is back. Saving is retried every degradedRetryInterval.
+//
+// In both cases the bot is degraded: /healthz and the scamwarnbot_storage_degraded metric report
+// it until the storage works again.
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// How often saving or loading is retried while the storage is unavailable.
+const degradedRetryInterval = 30 * time.Second
+
+var metricStorageDegraded = newGauge("scamwarnbot_storage_degraded", "1 if the storage is unavailable and the state is only kept in memory.")
+
+// storageHealth tracks whether the storage is available.
+var storageHealth struct {
+	lock   sync.Mutex
+	reason string
+	since  time.Time
+	// Set while the stored state could not be loaded yet, suspending saves.
+	unloaded bool
+}
+
+// markDegraded records that the storage failed.
+func markDegraded(reason string, unloaded bool) {
+	storageHealth.lock.Lock()
+	defer storageHealth.lock.Unlock()
+	if storageHealth.since.IsZero() {
+		storageHealth.since = time.Now()
+		slog.Error("storage unavailable, keeping the state in memory", "reason", reason)
+	}
+	storageHealth.reason = reason
+	storageHealth.unloaded = unloaded
+	metricStorageDegraded.set(1)
+}
+
+// markHealthy records that the storage works (again).
+func markHealthy() {
+	storageHealth.lock.Lock()
+	defer storageHealth.lock.Unlock()
+	if !storageHealth.since.IsZero() {
+		slog.Info("storage available again", "after", time.Since(storageHealth.since).Round(time.Second))
+	}
+	storageHealth.reason = ""
+	storageHealth.since = time.Time{}
+	storageHealth.unloaded = false
+	metricStorageDegraded.set(0)
+}
+
+func storageDegraded() (degraded bool, unloaded bool) {
+	storageHealth.lock.Lock()
+	defer storageHealth.lock.Unlock()
+	return !storageHealth.since.IsZero(), storageHealth.unloaded
+}
+
+// recoverStoredState loads the stored state after loading failed at startup, and merges the state
+// gathered in memory since then into it.
+func (d *Data) recoverStoredState() error {
+	stored, err := d.storage.Load()
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	// The settings in memory are those of the config file, which the stored settings take
+	// precedence over.
+	storedSettings := stored.Settings
+	mergeMissing(reflect.ValueOf(stored).Elem(), reflect.ValueOf(d).Elem())
+	stored.Settings = storedSettings
+	dst, src := reflect.ValueOf(d).Elem(), reflect.ValueOf(stored).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if dst.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	d.markChanged()
+	d.lock.Unlock()
+	slog.Info("stored state loaded and merged with the state gathered meanwhile")
+
+	config := *currentConfig()
+	return activateSettings(&config, d)
+}
+
+// mergeMissing adds the map entries of src missing in dst to dst, recursing into entries present
+// in both, and sets the fields of dst which are zero.
+func mergeMissing(dst, src reflect.Value) {
+	switch dst.Kind() {
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(src)
+		} else if !src.IsNil() {
+			mergeMissing(dst.Elem(), src.Elem())
+		}
+	case reflect.Struct:
+		if dst.Type() == reflect.TypeOf(time.Time{}) {
+			if dst.IsZero() {
+				dst.Set(src)
+			}
+			return
+		}
+		for i := 0; i < dst.NumField(); i++ {
+			if dst.Type().Field(i).IsExported() {
+				mergeMissing(dst.Field(i), src.Field(i))
+			}
+		}
+	case reflect.Map:
+		if src.IsNil() {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(dst.Type()))
+		}
+		iter := src.MapRange()
+		for iter.Next() {
+			existing := dst.MapIndex(iter.Key())
+			if !existing.IsValid() {
+				dst.SetMapIndex(iter.Key(), iter.Value())
+			} else if existing.Kind() == reflect.Ptr && !existing.IsNil() {
+				mergeMissing(existing.Elem(), iter.Value().Elem())
+			}
+		}
+	default:
+		if dst.IsZero() {
+			dst.Set(src)
+		}
+	}
+}
+
+// HealthStatus is whether the bot is healthy or degraded, when it last received an update and when
+// a request to Telegram last succeeded.
+type HealthStatus struct {
+	// "ok", "degraded" or "stalled".
+	Status         string
+	Storage        string    `json:",omitempty"`
+	DegradedFrom   time.Time `json:",omitempty"`
+	Updates        string
+	LastUpdate     time.Time `json:",omitempty"`
+	LastAPISuccess time.Time `json:",omitempty"`
+}
+
+// currentHealth returns the health of the bot. Only a bot whose updates stalled is unhealthy, as a
+// degraded bot keeps working.
+func currentHealth() HealthStatus {
+	storageHealth.lock.Lock()
+	defer storageHealth.lock.Unlock()
+	status := HealthStatus{
+		Status:         "ok",
+		Updates:        updatesHealth(),
+		LastUpdate:     unixNanoTime(lastUpdateAt.Load()),
+		LastAPISuccess: unixNanoTime(lastAPISuccessAt.Load()),
+	}
+	if !storageHealth.since.IsZero() {
+		status.Status = "degraded"
+		status.Storage = storageHealth.reason
+		status.DegradedFrom = storageHealth.since
+	}
+	if status.Updates != "ok" {
+		status.Status = status.Updates
+	}
+	return status
+}
+
+// healthzHandler reports the health of the bot. It responds with 200 OK, as a degraded bot keeps
+// working and must not be restarted, unless polling updates stalled and the watchdog could not
+// recover it.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := currentHealth()
+		w.Header().Set("Content-Type", "application/json")
+		if status.Updates != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+}
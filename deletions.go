@@ -0,0 +1,89 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// PendingDeletion is a message sent by the bot which is deleted at the given time. Pending
+// deletions are persisted, so they are carried out after a restart.
+type PendingDeletion struct {
+	ChatID    ChatID
+	MessageID int
+	At        time.Time
+}
+
+var metricScheduledDeletions = newCounter("scamwarnbot_scheduled_deletions_total",
+	"Messages of the bot deleted after their time to live, by result.", "result")
+
+// scheduleDeletion records a message to be deleted after the given duration.
+func (d *Data) scheduleDeletion(chatID ChatID, messageID int, after time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.PendingDeletions = append(d.PendingDeletions, &PendingDeletion{
+		ChatID:    chatID,
+		MessageID: messageID,
+		At:        time.Now().Add(after),
+	})
+	d.markChanged()
+}
+
+// deleteDueMessages deletes the messages whose deletion is due.
+func deleteDueMessages(data *Data, bot *tgbotapi.BotAPI) {
+	now := time.Now()
+	var due []*PendingDeletion
+	data.lock.Lock()
+	pending := data.PendingDeletions[:0]
+	for _, deletion := range data.PendingDeletions {
+		if deletion.At.After(now) {
+			pending = append(pending, deletion)
+		} else {
+			due = append(due, deletion)
+		}
+	}
+	if len(due) > 0 {
+		data.PendingDeletions = pending
+		data.markChanged()
+	}
+	data.lock.Unlock()
+
+	for _, deletion := range due {
+		_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{
+			ChatID:    int64(deletion.ChatID),
+			MessageID: deletion.MessageID,
+		})
+		if err != nil {
+			// Happens if the message was already deleted, e.g. by an admin, or is older than 48
+			// hours, after which Telegram no longer allows bots to delete messages.
+			chatLogger(deletion.ChatID, 0).Warn("could not delete scheduled message", "message_id", deletion.MessageID, "err", err)
+			metricScheduledDeletions.inc("error")
+			continue
+		}
+		metricScheduledDeletions.inc("deleted")
+	}
+}
+
+func periodicDeleteMessages(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for {
+		deleteDueMessages(data, bot)
+		if !sleepContext(ctx, time.Minute) {
+			return
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const flagScoreDefault = 1.0
+const watchThresholdFactorDefault = 0.5
+
+// Values of Settings.ExplainDeletions.
+const (
+	explainInChat    = "chat"
+	explainPrivately = "private"
+)
+
+// Rule scores messages whose text matches a regular expression or contains one of a list of
+// keywords. Keywords are matched as whole words, ignoring case.
+type Rule struct {
+	Name     string
+	Pattern  string   `json:",omitempty"`
+	Keywords []string `json:",omitempty"`
+	Score    float64
+	// Category of scam the rule detects, shown to users when a message is deleted. The category
+	// name is looked up as message key "category.<Category>".
+	Category string `json:",omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Finding is a single detector hit on a message.
+type Finding struct {
+	Detector string
+	Score    float64
+	Reason   string
+	Category string `json:",omitempty"`
+	// The pattern which matched, for rule findings.
+	Pattern string `json:",omitempty"`
+	// Findings of detectors in shadow mode do not count towards the score.
+	Shadow bool `json:",omitempty"`
+}
+
+// expression returns the regular expression matching the pattern or the keywords of the rule.
+func (r *Rule) expression() string {
+	var alternatives []string
+	if r.Pattern != "" {
+		alternatives = append(alternatives, r.Pattern)
+	}
+	if len(r.Keywords) > 0 {
+		keywords := make([]string, len(r.Keywords))
+		for i, keyword := range r.Keywords {
+			keywords[i] = regexp.QuoteMeta(strings.TrimSpace(keyword))
+		}
+		alternatives = append(alternatives, `(?i)\b(?:`+strings.Join(keywords, "|")+`)\b`)
+	}
+	return strings.Join(alternatives, "|")
+}
+
+// compileRules compiles the patterns of all configured rules.
+func (s *Settings) compileRules() error {
+	for i, rule := range s.Rules {
+		if rule.Pattern == "" && len(rule.Keywords) == 0 {
+			return fieldErrorf(fmt.Sprintf("Rules[%d]", i), "rule %q: Pattern or Keywords required", rule.Name)
+		}
+		re, err := regexp.Compile(rule.expression())
+		if err != nil {
+			return fieldErrorf(fmt.Sprintf("Rules[%d]", i), "rule %q: %w", rule.Name, err)
+		}
+		rule.re = re
+	}
+	return nil
+}
+
+// messageText returns the text and caption of a message.
+func messageText(msg *tgbotapi.Message) string {
+	return strings.TrimSpace(msg.Text + "\n" + msg.Caption)
+}
+
+// detect runs all detectors on a message.
+func detect(config *Config, data *Data, msg *tgbotapi.Message) []Finding {
+	text := messageText(msg)
+	findings := config.matchRules(text)
+	data.lock.Lock()
+	firstSeenAt := data.chat(ChatID(msg.Chat.ID)).user(UserID(msg.From.ID)).FirstSeenAt
+	data.lock.Unlock()
+	for _, pack := range config.enabledRulePacks(ChatID(msg.Chat.ID)) {
+		for _, rule := range pack.Rules {
+			if match := rule.re.FindString(text); match != "" {
+				finding := Finding{
+					Detector: "pack:" + pack.Name + "/" + rule.Name,
+					Score:    rule.Score,
+					Reason:   fmt.Sprintf("matched %q", match),
+					Category: rule.Category,
+					Pattern:  rule.Pattern,
+				}
+				if context := suspiciousContext(config, msg, firstSeenAt); pack.ContextFactor != 0 && context != "" {
+					finding.Score *= pack.ContextFactor
+					finding.Reason += fmt.Sprintf(", weighted %gx for %s", pack.ContextFactor, context)
+				}
+				findings = append(findings, finding)
+			}
+		}
+	}
+	findings = append(findings, detectReportedContacts(config, data, msg)...)
+	if config.Formatting != nil {
+		findings = append(findings, detectFormatting(config.Formatting, msg, firstSeenAt)...)
+	}
+	for i := range findings {
+		findings[i].Shadow = config.isShadow(ChatID(msg.Chat.ID), findings[i].Detector)
+	}
+	return findings
+}
+
+// linkPattern matches web and Telegram links in a message text.
+var linkPattern = regexp.MustCompile(`(?i)\bhttps?://|\bwww\.\w|\bt\.me/`)
+
+// suspiciousContext describes why the context of a message makes scam patterns more likely: a
+// link in the message or a new author. Returns "" if there is no such context.
+func suspiciousContext(config *Config, msg *tgbotapi.Message, firstSeenAt time.Time) string {
+	hasLink := linkPattern.MatchString(messageText(msg))
+	if msg.Entities != nil {
+		for _, entity := range *msg.Entities {
+			if entity.Type == "url" || entity.Type == "text_link" {
+				hasLink = true
+			}
+		}
+	}
+	if hasLink {
+		return "link"
+	}
+	if !firstSeenAt.IsZero() && time.Since(firstSeenAt) <= config.NewMemberAge.Duration {
+		return "new member"
+	}
+	return ""
+}
+
+// matchRules returns the findings of the rules in a text.
+func (s *Settings) matchRules(text string) []Finding {
+	var findings []Finding
+	for _, rule := range s.Rules {
+		if match := rule.re.FindString(text); match != "" {
+			findings = append(findings, Finding{
+				Detector: "rule:" + rule.Name,
+				Score:    rule.Score,
+				Reason:   fmt.Sprintf("matched %q", match),
+				Category: rule.Category,
+				Pattern:  rule.expression(),
+			})
+		}
+	}
+	return findings
+}
+
+// detectAll runs the detectors on a message, including those querying Telegram.
+func detectAll(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) []Finding {
+	findings := detect(config, data, msg)
+	findings = append(findings, detectImpersonation(config, data, bot, msg)...)
+	findings = append(findings, detectMentions(config, bot, msg)...)
+	findings = append(findings, detectPaymentRequests(config, bot, msg)...)
+	findings = append(findings, detectForwards(config, data, msg)...)
+	findings = append(findings, detectReplyScams(config, data, msg)...)
+	findings = append(findings, detectClassified(config, data, msg)...)
+	return append(findings, detectLinks(config, bot, msg)...)
+}
+
+// totalScore sums up the scores of all findings not in shadow mode.
+func totalScore(findings []Finding) float64 {
+	var score float64
+	for _, finding := range findings {
+		if !finding.Shadow {
+			score += finding.Score
+		}
+	}
+	return score
+}
+
+// category returns the category of the highest scoring finding which has one.
+func category(findings []Finding) string {
+	result, best := "scam", 0.0
+	for _, finding := range findings {
+		if finding.Category != "" && !finding.Shadow && finding.Score > best {
+			result, best = finding.Category, finding.Score
+		}
+	}
+	return result
+}
+
+// explainDeletion tells the author of a deleted message which category of rules it violated,
+// either in the chat or in a private message, depending on ExplainDeletions.
+func explainDeletion(config *Config, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, findings []Finding) {
+	lang := config.chatLanguage(ChatID(msg.Chat.ID))
+	text := config.translate(lang, "deleted.explanation", msg.From.String(),
+		config.message(lang, categoryKeyPrefix+category(findings)))
+	switch config.ExplainDeletions {
+	case explainInChat:
+		sendText(bot, msg.Chat.ID, text)
+	case explainPrivately:
+		// Only works if the user started a private chat with the bot before.
+		sendText(bot, int64(msg.From.ID), text)
+	}
+}
+
+// handleFindings acts on the findings of the detectors: messages reaching the flag score are
+// reported to the admins, messages reaching the delete score are also deleted and users reaching
+// the ban score are banned. If voting is enabled, the moderators vote on messages which are only
+// reported. The thresholds are lowered for watched users, during night mode and protection windows
+// and for users first seen after a downtime.
+func handleFindings(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, findings []Finding) {
+	if len(findings) == 0 {
+		data.recordRisk(ChatID(msg.Chat.ID), UserID(msg.From.ID), time.Now(), 0, false)
+		return
+	}
+	factor := 1.0
+	if data.hasState(UserID(msg.From.ID), stateWatched, ChatID(msg.Chat.ID)) {
+		factor = config.WatchThresholdFactor
+	}
+	factor *= nightFactor(config, data, ChatID(msg.Chat.ID), time.Now())
+	factor *= protectionFactor(config, ChatID(msg.Chat.ID), time.Now())
+	data.lock.Lock()
+	firstSeenAt := data.chat(ChatID(msg.Chat.ID)).user(UserID(msg.From.ID)).FirstSeenAt
+	data.lock.Unlock()
+	factor *= downtimeFactor(config, firstSeenAt, time.Now())
+	score := totalScore(findings)
+	logger := messageLogger(msg)
+	logger.Info("findings", "score", score, "factor", factor, "findings", findings)
+
+	recordShadowFindings(data, ChatID(msg.Chat.ID), findings, score >= config.FlagScore*factor)
+	data.recordRisk(ChatID(msg.Chat.ID), UserID(msg.From.ID), time.Now(), score, score >= config.FlagScore*factor)
+	if score < config.FlagScore*factor {
+		return
+	}
+	metricFlagged.inc()
+	recordTargeting(config, data, bot, msg)
+
+	var reason strings.Builder
+	if msg.EditDate != 0 {
+		fmt.Fprintf(&reason, "Suspicious edited message (score %.2f):\n", score)
+	} else {
+		fmt.Fprintf(&reason, "Suspicious message (score %.2f):\n", score)
+	}
+	for _, finding := range findings {
+		if finding.Shadow {
+			fmt.Fprintf(&reason, "- %s (shadow mode, not scored): %s\n", finding.Detector, finding.Reason)
+		} else {
+			fmt.Fprintf(&reason, "- %s: %s\n", finding.Detector, finding.Reason)
+		}
+	}
+	fmt.Fprintf(&reason, "Text: %s\n", messageText(msg))
+	outcome := config.outcome(score, factor)
+	pipeline := config.actionPipeline(ChatID(msg.Chat.ID), outcome, category(findings), score, factor)
+	actions, notify := runActions(config, data, bot, msg, pipeline, findings, score, &reason)
+	if len(actions) > 0 {
+		id := data.recordAction(&ActionRecord{
+			At:        time.Now(),
+			ChatID:    ChatID(msg.Chat.ID),
+			UserID:    UserID(msg.From.ID),
+			MessageID: msg.MessageID,
+			Text:      messageText(msg),
+			Actions:   actions,
+			Findings:  findings,
+			Score:     score,
+			Thresholds: ActionThresholds{
+				Flag:   config.FlagScore,
+				Delete: config.DeleteScore,
+				Ban:    config.BanScore,
+				Factor: factor,
+			},
+			SettingsVersion: config.Version,
+		})
+		fmt.Fprintf(&reason, "Details: /why %s\n", id)
+		if contacts := propagateContacts(config, data, bot, msg, id); contacts != "" {
+			reason.WriteString(contacts + "\n")
+		}
+	}
+	if !notify {
+		return
+	}
+	if len(actions) == 0 && config.Voting != nil && config.AdminChatID != 0 {
+		startVote(config, data, bot, msg, findings, score, reason.String())
+		return
+	}
+	reportToAdmins(config, data, bot, msg, reason.String())
+}
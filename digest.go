@@ -0,0 +1,149 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// The weekly digest is sent once the new week has started in the admin locale and it is at least
+// this hour of the day there.
+const digestHour = 9
+
+// DigestChat summarizes the past week of a single chat.
+type DigestChat struct {
+	Title     string
+	Messages  int
+	Warnings  int
+	NewUsers  int
+	Deletions int
+	Bans      int
+}
+
+// Digest summarizes the moderation activity of a week, rendered with the "digest.weekly" message
+// template.
+type Digest struct {
+	Start time.Time
+	// The last day of the week, Start plus six days.
+	LastDay   time.Time
+	TimeZone  string
+	Chats     []DigestChat
+	Messages  int
+	Warnings  int
+	Deletions int
+	Bans      int
+	Blocklist int
+}
+
+// computeDigest summarizes the week starting at start. Must be called with d.lock held.
+func (d *Data) computeDigest(start time.Time, timeZone string) *Digest {
+	end := start.AddDate(0, 0, 7)
+	digest := &Digest{
+		Start:     start,
+		LastDay:   start.AddDate(0, 0, 6),
+		TimeZone:  timeZone,
+		Blocklist: len(d.Blocklist),
+	}
+	inWeek := func(t time.Time) bool { return !t.Before(start) && t.Before(end) }
+	// Messages and warnings are counted per day in UTC.
+	startDay, endDay := start.UTC().Format("2006-01-02"), end.UTC().Format("2006-01-02")
+	chats := map[ChatID]int{}
+	for _, chatID := range sortedKeys(d.ChatData) {
+		chatData := d.ChatData[chatID]
+		if chatData.Dormant {
+			continue
+		}
+		chat := DigestChat{Title: chatData.Title}
+		for _, userData := range chatData.UserData {
+			if inWeek(userData.FirstSeenAt) {
+				chat.NewUsers++
+			}
+		}
+		for _, sample := range chatData.Risk {
+			if sample.Day >= startDay && sample.Day < endDay {
+				chat.Messages += sample.Messages
+				chat.Warnings += sample.Warnings
+			}
+		}
+		digest.Messages += chat.Messages
+		digest.Warnings += chat.Warnings
+		chats[chatID] = len(digest.Chats)
+		digest.Chats = append(digest.Chats, chat)
+	}
+	for _, record := range d.Actions {
+		if !inWeek(record.At) {
+			continue
+		}
+		for _, action := range record.Actions {
+			switch action {
+			case "delete":
+				digest.Deletions++
+				if i, ok := chats[record.ChatID]; ok {
+					digest.Chats[i].Deletions++
+				}
+			case "ban":
+				digest.Bans++
+				if i, ok := chats[record.ChatID]; ok {
+					digest.Chats[i].Bans++
+				}
+			}
+		}
+	}
+	return digest
+}
+
+// sendWeeklyDigest sends the summary of the past week to the admin chat, once per week.
+func sendWeeklyDigest(config *Config, data *Data, bot *tgbotapi.BotAPI, now time.Time) {
+	locale := &config.AdminLocale
+	thisWeek := locale.weekStart(now)
+	if locale.in(now).Hour() < digestHour {
+		return
+	}
+	lastWeek := locale.weekStart(thisWeek.Add(-time.Hour))
+
+	data.lock.Lock()
+	if !data.LastDigest.Before(lastWeek) {
+		data.lock.Unlock()
+		return
+	}
+	data.LastDigest = lastWeek
+	data.markChanged()
+	digest := data.computeDigest(lastWeek, thisWeek.Location().String())
+	data.lock.Unlock()
+
+	text, err := locale.render(config.message(locale.Language, "digest.weekly"), digest)
+	if err != nil {
+		slog.Error("could not render weekly digest", "err", err)
+		return
+	}
+	notifyAdmins(config, bot, text)
+	slog.Info("sent weekly digest", "week", lastWeek.Format("2006-01-02"))
+}
+
+func periodicWeeklyDigest(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for {
+		config := currentConfig()
+		if config.WeeklyDigest && config.AdminChatID != 0 {
+			sendWeeklyDigest(config, data, bot, time.Now())
+		}
+		if !sleepContext(ctx, 10*time.Minute) {
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const dormantAfterDefault = 90 * 24 * time.Hour
+
+// How often chats are checked for dormancy.
+const dormantCheckInterval = 6 * time.Hour
+
+// recordChatActivity records a message in a chat, waking the chat up if it was dormant. Returns
+// true if the chat was dormant. Must be called with d.lock held.
+func (c *ChatData) recordChatActivity(now time.Time) bool {
+	c.LastMessageAt = now
+	wasDormant := c.Dormant
+	c.Dormant = false
+	return wasDormant
+}
+
+// learning returns true during the learning period after the bot first saw the chat, in which
+// it does not warn.
+func (c *ChatData) learning(period time.Duration, now time.Time) bool {
+	return period > 0 && !c.FirstSeenAt.IsZero() && now.Before(c.FirstSeenAt.Add(period))
+}
+
+// activeChats returns the chats which are not dormant. Must be called with d.lock held.
+func (d *Data) activeChats() []ChatID {
+	var chatIDs []ChatID
+	for chatID, chatData := range d.ChatData {
+		if !chatData.Dormant {
+			chatIDs = append(chatIDs, chatID)
+		}
+	}
+	return chatIDs
+}
+
+// checkDormantChats marks chats without messages for DormantAfter as dormant and tells the
+// owners, as the group was probably abandoned or migrated. Dormant chats are skipped by
+// background work such as broadcasts until a message is posted in them again.
+func checkDormantChats(config *Config, data *Data, bot *tgbotapi.BotAPI) {
+	now := time.Now()
+	var dormant []string
+	data.lock.Lock()
+	for chatID, chatData := range data.ChatData {
+		if chatData.Dormant {
+			continue
+		}
+		if chatData.LastMessageAt.IsZero() {
+			// Chats recorded before activity was tracked get a full period of grace.
+			chatData.LastMessageAt = now
+			data.markChanged()
+			continue
+		}
+		if now.Sub(chatData.LastMessageAt) < config.DormantAfter.Duration {
+			continue
+		}
+		chatData.Dormant = true
+		data.markChanged()
+		dormant = append(dormant, fmt.Sprintf("%s (%d)", data.chatTitle(chatID), chatID))
+	}
+	data.lock.Unlock()
+
+	for _, chat := range dormant {
+		slog.Info("chat is dormant", "chat_title", chat)
+		notifyOwners(config, bot, fmt.Sprintf(
+			"No messages were posted in %s for %s. The chat is considered dormant and skipped by "+
+				"background work until a message is posted in it again. If the group was abandoned "+
+				"or migrated, remove the bot from it.", chat, config.DormantAfter.Duration))
+	}
+}
+
+func periodicCheckDormantChats(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for {
+		if !sleepContext(ctx, dormantCheckInterval) {
+			return
+		}
+		checkDormantChats(currentConfig(), data, bot)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// With -dry-run, the bot processes live traffic as usual, but the requests to Telegram which would
+// change anything, such as sending and deleting messages or banning users, are only logged and
+// answered with a fake success. This validates the config and new rules against live traffic
+// before they are enforced. Requests reading from Telegram, receiving updates and answering button
+// presses are passed through, and ban events are not posted to other bots.
+//
+// The state is tracked and saved as usual, including the actions which were not taken. Run with a
+// copy of the state (-cache or -storage) to keep them out of the live state.
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// dryRunMethods are the Telegram methods skipped in a dry run, mapped to whether they return a
+// message.
+var dryRunMethods = map[string]bool{
+	"sendMessage":            true,
+	"sendDocument":           true,
+	"sendPhoto":              true,
+	"sendSticker":            true,
+	"forwardMessage":         true,
+	"copyMessage":            true,
+	"editMessageText":        true,
+	"editMessageReplyMarkup": true,
+	"deleteMessage":          false,
+	"banChatMember":          false,
+	"kickChatMember":         false,
+	"unbanChatMember":        false,
+	"restrictChatMember":     false,
+	"promoteChatMember":      false,
+	"pinChatMessage":         false,
+	"unpinChatMessage":       false,
+	"leaveChat":              false,
+}
+
+var metricDryRunRequests = newCounter("scamwarnbot_dry_run_requests_total",
+	"Requests to Telegram skipped in a dry run, by method.", "method")
+
+// dryRunTransport logs and skips the requests to Telegram which would change anything.
+type dryRunTransport struct {
+	base http.RoundTripper
+	// IDs of the messages which were not sent.
+	nextMessageID atomic.Int64
+}
+
+func (t *dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := path.Base(req.URL.Path)
+	returnsMessage, skip := dryRunMethods[method]
+	if !skip {
+		return t.base.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	parsed := req.Clone(req.Context())
+	parsed.Body = io.NopCloser(bytes.NewReader(body))
+	// Fails for requests which are not multipart, but parses URL-encoded forms anyway.
+	_ = parsed.ParseMultipartForm(10 << 20)
+	chatID, _ := strconv.ParseInt(parsed.FormValue("chat_id"), 10, 64)
+	userID, _ := strconv.Atoi(parsed.FormValue("user_id"))
+	args := []any{"method", method}
+	for _, field := range []string{"message_id", "text", "caption", "until_date"} {
+		if value := parsed.FormValue(field); value != "" {
+			args = append(args, field, value)
+		}
+	}
+	chatLogger(ChatID(chatID), UserID(userID)).Info("dry run: skipped request", args...)
+	metricDryRunRequests.inc(method)
+
+	var result interface{} = true
+	if returnsMessage {
+		result = map[string]interface{}{
+			"message_id": t.nextMessageID.Add(1),
+			"date":       time.Now().Unix(),
+			"chat":       map[string]interface{}{"id": chatID},
+			"text":       parsed.FormValue("text"),
+		}
+	}
+	response, err := json.Marshal(map[string]interface{}{"ok": true, "result": result})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(response)),
+		ContentLength: int64(len(response)),
+		Request:       req,
+	}, nil
+}
+
+// enableDryRun makes the bot skip the requests to Telegram which would change anything.
+func enableDryRun(client *http.Client) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &dryRunTransport{base: base}
+	slog.Warn("dry run: messages are not sent, deleted or acted on")
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Giveaway spam is posted by many accounts at once: the same text shows up in all protected
+// groups, or again and again in one group, each copy from a fresh account, so the floods of single
+// users (see flood.go) do not catch it. The hashes of the recent texts of all chats are kept in
+// memory for a short while, and copies of a text beyond the allowed number are deleted. The admins
+// are alerted once per text. As with floods, the texts themselves are not kept.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	duplicateWindowDefault        = 10 * time.Minute
+	duplicateMinTextLengthDefault = 30
+	duplicateMaxCopiesDefault     = 1
+)
+
+// DuplicateDetector configures the detection of the same text posted repeatedly, by anyone.
+type DuplicateDetector struct {
+	// Copies of a text posted within Window after its first copy are duplicates. Default 10m.
+	Window jsonDuration
+	// Texts shorter than this are not compared. Default 30 characters.
+	MinTextLength int
+	// Number of copies of a text which are kept, across all chats. Default 1: all copies but the
+	// first are deleted.
+	MaxCopies int
+}
+
+func (d *DuplicateDetector) setDefaults() {
+	if d.Window.Duration == 0 {
+		d.Window.Duration = duplicateWindowDefault
+	}
+	if d.MinTextLength == 0 {
+		d.MinTextLength = duplicateMinTextLengthDefault
+	}
+	if d.MaxCopies == 0 {
+		d.MaxCopies = duplicateMaxCopiesDefault
+	}
+}
+
+var metricDuplicates = newCounter("scamwarnbot_duplicates_total",
+	"Copies of recently posted texts deleted, by whether they were posted in another chat (crosschat) or the same one (repeated).", "kind")
+
+// textSighting are the copies of a text posted recently.
+type textSighting struct {
+	firstAt time.Time
+	chats   map[ChatID]int
+	copies  int
+	// Whether the admins were alerted.
+	alerted bool
+}
+
+// recentTexts is the cache of the texts posted recently in all chats, by hash.
+type recentTexts struct {
+	lock      sync.Mutex
+	sightings map[string]*textSighting
+	lastSweep time.Time
+}
+
+var duplicates = &recentTexts{sightings: map[string]*textSighting{}}
+
+// record records a copy of a text posted in a chat and returns its sighting, with the copy
+// counted. Sightings older than window are forgotten.
+func (r *recentTexts) record(hash string, chatID ChatID, now time.Time, window time.Duration) textSighting {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if now.Sub(r.lastSweep) >= window/10 {
+		for key, sighting := range r.sightings {
+			if now.Sub(sighting.firstAt) > window {
+				delete(r.sightings, key)
+			}
+		}
+		r.lastSweep = now
+	}
+	sighting, ok := r.sightings[hash]
+	if !ok || now.Sub(sighting.firstAt) > window {
+		sighting = &textSighting{firstAt: now, chats: map[ChatID]int{}}
+		r.sightings[hash] = sighting
+	}
+	sighting.chats[chatID]++
+	sighting.copies++
+	result := *sighting
+	sighting.alerted = true
+	return result
+}
+
+// checkDuplicate deletes the message if its text is a duplicate of recently posted texts, and
+// alerts the admins the first time a text is duplicated. Returns true if the message was deleted.
+func checkDuplicate(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	detector := config.Duplicates
+	if detector == nil {
+		return false
+	}
+	hash := floodTextHash(messageText(msg), detector.MinTextLength)
+	if hash == "" {
+		return false
+	}
+	chatID := ChatID(msg.Chat.ID)
+	userID := UserID(msg.From.ID)
+	// Admins post announcements to all chats.
+	if userRole(config, data, bot, chatID, userID) >= roleModerator {
+		return false
+	}
+	sighting := duplicates.record(hash, chatID, time.Now(), detector.Window.Duration)
+	if sighting.copies <= detector.MaxCopies {
+		return false
+	}
+
+	kind := "crosschat"
+	if len(sighting.chats) == 1 {
+		kind = "repeated"
+	}
+	_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: msg.Chat.ID, MessageID: msg.MessageID})
+	logAction(messageLogger(msg), "delete", err, "reason", "duplicate", "kind", kind, "copies", sighting.copies)
+	if err != nil {
+		metricTelegramErrors.inc("deleteMessage")
+		return false
+	}
+	metricDuplicates.inc(kind)
+	if !sighting.alerted {
+		reportToAdmins(config, data, bot, msg, fmt.Sprintf(
+			"Deleted a copy of a text posted %d times in %d chats within %s. Further copies are deleted without notice.",
+			sighting.copies, len(sighting.chats), time.Since(sighting.firstAt).Round(time.Second)))
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers post an innocent message and edit in the scam link once it was checked. Edited
+// messages therefore go through the same detection as new ones and are deleted, banned on or
+// flagged with the same thresholds. Edits are not warned about and not counted as messages.
+
+import (
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var metricEditsChecked = newCounter("scamwarnbot_edits_checked_total",
+	"Edited messages checked, by whether they had findings.", "findings")
+
+// processEdit checks an edited message for scams.
+func processEdit(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	if msg == nil || msg.Chat == nil || msg.From == nil || msg.From.IsBot || msg.Chat.IsPrivate() {
+		return
+	}
+	chatID, userID := ChatID(msg.Chat.ID), UserID(msg.From.ID)
+	if int64(chatID) == config.AdminChatID || config.allowedGroup(msg.Chat) == nil || config.botOff(chatID) {
+		return
+	}
+	if data.hasState(userID, stateTrusted, chatID) {
+		return
+	}
+	findings := detectAll(config, data, bot, msg)
+	metricEditsChecked.inc(strconv.FormatBool(len(findings) > 0))
+	if len(findings) == 0 {
+		return
+	}
+	messageLogger(msg).Info("edited message has findings")
+	handleFindings(config, data, bot, msg, findings)
+}
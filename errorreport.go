@@ -0,0 +1,271 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Errors are easy to miss in the logs of a bot which runs unattended for months. With
+// ErrorReporting in the config, every record logged at error level, which includes failed requests
+// to Telegram, failed saves of the state and recovered panics, is additionally reported to Sentry
+// or posted to a generic webhook. Reports are sent in the background and dropped if the reporting
+// endpoint does not keep up, so that it can never slow down the bot. Identical errors are reported
+// at most once per minute.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Identical errors are reported at most once per this interval.
+const errorReportInterval = time.Minute
+
+// ErrorReportingConfig configures where errors are reported to. Either or both can be set.
+type ErrorReportingConfig struct {
+	// DSN of a Sentry project, e.g. "https://<key>@o1.ingest.sentry.io/<project>".
+	SentryDSN string `json:",omitempty"`
+	// URL errors are posted to as JSON objects, see ErrorReport.
+	WebhookURL string `json:",omitempty"`
+	// Environment the bot runs in, e.g. "production". Included in the reports.
+	Environment string `json:",omitempty"`
+}
+
+// ErrorReport is an error posted to ErrorReportingConfig.WebhookURL.
+type ErrorReport struct {
+	Time        time.Time
+	Message     string
+	Attrs       map[string]string `json:",omitempty"`
+	Release     string
+	Environment string `json:",omitempty"`
+}
+
+var metricErrorReports = newCounter("scamwarnbot_error_reports_total",
+	"Errors reported to Sentry or the webhook, by outcome (sent, failed, dropped, deduplicated).", "outcome")
+
+// errorReporter sends the reports in the background.
+type errorReporter struct {
+	config *ErrorReportingConfig
+	sentry *sentryDSN
+	queue  chan *ErrorReport
+	client *http.Client
+
+	lock sync.Mutex
+	// Time each message was last reported at.
+	reported map[string]time.Time
+}
+
+// reporter is the active errorReporter, nil if error reporting is disabled.
+var reporter atomic.Pointer[errorReporter]
+
+// sentryDSN is a parsed Sentry DSN.
+type sentryDSN struct {
+	storeURL string
+	key      string
+}
+
+func parseSentryDSN(dsn string) (*sentryDSN, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	project := strings.TrimPrefix(parsed.Path, "/")
+	if parsed.User == nil || parsed.User.Username() == "" || parsed.Host == "" || project == "" {
+		return nil, errors.New("expected https://<key>@<host>/<project>")
+	}
+	return &sentryDSN{
+		storeURL: fmt.Sprintf("%s://%s/api/%s/store/", parsed.Scheme, parsed.Host, project),
+		key:      parsed.User.Username(),
+	}, nil
+}
+
+// configureErrorReporting starts reporting errors as configured. Disabled if config is nil.
+func configureErrorReporting(config *ErrorReportingConfig) error {
+	if config == nil || (config.SentryDSN == "" && config.WebhookURL == "") {
+		return nil
+	}
+	r := &errorReporter{
+		config:   config,
+		queue:    make(chan *ErrorReport, 100),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		reported: map[string]time.Time{},
+	}
+	if config.SentryDSN != "" {
+		dsn, err := parseSentryDSN(config.SentryDSN)
+		if err != nil {
+			return fmt.Errorf("ErrorReporting.SentryDSN: %w", err)
+		}
+		r.sentry = dsn
+	}
+	go r.run()
+	reporter.Store(r)
+	slog.Info("reporting errors", "sentry", config.SentryDSN != "", "webhook", config.WebhookURL != "")
+	return nil
+}
+
+// enqueue queues a report unless the same message was reported recently or the queue is full.
+func (r *errorReporter) enqueue(report *ErrorReport) {
+	r.lock.Lock()
+	last, ok := r.reported[report.Message]
+	if ok && report.Time.Sub(last) < errorReportInterval {
+		r.lock.Unlock()
+		metricErrorReports.inc("deduplicated")
+		return
+	}
+	r.reported[report.Message] = report.Time
+	for message, at := range r.reported {
+		if report.Time.Sub(at) >= errorReportInterval {
+			delete(r.reported, message)
+		}
+	}
+	r.lock.Unlock()
+	select {
+	case r.queue <- report:
+	default:
+		metricErrorReports.inc("dropped")
+	}
+}
+
+func (r *errorReporter) run() {
+	for report := range r.queue {
+		// Not logged at error level, which would report the failure again.
+		if err := r.send(report); err != nil {
+			metricErrorReports.inc("failed")
+			slog.Warn("could not report error", "err", err)
+			continue
+		}
+		metricErrorReports.inc("sent")
+	}
+}
+
+// send sends a report to Sentry and to the webhook.
+func (r *errorReporter) send(report *ErrorReport) error {
+	if r.sentry != nil {
+		eventID := make([]byte, 16)
+		if _, err := rand.Read(eventID); err != nil {
+			return err
+		}
+		event := map[string]interface{}{
+			"event_id":  hex.EncodeToString(eventID),
+			"timestamp": report.Time.UTC().Format(time.RFC3339),
+			"level":     "error",
+			"logger":    "scamwarnbot",
+			"platform":  "go",
+			"message":   report.Message,
+			"extra":     report.Attrs,
+			"release":   report.Release,
+		}
+		if report.Environment != "" {
+			event["environment"] = report.Environment
+		}
+		auth := fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=scamwarnbot/%s", r.sentry.key, buildCommit)
+		if err := r.post(r.sentry.storeURL, event, map[string]string{"X-Sentry-Auth": auth}); err != nil {
+			return fmt.Errorf("sentry: %w", err)
+		}
+	}
+	if r.config.WebhookURL != "" {
+		if err := r.post(r.config.WebhookURL, report, nil); err != nil {
+			return fmt.Errorf("webhook: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *errorReporter) post(url string, body interface{}, headers map[string]string) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	response, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("responded with %s", response.Status)
+	}
+	return nil
+}
+
+// errorReportHandler passes all records to the handler of the regular logs and additionally
+// reports those at error level, regardless of the log level.
+type errorReportHandler struct {
+	base slog.Handler
+	// Attributes added with WithAttrs, keys prefixed with their groups.
+	attrs  []slog.Attr
+	prefix string
+}
+
+// withErrorReporting returns a handler additionally reporting errors once error reporting is
+// configured.
+func withErrorReporting(base slog.Handler) slog.Handler {
+	return &errorReportHandler{base: base}
+}
+
+func (h *errorReportHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelError || h.base.Enabled(ctx, level)
+}
+
+func (h *errorReportHandler) Handle(ctx context.Context, record slog.Record) error {
+	if r := reporter.Load(); r != nil && record.Level >= slog.LevelError {
+		attrs := map[string]string{}
+		for _, attr := range h.attrs {
+			attrs[attr.Key] = attr.Value.String()
+		}
+		record.Attrs(func(attr slog.Attr) bool {
+			attrs[h.prefix+attr.Key] = attr.Value.String()
+			return true
+		})
+		r.enqueue(&ErrorReport{
+			Time:        record.Time,
+			Message:     record.Message,
+			Attrs:       attrs,
+			Release:     buildCommit,
+			Environment: r.config.Environment,
+		})
+	}
+	if !h.base.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.base.Handle(ctx, record)
+}
+
+func (h *errorReportHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := append([]slog.Attr{}, h.attrs...)
+	for _, attr := range attrs {
+		prefixed = append(prefixed, slog.Attr{Key: h.prefix + attr.Key, Value: attr.Value})
+	}
+	return &errorReportHandler{base: h.base.WithAttrs(attrs), attrs: prefixed, prefix: h.prefix}
+}
+
+func (h *errorReportHandler) WithGroup(name string) slog.Handler {
+	return &errorReportHandler{base: h.base.WithGroup(name), attrs: h.attrs, prefix: h.prefix + name + "."}
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Every user who ever posted or joined stays in the state, so it grows without bound. Chat members
+// inactive for UserRetention are evicted periodically, and chats with more than MaxChatMembers
+// members lose their least recently active ones. An evicted user returning is treated like a user
+// seen for the first time.
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+const userRetentionDefault = 90 * 24 * time.Hour
+
+// How often stale users are evicted.
+const evictionInterval = 6 * time.Hour
+
+var metricEvictedUsers = newCounter("scamwarnbot_evicted_users_total",
+	"Chat members evicted from the state for inactivity or to cap its size.")
+
+// lastActiveAt returns when the user was last seen in the chat.
+func (u *UserData) lastActiveAt() time.Time {
+	if u.LastMessageAt.After(u.FirstSeenAt) {
+		return u.LastMessageAt
+	}
+	return u.FirstSeenAt
+}
+
+// evictStaleUsers removes the chat members inactive for the retention, and the least recently
+// active members of chats with more than maxPerChat members, unless maxPerChat is zero. Users no
+// longer referenced anywhere and private contacts inactive for the retention are forgotten.
+// Returns the number of chat members and users removed. Must be called with d.lock held.
+func (d *Data) evictStaleUsers(retention time.Duration, maxPerChat int, now time.Time) (members int, users int) {
+	for _, chatData := range d.ChatData {
+		var remaining []UserID
+		for userID, userData := range chatData.UserData {
+			if userData.lastActiveAt().IsZero() {
+				// Users recorded before activity was tracked get a full period of grace.
+				userData.FirstSeenAt = now
+				d.markChanged()
+			}
+			if now.Sub(userData.lastActiveAt()) > retention {
+				delete(chatData.UserData, userID)
+				members++
+				continue
+			}
+			remaining = append(remaining, userID)
+		}
+		if maxPerChat > 0 && len(remaining) > maxPerChat {
+			sort.Slice(remaining, func(i, j int) bool {
+				return chatData.UserData[remaining[i]].lastActiveAt().Before(chatData.UserData[remaining[j]].lastActiveAt())
+			})
+			for _, userID := range remaining[:len(remaining)-maxPerChat] {
+				delete(chatData.UserData, userID)
+				members++
+			}
+		}
+	}
+
+	for userID, contact := range d.DMContacts {
+		if now.Sub(contact.LastAt) > retention {
+			delete(d.DMContacts, userID)
+		}
+	}
+
+	referenced := map[UserID]bool{}
+	for _, chatData := range d.ChatData {
+		for userID := range chatData.UserData {
+			referenced[userID] = true
+		}
+	}
+	for userID := range d.UserStates {
+		referenced[userID] = true
+	}
+	for userID := range d.Blocklist {
+		referenced[userID] = true
+	}
+	for userID := range d.Roles {
+		referenced[userID] = true
+	}
+	for _, record := range d.Actions {
+		referenced[record.UserID] = true
+	}
+	for _, vote := range d.Votes {
+		referenced[vote.UserID] = true
+	}
+	for userID := range d.Users {
+		if !referenced[userID] {
+			delete(d.Users, userID)
+			users++
+		}
+	}
+	if members > 0 || users > 0 {
+		d.markChanged()
+	}
+	return members, users
+}
+
+// evictUsers evicts stale users according to the settings.
+func evictUsers(config *Config, data *Data) {
+	data.lock.Lock()
+	members, users := data.evictStaleUsers(config.UserRetention.Duration, config.MaxChatMembers, time.Now())
+	data.lock.Unlock()
+	metricEvictedUsers.add(float64(members))
+	slog.Info("evicted stale users", "members", members, "users", users)
+}
+
+func periodicEvictUsers(ctx context.Context, data *Data) {
+	for {
+		if !sleepContext(ctx, evictionInterval) {
+			return
+		}
+		evictUsers(currentConfig(), data)
+	}
+}
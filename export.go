@@ -0,0 +1,282 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The tracked state can be exported and imported with the export and import subcommands, to
+// inspect it, answer data requests of users (export -user), move it between deployments and seed
+// a new deployment. JSON exports contain the whole state and are restored as they are. CSV exports
+// contain one row per chat member, and importing them merges the activity into the state.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var exportCSVHeader = []string{"chat_id", "chat_title", "user_id", "username", "name", "first_seen_at", "last_message_at", "warnings", "strikes"}
+
+// UserExport is everything the bot stores about a user.
+type UserExport struct {
+	UserID    UserID
+	Profile   *UserInfo            `json:",omitempty"`
+	Chats     map[ChatID]*UserData `json:",omitempty"`
+	States    []*UserState         `json:",omitempty"`
+	Blocklist *BlockEntry          `json:",omitempty"`
+	Role      Role                 `json:",omitempty"`
+	Actions   []*ActionRecord      `json:",omitempty"`
+	Contact   *DMContact           `json:",omitempty"`
+	Targeted  *TargetProfile       `json:",omitempty"`
+}
+
+// exportUser collects everything stored about a user. Must be called with d.lock held.
+func (d *Data) exportUser(userID UserID) *UserExport {
+	export := &UserExport{
+		UserID:    userID,
+		Profile:   d.Users[userID],
+		States:    d.UserStates[userID],
+		Blocklist: d.Blocklist[userID],
+		Role:      d.Roles[userID],
+		Contact:   d.DMContacts[userID],
+		Targeted:  d.TargetedUsers[userID],
+		Chats:     map[ChatID]*UserData{},
+	}
+	for chatID, chatData := range d.ChatData {
+		if userData, ok := chatData.UserData[userID]; ok {
+			export.Chats[chatID] = userData
+		}
+	}
+	for _, record := range d.Actions {
+		if record.UserID == userID {
+			export.Actions = append(export.Actions, record)
+		}
+	}
+	return export
+}
+
+// writeExportCSV writes one row per chat member, or per chat of the given user if userID is set.
+// Must be called with data.lock held.
+func writeExportCSV(w io.Writer, data *Data, userID UserID) error {
+	writer := csv.NewWriter(w)
+	writer.Write(exportCSVHeader)
+	for _, chatID := range sortedKeys(data.ChatData) {
+		chatData := data.ChatData[chatID]
+		for _, memberID := range sortedKeys(chatData.UserData) {
+			if userID != 0 && memberID != userID {
+				continue
+			}
+			userData := chatData.UserData[memberID]
+			var userName, name string
+			if info := data.Users[memberID]; info != nil {
+				userName = info.UserName
+				name = strings.TrimSpace(info.FirstName + " " + info.LastName)
+			}
+			writer.Write([]string{
+				strconv.FormatInt(int64(chatID), 10), chatData.Title, strconv.FormatInt(int64(memberID), 10),
+				userName, name, formatExportTime(userData.FirstSeenAt), formatExportTime(userData.LastMessageAt),
+				strconv.Itoa(userData.Warnings), strconv.Itoa(len(userData.Strikes)),
+			})
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func formatExportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// runExport writes the state, or everything about a user, as JSON or CSV.
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "json", "Format of the export: json or csv")
+	user := flags.Int64("user", 0, "Only export what is stored about this user ID")
+	output := flags.String("o", "", "Write the export to this file instead of stdout")
+	flags.Parse(args)
+	if flags.NArg() != 0 || (*format != "json" && *format != "csv") {
+		return errors.New("usage: export [-format json|csv] [-user <user ID>] [-o <file>]")
+	}
+	storage, err := openStorage(storageSpec())
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	data, err := storage.Load()
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		return writeExport(os.Stdout, data, *format, UserID(*user))
+	}
+	file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeExport(file, data, *format, UserID(*user)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeExport writes the state, or everything about a user if userID is set, in a format.
+func writeExport(w io.Writer, data *Data, format string, userID UserID) error {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	switch {
+	case format == "csv":
+		return writeExportCSV(w, data, userID)
+	case userID != 0:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(data.exportUser(userID))
+	}
+	return writeSnapshot(w, data)
+}
+
+// importCSV merges the chat members of a CSV export into the state, keeping the earliest first
+// seen and latest message time of members who are already known. Returns the number of rows.
+// Must be called with data.lock held.
+func importCSV(r io.Reader, data *Data) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(exportCSVHeader)
+	header, err := reader.Read()
+	if err != nil {
+		return 0, err
+	}
+	if strings.Join(header, ",") != strings.Join(exportCSVHeader, ",") {
+		return 0, fmt.Errorf("unexpected header %q", strings.Join(header, ","))
+	}
+	rows := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		line, _ := reader.FieldPos(0)
+		chatID, err := strconv.ParseInt(record[0], 10, 64)
+		if err != nil {
+			return rows, fmt.Errorf("line %d: invalid chat ID %q", line, record[0])
+		}
+		userID, err := strconv.ParseInt(record[2], 10, 64)
+		if err != nil {
+			return rows, fmt.Errorf("line %d: invalid user ID %q", line, record[2])
+		}
+		var times [2]time.Time
+		for i, value := range record[5:7] {
+			if value == "" {
+				continue
+			}
+			if times[i], err = time.Parse(time.RFC3339, value); err != nil {
+				return rows, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		chatData := data.chat(ChatID(chatID))
+		if chatData.Title == "" {
+			chatData.Title = record[1]
+		}
+		userData, known := chatData.UserData[UserID(userID)]
+		if !known {
+			userData = &UserData{}
+			chatData.UserData[UserID(userID)] = userData
+		}
+		if !times[0].IsZero() && (userData.FirstSeenAt.IsZero() || times[0].Before(userData.FirstSeenAt)) {
+			userData.FirstSeenAt = times[0]
+		}
+		if times[1].After(userData.LastMessageAt) {
+			userData.LastMessageAt = times[1]
+		}
+		if _, ok := data.Users[UserID(userID)]; !ok && (record[3] != "" || record[4] != "") {
+			data.Users[UserID(userID)] = &UserInfo{UserName: record[3], FirstName: record[4]}
+		}
+		rows++
+	}
+}
+
+// runImport restores a JSON export, replacing the state, or merges a CSV export into the state.
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "Format of the export: json or csv. Derived from the file extension by default.")
+	force := flags.Bool("force", false, "Replace a state which already contains data with a JSON export")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [-format json|csv] [-force] <file>")
+	}
+	filename := flags.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	switch *format {
+	case "csv":
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		data := loadData()
+		data.lock.Lock()
+		rows, err := importCSV(file, data)
+		data.markChanged()
+		data.lock.Unlock()
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		if err := data.saveErr(); err != nil {
+			return fmt.Errorf("storing the imported chat members: %w", err)
+		}
+		slog.Info("imported chat members", "rows", rows)
+		return nil
+	case "json":
+		imported, err := readSnapshot(filename)
+		if err != nil {
+			return err
+		}
+		storage, err := openStorage(storageSpec())
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+		empty, err := storage.Empty()
+		if err != nil {
+			return err
+		}
+		if !empty && !*force {
+			return fmt.Errorf("%s already contains data; use -force to replace it", storageSpec())
+		}
+		imported.lock.Lock()
+		err = replaceState(storage, imported)
+		imported.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		slog.Info("imported state", "chats", len(imported.ChatData), "users", len(imported.Users))
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, expected json or csv", *format)
+}
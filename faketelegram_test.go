@@ -0,0 +1,100 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// fakeTelegram is a minimal Telegram Bot API server which accepts every request and counts the
+// calls per method.
+type fakeTelegram struct {
+	server *httptest.Server
+
+	lock  sync.Mutex
+	calls map[string]int
+}
+
+// newFakeTelegram starts a fake Telegram server and returns a bot connected to it.
+func newFakeTelegram(tb testing.TB) (*tgbotapi.BotAPI, *fakeTelegram) {
+	fake := &fakeTelegram{calls: map[string]int{}}
+	fake.server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	tb.Cleanup(fake.server.Close)
+	target, err := url.Parse(fake.server.URL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	// The API endpoint is a constant, so requests are redirected to the fake server instead.
+	client := &http.Client{Transport: redirectTransport{target: target, next: fake.server.Client().Transport}}
+	bot, err := tgbotapi.NewBotAPIWithClient("123:fake", client)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return bot, fake
+}
+
+// redirectTransport sends all requests to the target host.
+type redirectTransport struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	r.Host = t.target.Host
+	return t.next.RoundTrip(r)
+}
+
+func (f *fakeTelegram) handle(w http.ResponseWriter, r *http.Request) {
+	method := path.Base(r.URL.Path)
+	f.lock.Lock()
+	f.calls[method]++
+	f.lock.Unlock()
+
+	var result interface{} = true
+	switch method {
+	case "getMe":
+		result = map[string]interface{}{"id": 123, "is_bot": true, "first_name": "Bot", "username": "scamwarnbot"}
+	case "sendMessage":
+		chatID, _ := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+		result = map[string]interface{}{"message_id": 1, "date": 0, "chat": map[string]interface{}{"id": chatID}}
+	case "getChatAdministrators":
+		result = []interface{}{}
+	case "getChat":
+		chatID, _ := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+		result = map[string]interface{}{"id": chatID, "type": "supergroup"}
+	}
+	resultJSON, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": json.RawMessage(resultJSON)})
+}
+
+// count returns how often a method was called.
+func (f *fakeTelegram) count(method string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[method]
+}
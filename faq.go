@@ -0,0 +1,95 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const faqCooldownDefault = 10 * time.Minute
+
+// FAQEntry answers common questions with a canned answer, so users get the official answer before
+// scammers "helpfully" reply with their own.
+type FAQEntry struct {
+	Name    string
+	Pattern string
+	// Answers by language code. The English answer is used if there is none in the chat language.
+	Answers map[string]string
+
+	re *regexp.Regexp
+}
+
+// faqLastAnswerAt limits how often each FAQ entry is answered per chat.
+var faqLastAnswerAt = struct {
+	at   map[string]time.Time
+	lock sync.Mutex
+}{at: map[string]time.Time{}}
+
+// compileFAQ compiles the patterns of all FAQ entries.
+func (s *Settings) compileFAQ() error {
+	for i, entry := range s.FAQ {
+		re, err := regexp.Compile(entry.Pattern)
+		if err != nil {
+			return fieldErrorf(fmt.Sprintf("FAQ[%d].Pattern", i), "FAQ %q: %w", entry.Name, err)
+		}
+		entry.re = re
+	}
+	return nil
+}
+
+// answerFAQ replies to a message matching an FAQ entry. Returns true if an answer was sent.
+func answerFAQ(config *Config, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	text := messageText(msg)
+	for _, entry := range config.FAQ {
+		if !entry.re.MatchString(text) {
+			continue
+		}
+		var answer string
+		for _, lang := range config.languageChain(config.chatLanguage(ChatID(msg.Chat.ID))) {
+			if localized, ok := entry.Answers[lang]; ok {
+				answer = localized
+				break
+			}
+		}
+		if answer == "" {
+			continue
+		}
+
+		key := fmt.Sprintf("%d/%s", msg.Chat.ID, entry.Name)
+		faqLastAnswerAt.lock.Lock()
+		if time.Since(faqLastAnswerAt.at[key]) < config.FAQCooldown.Duration {
+			faqLastAnswerAt.lock.Unlock()
+			messageLogger(msg).Debug("not answering FAQ: answered recently", "faq", entry.Name)
+			return false
+		}
+		faqLastAnswerAt.at[key] = time.Now()
+		faqLastAnswerAt.lock.Unlock()
+
+		reply := tgbotapi.NewMessage(msg.Chat.ID, answer)
+		reply.ReplyToMessageID = msg.MessageID
+		_, err := send(bot, ChatID(msg.Chat.ID), reply)
+		logAction(messageLogger(msg), "answer FAQ", err, "faq", entry.Name)
+		if err != nil {
+			return false
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers race to be the first to answer questions of newcomers. The bot answers first-time
+// questions immediately, and can keep brand-new accounts from replying to them for a while.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const firstQuestionNoteDefaultEn = "An admin will respond here. Never accept DMs from anyone offering help."
+const firstQuestionNoteDefaultDe = "Ein Admin wird hier antworten. Akzeptiere niemals private Nachrichten von Helfern."
+const newMemberAgeDefault = 24 * time.Hour
+
+// protectedQuestions holds the first-time questions new accounts may not reply to, by chat and
+// message ID, with the time the protection ends.
+var protectedQuestions = struct {
+	until map[ChatID]map[int]time.Time
+	lock  sync.Mutex
+}{until: map[ChatID]map[int]time.Time{}}
+
+// isQuestion returns true if the text looks like a question.
+func isQuestion(text string) bool {
+	return strings.Contains(text, "?")
+}
+
+// protectQuestion keeps brand-new accounts from replying to a question for the configured time.
+func protectQuestion(config *Config, msg *tgbotapi.Message) {
+	if config.ProtectFirstQuestions.Duration == 0 {
+		return
+	}
+	chatID := ChatID(msg.Chat.ID)
+	protectedQuestions.lock.Lock()
+	defer protectedQuestions.lock.Unlock()
+	now := time.Now()
+	if protectedQuestions.until[chatID] == nil {
+		protectedQuestions.until[chatID] = map[int]time.Time{}
+	}
+	for messageID, until := range protectedQuestions.until[chatID] {
+		if now.After(until) {
+			delete(protectedQuestions.until[chatID], messageID)
+		}
+	}
+	protectedQuestions.until[chatID][msg.MessageID] = now.Add(config.ProtectFirstQuestions.Duration)
+}
+
+// guardProtectedQuestion deletes replies of brand-new accounts to protected questions. Returns
+// true if the message was deleted.
+func guardProtectedQuestion(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	if msg.ReplyToMessage == nil {
+		return false
+	}
+	chatID := ChatID(msg.Chat.ID)
+	protectedQuestions.lock.Lock()
+	until, ok := protectedQuestions.until[chatID][msg.ReplyToMessage.MessageID]
+	protectedQuestions.lock.Unlock()
+	if !ok || time.Now().After(until) {
+		return false
+	}
+	if msg.ReplyToMessage.From != nil && msg.ReplyToMessage.From.ID == msg.From.ID {
+		return false
+	}
+
+	data.lock.Lock()
+	firstSeenAt := data.chat(chatID).user(UserID(msg.From.ID)).FirstSeenAt
+	data.lock.Unlock()
+	if firstSeenAt.IsZero() || time.Since(firstSeenAt) > config.NewMemberAge.Duration {
+		return false
+	}
+
+	_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: msg.Chat.ID, MessageID: msg.MessageID})
+	logAction(messageLogger(msg), "delete", err, "reason", "reply of new user to protected question")
+	if err != nil {
+		return false
+	}
+	reportToAdmins(config, data, bot, msg.ReplyToMessage, fmt.Sprintf(
+		"Deleted a reply of new user %s to a first-time question:\n%s", msg.From.String(), messageText(msg)))
+	return true
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Spam bots post in bursts: many messages within seconds, or the same text in every group they
+// are in. The times of the recent messages of each user are kept in the chat, with a hash of the
+// text, so both patterns are detected without keeping the texts. A flooding user is muted for a
+// while in the chats the burst was posted in, and the admins are alerted.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	floodMessagesDefault        = 5
+	floodWindowDefault          = 10 * time.Second
+	floodCrossChatsDefault      = 2
+	floodCrossChatWindowDefault = time.Minute
+	floodMinTextLengthDefault   = 20
+	floodMuteDurationDefault    = time.Hour
+)
+
+// FloodDetector configures the detection of bursts of messages.
+type FloodDetector struct {
+	// A user posting more than this many messages in a chat within Window is flooding. Default 5
+	// within 10s.
+	Messages int
+	Window   jsonDuration
+	// A user posting the same text in this many chats within CrossChatWindow is flooding. Texts
+	// shorter than MinTextLength are not compared. Default 2 chats within 1m, and 20 characters.
+	CrossChats      int
+	CrossChatWindow jsonDuration
+	MinTextLength   int
+	// How long flooding users are muted. Default 1h.
+	MuteDuration jsonDuration
+}
+
+func (f *FloodDetector) setDefaults() {
+	if f.Messages == 0 {
+		f.Messages = floodMessagesDefault
+	}
+	if f.Window.Duration == 0 {
+		f.Window.Duration = floodWindowDefault
+	}
+	if f.CrossChats == 0 {
+		f.CrossChats = floodCrossChatsDefault
+	}
+	if f.CrossChatWindow.Duration == 0 {
+		f.CrossChatWindow.Duration = floodCrossChatWindowDefault
+	}
+	if f.MinTextLength == 0 {
+		f.MinTextLength = floodMinTextLengthDefault
+	}
+	if f.MuteDuration.Duration == 0 {
+		f.MuteDuration.Duration = floodMuteDurationDefault
+	}
+}
+
+// retention returns how long the times of messages are kept.
+func (f *FloodDetector) retention() time.Duration {
+	return max(f.Window.Duration, f.CrossChatWindow.Duration)
+}
+
+// RecentMessage is a recent message of a user, kept to detect floods.
+type RecentMessage struct {
+	At time.Time
+	// Hash of the normalized text, empty for short texts.
+	TextHash string `json:",omitempty"`
+}
+
+var metricFloods = newCounter("scamwarnbot_floods_total",
+	"Users muted for flooding, by kind: many messages in a chat (burst) or the same text in several chats (crosschat).", "kind")
+
+// floodTextHash returns the hash of the normalized text of a message, or "" if it is too short to
+// compare.
+func floodTextHash(text string, minLength int) string {
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+	if len([]rune(text)) < minLength {
+		return ""
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(text))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordRecentMessage records a message of the user and drops those older than retention. Must
+// be called with data.lock held.
+func (u *UserData) recordRecentMessage(message *RecentMessage, retention time.Duration) {
+	recent := u.RecentMessages[:0]
+	for _, m := range u.RecentMessages {
+		if message.At.Sub(m.At) <= retention {
+			recent = append(recent, m)
+		}
+	}
+	u.RecentMessages = append(recent, message)
+}
+
+// detectFlood records the message and returns the kind of flood and the chats the user flooded, or
+// nil if the user is not flooding. Must be called with data.lock held.
+func (d *Data) detectFlood(detector *FloodDetector, chatID ChatID, userID UserID, message *RecentMessage) (string, []ChatID) {
+	userData := d.chat(chatID).user(userID)
+	userData.recordRecentMessage(message, detector.retention())
+	d.userChanged(chatID, userID)
+
+	inWindow := 0
+	for _, m := range userData.RecentMessages {
+		if message.At.Sub(m.At) <= detector.Window.Duration {
+			inWindow++
+		}
+	}
+	if inWindow > detector.Messages {
+		userData.RecentMessages = nil
+		return "burst", []ChatID{chatID}
+	}
+
+	if message.TextHash == "" {
+		return "", nil
+	}
+	var chats []ChatID
+	for otherChatID, chatData := range d.ChatData {
+		other, ok := chatData.UserData[userID]
+		if !ok {
+			continue
+		}
+		for _, m := range other.RecentMessages {
+			if m.TextHash == message.TextHash && message.At.Sub(m.At) <= detector.CrossChatWindow.Duration {
+				chats = append(chats, otherChatID)
+				break
+			}
+		}
+	}
+	if len(chats) < detector.CrossChats {
+		return "", nil
+	}
+	for _, floodedChatID := range chats {
+		d.ChatData[floodedChatID].UserData[userID].RecentMessages = nil
+	}
+	return "crosschat", chats
+}
+
+// checkFlood mutes the author of the message and alerts the admins if the user is flooding.
+// Returns true if the user was muted.
+func checkFlood(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	detector := config.Flood
+	if detector == nil {
+		return false
+	}
+	chatID := ChatID(msg.Chat.ID)
+	userID := UserID(msg.From.ID)
+	message := &RecentMessage{At: time.Now(), TextHash: floodTextHash(messageText(msg), detector.MinTextLength)}
+	data.lock.Lock()
+	kind, chats := data.detectFlood(detector, chatID, userID, message)
+	data.lock.Unlock()
+	if chats == nil || userRole(config, data, bot, chatID, userID) >= roleModerator {
+		return false
+	}
+
+	metricFloods.inc(kind)
+	var titles, failures []string
+	for _, floodedChatID := range chats {
+		state := &UserState{
+			Kind:   stateRestricted,
+			ChatID: floodedChatID,
+			Until:  time.Now().Add(detector.MuteDuration.Duration),
+			Reason: "flood: " + kind,
+		}
+		err := applyState(bot, userID, state, true)
+		logAction(chatLogger(floodedChatID, userID), "mute flooding user", err, "kind", kind)
+		data.lock.Lock()
+		title := data.chatTitle(floodedChatID)
+		if err == nil {
+			data.setState(userID, state)
+		}
+		data.lock.Unlock()
+		if err != nil {
+			metricTelegramErrors.inc("restrictChatMember")
+			failures = append(failures, fmt.Sprintf("%s (%v)", title, err))
+			continue
+		}
+		titles = append(titles, title)
+	}
+	what := fmt.Sprintf("more than %d messages within %s", detector.Messages, detector.Window.Duration)
+	if kind == "crosschat" {
+		what = fmt.Sprintf("the same text in %d chats within %s", len(chats), detector.CrossChatWindow.Duration)
+	}
+	text := fmt.Sprintf("%s posted %s.", msg.From.String(), what)
+	if len(titles) > 0 {
+		text += fmt.Sprintf(" Muted for %s in %s.", detector.MuteDuration.Duration, strings.Join(titles, ", "))
+	}
+	if len(failures) > 0 {
+		text += " Could not mute in " + strings.Join(failures, ", ") + "."
+	}
+	notifyAdmins(config, bot, text)
+	return len(titles) > 0
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Users can have the bot forget them: /forgetme in a private chat deletes what the bot stored
+// about them, i.e. their activity in the chats, their profile, their private messages to the bot
+// and whether they were targeted by scammers. Admins can do the same for a user with /forget, e.g.
+// for a request by e-mail. As with opting out, moderation decisions (user states, strikes, votes
+// and quarantined messages) are kept, so that scammers cannot erase their bans. Unlike opting out,
+// the user is tracked again from their next message. The activity of users in a chat is also
+// forgotten when they leave it or are banned, and users rejoining a chat are treated as new members,
+// so that they are warned again on their first message even if the bot missed them leaving.
+
+import (
+	"log/slog"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var metricForgottenUsers = newCounter("scamwarnbot_forgotten_users_total",
+	"Users whose data was deleted, by trigger: the user (forgetme), an admin (forget), leaving or being "+
+		"banned from a chat (left) or rejoining a chat (rejoined).", "trigger")
+
+// rejoinGrace is how recently a member must have been first seen for a join to not reset them: the
+// service message and the chat_member update both report the same join.
+const rejoinGrace = time.Minute
+
+// forgetUser deletes the data stored about a user, except for moderation decisions.
+func (d *Data) forgetUser(userID UserID) {
+	d.forgetTrackedUser(userID)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.DMContacts, userID)
+	delete(d.TargetedUsers, userID)
+	d.markChanged()
+}
+
+// forgetChatMember deletes the activity of a user in a chat, except for their strikes. Returns
+// false if there was none.
+func (d *Data) forgetChatMember(chatID ChatID, userID UserID) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	chatData, ok := d.ChatData[chatID]
+	if !ok {
+		return false
+	}
+	userData, ok := chatData.UserData[userID]
+	if !ok {
+		return false
+	}
+	if len(userData.Strikes) > 0 {
+		chatData.UserData[userID] = &UserData{Strikes: userData.Strikes}
+	} else {
+		delete(chatData.UserData, userID)
+	}
+	d.markChanged()
+	return true
+}
+
+// rejoinChatMember resets the activity of a user who joined a chat they were seen in before, except
+// for their strikes, so that they are treated as a new member. Returns false if there was nothing
+// to reset. Must be called with d.lock held.
+func (d *Data) rejoinChatMember(chatID ChatID, userID UserID, now time.Time) bool {
+	chatData, ok := d.ChatData[chatID]
+	if !ok {
+		return false
+	}
+	userData, ok := chatData.UserData[userID]
+	if !ok || (!userData.FirstSeenAt.IsZero() && now.Sub(userData.FirstSeenAt) < rejoinGrace) {
+		return false
+	}
+	chatData.UserData[userID] = &UserData{FirstSeenAt: now, Strikes: userData.Strikes}
+	d.userChanged(chatID, userID)
+	return true
+}
+
+// resetRejoinedMember treats a user joining a chat as a new member. Must be called with data.lock
+// held.
+func resetRejoinedMember(data *Data, chatID ChatID, user *tgbotapi.User) {
+	if user == nil || user.IsBot {
+		return
+	}
+	if data.rejoinChatMember(chatID, UserID(user.ID), time.Now()) {
+		metricForgottenUsers.inc("rejoined")
+		chatLogger(chatID, UserID(user.ID)).Info("reset member who rejoined")
+	}
+}
+
+// forgetLeftMember deletes the activity of a user who left or was banned from a chat.
+func forgetLeftMember(data *Data, chatID ChatID, user *tgbotapi.User) {
+	if user == nil || user.IsBot {
+		return
+	}
+	if data.forgetChatMember(chatID, UserID(user.ID)) {
+		metricForgottenUsers.inc("left")
+		chatLogger(chatID, UserID(user.ID)).Info("forgot member who left")
+	}
+}
+
+// handleForgetMe deletes the data stored about the user: `/forgetme` in a private chat.
+func handleForgetMe(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	data.forgetUser(UserID(msg.From.ID))
+	metricForgottenUsers.inc("forgetme")
+	// The user ID is not logged, to not keep a trace of the user.
+	slog.Info("forgot user on request")
+	lang := config.resolveLanguage(msg.From.LanguageCode, "en", "de")
+	sendText(bot, msg.Chat.ID, config.translate(lang, "Your data was deleted: your activity in the chats, your "+
+		"profile and your messages to the bot. Moderation decisions such as bans are kept. The bot records "+
+		"your activity again from your next message in a chat; send /optout to prevent this."))
+}
+
+// cmdForget deletes the data stored about a user: `/forget @user`.
+func cmdForget(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	userID, _, err := resolveTarget(data, msg)
+	if err != nil {
+		return err.Error()
+	}
+	data.forgetUser(userID)
+	metricForgottenUsers.inc("forget")
+	logAction(messageLogger(msg), "forget user", nil, "target_user_id", userID)
+	return tr(config, msg, "Deleted the data of user %d, except for moderation decisions.", userID)
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"unicode"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	formattingMinLengthDefault    = 10
+	formattingEmojiRatioDefault   = 0.5
+	formattingCapsRatioDefault    = 0.7
+	formattingCustomEmojisDefault = 5
+	formattingScoreDefault        = 0.5
+)
+
+// FormattingDetector scores messages abusing formatting, typical of giveaway raids: messages
+// consisting mostly of emoji, shouted in capitals or stuffed with premium (custom) emoji.
+type FormattingDetector struct {
+	// Only messages of users first seen within this time are checked. All users are checked if
+	// zero.
+	MaxUserAge jsonDuration
+	// Messages with fewer letters, digits and emoji are not checked.
+	MinLength int
+	// Share of emoji among the letters, digits and emoji of a message.
+	EmojiRatio float64
+	// Share of capitals among the letters of a message.
+	CapsRatio float64
+	// Number of custom emoji in a message.
+	CustomEmojis int
+	// Score of each finding.
+	Score float64
+}
+
+func (f *FormattingDetector) setDefaults() {
+	if f.MinLength == 0 {
+		f.MinLength = formattingMinLengthDefault
+	}
+	if f.EmojiRatio == 0 {
+		f.EmojiRatio = formattingEmojiRatioDefault
+	}
+	if f.CapsRatio == 0 {
+		f.CapsRatio = formattingCapsRatioDefault
+	}
+	if f.CustomEmojis == 0 {
+		f.CustomEmojis = formattingCustomEmojisDefault
+	}
+	if f.Score == 0 {
+		f.Score = formattingScoreDefault
+	}
+}
+
+// isEmoji returns true for pictographic runes. Joiners and variation selectors, which are part of
+// emoji sequences, are not counted.
+func isEmoji(r rune) bool {
+	return unicode.Is(unicode.So, r) || (r >= 0x1F000 && r <= 0x1FAFF)
+}
+
+// detectFormatting returns the findings of the formatting detector for a message of a user first
+// seen at firstSeenAt.
+func detectFormatting(detector *FormattingDetector, msg *tgbotapi.Message, firstSeenAt time.Time) []Finding {
+	if detector.MaxUserAge.Duration > 0 && !firstSeenAt.IsZero() && time.Since(firstSeenAt) > detector.MaxUserAge.Duration {
+		return nil
+	}
+	var letters, upper, digits, emoji int
+	for _, r := range messageText(msg) {
+		switch {
+		case unicode.IsLetter(r):
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		case unicode.IsDigit(r):
+			digits++
+		case isEmoji(r):
+			emoji++
+		}
+	}
+	customEmojis := 0
+	if msg.Entities != nil {
+		for _, entity := range *msg.Entities {
+			if entity.Type == "custom_emoji" {
+				customEmojis++
+			}
+		}
+	}
+
+	var findings []Finding
+	finding := func(detector string, score float64, reason string) {
+		findings = append(findings, Finding{Detector: detector, Score: score, Reason: reason, Category: "spam"})
+	}
+	if total := letters + digits + emoji; total >= detector.MinLength {
+		if ratio := float64(emoji) / float64(total); ratio >= detector.EmojiRatio {
+			finding("formatting:emoji", detector.Score, fmt.Sprintf("%.0f%% emoji", ratio*100))
+		}
+	}
+	if letters >= detector.MinLength {
+		if ratio := float64(upper) / float64(letters); ratio >= detector.CapsRatio {
+			finding("formatting:caps", detector.Score, fmt.Sprintf("%.0f%% capitals", ratio*100))
+		}
+	}
+	if customEmojis >= detector.CustomEmojis {
+		finding("formatting:custom-emoji", detector.Score, fmt.Sprintf("%d custom emoji", customEmojis))
+	}
+	return findings
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Many scams arrive as forwarded "giveaway" posts of scam channels, or as screenshots and QR
+// codes, which the text rules cannot see. Forwards are checked against a blocklist of known scam
+// channels and users, and photos posted by accounts without any history in the chat can be
+// flagged for review by the admins.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// ForwardDetector scores messages forwarded from known scam sources and photos of new users.
+type ForwardDetector struct {
+	// Channels, groups and users whose forwarded messages are scams, by ID or username.
+	BlockedSources []string `json:",omitempty"`
+	// Score of forwards from blocked sources. Defaults to DeleteScore, so they are deleted, or to
+	// FlagScore if deletion is disabled.
+	Score float64
+	// Report photos posted by users whose first message in the chat it is, if they were first seen
+	// within NewMemberAge.
+	FlagNewUserPhotos bool `json:",omitempty"`
+}
+
+func (f *ForwardDetector) setDefaults(flagScore, deleteScore float64) {
+	if f.Score == 0 {
+		f.Score = deleteScore
+	}
+	if f.Score == 0 {
+		f.Score = flagScore
+	}
+}
+
+// blocked returns true if the source with the given ID or username is blocked.
+func (f *ForwardDetector) blocked(id int64, username string) bool {
+	for _, source := range f.BlockedSources {
+		source = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(source)), "@")
+		if source == strconv.FormatInt(id, 10) || (username != "" && source == strings.ToLower(username)) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectForwards finds forwards from blocked sources and photos of users without history.
+func detectForwards(config *Config, data *Data, msg *tgbotapi.Message) []Finding {
+	detector := config.Forwards
+	if detector == nil {
+		return nil
+	}
+	chatID := ChatID(msg.Chat.ID)
+	var findings []Finding
+	var source string
+	switch {
+	case msg.ForwardFromChat != nil && detector.blocked(msg.ForwardFromChat.ID, msg.ForwardFromChat.UserName):
+		source = msg.ForwardFromChat.Title
+	case msg.ForwardFrom != nil && detector.blocked(int64(msg.ForwardFrom.ID), msg.ForwardFrom.UserName):
+		source = msg.ForwardFrom.String()
+	}
+	if source != "" {
+		findings = append(findings, Finding{
+			Detector: "forward",
+			Score:    detector.Score,
+			Reason:   fmt.Sprintf("forwarded from blocked source %q", source),
+			Shadow:   config.isShadow(chatID, "forward"),
+		})
+	}
+
+	if detector.FlagNewUserPhotos && msg.Photo != nil {
+		data.lock.Lock()
+		userData := data.chat(chatID).user(UserID(msg.From.ID))
+		newUser := userData.LastMessageAt.IsZero() && !userData.FirstSeenAt.IsZero() &&
+			time.Since(userData.FirstSeenAt) <= config.NewMemberAge.Duration
+		data.lock.Unlock()
+		if newUser {
+			findings = append(findings, Finding{
+				Detector: "new-user-photo",
+				Score:    config.FlagScore,
+				Reason:   "photo in the first message of a new user",
+				Shadow:   config.isShadow(chatID, "new-user-photo"),
+			})
+		}
+	}
+	return findings
+}
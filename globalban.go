@@ -0,0 +1,155 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Source of blocklist entries added by /gban.
+const blockSourceGlobalBan = "gban"
+
+// A global ban is attempted this many times per chat, waiting globalBanBackoff after the first
+// failure and doubling the wait after each further failure.
+const globalBanAttempts = 3
+const globalBanBackoff = time.Second
+
+// Number of the most recent global bans checked by /bancheck without argument.
+const banCheckLimit = 50
+
+// allowedChats returns the IDs of the chats the bot is allowed in.
+func (s *Settings) allowedChats() []ChatID {
+	var chatIDs []ChatID
+	for _, group := range s.Groups {
+		if group.ChatID != 0 {
+			chatIDs = append(chatIDs, group.ChatID)
+		}
+	}
+	return chatIDs
+}
+
+// globalBan bans a user in all allowed chats, retrying failed chats with backoff, and adds the
+// user to the blocklist so chats the ban failed in still ban the user on their next message.
+// Returns the error of each chat the ban failed in.
+func globalBan(config *Config, data *Data, bot *tgbotapi.BotAPI, userID UserID, addedBy UserID, reason string) map[ChatID]error {
+	data.lock.Lock()
+	data.Blocklist[userID] = &BlockEntry{Reason: reason, Source: blockSourceGlobalBan, AddedAt: time.Now()}
+	data.markChanged()
+	data.lock.Unlock()
+
+	failed := map[ChatID]error{}
+	for _, chatID := range config.allowedChats() {
+		failed[chatID] = nil
+	}
+	backoff := globalBanBackoff
+	for attempt := 1; attempt <= globalBanAttempts && len(failed) > 0; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		for chatID := range failed {
+			err := banUser(data, bot, chatID, userID, 0, addedBy, reason)
+			if err == nil {
+				delete(failed, chatID)
+				continue
+			}
+			chatLogger(chatID, userID).Warn("global ban failed", "action", "ban", "outcome", "error", "attempt", attempt, "err", err)
+			failed[chatID] = err
+		}
+	}
+	return failed
+}
+
+// cmdGlobalBan bans a user in all allowed chats and reports the result per chat:
+// `/gban @user [reason]`.
+func cmdGlobalBan(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	userID, args, err := resolveTarget(data, msg)
+	if err != nil {
+		return err.Error()
+	}
+	failed := globalBan(config, data, bot, userID, UserID(msg.From.ID), strings.Join(args, " "))
+	chatIDs := config.allowedChats()
+	var text strings.Builder
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	description := data.describeUser(userID)
+	text.WriteString(tr(config, msg, "%s is banned in %d of %d chats and blocklisted.\n",
+		description, len(chatIDs)-len(failed), len(chatIDs)))
+	for _, chatID := range chatIDs {
+		if err, ok := failed[chatID]; ok {
+			text.WriteString(tr(config, msg, "- %s: failed after %d attempts: %v\n", data.chatTitle(chatID), globalBanAttempts, err))
+		} else {
+			text.WriteString(tr(config, msg, "- %s: banned\n", data.chatTitle(chatID)))
+		}
+	}
+	return text.String()
+}
+
+// cmdBanCheck shows the allowed chats in which globally banned users are not banned:
+// `/bancheck [@user]`. Without argument, the most recent global bans are checked.
+func cmdBanCheck(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	var userIDs []UserID
+	if strings.TrimSpace(msg.CommandArguments()) != "" || msg.ReplyToMessage != nil {
+		userID, _, err := resolveTarget(data, msg)
+		if err != nil {
+			return err.Error()
+		}
+		userIDs = append(userIDs, userID)
+	} else {
+		data.lock.Lock()
+		for userID, entry := range data.Blocklist {
+			if entry.Source == blockSourceGlobalBan {
+				userIDs = append(userIDs, userID)
+			}
+		}
+		sort.Slice(userIDs, func(i, j int) bool {
+			return data.Blocklist[userIDs[i]].AddedAt.After(data.Blocklist[userIDs[j]].AddedAt)
+		})
+		data.lock.Unlock()
+		if len(userIDs) > banCheckLimit {
+			userIDs = userIDs[:banCheckLimit]
+		}
+	}
+
+	var text strings.Builder
+	for _, userID := range userIDs {
+		for _, chatID := range config.allowedChats() {
+			member, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: int64(chatID), UserID: int(userID)})
+			var problem string
+			switch {
+			case err != nil:
+				problem = tr(config, msg, "unknown (%v)", err)
+			case member.WasKicked():
+				continue
+			case member.HasLeft():
+				problem = tr(config, msg, "not a member, but not banned")
+			default:
+				problem = tr(config, msg, "still present (%s)", member.Status)
+			}
+			data.lock.Lock()
+			fmt.Fprintf(&text, "%s in %s: %s\n", data.describeUser(userID), data.chatTitle(chatID), problem)
+			data.lock.Unlock()
+		}
+	}
+	if text.Len() == 0 {
+		return tr(config, msg, "Checked %d users: banned in all chats.", len(userIDs))
+	}
+	return text.String()
+}
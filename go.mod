@@ -1,7 +1,10 @@
 module github.com/digitalbitbox/scamwarnbot
 
-go 1.19
+go 1.21
 
-require github.com/go-telegram-bot-api/telegram-bot-api v4.6.4+incompatible
+require (
+	github.com/go-telegram-bot-api/telegram-bot-api v4.6.4+incompatible
+	github.com/mattn/go-sqlite3 v1.14.17
+)
 
 require github.com/technoweenie/multipartstreamer v1.0.1 // indirect
@@ -0,0 +1,196 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Users who received a suspicious DM can report the sender with /gotdm. As the bot can only write
+// to users who started a private chat with it, the report is collected in a guided DM flow.
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const gotDMStartParameter = "gotdm"
+const gotDMFlowTimeout = time.Hour
+
+// ReportedName is a username (or phone number) reported by users as a DM scammer or mentioned in
+// a scam message. Users with this username are put on the watchlist as soon as they appear in an
+// allowed chat.
+type ReportedName struct {
+	ReportedBy []UserID `json:",omitempty"`
+	ReportedAt time.Time
+	// Where the name was found if it was not reported via /gotdm, e.g. "action A12".
+	Source string `json:",omitempty"`
+}
+
+// describe returns how the name was reported.
+func (r *ReportedName) describe() string {
+	if r.Source != "" {
+		return "mentioned in a scam message (" + r.Source + ")"
+	}
+	return fmt.Sprintf("reported by %d user(s) via /gotdm", len(r.ReportedBy))
+}
+
+// gotDMFlow is a report in progress, started by /gotdm in a group.
+type gotDMFlow struct {
+	chatID    ChatID
+	messageID int
+	startedAt time.Time
+}
+
+var gotDMFlows = struct {
+	flows map[UserID]*gotDMFlow
+	lock  sync.Mutex
+}{flows: map[UserID]*gotDMFlow{}}
+
+// cmdGotDM starts a report of a suspicious DM: `/gotdm` in a group.
+func cmdGotDM(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	gotDMFlows.lock.Lock()
+	gotDMFlows.flows[UserID(msg.From.ID)] = &gotDMFlow{
+		chatID:    ChatID(msg.Chat.ID),
+		messageID: msg.MessageID,
+		startedAt: time.Now(),
+	}
+	gotDMFlows.lock.Unlock()
+	return fmt.Sprintf("Thanks for reporting! Never answer such messages. Please tell me who contacted you "+
+		"here: https://t.me/%s?start=%s", bot.Self.UserName, gotDMStartParameter)
+}
+
+// startGotDMFlow asks the reporter for the scammer in the private chat.
+func startGotDMFlow(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	gotDMFlows.lock.Lock()
+	if _, ok := gotDMFlows.flows[UserID(msg.From.ID)]; !ok {
+		gotDMFlows.flows[UserID(msg.From.ID)] = &gotDMFlow{startedAt: time.Now()}
+	}
+	gotDMFlows.lock.Unlock()
+	sendText(bot, msg.Chat.ID, "Please send me the @username of the account that contacted you, "+
+		"or forward one of its messages to me.")
+}
+
+// continueGotDMFlow records the scammer named by the reporter. Returns false if the reporter has
+// no report in progress.
+func continueGotDMFlow(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	reporterID := UserID(msg.From.ID)
+	gotDMFlows.lock.Lock()
+	flow, ok := gotDMFlows.flows[reporterID]
+	if ok && time.Since(flow.startedAt) > gotDMFlowTimeout {
+		delete(gotDMFlows.flows, reporterID)
+		ok = false
+	}
+	gotDMFlows.lock.Unlock()
+	if !ok {
+		return false
+	}
+
+	var description string
+	switch {
+	case msg.ForwardFrom != nil:
+		scammerID := UserID(msg.ForwardFrom.ID)
+		data.lock.Lock()
+		data.updateUser(msg.ForwardFrom)
+		data.setState(scammerID, &UserState{
+			Kind:    stateWatched,
+			Until:   time.Now().Add(config.WatchDuration.Duration),
+			AddedBy: reporterID,
+			Reason:  "reported via /gotdm",
+		})
+		description = data.describeUser(scammerID)
+		data.lock.Unlock()
+	case strings.HasPrefix(strings.TrimSpace(msg.Text), "@"):
+		name := strings.ToLower(strings.TrimPrefix(strings.Fields(msg.Text)[0], "@"))
+		data.lock.Lock()
+		reported, ok := data.ReportedNames[name]
+		if !ok {
+			reported = &ReportedName{}
+			data.ReportedNames[name] = reported
+		}
+		reported.ReportedBy = append(reported.ReportedBy, reporterID)
+		reported.ReportedAt = time.Now()
+		data.markChanged()
+		if userID, ok := data.userByName(name); ok {
+			data.setState(userID, &UserState{
+				Kind:    stateWatched,
+				Until:   time.Now().Add(config.WatchDuration.Duration),
+				AddedBy: reporterID,
+				Reason:  "reported via /gotdm",
+			})
+		}
+		data.lock.Unlock()
+		description = "@" + name
+	default:
+		sendText(bot, msg.Chat.ID, "Please send the @username, or forward a message of the account. "+
+			"If its messages show no sender when forwarded, send its @username instead.")
+		return true
+	}
+
+	gotDMFlows.lock.Lock()
+	delete(gotDMFlows.flows, reporterID)
+	gotDMFlows.lock.Unlock()
+
+	slog.Info("DM scammer reported", "user_id", reporterID, "scammer", description)
+	data.recordVariantReport(reporterID)
+	sendText(bot, msg.Chat.ID, "Thank you! The account is now being watched by the admins.")
+	notifyAdmins(config, bot, fmt.Sprintf("%s reported a DM from %s via /gotdm.", msg.From.String(), description))
+	if flow.chatID != 0 {
+		thanks := tgbotapi.NewMessage(int64(flow.chatID), fmt.Sprintf(
+			"Thanks %s for reporting a scammer! Remember: admins never contact you first.", msg.From.FirstName))
+		thanks.ReplyToMessageID = flow.messageID
+		if _, err := send(bot, flow.chatID, thanks); err != nil {
+			slog.Error("could not thank reporter", "err", err)
+		}
+	}
+	return true
+}
+
+// watchReportedName puts a user on the watchlist if their current or a previous username was
+// reported via /gotdm.
+func watchReportedName(config *Config, data *Data, bot *tgbotapi.BotAPI, user *tgbotapi.User) {
+	userID := UserID(user.ID)
+	data.lock.Lock()
+	var reported *ReportedName
+	if info, ok := data.Users[userID]; ok {
+		for _, name := range info.userNames() {
+			if r, ok := data.ReportedNames[strings.ToLower(name)]; ok {
+				reported = r
+				break
+			}
+		}
+	}
+	if reported == nil {
+		data.lock.Unlock()
+		return
+	}
+	for _, state := range data.UserStates[userID] {
+		if state.Kind == stateWatched {
+			data.lock.Unlock()
+			return
+		}
+	}
+	data.setState(userID, &UserState{
+		Kind:   stateWatched,
+		Until:  time.Now().Add(config.WatchDuration.Duration),
+		Reason: reported.describe(),
+	})
+	description := data.describeUser(userID)
+	data.lock.Unlock()
+
+	notifyAdmins(config, bot, fmt.Sprintf(
+		"%s, %s, appeared and is now watched.", description, reported.describe()))
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// allowedGroup returns the settings of a chat the bot is allowed in, or nil if the bot must leave
+// the chat. Chats are allowed by ID or, for entries without an ID, by title.
+func (s *Settings) allowedGroup(chat *tgbotapi.Chat) *GroupConfig {
+	if group := s.group(ChatID(chat.ID)); group != nil {
+		return group
+	}
+	for _, group := range s.Groups {
+		if group.ChatID == 0 && group.Title != "" && group.Title == chat.Title {
+			return group
+		}
+	}
+	return nil
+}
+
+// bindGroup stores the ID of a chat allowed by its title in its settings entry, so the chat stays
+// allowed when it is renamed and its settings can be looked up by ID.
+func bindGroup(data *Data, chat *tgbotapi.Chat) {
+	version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+		for _, group := range settings.Groups {
+			if group.ChatID == 0 && group.Title == chat.Title {
+				group.ChatID = ChatID(chat.ID)
+				return nil
+			}
+		}
+		return nil
+	})
+	logAction(chatLogger(ChatID(chat.ID), 0), "bind group", err, "chat_title", chat.Title)
+	if err != nil {
+		return
+	}
+	data.audit(auditAreaSettings, "bot", version, "bound group "+chat.Title+" to its chat ID")
+}
+
+// chatLanguage returns the language code of a chat.
+func (s *Settings) chatLanguage(chatID ChatID) string {
+	if group := s.group(chatID); group != nil && group.Language != "" {
+		return group.Language
+	}
+	return defaultLanguage
+}
+
+// languageWarning returns the warning, or the note for first-time posters asking a question, in
+// exactly the given language. The warnings in English and German are settings of their own, those
+// in other languages have the message keys "warning" and "warning.question".
+func (s *Settings) languageWarning(lang string, question bool) (string, bool) {
+	key, en, de := "warning", s.WarnMessageEn, s.WarnMessageDe
+	if question {
+		key, en, de = "warning.question", s.FirstQuestionNoteEn, s.FirstQuestionNoteDe
+	}
+	switch lang {
+	case "en":
+		return en, true
+	case "de":
+		return de, true
+	}
+	if text, ok := s.Messages[lang][key]; ok {
+		return text, true
+	}
+	text, ok := builtinMessages[lang][key]
+	return text, ok
+}
+
+// warningLanguage returns the language in which a user of a chat is warned: with
+// WarnInUserLanguage, the language of the user's Telegram app if there is a warning in it or one
+// of its fallbacks, and the chat language otherwise.
+func (s *Settings) warningLanguage(chatID ChatID, userLanguage string) string {
+	if s.WarnInUserLanguage {
+		for _, l := range s.appendLanguageChain(nil, userLanguage) {
+			if _, ok := s.languageWarning(l, false); ok {
+				return l
+			}
+		}
+	}
+	return s.chatLanguage(chatID)
+}
+
+// warnMessage returns the warning in a language sent to users of a chat in a topic. The warning of
+// the topic or else of the chat replaces the warning in the chat language.
+func (s *Settings) warnMessage(chatID ChatID, threadID int, lang string) string {
+	if topic := s.topic(chatID, threadID); topic != nil && topic.WarnMessage != "" && lang == s.chatLanguage(chatID) {
+		return topic.WarnMessage
+	}
+	if group := s.group(chatID); group != nil && group.WarnMessage != "" && lang == s.chatLanguage(chatID) {
+		return group.WarnMessage
+	}
+	for _, l := range s.languageChain(lang) {
+		if text, ok := s.languageWarning(l, false); ok {
+			return text
+		}
+	}
+	return s.WarnMessageEn
+}
+
+// warnAfter returns after how long without a message users of a chat are warned again.
+func (s *Settings) warnAfter(chatID ChatID) time.Duration {
+	if group := s.group(chatID); group != nil && group.WarnAfter.Duration != 0 {
+		return group.WarnAfter.Duration
+	}
+	return s.WarnAfter.Duration
+}
+
+// warningCooldown returns the minimum time between two warnings in a chat, zero if unlimited.
+func (s *Settings) warningCooldown(chatID ChatID) time.Duration {
+	if group := s.group(chatID); group != nil && group.WarningCooldown.Duration != 0 {
+		return group.WarningCooldown.Duration
+	}
+	return s.WarningCooldown.Duration
+}
+
+// firstQuestionNote returns the note in a language appended to the warning of first-time posters
+// asking a question.
+func (s *Settings) firstQuestionNote(lang string) string {
+	for _, l := range s.languageChain(lang) {
+		if text, ok := s.languageWarning(l, true); ok {
+			return text
+		}
+	}
+	return s.FirstQuestionNoteEn
+}
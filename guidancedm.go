@@ -0,0 +1,79 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// A warning in the chat must be short to be read, and too short to explain how the scams work. With
+// GuidanceDM, users warned for the first time ever also get the details in a private message
+// (message key "warning.dm"), and the warning in the chat is the short one. Bots can only message
+// users who started them, so if the private message cannot be sent, the full warning is sent in
+// the chat as usual. Each user gets the private message at most once.
+
+import (
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var metricGuidanceDMs = newCounter("scamwarnbot_guidance_dms_total",
+	"Private messages with guidance to users warned for the first time, by result: sent or failed.", "result")
+
+// firstWarningEver returns whether a user was never warned in any chat. Called with data locked,
+// before the warning is recorded.
+func (d *Data) firstWarningEver(userID UserID) bool {
+	for _, chatData := range d.ChatData {
+		if userData, ok := chatData.UserData[userID]; ok && (userData.Warnings > 0 || !userData.GuidanceDMAt.IsZero()) {
+			return false
+		}
+	}
+	return true
+}
+
+// sendGuidanceDM sends the guidance to the author of msg in a private message, and calls done with
+// whether it was sent.
+func sendGuidanceDM(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, lang string, done func(sent bool)) {
+	chatID, userID := ChatID(msg.Chat.ID), UserID(msg.From.ID)
+	logger := chatLogger(chatID, userID)
+	// Rendered without escaping, as the private message is plain text.
+	text, err := renderWarningTemplate(config.message(lang, "warning.dm"), &WarningData{
+		FirstName:  msg.From.FirstName,
+		LastName:   msg.From.LastName,
+		Username:   msg.From.UserName,
+		GroupTitle: msg.Chat.Title,
+		SupportURL: config.supportURL(chatID),
+	})
+	if err != nil {
+		logger.Error("could not render guidance", "err", err)
+		done(false)
+		return
+	}
+	dm := tgbotapi.NewMessage(int64(userID), text)
+	dm.DisableWebPagePreview = true
+	enqueueSend(bot, ChatID(userID), dm, func(_ tgbotapi.Message, err error) {
+		if err != nil {
+			// Most likely, the user has not started the bot.
+			logger.Info("could not send guidance in a private message, warning in the chat", "err", err)
+			metricGuidanceDMs.inc("failed")
+			done(false)
+			return
+		}
+		logger.Info("sent guidance in a private message")
+		metricGuidanceDMs.inc("sent")
+		data.lock.Lock()
+		data.chat(chatID).user(userID).GuidanceDMAt = time.Now()
+		data.userChanged(chatID, userID)
+		data.lock.Unlock()
+		done(true)
+	})
+}
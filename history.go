@@ -0,0 +1,158 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// A freshly deployed bot does not know anyone and would warn every long-time regular on their
+// next message. The import-history subcommand backfills the state from the JSON chat export of
+// Telegram Desktop (Export chat history, format "Machine-readable JSON"): when each author was
+// first and last seen, and the daily message counts of the chat for the days the bot has no
+// record of.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyExport is the part of a Telegram Desktop chat export used for the backfill.
+type historyExport struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	ID       int64  `json:"id"`
+	Messages []struct {
+		Type string `json:"type"`
+		// Local time of the exporting computer.
+		Date         string `json:"date"`
+		DateUnixtime string `json:"date_unixtime"`
+		// "user<ID>" for users, "channel<ID>" for posts on behalf of a chat.
+		FromID string `json:"from_id"`
+	} `json:"messages"`
+}
+
+// chatID returns the Bot API ID of the exported chat. Exports contain the bare ID of supergroups,
+// which the Bot API prefixes with -100.
+func (e *historyExport) chatID() (ChatID, error) {
+	switch {
+	case e.ID == 0:
+		return 0, errors.New("export has no chat ID; pass -chat")
+	case strings.HasSuffix(e.Type, "supergroup") || strings.HasSuffix(e.Type, "channel"):
+		return ChatID(-1000000000000 - e.ID), nil
+	case strings.HasSuffix(e.Type, "group"):
+		return ChatID(-e.ID), nil
+	}
+	return 0, fmt.Errorf("export of a %s, not of a group", e.Type)
+}
+
+// backfillHistory adds the activity in an export of the chat to the state. Returns the number of
+// authors and messages.
+func (d *Data) backfillHistory(chatID ChatID, export *historyExport, now time.Time) (int, int) {
+	firstSeen := map[UserID]time.Time{}
+	lastSeen := map[UserID]time.Time{}
+	dailyMessages := map[string]int{}
+	messages := 0
+	for _, message := range export.Messages {
+		if message.Type != "message" || !strings.HasPrefix(message.FromID, "user") {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(message.FromID, "user"))
+		if err != nil {
+			continue
+		}
+		var at time.Time
+		if unix, err := strconv.ParseInt(message.DateUnixtime, 10, 64); err == nil {
+			at = time.Unix(unix, 0)
+		} else if at, err = time.Parse("2006-01-02T15:04:05", message.Date); err != nil {
+			continue
+		}
+		if at.After(now) {
+			continue
+		}
+		userID := UserID(id)
+		if first, ok := firstSeen[userID]; !ok || at.Before(first) {
+			firstSeen[userID] = at
+		}
+		if at.After(lastSeen[userID]) {
+			lastSeen[userID] = at
+		}
+		dailyMessages[at.UTC().Format("2006-01-02")]++
+		messages++
+	}
+
+	chatData := d.chat(chatID)
+	if chatData.Title == "" {
+		chatData.Title = export.Name
+	}
+	for userID, first := range firstSeen {
+		userData := chatData.user(userID)
+		if userData.FirstSeenAt.IsZero() || first.Before(userData.FirstSeenAt) {
+			userData.FirstSeenAt = first
+		}
+		if lastSeen[userID].After(userData.LastMessageAt) {
+			userData.LastMessageAt = lastSeen[userID]
+		}
+	}
+
+	// Days the bot has samples for were recorded live and are complete already.
+	recorded := map[string]bool{}
+	for _, sample := range chatData.Risk {
+		recorded[sample.Day] = true
+	}
+	cutoff := now.UTC().AddDate(0, 0, -riskTrendDays).Format("2006-01-02")
+	for day, count := range dailyMessages {
+		if !recorded[day] && day > cutoff {
+			chatData.Risk = append(chatData.Risk, &RiskSample{Day: day, Messages: count})
+		}
+	}
+	sort.Slice(chatData.Risk, func(i, j int) bool { return chatData.Risk[i].Day < chatData.Risk[j].Day })
+	d.markChanged()
+	return len(firstSeen), messages
+}
+
+// runImportHistory backfills the state from a Telegram Desktop chat export.
+func runImportHistory(args []string) error {
+	flags := flag.NewFlagSet("import-history", flag.ExitOnError)
+	chatIDFlag := flags.Int64("chat", 0, "Bot API ID of the exported chat, e.g. -1001234567890. Derived from the export by default.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: import-history [-chat <chat ID>] <result.json>")
+	}
+	content, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var export historyExport
+	if err := json.Unmarshal(content, &export); err != nil {
+		return fmt.Errorf("%s: %w", flags.Arg(0), err)
+	}
+	chatID := ChatID(*chatIDFlag)
+	if chatID == 0 {
+		if chatID, err = export.chatID(); err != nil {
+			return err
+		}
+	}
+
+	data := loadData()
+	users, messages := data.backfillHistory(chatID, &export, time.Now())
+	data.save()
+	slog.Info("imported chat history", "chat_id", chatID, "chat_title", export.Name, "users", users, "messages", messages)
+	return nil
+}
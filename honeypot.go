@@ -0,0 +1,106 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Users writing to the bot in private are usually members wondering whether a DM they got is a
+// scam, and sometimes scammers trying their script on the bot. Either way they get the safety
+// guidance, at most once per day, and the contact is recorded. With ForwardScamDMs, private
+// messages matching the rules are forwarded to the admin chat, as they show the current scripts.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// The safety guidance is sent to a user at most this often.
+const dmGuidanceInterval = 24 * time.Hour
+
+// DMContact is a user who wrote to the bot in private.
+type DMContact struct {
+	FirstAt  time.Time
+	LastAt   time.Time
+	Messages int
+	// Messages matching the rules.
+	Flagged int `json:",omitempty"`
+	// When the safety guidance was last sent.
+	GuidedAt time.Time `json:",omitempty"`
+}
+
+var metricScamDMs = newCounter("scamwarnbot_scam_dms_total", "Private messages to the bot matching the rules.")
+
+// recordDMContact records a private message of a user. Returns true if the safety guidance is due.
+// Must be called with d.lock held.
+func (d *Data) recordDMContact(userID UserID, flagged bool, now time.Time) bool {
+	if d.DMContacts == nil {
+		d.DMContacts = map[UserID]*DMContact{}
+	}
+	contact, ok := d.DMContacts[userID]
+	if !ok {
+		contact = &DMContact{FirstAt: now}
+		d.DMContacts[userID] = contact
+	}
+	contact.LastAt = now
+	contact.Messages++
+	if flagged {
+		contact.Flagged++
+	}
+	d.markChanged()
+	if now.Sub(contact.GuidedAt) < dmGuidanceInterval {
+		return false
+	}
+	contact.GuidedAt = now
+	return true
+}
+
+// respondToDM answers a private message to the bot with the safety guidance, records the contact
+// and forwards the message to the admins if it matches the rules and ForwardScamDMs is set.
+// /start always gets the guidance.
+func respondToDM(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	userID := UserID(msg.From.ID)
+	logger := chatLogger(ChatID(msg.Chat.ID), userID)
+	findings := config.matchRules(messageText(msg))
+	flagged := config.FlagScore > 0 && totalScore(findings) >= config.FlagScore
+
+	data.lock.Lock()
+	guide := msg.Command() == "start"
+	if !data.optedOut(userID) {
+		guide = data.recordDMContact(userID, flagged, time.Now()) || guide
+	}
+	data.lock.Unlock()
+
+	if flagged {
+		metricScamDMs.inc()
+		logger.Info("private message matches the rules", "score", totalScore(findings))
+		if config.ForwardScamDMs {
+			var reasons []string
+			for _, finding := range findings {
+				reasons = append(reasons, finding.Detector+": "+finding.Reason)
+			}
+			notifyAdmins(config, bot, fmt.Sprintf("%s (%d) sent the bot a private message matching the rules:\n%s",
+				msg.From.String(), userID, strings.Join(reasons, "\n")))
+			forwardToAdmins(config, bot, msg)
+		}
+	}
+	if guide {
+		lang := config.resolveLanguage(msg.From.LanguageCode, "en", "de")
+		sendText(bot, msg.Chat.ID, config.translate(lang, "Stay safe: admins and support staff will never "+
+			"contact you first, and nobody legitimate will ever ask for your recovery words, PIN or a payment "+
+			"to \"validate\" or \"recover\" your wallet. If someone offers help in a private message, do not "+
+			"respond; it is a scam. To report the account, use /gotdm in the group where you met them."))
+	}
+}
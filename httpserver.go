@@ -0,0 +1,111 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// serveHTTP serves the metrics, the Alertmanager webhook receiver, the admin API, the published
+// statistics, the operator dashboard, the verification page and the pprof profiles on
+// *listenAddress, as well as the Telegram webhook if webhook is not nil. bot is nil in read
+// replicas, which do not relay alerts. If listener, the socket passed by systemd, is not nil, it is
+// served instead of *listenAddress. Returns once the server was shut down after ctx is cancelled.
+func serveHTTP(ctx context.Context, data *Data, bot *tgbotapi.BotAPI, webhook *webhookReceiver, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	mux.Handle("/healthz", healthzHandler())
+	if bot != nil {
+		mux.Handle("/alertmanager", alertmanagerHandler(bot))
+	}
+	mux.Handle("/api/settings", requireAPIToken(settingsAPIHandler(data)))
+	mux.Handle("/api/stats", requireAPIToken(statsAPIHandler(data)))
+	mux.Handle("/api/risk", requireAPIToken(riskAPIHandler(data)))
+	mux.Handle("/api/bans", requireAPIToken(banEventsAPIHandler(data)))
+	mux.Handle("/api/replication", requireAPIToken(replicationAPIHandler()))
+	mux.Handle("/api/verification", requireAPIToken(verificationAPIHandler(data)))
+	mux.Handle("/public/stats", publicStatsHandler(data))
+	mux.Handle("/dashboard", requireDashboardLogin(dashboardHandler(data)))
+	mux.Handle("/dashboard/settings", requireDashboardLogin(dashboardSettingsHandler(data)))
+	botUserName := ""
+	if bot != nil {
+		botUserName = bot.Self.UserName
+	}
+	mux.Handle("/public/verify", verificationPageHandler(botUserName))
+	registerProfiling(mux)
+	if webhook != nil {
+		mux.Handle(webhook.path, webhook)
+	}
+	go periodicMemoryMetrics(ctx)
+
+	server := &http.Server{Addr: *listenAddress, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			slog.Error("could not shut down the HTTP server", "err", err)
+		}
+	}()
+	var err error
+	switch {
+	case listener != nil && *tlsCert != "":
+		slog.Info("serving HTTPS on the activated socket", "address", listener.Addr())
+		err = server.ServeTLS(listener, *tlsCert, *tlsKey)
+	case listener != nil:
+		slog.Info("serving HTTP on the activated socket", "address", listener.Addr())
+		err = server.Serve(listener)
+	case *tlsCert != "":
+		slog.Info("serving HTTPS", "address", *listenAddress)
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	default:
+		slog.Info("serving HTTP", "address", *listenAddress)
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		fatal("could not serve HTTP", "err", err)
+	}
+}
+
+// apiTokenHolder returns the name of the holder of the bearer token of the request, or false if
+// the token is missing or invalid.
+func apiTokenHolder(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return "", false
+	}
+	name, ok := currentConfig().APITokens[token]
+	return name, ok
+}
+
+// requireAPIToken only passes requests with a valid admin API token to the handler.
+func requireAPIToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := apiTokenHolder(r); !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,315 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Messages are rendered in this language if there is no translation for the chat language.
+const defaultLanguage = "en"
+
+// Prefix of the message keys of rule categories, e.g. "category.giveaway".
+const categoryKeyPrefix = "category."
+
+// builtinMessages are the user-facing messages by language and message key. They can be
+// overridden and extended with Settings.Messages.
+var builtinMessages = map[string]map[string]string{
+	"en": {
+		"deleted.explanation":        "A message by %s was removed: %s.",
+		"category.scam":              "suspected scam",
+		"category.spam":              "spam",
+		"category.fake-support":      "impersonating support staff",
+		"category.giveaway":          "fake giveaway",
+		"category.recovery-service":  "fraudulent fund recovery service",
+		"category.wallet-validation": "fake wallet validation",
+		"category.wallet-drainer":    "wallet drainer link",
+		"category.impersonation":     "impersonating an admin",
+		"category.payment-request":   "payment request",
+		"category.phishing-link":     "link to a suspicious site, do not open it",
+		"warning.short":              "Reminder: never respond to DMs offering help.",
+		"reminder":                   "Reminder: admins will never DM you first. Anyone offering help, investments or giveaways in a private message is a scammer. Never share your recovery words with anyone.",
+		"warning.dm": "Hi {{.FirstName}}, a quick word about scams, as you just joined the conversation in {{.GroupTitle}}:\n\n" +
+			"- Admins and support staff will never message you first. Anyone who does is a scammer, even if their name and picture look official.\n" +
+			"- Nobody legitimate will ever ask for your recovery words, your PIN or a payment to \"validate\", \"sync\" or \"recover\" your wallet.\n" +
+			"- Fake giveaways, investment offers and fund recovery services are scams.\n" +
+			"- Ask your questions in the group, not in private messages.\n\n" +
+			"To report an account that messaged you, use /gotdm in the group.",
+		"digest.weekly": "Weekly report {{date .Start}} – {{date .LastDay}} ({{.TimeZone}})\n" +
+			"{{range .Chats}}{{.Title}}: {{int .Messages}} messages, {{int .Warnings}} warnings, {{int .NewUsers}} new users, {{int .Deletions}} deleted messages, {{int .Bans}} bans\n{{end}}" +
+			"Total: {{int .Messages}} messages, {{int .Warnings}} warnings, {{int .Deletions}} deleted messages, {{int .Bans}} bans, {{int .Blocklist}} blocklist entries",
+	},
+	// Warnings for users whose Telegram app is set to a language the chats are not in, see
+	// WarnInUserLanguage. The warnings in English and German are WarnMessageEn and WarnMessageDe.
+	"es": {
+		"warning":          "No respondas a mensajes privados ni llamadas. Hay estafadores activos.",
+		"warning.question": "Un administrador responderá aquí. Nunca aceptes mensajes privados de nadie que ofrezca ayuda.",
+		"warning.short":    "Recuerda: nunca respondas a mensajes privados que ofrezcan ayuda.",
+	},
+	"pt": {
+		"warning":          "Não responda a mensagens privadas nem a chamadas. Há golpistas ativos.",
+		"warning.question": "Um administrador responderá aqui. Nunca aceite mensagens privadas de quem oferece ajuda.",
+		"warning.short":    "Lembrete: nunca responda a mensagens privadas que oferecem ajuda.",
+	},
+	"de": {
+		"deleted.explanation":        "Eine Nachricht von %s wurde entfernt: %s.",
+		"category.scam":              "Verdacht auf Betrug",
+		"category.spam":              "Spam",
+		"category.fake-support":      "Vortäuschen von Support-Mitarbeitern",
+		"category.giveaway":          "gefälschtes Gewinnspiel",
+		"category.recovery-service":  "betrügerischer Wiederherstellungsdienst",
+		"category.wallet-validation": "gefälschte Wallet-Validierung",
+		"category.wallet-drainer":    "Link zu einem Wallet-Drainer",
+		"category.impersonation":     "Nachahmung eines Admins",
+		"category.payment-request":   "Zahlungsaufforderung",
+		"category.phishing-link":     "Link zu einer verdächtigen Seite, öffne ihn nicht",
+		"warning.short":              "Zur Erinnerung: Antworte nie auf private Nachrichten, die Hilfe anbieten.",
+		"reminder":                   "Zur Erinnerung: Admins schreiben dir nie zuerst privat. Wer dir per privater Nachricht Hilfe, Investitionen oder Gewinnspiele anbietet, ist ein Betrüger. Gib deine Wiederherstellungswörter niemals weiter.",
+		"warning.dm": "Hallo {{.FirstName}}, ein kurzer Hinweis zu Betrug, da du gerade in {{.GroupTitle}} mitschreibst:\n\n" +
+			"- Admins und Support-Mitarbeiter schreiben dir nie zuerst. Wer es tut, ist ein Betrüger, auch wenn Name und Bild offiziell aussehen.\n" +
+			"- Niemand Seriöses wird dich je nach deinen Wiederherstellungswörtern, deiner PIN oder einer Zahlung fragen, um deine Wallet zu \"validieren\", zu \"synchronisieren\" oder \"wiederherzustellen\".\n" +
+			"- Gefälschte Gewinnspiele, Investitionsangebote und Dienste zur Wiederherstellung von Geldern sind Betrug.\n" +
+			"- Stelle deine Fragen in der Gruppe, nicht in privaten Nachrichten.\n\n" +
+			"Um ein Konto zu melden, das dir geschrieben hat, nutze /gotdm in der Gruppe.",
+		"digest.weekly": "Wochenbericht {{date .Start}} – {{date .LastDay}} ({{.TimeZone}})\n" +
+			"{{range .Chats}}{{.Title}}: {{int .Messages}} Nachrichten, {{int .Warnings}} Warnungen, {{int .NewUsers}} neue Benutzer, {{int .Deletions}} gelöschte Nachrichten, {{int .Bans}} Sperren\n{{end}}" +
+			"Gesamt: {{int .Messages}} Nachrichten, {{int .Warnings}} Warnungen, {{int .Deletions}} gelöschte Nachrichten, {{int .Bans}} Sperren, {{int .Blocklist}} Einträge in der Sperrliste",
+
+		// Command replies, keyed by the English text.
+		"Usage: /%s keyword <keyword>, /%s domain <domain> or /%s user <@user or ID> [reason]": "Verwendung: /%s keyword <Wort>, /%s domain <Domain> oder /%s user <@Benutzer oder ID> [Grund]",
+		"%s is blocklisted already.":                         "%s ist bereits auf der Sperrliste.",
+		"Usage: /audit settings|roles|actions [<count>]":     "Verwendung: /audit settings|roles|actions [<Anzahl>]",
+		"%s is not blocklisted.":                             "%s ist nicht auf der Sperrliste.",
+		"%s is blocklisted and banned as soon as they post.": "%s ist auf der Sperrliste und wird beim nächsten Beitrag gesperrt.",
+		"%s is no longer blocklisted.":                       "%s ist nicht mehr auf der Sperrliste.",
+		"%s is blocked already.":                             "%s ist bereits gesperrt.",
+		"%s is not blocked.":                                 "%s ist nicht gesperrt.",
+		"Blocked %s %s. Settings version %d.":                "%s %s gesperrt. Einstellungsversion %d.",
+		"Unblocked %s %s. Settings version %d.":              "%s %s entsperrt. Einstellungsversion %d.",
+		"Usage: /blocklist [page]":                           "Verwendung: /blocklist [Seite]",
+		"keyword: %s":                                        "Wort: %s",
+		"domain: %s":                                         "Domain: %s",
+		"user: %s, source: %s":                               "Benutzer: %s, Quelle: %s",
+		"The blocklist is empty.":                            "Die Sperrliste ist leer.",
+		"There are only %d pages.":                           "Es gibt nur %d Seiten.",
+		"Blocklist, page %d of %d:\n":                        "Sperrliste, Seite %d von %d:\n",
+		"Warning %q: %d warned, %d reported a DM (%.1f%%)\n": "Warnung %q: %d gewarnt, %d haben eine DM gemeldet (%.1f%%)\n",
+		"Your data was deleted: your activity in the chats, your profile and your messages to the bot. Moderation decisions such as bans are kept. The bot records your activity again from your next message in a chat; send /optout to prevent this.": "Deine Daten wurden gelöscht: deine Aktivität in den Chats, dein Profil und deine Nachrichten an den Bot. Moderationsentscheidungen wie Sperren bleiben erhalten. Der Bot zeichnet deine Aktivität ab deiner nächsten Nachricht in einem Chat wieder auf; sende /optout, um das zu verhindern.",
+		"Deleted the data of user %d, except for moderation decisions.": "Die Daten von Benutzer %d wurden gelöscht, außer Moderationsentscheidungen.",
+		"Read the pinned message": "Angepinnte Nachricht lesen",
+		"Stay safe: admins and support staff will never contact you first, and nobody legitimate will ever ask for your recovery words, PIN or a payment to \"validate\" or \"recover\" your wallet. If someone offers help in a private message, do not respond; it is a scam. To report the account, use /gotdm in the group where you met them.": "Bleib sicher: Admins und Support-Mitarbeiter kontaktieren dich nie zuerst, und niemand Seriöses wird dich je nach deinen Wiederherstellungswörtern, deiner PIN oder einer Zahlung fragen, um deine Wallet zu \"validieren\" oder \"wiederherzustellen\". Wenn dir jemand per privater Nachricht Hilfe anbietet, antworte nicht; es ist Betrug. Um das Konto zu melden, nutze /gotdm in der Gruppe, in der du es getroffen hast.",
+		"Config reloaded. Settings changed in the file: %s. All other settings are kept.": "Konfiguration neu geladen. In der Datei geänderte Einstellungen: %s. Alle anderen Einstellungen bleiben erhalten.",
+		"Scammers are targeting you in %s: several suspicious accounts replied to you recently. Admins will never message you first or ask for your recovery words. For your protection, replies to you from new members are deleted for a while.": "Betrüger haben es in %s auf dich abgesehen: Mehrere verdächtige Konten haben dir kürzlich geantwortet. Admins schreiben dich nie zuerst an und fragen nie nach deinen Wiederherstellungswörtern. Zu deinem Schutz werden Antworten neuer Mitglieder an dich eine Zeit lang gelöscht.",
+		"%s, your first message here is shown once an admin approved it.": "%s, deine erste Nachricht hier wird angezeigt, sobald ein Admin sie freigegeben hat.",
+		"Verify official admins": "Offizielle Admins überprüfen",
+		"The warning is a sticker. Use /warnsticker off to warn with text again.":                      "Die Warnung ist ein Sticker. Mit /warnsticker off wird wieder mit Text gewarnt.",
+		"The warning is text. Reply to a sticker with /warnsticker [caption] to warn with it instead.": "Die Warnung ist Text. Antworte mit /warnsticker [Text] auf einen Sticker, um stattdessen mit ihm zu warnen.",
+		"Usage: reply to a sticker with /warnsticker [caption], or /warnsticker off":                   "Verwendung: Antworte mit /warnsticker [Text] auf einen Sticker, oder /warnsticker off",
+		"The warning is text again.":                                                              "Die Warnung ist wieder Text.",
+		"New users are now warned with this sticker.":                                             "Neue Nutzer werden jetzt mit diesem Sticker gewarnt.",
+		"Careful, this message was flagged: %s.":                                                  "Vorsicht, diese Nachricht wurde markiert: %s.",
+		"Last %d days: %d messages, %d warnings, %d flagged, %d new users, %d deleted, %d bans\n": "Letzte %d Tage: %d Nachrichten, %d Warnungen, %d gemeldet, %d neue Benutzer, %d gelöscht, %d Sperren\n",
+		"No chats.":      "Keine Chats.",
+		"trusted":        "vertrauenswürdig",
+		"watched":        "beobachtet",
+		"restricted":     "stummgeschaltet",
+		"banned":         "gesperrt",
+		"permanently":    "dauerhaft",
+		"until %s":       "bis %s",
+		"for another %s": "noch für %s",
+		"enabled":        "aktiviert",
+		"disabled":       "deaktiviert",
+		"Error: %v":      "Fehler: %v",
+		"This command must be used in the group.": "Dieser Befehl muss in der Gruppe verwendet werden.",
+		"%s is %s %s.":                                      "%s ist %s %s.",
+		"%s is not %s.":                                     "%s ist nicht %s.",
+		"%s is no longer %s.":                               "%s ist nicht mehr %s.",
+		"%s is banned permanently.":                         "%s ist dauerhaft gesperrt.",
+		"%s is banned for %s.":                              "%s ist für %s gesperrt.",
+		"Previously: %s (until %s)\n":                       "Früher: %s (bis %s)\n",
+		"Last message in %s: %s\n":                          "Letzte Nachricht in %s: %s\n",
+		"Strikes in %s: %.1f\n":                             "Verwarnungen in %s: %.1f\n",
+		"Strikes are not enabled in this chat.":             "Verwarnungen sind in diesem Chat nicht aktiviert.",
+		"Attended.\n":                                       "Betreut.\n",
+		"Unattended: no moderator active within %s.\n":      "Unbetreut: kein Moderator aktiv innerhalb von %s.\n",
+		"%s: %s ago\n":                                      "%s: vor %s\n",
+		"No changes recorded.":                              "Keine Änderungen aufgezeichnet.",
+		"Invalid count %q":                                  "Ungültige Anzahl %q",
+		" (version %d)":                                     " (Version %d)",
+		"No roles assigned. Telegram chat admins are %s.":   "Keine Rollen vergeben. Telegram-Chat-Admins sind %s.",
+		"Owners of the config file cannot be changed here.": "Besitzer aus der Konfigurationsdatei können hier nicht geändert werden.",
+		"Only owners can assign or revoke the admin and owner roles.": "Nur Besitzer können die Rollen admin und owner vergeben oder entziehen.",
+		"%s is now %s.": "%s ist jetzt %s.",
+		"Reply to the first message to delete with /purge.": "Antworte mit /purge auf die erste zu löschende Nachricht.",
+		"At most %d messages can be purged at once.":        "Es können höchstens %d Nachrichten auf einmal gelöscht werden.",
+		"Sent to %d of %d chats.":                           "An %d von %d Chats gesendet.",
+		"This chat uses the global settings. Change them with /settings global <key> <value>, or override them for this chat with /settings <key> <value>.": "Dieser Chat verwendet die globalen Einstellungen. Ändere sie mit /settings global <key> <value> oder überschreibe sie für diesen Chat mit /settings <key> <value>.",
+		"Changing settings requires the admin role.":         "Zum Ändern der Einstellungen ist die Rolle admin nötig.",
+		"The version cannot be changed.":                     "Die Version kann nicht geändert werden.",
+		"%s set to %s (previously %s). Settings version %d.": "%s auf %s gesetzt (vorher %s). Einstellungsversion %d.",
+		"No rules.":           "Keine Regeln.",
+		"%s (score %v): %s\n": "%s (Punkte %v): %s\n",
+		"Changing rules requires the admin role.":                             "Zum Ändern der Regeln ist die Rolle admin nötig.",
+		"Invalid score %q":                                                    "Ungültige Punktzahl %q",
+		"Rules updated.":                                                      "Regeln aktualisiert.",
+		"%s (version %d, %d rules, %s): %s\n":                                 "%s (Version %d, %d Regeln, %s): %s\n",
+		"Rule packs are enabled per chat. Use this command in the group.":     "Regelpakete werden pro Chat aktiviert. Verwende diesen Befehl in der Gruppe.",
+		"Changing rule packs requires the admin role.":                        "Zum Ändern der Regelpakete ist die Rolle admin nötig.",
+		"No rule pack %q.":                                                    "Kein Regelpaket %q.",
+		"Rule pack %s enabled.":                                               "Regelpaket %s aktiviert.",
+		"Rule pack %s disabled.":                                              "Regelpaket %s deaktiviert.",
+		"Shadow mode is set per chat. Use this command in the group.":         "Der Schattenmodus wird pro Chat gesetzt. Verwende diesen Befehl in der Gruppe.",
+		"Shadow detectors: %s\n":                                              "Detektoren im Schattenmodus: %s\n",
+		"No shadow detectors.\n":                                              "Keine Detektoren im Schattenmodus.\n",
+		"%s: %d hits since %s, %d also flagged by enforced detectors\n":       "%s: %d Treffer seit %s, davon %d auch von aktiven Detektoren gemeldet\n",
+		"Changing shadow detectors requires the admin role.":                  "Zum Ändern der Schattendetektoren ist die Rolle admin nötig.",
+		"%s runs in shadow mode now.":                                         "%s läuft jetzt im Schattenmodus.",
+		"%s is enforced now.":                                                 "%s ist jetzt aktiv.",
+		"No action %s. Only the last %d actions are kept.":                    "Keine Aktion %s. Nur die letzten %d Aktionen werden aufbewahrt.",
+		"Action %s at %s: %s\n":                                               "Aktion %s am %s: %s\n",
+		"Chat: %s\nUser: %s\n":                                                "Chat: %s\nBenutzer: %s\n",
+		"Score %.2f from:\n":                                                  "Punktzahl %.2f aus:\n",
+		" by %s":                                                              " durch %s",
+		" (shadow mode, not scored)":                                          " (Schattenmodus, nicht gezählt)",
+		"Usage: /setwarn <text>":                                              "Verwendung: /setwarn <Text>",
+		"Usage in the admin chat: /setwarn <language> <text>":                 "Verwendung im Admin-Chat: /setwarn <Sprache> <Text>",
+		"Warning updated. Settings version %d.":                               "Warnung aktualisiert. Einstellungsversion %d.",
+		"Config reloaded. Settings are kept; change them with /settings.":     "Konfiguration neu geladen. Die Einstellungen bleiben erhalten; ändere sie mit /settings.",
+		"Welcome, %s!":                                                        "Willkommen, %s!",
+		"Reply to the message you want to report with /report.":               "Antworte mit /report auf die Nachricht, die du melden möchtest.",
+		"You reported a message recently. Please try again later.":            "Du hast kürzlich eine Nachricht gemeldet. Bitte versuche es später erneut.",
+		"Thank you, the admins were notified.":                                "Danke, die Admins wurden benachrichtigt.",
+		"Protection windows are set per chat. Use this command in the group.": "Schutzzeiten werden pro Chat gesetzt. Verwende diesen Befehl in der Gruppe.",
+		"Protected from %s to %s\n":                                           "Geschützt von %s bis %s\n",
+		"No protection windows scheduled.":                                    "Keine Schutzzeiten geplant.",
+		"Protection windows cleared.":                                         "Schutzzeiten gelöscht.",
+		"Usage: /protect [<YYYY-MM-DD HH:MM>|now <duration>|clear]":           "Verwendung: /protect [<JJJJ-MM-TT HH:MM>|now <Dauer>|clear]",
+		"%s, please confirm that you are human to post in this chat.":         "%s, bitte bestätige, dass du ein Mensch bist, um in diesem Chat zu schreiben.",
+		"%s, please confirm within %d minutes that you are human.":            "%s, bitte bestätige innerhalb von %d Minuten, dass du ein Mensch bist.",
+		"%s, please answer within %d minutes: what is %s?":                    "%s, bitte antworte innerhalb von %d Minuten: Was ist %s?",
+		"This verification has expired.":                                      "Diese Überprüfung ist abgelaufen.",
+		"Wrong answer.":                                                       "Falsche Antwort.",
+		"I am human":                                                          "Ich bin ein Mensch",
+		"Verify official support":                                             "Offiziellen Support prüfen",
+		"How scammers operate":                                                "So gehen Betrüger vor",
+		"Got it":                                                              "Verstanden",
+		"This button is not for you.":                                         "Diese Schaltfläche ist nicht für dich.",
+		"Something went wrong, please try again.":                             "Etwas ist schiefgelaufen, bitte versuche es erneut.",
+		"Thank you, you can post now.":                                        "Danke, du kannst jetzt schreiben.",
+		"Usage: /lockdown [off] [all]":                                        "Verwendung: /lockdown [off] [all]",
+		"Use /lockdown all in the admin chat, or /lockdown in the group.":     "Verwende /lockdown all im Admin-Chat oder /lockdown in der Gruppe.",
+		"The bot is switched off per chat. Use this command in the group.":    "Der Bot wird pro Chat ausgeschaltet. Verwende diesen Befehl in der Gruppe.",
+		"The bot was switched off in this chat by %s on %s.":                  "Der Bot wurde in diesem Chat von %s am %s ausgeschaltet.",
+		"The bot is on in this chat.":                                         "Der Bot ist in diesem Chat eingeschaltet.",
+		"Usage: /bot [off|on]":                                                "Verwendung: /bot [off|on]",
+		"The bot is already off in this chat.":                                "Der Bot ist in diesem Chat bereits ausgeschaltet.",
+		"The bot is off in this chat. Use /bot on to switch it on again.":     "Der Bot ist in diesem Chat ausgeschaltet. Mit /bot on schaltest du ihn wieder ein.",
+		"Lockdown lifted.":                                                    "Sperrmodus aufgehoben.",
+		"Usage: /incident <duration> [all]":                                   "Verwendung: /incident <Dauer> [all]",
+		"Reporting is disabled: no admin chat is configured.":                 "Meldungen sind deaktiviert: Es ist kein Admin-Chat konfiguriert.",
+		"The incident report was posted to the admin chat.":                   "Der Vorfallbericht wurde im Admin-Chat gepostet.",
+		"Locked down: new members must solve a captcha, links are deleted and users who are not trusted can post once per %s.": "Sperrmodus aktiv: Neue Mitglieder müssen ein Captcha lösen, Links werden gelöscht und nicht vertrauenswürdige Benutzer können einmal pro %s schreiben.",
+		"\nThresholds (settings version %d, factor %.2f): flag %.2f, delete %.2f, ban %.2f\n":                                  "\nSchwellen (Einstellungsversion %d, Faktor %.2f): melden %.2f, löschen %.2f, sperren %.2f\n",
+		"You opted in to tracking again. Send /optout to opt out.":                                                             "Du hast der Erfassung wieder zugestimmt. Sende /optout, um sie abzulehnen.",
+		"You did not opt out of tracking. Send /optout to opt out.":                                                            "Du hast die Erfassung nicht abgelehnt. Sende /optout, um sie abzulehnen.",
+		"You opted out of tracking. Your activity in the chats is no longer recorded, and what was recorded is deleted. Please note that this weakens your protection: the bot cannot tell how long you have been around, so you are warned about scammers as if you were new and your messages are checked as strictly as those of new members. Moderation decisions such as bans are kept. Send /optin to be tracked again.": "Du hast die Erfassung abgelehnt. Deine Aktivität in den Chats wird nicht mehr erfasst und das bisher Erfasste wird gelöscht. Bitte beachte, dass dies deinen Schutz schwächt: Der Bot kann nicht erkennen, wie lange du schon dabei bist, daher wirst du wie ein neues Mitglied vor Betrügern gewarnt und deine Nachrichten werden so streng geprüft wie die neuer Mitglieder. Moderationsentscheidungen wie Sperren bleiben bestehen. Sende /optin, um wieder erfasst zu werden.",
+	},
+}
+
+// languageChain returns the languages whose messages are used for a language, in order: the
+// language, its fallbacks and their fallbacks, and finally the default language.
+func (s *Settings) languageChain(lang string) []string {
+	return s.appendLanguageChain(s.appendLanguageChain(nil, lang), defaultLanguage)
+}
+
+// appendLanguageChain appends a language and its fallbacks and their fallbacks to the chain,
+// skipping the languages already in it.
+func (s *Settings) appendLanguageChain(chain []string, lang string) []string {
+	if lang == "" {
+		return chain
+	}
+	for _, l := range chain {
+		if l == lang {
+			return chain
+		}
+	}
+	chain = append(chain, lang)
+	if fallbacks, ok := s.LanguageFallbacks[lang]; ok {
+		for _, fallback := range fallbacks {
+			chain = s.appendLanguageChain(chain, fallback)
+		}
+	} else if base, _, ok := strings.Cut(lang, "-"); ok {
+		chain = s.appendLanguageChain(chain, base)
+	}
+	return chain
+}
+
+// resolveLanguage returns the first language of the chain of a language which is one of the given
+// languages, or the default language.
+func (s *Settings) resolveLanguage(lang string, languages ...string) string {
+	for _, l := range s.languageChain(lang) {
+		for _, language := range languages {
+			if l == language {
+				return l
+			}
+		}
+	}
+	return defaultLanguage
+}
+
+// hasMessages returns true if there are messages in a language other than the default language or
+// in one of its fallbacks.
+func (s *Settings) hasMessages(lang string) bool {
+	for _, l := range s.languageChain(lang) {
+		if l == defaultLanguage && lang != defaultLanguage {
+			continue
+		}
+		if builtinMessages[l] != nil || s.Messages[l] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// message returns the message with the given key in a language, falling back along the language
+// chain and finally to the key itself.
+func (s *Settings) message(lang string, key string) string {
+	for _, l := range s.languageChain(lang) {
+		if text, ok := s.Messages[l][key]; ok {
+			return text
+		}
+		if text, ok := builtinMessages[l][key]; ok {
+			return text
+		}
+	}
+	return key
+}
+
+// tr translates a command reply into the language of the chat the command was used in. The
+// English text is the message key, so replies without translation are shown in English.
+func tr(config *Config, msg *tgbotapi.Message, format string, args ...interface{}) string {
+	return config.translate(config.chatLanguage(ChatID(msg.Chat.ID)), format, args...)
+}
+
+// translate renders the message with the given key in a language.
+func (s *Settings) translate(lang string, key string, args ...interface{}) string {
+	if len(args) == 0 {
+		return s.message(lang, key)
+	}
+	return fmt.Sprintf(s.message(lang, key), args...)
+}
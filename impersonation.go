@@ -0,0 +1,169 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The most common scam in our groups: a new account copies the name of an admin, often with
+// lookalike characters ("BitB0x Support", "Jоhn" with a Cyrillic o), and DMs users asking for
+// help. The impersonation detector compares the names of new posters with the names of the
+// admins of the chat.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const impersonationScoreDefault = 1.0
+const impersonationMinNameLength = 4
+
+// ImpersonationDetector scores messages of new users whose display name or username mimics an
+// admin of the chat. Set Score to the ban score to ban impersonators automatically.
+type ImpersonationDetector struct {
+	// Only users first seen within this time are checked. Defaults to NewMemberAge.
+	MaxUserAge jsonDuration
+	Score      float64
+}
+
+func (i *ImpersonationDetector) setDefaults(newMemberAge time.Duration) {
+	if i.MaxUserAge.Duration == 0 {
+		i.MaxUserAge.Duration = newMemberAge
+	}
+	if i.Score == 0 {
+		i.Score = impersonationScoreDefault
+	}
+}
+
+// confusables maps characters commonly used to imitate latin letters to these letters.
+var confusables = map[rune]rune{
+	'0': 'o', '1': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', '@': 'a', '$': 's', '|': 'l',
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c',
+	'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's', 'ԁ': 'd', 'ո': 'n',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't',
+	'υ': 'u', 'χ': 'x',
+}
+
+// normalizeName lowercases a name, replaces lookalike characters and drops everything but
+// letters, so that "BitB0x_Suppоrt" and "bitbox support" compare equal.
+func normalizeName(name string) string {
+	var result strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if replacement, ok := confusables[r]; ok {
+			r = replacement
+		}
+		if unicode.IsLetter(r) {
+			result.WriteRune(r)
+		}
+	}
+	// "l" and "i" are often swapped, e.g. in "Danie1" vs. "Daniel" and "I" vs. "l".
+	return strings.ReplaceAll(result.String(), "i", "l")
+}
+
+// editDistance returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// namesOf returns the normalized display name and username of a user.
+func namesOf(user *tgbotapi.User) []string {
+	var names []string
+	for _, name := range []string{strings.TrimSpace(user.FirstName + " " + user.LastName), user.UserName} {
+		if normalized := normalizeName(name); len([]rune(normalized)) >= impersonationMinNameLength {
+			names = append(names, normalized)
+		}
+	}
+	return names
+}
+
+// mimics returns true if the normalized name imitates the normalized admin name: it contains it
+// or differs from it by a single character.
+func mimics(name, adminName string) bool {
+	if strings.Contains(name, adminName) {
+		return true
+	}
+	return len([]rune(adminName)) >= 6 && editDistance(name, adminName) <= 1
+}
+
+// detectImpersonation finds new users whose name mimics an admin of the chat.
+func detectImpersonation(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) []Finding {
+	detector := config.Impersonation
+	if detector == nil {
+		return nil
+	}
+	chatID := ChatID(msg.Chat.ID)
+	data.lock.Lock()
+	firstSeenAt := data.chat(chatID).user(UserID(msg.From.ID)).FirstSeenAt
+	data.lock.Unlock()
+	if firstSeenAt.IsZero() || time.Since(firstSeenAt) > detector.MaxUserAge.Duration {
+		return nil
+	}
+	admins, err := chatAdmins.users(bot, chatID)
+	if err != nil {
+		chatLogger(chatID, 0).Error("could not fetch chat admins", "err", err)
+		return nil
+	}
+	names := namesOf(msg.From)
+	for i := range admins {
+		admin := &admins[i]
+		if admin.ID == msg.From.ID || admin.IsBot {
+			continue
+		}
+		for _, adminName := range namesOf(admin) {
+			for _, name := range names {
+				if mimics(name, adminName) {
+					return []Finding{{
+						Detector: "impersonation",
+						Score:    detector.Score,
+						Reason:   fmt.Sprintf("name %q mimics admin %s", msg.From.String(), admin.String()),
+						Category: "impersonation",
+						Shadow:   config.isShadow(chatID, "impersonation"),
+					}}
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// After an incident, the admins write a postmortem. When a lockdown is lifted, and on demand with
+// /incident after a raid, the bot compiles what it knows about the incident into a Markdown
+// report: a timeline of its actions and of the moderators' changes, the accounts banned, the
+// rules hit, the messages deleted and the users affected. The admin chat gets a summary and the
+// report as a file.
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Incident is a period of attack on some chats.
+type Incident struct {
+	Chats []ChatID
+	Start time.Time
+	End   time.Time
+	// What the incident was, e.g. "lockdown".
+	Cause string
+}
+
+// covers returns true if the incident covers the chat at the given time.
+func (i *Incident) covers(chatID ChatID, at time.Time) bool {
+	if at.Before(i.Start) || at.After(i.End) {
+		return false
+	}
+	for _, id := range i.Chats {
+		if id == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// incidentSummary counts what happened during an incident.
+type incidentSummary struct {
+	bans      map[UserID]bool
+	deletions int
+	affected  map[UserID]bool
+	hits      map[string]int
+}
+
+// incidentReport renders the Markdown report of an incident and a short summary of it. Must be
+// called with d.lock held.
+func (d *Data) incidentReport(incident *Incident) (report string, summary string) {
+	s := incidentSummary{bans: map[UserID]bool{}, affected: map[UserID]bool{}, hits: map[string]int{}}
+	type event struct {
+		at   time.Time
+		text string
+	}
+	var timeline []event
+
+	for _, entry := range d.AuditLog[auditAreaSettings] {
+		if !entry.At.Before(incident.Start) && !entry.At.After(incident.End) {
+			timeline = append(timeline, event{entry.At, fmt.Sprintf("%s: %s", entry.Actor, entry.Change)})
+		}
+	}
+	for _, record := range d.Actions {
+		if !incident.covers(record.ChatID, record.At) {
+			continue
+		}
+		s.affected[record.UserID] = true
+		for _, action := range record.Actions {
+			switch action {
+			case "delete":
+				s.deletions++
+			case "ban":
+				s.bans[record.UserID] = true
+			}
+		}
+		var detectors []string
+		for _, finding := range record.Findings {
+			if !finding.Shadow {
+				s.hits[finding.Detector]++
+				detectors = append(detectors, finding.Detector)
+			}
+		}
+		timeline = append(timeline, event{record.At, fmt.Sprintf("%s in %s: %s (action %s, score %.2f by %s)",
+			d.describeUser(record.UserID), d.chatTitle(record.ChatID), strings.Join(record.Actions, ", "),
+			record.ID, record.Score, strings.Join(detectors, ", "))})
+	}
+	for _, userID := range sortedKeys(d.UserStates) {
+		for _, state := range d.UserStates[userID] {
+			// Bans by the bot are action records already.
+			if state.Kind != stateBanned || state.AddedBy == 0 || !incident.covers(state.ChatID, state.Since) {
+				continue
+			}
+			s.affected[userID] = true
+			s.bans[userID] = true
+			timeline = append(timeline, event{state.Since, fmt.Sprintf("%s banned %s in %s: %s",
+				d.describeUser(state.AddedBy), d.describeUser(userID), d.chatTitle(state.ChatID), state.Reason)})
+		}
+	}
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].at.Before(timeline[j].at) })
+
+	var chats []string
+	for _, chatID := range incident.Chats {
+		chats = append(chats, d.chatTitle(chatID))
+	}
+	var text strings.Builder
+	fmt.Fprintf(&text, "# Incident report: %s\n\n", incident.Cause)
+	fmt.Fprintf(&text, "- Chats: %s\n", strings.Join(chats, ", "))
+	fmt.Fprintf(&text, "- From: %s\n", incident.Start.UTC().Format("2006-01-02 15:04:05 UTC"))
+	fmt.Fprintf(&text, "- To: %s (%s)\n", incident.End.UTC().Format("2006-01-02 15:04:05 UTC"),
+		incident.End.Sub(incident.Start).Round(time.Minute))
+	fmt.Fprintf(&text, "- Accounts banned: %d\n", len(s.bans))
+	fmt.Fprintf(&text, "- Messages deleted: %d\n", s.deletions)
+	fmt.Fprintf(&text, "- Users affected: %d\n", len(s.affected))
+
+	text.WriteString("\n## Timeline\n\n")
+	if len(timeline) == 0 {
+		text.WriteString("Nothing recorded.\n")
+	}
+	for _, e := range timeline {
+		fmt.Fprintf(&text, "- %s %s\n", e.at.UTC().Format("15:04:05"), e.text)
+	}
+
+	text.WriteString("\n## Rules hit\n\n")
+	detectors := sortedKeys(s.hits)
+	sort.SliceStable(detectors, func(i, j int) bool { return s.hits[detectors[i]] > s.hits[detectors[j]] })
+	if len(detectors) == 0 {
+		text.WriteString("None.\n")
+	}
+	for _, detector := range detectors {
+		fmt.Fprintf(&text, "- %s: %d\n", detector, s.hits[detector])
+	}
+
+	text.WriteString("\n## Accounts banned\n\n")
+	if len(s.bans) == 0 {
+		text.WriteString("None.\n")
+	}
+	for _, userID := range sortedKeys(s.bans) {
+		fmt.Fprintf(&text, "- %s\n", d.describeUser(userID))
+	}
+
+	text.WriteString("\n## Users affected\n\n")
+	if len(s.affected) == 0 {
+		text.WriteString("None.\n")
+	}
+	for _, userID := range sortedKeys(s.affected) {
+		fmt.Fprintf(&text, "- %s\n", d.describeUser(userID))
+	}
+
+	var top string
+	if len(detectors) > 0 {
+		top = fmt.Sprintf(", mostly %s", detectors[0])
+	}
+	summary = fmt.Sprintf("Incident report (%s) for %s, %s: %d accounts banned, %d messages deleted, %d users affected%s.",
+		incident.Cause, strings.Join(chats, ", "), incident.End.Sub(incident.Start).Round(time.Minute),
+		len(s.bans), s.deletions, len(s.affected), top)
+	return text.String(), summary
+}
+
+// postIncidentReport posts the summary of an incident to the admin chat, followed by the report as
+// a Markdown file.
+func postIncidentReport(config *Config, data *Data, bot *tgbotapi.BotAPI, incident *Incident) {
+	if config.AdminChatID == 0 {
+		return
+	}
+	data.lock.Lock()
+	report, summary := data.incidentReport(incident)
+	data.lock.Unlock()
+	notifyAdmins(config, bot, summary)
+	document := tgbotapi.NewDocumentUpload(config.AdminChatID, tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("incident-%s.md", incident.End.UTC().Format("2006-01-02-1504")),
+		Bytes: []byte(report),
+	})
+	enqueueSend(bot, ChatID(config.AdminChatID), document, func(_ tgbotapi.Message, err error) {
+		if err != nil {
+			slog.Error("could not post incident report", "err", err)
+			metricTelegramErrors.inc("sendDocument")
+		}
+	})
+}
+
+// cmdIncident posts the report of an incident which lasted for the given duration until now, e.g.
+// after a raid: `/incident <duration> [all]`. In the admin chat, the report covers all chats.
+func cmdIncident(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "all") {
+		return tr(config, msg, "Usage: /incident <duration> [all]")
+	}
+	duration, err := parseDuration(args[0])
+	if err != nil || duration <= 0 {
+		return tr(config, msg, "Usage: /incident <duration> [all]")
+	}
+	if config.AdminChatID == 0 {
+		return tr(config, msg, "Reporting is disabled: no admin chat is configured.")
+	}
+	now := time.Now()
+	incident := &Incident{Start: now.Add(-duration), End: now, Cause: "raid"}
+	if len(args) == 2 || msg.Chat.ID == config.AdminChatID {
+		incident.Chats = config.allowedChats()
+	} else {
+		incident.Chats = []ChatID{ChatID(msg.Chat.ID)}
+	}
+	postIncidentReport(config, data, bot, incident)
+	return tr(config, msg, "The incident report was posted to the admin chat.")
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Speed is the whole point of a scam-warning bot: a scam message is most dangerous in the first
+// seconds after it was posted. The time from receiving an update to completing the resulting
+// action (warning sent, message deleted, user muted or banned) is exported as a histogram by
+// action, from which Prometheus derives percentiles, and AlertConfig.MaxActionLatency turns it
+// into an alert rule.
+
+import (
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Updates are forgotten if no action completes within this time.
+const latencyTrackingTimeout = 5 * time.Minute
+
+const actionLatencyPercentileDefault = 95
+
+var metricActionLatency = newHistogram("scamwarnbot_action_latency_seconds",
+	"Time from receiving an update to completing the resulting action, by action.",
+	[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}, "action")
+
+type messageKey struct {
+	chatID    ChatID
+	messageID int
+}
+
+// latencyTracker remembers when the recent updates were received.
+type latencyTracker struct {
+	lock       sync.Mutex
+	receivedAt map[messageKey]time.Time
+	prunedAt   time.Time
+}
+
+var latencies = &latencyTracker{receivedAt: map[messageKey]time.Time{}}
+
+// receive records that a message was received now.
+func (t *latencyTracker) receive(msg *tgbotapi.Message) {
+	if msg == nil || msg.Chat == nil {
+		return
+	}
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.receivedAt[messageKey{ChatID(msg.Chat.ID), msg.MessageID}] = now
+	if now.Sub(t.prunedAt) < latencyTrackingTimeout {
+		return
+	}
+	for key, at := range t.receivedAt {
+		if now.Sub(at) > latencyTrackingTimeout {
+			delete(t.receivedAt, key)
+		}
+	}
+	t.prunedAt = now
+}
+
+// observeLatency records that an action resulting from a message completed now.
+func observeLatency(action string, chatID ChatID, messageID int) {
+	latencies.lock.Lock()
+	at, ok := latencies.receivedAt[messageKey{chatID, messageID}]
+	latencies.lock.Unlock()
+	if ok {
+		metricActionLatency.observe(time.Since(at).Seconds(), action)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers drop links to phishing sites, often on domains resembling ours (shiftcrypto.ch ->
+// shiftcrypto-support.ch, shlftcrypto.ch), and invite links to their own groups. The link scanner
+// checks the links of messages against a blocklist of domains, an optional remote threat feed and
+// lookalikes of our own domains.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const threatFeedIntervalDefault = time.Hour
+
+// LinkScanner scores messages of users who are not admins linking to blocked domains or to
+// lookalikes of protected domains, and optionally Telegram invite links. Deleted messages are
+// explained to the poster according to ExplainDeletions.
+type LinkScanner struct {
+	// Domains whose links are blocked, including their subdomains.
+	BlockedDomains []string `json:",omitempty"`
+	// Our own domains: links to other domains resembling them are blocked.
+	ProtectedDomains []string `json:",omitempty"`
+	// Block invite links to other Telegram groups (t.me/+..., t.me/joinchat/...).
+	BlockInviteLinks bool `json:",omitempty"`
+	// URL of a threat feed listing blocked domains, one per line, refreshed every
+	// ThreatFeedInterval.
+	ThreatFeedURL      string       `json:",omitempty"`
+	ThreatFeedInterval jsonDuration `json:",omitempty"`
+	// Defaults to DeleteScore, or to FlagScore if deletion is disabled.
+	Score float64
+}
+
+func (l *LinkScanner) setDefaults(flagScore, deleteScore float64) {
+	if l.Score == 0 {
+		l.Score = deleteScore
+	}
+	if l.Score == 0 {
+		l.Score = flagScore
+	}
+	if l.ThreatFeedInterval.Duration == 0 {
+		l.ThreatFeedInterval.Duration = threatFeedIntervalDefault
+	}
+}
+
+var (
+	// Links with or without scheme, e.g. "https://example.com/x" or "example.com".
+	urlPattern = regexp.MustCompile(`(?i)\b(https?://)?([a-z0-9](-*[a-z0-9])*\.)+[a-z]{2,}\b(:\d+)?(/[^\s]*)?`)
+	// Telegram invite links.
+	inviteLinkPattern = regexp.MustCompile(`(?i)\b(t|telegram)\.me/(\+|joinchat/)[\w-]+`)
+)
+
+// threatFeedDomains holds the domains of the remote threat feed.
+var threatFeedDomains atomic.Pointer[map[string]bool]
+
+var threatFeedBreaker = newCircuitBreaker("threatfeed")
+
+var metricThreatFeedDomains = newGauge("scamwarnbot_threat_feed_domains", "Domains in the remote threat feed.")
+
+// messageLinks returns the links in the text of a message and the URLs of its text links.
+func messageLinks(msg *tgbotapi.Message) []string {
+	links := urlPattern.FindAllString(messageText(msg), -1)
+	if msg.Entities != nil {
+		for _, entity := range *msg.Entities {
+			if entity.Type == "text_link" && entity.URL != "" {
+				links = append(links, entity.URL)
+			}
+		}
+	}
+	return links
+}
+
+// linkHost returns the lowercased host name of a link, which may lack the scheme.
+func linkHost(link string) string {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// inDomain returns true if host is the domain or one of its subdomains.
+func inDomain(host, domain string) bool {
+	domain = strings.ToLower(domain)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// domainName returns the name of a domain without its top-level domain, e.g. "shiftcrypto" for
+// "shop.shiftcrypto.ch".
+func domainName(host string) string {
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return host
+	}
+	return labels[len(labels)-2]
+}
+
+// lookalike returns true if host resembles the protected domain without belonging to it.
+func lookalike(host, protected string) bool {
+	if inDomain(host, protected) {
+		return false
+	}
+	name, protectedName := normalizeName(domainName(host)), normalizeName(domainName(protected))
+	if len(protectedName) < impersonationMinNameLength {
+		return name == protectedName
+	}
+	return strings.Contains(name, protectedName) || editDistance(name, protectedName) <= 2
+}
+
+// blockedLink returns why a link is blocked, or "" if it is not.
+func (l *LinkScanner) blockedLink(link string) string {
+	if l.BlockInviteLinks && inviteLinkPattern.MatchString(link) {
+		return fmt.Sprintf("invite link %s", link)
+	}
+	host := linkHost(link)
+	if host == "" {
+		return ""
+	}
+	for _, domain := range l.BlockedDomains {
+		if inDomain(host, domain) {
+			return fmt.Sprintf("link to blocked domain %s", host)
+		}
+	}
+	if feed := threatFeedDomains.Load(); feed != nil {
+		// Check the domain and each parent domain.
+		for domain := host; strings.Contains(domain, "."); domain = domain[strings.Index(domain, ".")+1:] {
+			if (*feed)[domain] {
+				return fmt.Sprintf("link to %s listed in the threat feed", host)
+			}
+		}
+	}
+	for _, protected := range l.ProtectedDomains {
+		if lookalike(host, protected) {
+			return fmt.Sprintf("link to %s resembling %s", host, protected)
+		}
+	}
+	return ""
+}
+
+// detectLinks finds blocked links in messages of users who are not admins of the chat.
+func detectLinks(config *Config, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) []Finding {
+	scanner := config.LinkScanner
+	if scanner == nil {
+		return nil
+	}
+	var reason string
+	for _, link := range messageLinks(msg) {
+		if reason = scanner.blockedLink(link); reason != "" {
+			break
+		}
+	}
+	if reason == "" {
+		return nil
+	}
+	chatID := ChatID(msg.Chat.ID)
+	if isChatAdmin(config, bot, chatID, UserID(msg.From.ID)) {
+		return nil
+	}
+	return []Finding{{
+		Detector: "link",
+		Score:    scanner.Score,
+		Reason:   reason,
+		Category: "phishing-link",
+		Shadow:   config.isShadow(chatID, "link"),
+	}}
+}
+
+// fetchThreatFeed downloads the domains of a threat feed: one domain per line, ignoring empty
+// lines and comments starting with "#".
+func fetchThreatFeed(feedURL string) (map[string]bool, error) {
+	domains := map[string]bool{}
+	err := threatFeedBreaker.call(func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+			if line != "" && !strings.HasPrefix(line, "#") {
+				domains[line] = true
+			}
+		}
+		return scanner.Err()
+	})
+	return domains, err
+}
+
+func periodicRefreshThreatFeed(ctx context.Context) {
+	for {
+		interval := threatFeedIntervalDefault
+		if scanner := currentConfig().LinkScanner; scanner != nil && scanner.ThreatFeedURL != "" {
+			interval = scanner.ThreatFeedInterval.Duration
+			domains, err := fetchThreatFeed(scanner.ThreatFeedURL)
+			if err != nil {
+				// Keep using the previous version of the feed.
+				slog.Error("could not fetch threat feed", "err", err)
+			} else {
+				threatFeedDomains.Store(&domains)
+				metricThreatFeedDomains.set(float64(len(domains)))
+				slog.Info("threat feed refreshed", "domains", len(domains))
+			}
+		}
+		if !sleepContext(ctx, interval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var (
+	loadTest    = flag.Bool("load", false, "Run the load test against the fake Telegram server.")
+	loadUpdates = flag.Int("load.updates", 20000, "Number of updates sent by the load test.")
+	loadBudget  = flag.Float64("load.budget", 2000, "Minimum throughput of the load test in updates per second.")
+)
+
+const loadChatID = -1001
+
+// newLoadConfig returns a config with a few rules, allowing the load test chat, and makes it live.
+func newLoadConfig(tb testing.TB) *Config {
+	// The fake server does not rate limit.
+	globalInterval, chatInterval := sendIntervalGlobal, sendIntervalPerChat
+	sendIntervalGlobal, sendIntervalPerChat = 0, 0
+	tb.Cleanup(func() { sendIntervalGlobal, sendIntervalPerChat = globalInterval, chatInterval })
+	config := &Config{AdminChatID: -1002}
+	config.telegramAdminRole = roleModerator
+	config.WarnMessageEn = "Beware of scammers."
+	config.WarnAfter.Duration = 30 * 24 * time.Hour
+	config.FlagScore = 1
+	config.DeleteScore = 2
+	config.BanScore = 3
+	config.Rules = []*Rule{
+		{Name: "support", Pattern: `(?i)\bsupport (team|agent)\b`, Score: 1},
+		{Name: "dm", Pattern: `(?i)\b(dm|pm) me\b`, Score: 1},
+		{Name: "seed", Pattern: `(?i)\b(seed|recovery) (phrase|words)\b`, Score: 2},
+	}
+	config.Groups = []*GroupConfig{{ChatID: loadChatID, RulePacks: []string{"fake-support", "giveaway"}}}
+	config.setDefaults()
+	if err := config.compile(); err != nil {
+		tb.Fatal(err)
+	}
+	liveConfig.Store(config)
+	return config
+}
+
+func newLoadData(tb testing.TB) *Data {
+	data := &Data{}
+	data.initialize()
+	data.storage = &jsonStorage{filename: filepath.Join(tb.TempDir(), "cache.json")}
+	return data
+}
+
+var loadTexts = []string{
+	"How do I update the firmware of my BitBox02?",
+	"thanks, that worked",
+	"Hello, I am from the support team, DM me to fix your wallet",
+	"Send me your recovery words and I will validate your wallet",
+	"Which coins are supported?",
+}
+
+// syntheticMessage returns the i-th message of the synthetic load: a mix of regular questions,
+// replies and scam attempts by a few thousand users.
+func syntheticMessage(i int) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		MessageID: i + 1,
+		From:      &tgbotapi.User{ID: 1000 + i%5000, FirstName: "User", UserName: fmt.Sprintf("user%d", i%5000)},
+		Chat:      &tgbotapi.Chat{ID: loadChatID, Type: "supergroup", Title: "Load test"},
+		Date:      int(time.Now().Unix()),
+		Text:      loadTexts[i%len(loadTexts)],
+	}
+}
+
+func quietLog(tb testing.TB) {
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tb.Cleanup(func() { slog.SetDefault(previous) })
+}
+
+func BenchmarkDetect(b *testing.B) {
+	config := newLoadConfig(b)
+	data := newLoadData(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		detect(config, data, syntheticMessage(i))
+	}
+}
+
+func BenchmarkProcess(b *testing.B) {
+	quietLog(b)
+	bot, _ := newFakeTelegram(b)
+	config := newLoadConfig(b)
+	data := newLoadData(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		process(config, data, bot, syntheticMessage(i))
+	}
+}
+
+func BenchmarkSave(b *testing.B) {
+	quietLog(b)
+	bot, _ := newFakeTelegram(b)
+	config := newLoadConfig(b)
+	data := newLoadData(b)
+	for i := 0; i < 10000; i++ {
+		process(config, data, bot, syntheticMessage(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data.lock.Lock()
+		data.markChanged()
+		data.lock.Unlock()
+		data.save()
+	}
+}
+
+// TestLoad pumps synthetic updates through the pipeline against the fake Telegram server and
+// fails if the throughput drops below the budget. Run with `go test -run TestLoad -load`.
+func TestLoad(t *testing.T) {
+	if !*loadTest {
+		t.Skip("load test disabled; enable with -load")
+	}
+	quietLog(t)
+	bot, fake := newFakeTelegram(t)
+	config := newLoadConfig(t)
+	data := newLoadData(t)
+
+	updates := make(chan tgbotapi.Update, 100)
+	go func() {
+		for i := 0; i < *loadUpdates; i++ {
+			updates <- tgbotapi.Update{UpdateID: i, Message: syntheticMessage(i)}
+		}
+		close(updates)
+	}()
+	start := time.Now()
+	for update := range updates {
+		process(config, data, bot, update.Message)
+	}
+	elapsed := time.Since(start)
+	rate := float64(*loadUpdates) / elapsed.Seconds()
+	t.Logf("%d updates in %s: %.0f updates/s, %d messages sent, %d deleted, %d bans",
+		*loadUpdates, elapsed.Round(time.Millisecond), rate,
+		fake.count("sendMessage"), fake.count("deleteMessage"), fake.count("banChatMember"))
+	if rate < *loadBudget {
+		t.Errorf("throughput %.0f updates/s is below the budget of %.0f updates/s", rate, *loadBudget)
+	}
+}
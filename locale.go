@@ -0,0 +1,154 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// localeFormat describes how dates and numbers are written in a language.
+type localeFormat struct {
+	Date         string
+	DateTime     string
+	Decimal      string
+	Thousands    string
+	FirstWeekday time.Weekday
+}
+
+var localeFormats = map[string]localeFormat{
+	"en": {
+		Date:         "Jan 2, 2006",
+		DateTime:     "Jan 2, 2006 15:04 MST",
+		Decimal:      ".",
+		Thousands:    ",",
+		FirstWeekday: time.Sunday,
+	},
+	"de": {
+		Date:         "02.01.2006",
+		DateTime:     "02.01.2006 15:04 MST",
+		Decimal:      ",",
+		Thousands:    ".",
+		FirstWeekday: time.Monday,
+	},
+}
+
+// Locale is the language and time zone in which dates, week boundaries and numbers are rendered,
+// e.g. {"Language": "de", "TimeZone": "Europe/Zurich"}. Defaults to English and UTC.
+type Locale struct {
+	Language string `json:",omitempty"`
+	TimeZone string `json:",omitempty"`
+
+	location *time.Location
+}
+
+// compile validates the locale and prepares it for use.
+func (l *Locale) compile() error {
+	if l.Language == "" {
+		l.Language = defaultLanguage
+	}
+	if _, ok := localeFormats[l.Language]; !ok {
+		return fmt.Errorf("unsupported locale language %q", l.Language)
+	}
+	l.location = time.UTC
+	if l.TimeZone != "" {
+		var err error
+		if l.location, err = time.LoadLocation(l.TimeZone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Locale) format() localeFormat {
+	if format, ok := localeFormats[l.Language]; ok {
+		return format
+	}
+	return localeFormats[defaultLanguage]
+}
+
+func (l *Locale) in(t time.Time) time.Time {
+	if l.location == nil {
+		return t.UTC()
+	}
+	return t.In(l.location)
+}
+
+func (l *Locale) formatDate(t time.Time) string {
+	return l.in(t).Format(l.format().Date)
+}
+
+func (l *Locale) formatDateTime(t time.Time) string {
+	return l.in(t).Format(l.format().DateTime)
+}
+
+// formatNumber renders a number with the given number of decimals and grouped thousands.
+func (l *Locale) formatNumber(n float64, decimals int) string {
+	format := l.format()
+	s := strconv.FormatFloat(n, 'f', decimals, 64)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	integer, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		integer, fraction = s[:i], s[i+1:]
+	}
+	var grouped strings.Builder
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			grouped.WriteString(format.Thousands)
+		}
+		grouped.WriteRune(digit)
+	}
+	if fraction != "" {
+		return sign + grouped.String() + format.Decimal + fraction
+	}
+	return sign + grouped.String()
+}
+
+// weekStart returns the local midnight starting the week containing t.
+func (l *Locale) weekStart(t time.Time) time.Time {
+	t = l.in(t)
+	days := (int(t.Weekday()) - int(l.format().FirstWeekday) + 7) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-days, 0, 0, 0, 0, t.Location())
+}
+
+// templateFuncs are the formatting functions available in message templates rendered in the
+// locale.
+func (l *Locale) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"date":     l.formatDate,
+		"datetime": l.formatDateTime,
+		"int":      func(n int) string { return l.formatNumber(float64(n), 0) },
+		"number":   l.formatNumber,
+	}
+}
+
+// render executes a message template with the formatting functions of the locale.
+func (l *Locale) render(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("").Funcs(l.templateFuncs()).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var result strings.Builder
+	if err := tmpl.Execute(&result, data); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
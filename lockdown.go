@@ -0,0 +1,304 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// During a severe attack, /lockdown puts a chat (or all chats) into incident mode in one step:
+// users joining must solve a captcha before they can post, users who are not trusted can post
+// only once per LockdownSlowMode and not post links, and every message is logged. The Bot API
+// cannot set Telegram's own slow mode, so the bot enforces it by deleting messages.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const lockdownSlowModeDefault = 30 * time.Second
+
+// The reason of the restriction of users who did not solve the captcha yet.
+const captchaReason = "lockdown captcha"
+
+// Lockdown records who locked down a chat.
+type Lockdown struct {
+	Since time.Time
+	By    string
+}
+
+// lockdownLastMessageAt holds when each user last posted in a locked down chat, for the slow mode.
+// Entries older than the slow mode are dropped at most once per slow mode, and those of a chat
+// when its lockdown is lifted.
+var lockdownLastMessageAt = struct {
+	at     map[chatUser]time.Time
+	pruned time.Time
+	lock   sync.Mutex
+}{at: map[chatUser]time.Time{}}
+
+// clearLockdownMessages forgets when the users posted in a chat whose lockdown was lifted.
+func clearLockdownMessages(chatID ChatID) {
+	lockdownLastMessageAt.lock.Lock()
+	defer lockdownLastMessageAt.lock.Unlock()
+	for key := range lockdownLastMessageAt.at {
+		if key.chatID == chatID {
+			delete(lockdownLastMessageAt.at, key)
+		}
+	}
+}
+
+// lockedDown returns true if the chat is locked down.
+func (s *Settings) lockedDown(chatID ChatID) bool {
+	group := s.group(chatID)
+	return group != nil && group.Lockdown != nil
+}
+
+// enforceLockdown deletes messages of users who are not trusted posting links or posting faster
+// than the slow mode allows in a locked down chat. Returns true if the message was deleted.
+func enforceLockdown(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	chatID := ChatID(msg.Chat.ID)
+	if !config.lockedDown(chatID) {
+		return false
+	}
+	logger := messageLogger(msg)
+	logger.Info("lockdown: message", "user", msg.From.String(), "text", messageText(msg))
+	if isChatAdmin(config, bot, chatID, UserID(msg.From.ID)) {
+		return false
+	}
+
+	var reason string
+	key := chatUser{chatID, UserID(msg.From.ID)}
+	slowMode := config.LockdownSlowMode.Duration
+	now := time.Now()
+	lockdownLastMessageAt.lock.Lock()
+	if now.Sub(lockdownLastMessageAt.pruned) >= slowMode {
+		for k, at := range lockdownLastMessageAt.at {
+			if now.Sub(at) >= slowMode {
+				delete(lockdownLastMessageAt.at, k)
+			}
+		}
+		lockdownLastMessageAt.pruned = now
+	}
+	if now.Sub(lockdownLastMessageAt.at[key]) < slowMode {
+		reason = "slow mode"
+	} else {
+		lockdownLastMessageAt.at[key] = now
+	}
+	lockdownLastMessageAt.lock.Unlock()
+	if reason == "" && len(messageLinks(msg)) > 0 {
+		reason = "link"
+	}
+	if reason == "" {
+		return false
+	}
+
+	_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: msg.Chat.ID, MessageID: msg.MessageID})
+	logAction(logger, "delete", err, "reason", "lockdown "+reason)
+	if err != nil {
+		metricTelegramErrors.inc("deleteMessage")
+		return false
+	}
+	metricDeleted.inc()
+	return true
+}
+
+// challengeNewMembers mutes the users joining a locked down chat until they solve a captcha.
+func challengeNewMembers(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	chatID := ChatID(msg.Chat.ID)
+	if msg.NewChatMembers == nil || !config.lockedDown(chatID) {
+		return
+	}
+	for _, member := range *msg.NewChatMembers {
+		if member.IsBot {
+			continue
+		}
+		userID := UserID(member.ID)
+		state := &UserState{Kind: stateRestricted, ChatID: chatID, Reason: captchaReason}
+		err := applyState(bot, userID, state, true)
+		logAction(chatLogger(chatID, userID), "restrict", err, "reason", captchaReason)
+		if err != nil {
+			metricTelegramErrors.inc("restrictChatMember")
+			continue
+		}
+		data.lock.Lock()
+		data.setState(userID, state)
+		data.lock.Unlock()
+
+		challenge := tgbotapi.NewMessage(int64(chatID), tr(config, msg,
+			"%s, please confirm that you are human to post in this chat.", member.String()))
+		challenge.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(tr(config, msg, "I am human"),
+				callbackData("captcha", strconv.Itoa(member.ID))),
+		))
+		enqueueSend(bot, chatID, challenge, func(_ tgbotapi.Message, err error) {
+			if err != nil {
+				chatLogger(chatID, userID).Error("could not post captcha", "err", err)
+				metricTelegramErrors.inc("sendMessage")
+			}
+		})
+	}
+}
+
+// liftRestriction lifts the restriction of a user in a chat with the given reason, e.g. of a user
+// who has not solved the captcha yet. Returns false if there is none.
+func liftRestriction(data *Data, bot *tgbotapi.BotAPI, chatID ChatID, userID UserID, reason string) (bool, error) {
+	data.lock.Lock()
+	pending := false
+	for _, state := range data.UserStates[userID] {
+		if state.Kind == stateRestricted && state.ChatID == chatID && state.Reason == reason {
+			pending = true
+		}
+	}
+	data.lock.Unlock()
+	if !pending {
+		return false, nil
+	}
+	if err := applyState(bot, userID, &UserState{Kind: stateRestricted, ChatID: chatID}, false); err != nil {
+		return true, err
+	}
+	data.lock.Lock()
+	data.removeState(userID, stateRestricted, chatID)
+	data.lock.Unlock()
+	return true, nil
+}
+
+// captchaCallback handles the captcha button: `captcha:<user ID>`. Only the challenged user can
+// solve it.
+func captchaCallback(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args []string) string {
+	lang := config.chatLanguage(ChatID(query.Message.Chat.ID))
+	if len(args) != 1 || args[0] != strconv.Itoa(query.From.ID) {
+		return config.translate(lang, "This button is not for you.")
+	}
+	chatID := ChatID(query.Message.Chat.ID)
+	logger := chatLogger(chatID, UserID(query.From.ID))
+	_, err := liftRestriction(data, bot, chatID, UserID(query.From.ID), captchaReason)
+	logAction(logger, "lift captcha", err)
+	if err != nil {
+		return config.translate(lang, "Something went wrong, please try again.")
+	}
+	startProbation(config, data, bot, chatID, UserID(query.From.ID))
+	_, err = bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(chatID), MessageID: query.Message.MessageID})
+	if err != nil {
+		logger.Warn("could not delete captcha", "err", err)
+	}
+	return config.translate(lang, "Thank you, you can post now.")
+}
+
+// cmdLockdown locks down the chat, or all chats: `/lockdown [off] [all]`. Lifting the lockdown
+// also lifts the restrictions of users who did not solve the captcha and posts the incident
+// report.
+func cmdLockdown(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	off, all := false, false
+	for _, arg := range strings.Fields(msg.CommandArguments()) {
+		switch arg {
+		case "off":
+			off = true
+		case "all":
+			all = true
+		default:
+			return tr(config, msg, "Usage: /lockdown [off] [all]")
+		}
+	}
+	var chatIDs []ChatID
+	if all {
+		chatIDs = config.allowedChats()
+	} else if int64(msg.Chat.ID) == config.AdminChatID {
+		return tr(config, msg, "Use /lockdown all in the admin chat, or /lockdown in the group.")
+	} else {
+		chatIDs = []ChatID{ChatID(msg.Chat.ID)}
+	}
+
+	// The lifted lockdowns are reported as an incident.
+	var incident *Incident
+	for _, chatID := range chatIDs {
+		if !off || !config.lockedDown(chatID) {
+			continue
+		}
+		since := config.group(chatID).Lockdown.Since
+		if incident == nil {
+			incident = &Incident{Start: since, Cause: "lockdown"}
+		} else if since.Before(incident.Start) {
+			incident.Start = since
+		}
+		incident.Chats = append(incident.Chats, chatID)
+	}
+
+	version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+		for _, chatID := range chatIDs {
+			group := settings.group(chatID)
+			if group == nil {
+				group = &GroupConfig{ChatID: chatID}
+				settings.Groups = append(settings.Groups, group)
+			}
+			if off {
+				group.Lockdown = nil
+			} else if group.Lockdown == nil {
+				group.Lockdown = &Lockdown{Since: time.Now(), By: msg.From.String()}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+
+	data.lock.Lock()
+	var titles []string
+	for _, chatID := range chatIDs {
+		titles = append(titles, data.chatTitle(chatID))
+	}
+	data.lock.Unlock()
+	change := "locked down"
+	if off {
+		change = "lifted the lockdown of"
+		for _, chatID := range chatIDs {
+			liftPendingCaptchas(data, bot, chatID)
+			clearLockdownMessages(chatID)
+		}
+	}
+	data.audit(auditAreaSettings, telegramActor(msg.From), version,
+		fmt.Sprintf("%s %s", change, strings.Join(titles, ", ")))
+	messageLogger(msg).Info(change, "chats", strings.Join(titles, ", "))
+	notifyAdmins(config, bot, fmt.Sprintf("%s %s %s.", msg.From.String(), change, strings.Join(titles, ", ")))
+	if incident != nil {
+		incident.End = time.Now()
+		postIncidentReport(config, data, bot, incident)
+	}
+	if off {
+		return tr(config, msg, "Lockdown lifted.")
+	}
+	return tr(config, msg, "Locked down: new members must solve a captcha, links are deleted and users who are not trusted can post once per %s.",
+		config.LockdownSlowMode.Duration)
+}
+
+// liftPendingCaptchas lifts the restrictions of the users of a chat who did not solve the captcha.
+func liftPendingCaptchas(data *Data, bot *tgbotapi.BotAPI, chatID ChatID) {
+	var pending []UserID
+	data.lock.Lock()
+	for userID, states := range data.UserStates {
+		for _, state := range states {
+			if state.Kind == stateRestricted && state.ChatID == chatID && state.Reason == captchaReason {
+				pending = append(pending, userID)
+			}
+		}
+	}
+	data.lock.Unlock()
+	for _, userID := range pending {
+		if _, err := liftRestriction(data, bot, chatID, userID, captchaReason); err != nil {
+			chatLogger(chatID, userID).Error("lift captcha failed", "action", "lift captcha", "outcome", "error", "err", err)
+		}
+	}
+}
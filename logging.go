@@ -0,0 +1,81 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Logs are structured, so dashboards can be built on them and it can be traced why a user was (not)
+// warned. Messages about a chat or a user carry the fields chat_id and user_id, and actions of the
+// bot the fields action and outcome ("ok" or "error", with the error in err).
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// setupLogging configures the default logger according to -log-level and -log-json, the activity
+// log and the audit log of the actions.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("-log-level: %w", err)
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if *logJSON {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	handler, err := withActivityLog(withErrorReporting(handler))
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(withActionAudit(handler)))
+	return nil
+}
+
+// chatLogger returns a logger adding the chat and the user to its messages. The user is left out
+// if zero.
+func chatLogger(chatID ChatID, userID UserID) *slog.Logger {
+	if userID == 0 {
+		return slog.With("chat_id", chatID)
+	}
+	return slog.With("chat_id", chatID, "user_id", userID)
+}
+
+// messageLogger returns a logger adding the chat and the sender of a message to its messages.
+func messageLogger(msg *tgbotapi.Message) *slog.Logger {
+	var userID UserID
+	if msg.From != nil {
+		userID = UserID(msg.From.ID)
+	}
+	return chatLogger(ChatID(msg.Chat.ID), userID)
+}
+
+// logAction logs the outcome of an action of the bot: at info level if it succeeded, at error
+// level otherwise.
+func logAction(logger *slog.Logger, action string, err error, args ...any) {
+	if err != nil {
+		logger.Error(action+" failed", append(args, "action", action, "outcome", "error", "err", err)...)
+		return
+	}
+	logger.Info(action, append(args, "action", action, "outcome", "ok")...)
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
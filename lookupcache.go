@@ -0,0 +1,141 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	metricLookupCacheHits   = newCounter("scamwarnbot_lookup_cache_hits_total", "External lookups answered from the cache.", "namespace", "tier")
+	metricLookupCacheMisses = newCounter("scamwarnbot_lookup_cache_misses_total", "External lookups not found in the cache.", "namespace")
+)
+
+// CachedLookup is the stored result of an external lookup.
+type CachedLookup struct {
+	Value   json.RawMessage
+	Expires time.Time
+}
+
+// lookupCache caches the results of external lookups (URL scans, reputation checks, ...), so
+// content repeated during a raid is only looked up once. Results are kept in memory; namespaces
+// marked as persistent are also stored in the cache file and survive restarts.
+type lookupCache struct {
+	lock    sync.Mutex
+	entries map[string]*CachedLookup
+}
+
+var lookups = &lookupCache{entries: map[string]*CachedLookup{}}
+
+// lookupKey builds the cache key of a lookup. The parts are hashed, so arbitrary content like
+// message texts can be used as key without storing it.
+func lookupKey(namespace string, parts ...string) string {
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return namespace + ":" + hex.EncodeToString(hash[:16])
+}
+
+// cachedLookup returns the cached result of a lookup, or calls fetch and caches its result for
+// ttl. Errors are not cached. If persistent is set, the result is also stored in data.
+func cachedLookup[T any](data *Data, namespace string, key string, ttl time.Duration, persistent bool,
+	fetch func() (T, error)) (T, error) {
+	var result T
+	now := time.Now()
+	if value, tier, ok := lookups.get(data, key, persistent, now); ok {
+		if err := json.Unmarshal(value, &result); err == nil {
+			metricLookupCacheHits.inc(namespace, tier)
+			return result, nil
+		}
+	}
+	metricLookupCacheMisses.inc(namespace)
+	result, err := fetch()
+	if err != nil {
+		return result, err
+	}
+	value, err := json.Marshal(result)
+	if err != nil {
+		return result, err
+	}
+	entry := &CachedLookup{Value: value, Expires: now.Add(ttl)}
+	lookups.lock.Lock()
+	lookups.entries[key] = entry
+	lookups.lock.Unlock()
+	if persistent {
+		data.lock.Lock()
+		if data.Lookups == nil {
+			data.Lookups = map[string]*CachedLookup{}
+		}
+		data.Lookups[key] = entry
+		data.markChanged()
+		data.lock.Unlock()
+	}
+	return result, nil
+}
+
+// get returns an unexpired cached value and the tier it was found in ("memory" or "persistent").
+func (c *lookupCache) get(data *Data, key string, persistent bool, now time.Time) (json.RawMessage, string, bool) {
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok && now.Before(entry.Expires) {
+		return entry.Value, "memory", true
+	}
+	if !persistent {
+		return nil, "", false
+	}
+	data.lock.Lock()
+	entry, ok = data.Lookups[key]
+	data.lock.Unlock()
+	if !ok || !now.Before(entry.Expires) {
+		return nil, "", false
+	}
+	c.lock.Lock()
+	c.entries[key] = entry
+	c.lock.Unlock()
+	return entry.Value, "persistent", true
+}
+
+// expire removes expired results from both tiers.
+func (c *lookupCache) expire(data *Data, now time.Time) {
+	c.lock.Lock()
+	for key, entry := range c.entries {
+		if !now.Before(entry.Expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.lock.Unlock()
+	data.lock.Lock()
+	for key, entry := range data.Lookups {
+		if !now.Before(entry.Expires) {
+			delete(data.Lookups, key)
+			data.markChanged()
+		}
+	}
+	data.lock.Unlock()
+}
+
+func periodicExpireLookups(ctx context.Context, data *Data) {
+	for {
+		if !sleepContext(ctx, 10*time.Minute) {
+			return
+		}
+		lookups.expire(data, time.Now())
+	}
+}
@@ -15,11 +15,10 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"runtime/debug"
@@ -31,8 +30,28 @@ import (
 )
 
 var (
-	cacheFilename  = flag.String("cache", "cache.json", "Filename for the persistent cache")
-	configFilename = flag.String("config", "config.json", "Config file. Protect with 0600 as it contains the secret bot token.")
+	cacheFilename       = flag.String("cache", "cache.json", "Filename for the persistent cache")
+	jsonBackups         = flag.Int("cache-backups", 3, "Number of previous versions of the JSON cache kept as backups (<cache>.1 is the most recent).")
+	storageFlag         = flag.String("storage", "", "Storage of the state, e.g. sqlite:state.db, redis:localhost:6379 or json:cache.json. Defaults to the JSON file given by -cache.")
+	configFilename      = flag.String("config", "config.json", "Config file. Protect with 0600 as it contains the secret bot token.")
+	listenAddress       = flag.String("listen", "", "Address to serve metrics and webhooks on, e.g. localhost:8080. Disabled if empty.")
+	webhookURL          = flag.String("webhook-url", "", "Receive updates via a Telegram webhook at this HTTPS URL, served on -listen, instead of long polling.")
+	tlsCert             = flag.String("tls-cert", "", "Certificate file to serve HTTPS on -listen instead of HTTP.")
+	tlsKey              = flag.String("tls-key", "", "Key file of -tls-cert.")
+	readOnly            = flag.Bool("readonly", false, "Run as read replica: only serve the HTTP API from the state written by the live bot, without connecting to Telegram.")
+	logLevel            = flag.String("log-level", "info", "Minimum level of the logged messages: debug, info, warn or error.")
+	logJSON             = flag.Bool("log-json", false, "Log in JSON instead of text.")
+	activityLogFilename = flag.String("activity-log", "", "Also write the actions of the bot to this file, one JSON object per line. Disabled if empty.")
+	activityLogMaxSize  = flag.Int("activity-log-max-size", 100, "Size in MB at which the activity log is rotated.")
+	activityLogMaxAge   = flag.Duration("activity-log-max-age", 24*time.Hour, "Age at which the activity log is rotated. Never rotated by age if zero.")
+	activityLogKeep     = flag.Int("activity-log-keep", 30, "Number of rotated, gzipped activity logs kept.")
+	dumpDir             = flag.String("dump-dir", "", "Write the state dumps triggered by SIGUSR1 to files in this directory instead of only logging a summary.")
+	standbyOf           = flag.String("standby", "", "Run as warm standby of the live bot at this URL, e.g. https://bot.example.com:8080: keep the storage up to date with its state, without connecting to Telegram.")
+	dryRun              = flag.Bool("dry-run", false, "Process updates as usual, but only log messages, deletions and bans instead of carrying them out.")
+	daemonMode          = flag.Bool("daemon", false, "Run as systemd service: notify systemd of readiness, ping its watchdog and write -pid-file and -status-file.")
+	pidFilename         = flag.String("pid-file", "", "In -daemon mode, write the PID to this file. Disabled if empty.")
+	statusFilename      = flag.String("status-file", "", "In -daemon mode, write the health of the bot to this file as JSON. Disabled if empty.")
+	updateWorkers       = flag.Int("update-workers", 8, "Number of updates of different chats processed in parallel.")
 )
 
 var buildCommit = func() string {
@@ -47,160 +66,518 @@ var buildCommit = func() string {
 	return ""
 }()
 
-const groupTitleBitBoxEn = "BitBox"
-const groupTitleBitBoxDE = "BitBox DE"
-const warnMessageDefaultEn = "Do not respond to any direct messages or calls."
-const warnMessageDefaultDe = "Antworte nicht auf private Nachrichten oder Anrufe. Betrüger am Werk."
-const warnAfterDefault = 14 * 24 * time.Hour
-
-type jsonDuration struct {
-	time.Duration
-}
-
-func (d *jsonDuration) UnmarshalJSON(b []byte) error {
-	var s string
-	if err := json.Unmarshal(b, &s); err != nil {
-		return err
-	}
-	var err error
-	d.Duration, err = time.ParseDuration(s)
-	return err
-}
-
-type Config struct {
-	BotToken      string
-	WarnMessageEn string
-	WarnMessageDe string
-	// If a user posts a message for the first time after this amount of time, we send a message
-	// replying to them that warns them of scammers.
-	WarnAfter jsonDuration
-}
-
 type UserID int
 type ChatID int64
 
 type UserData struct {
+	// Zero for users first seen before this was recorded.
+	FirstSeenAt   time.Time `json:",omitempty"`
 	LastMessageAt time.Time
+	Strikes       []Strike `json:",omitempty"`
+	// Daily scores of the messages of the user, from the first suspicious one on.
+	Risk []*RiskSample `json:",omitempty"`
+	// The most recent messages of the user, to detect floods.
+	RecentMessages []*RecentMessage `json:",omitempty"`
+	// How often the user was warned in the chat, and when the most recent warnings were sent.
+	Warnings int         `json:",omitempty"`
+	WarnedAt []time.Time `json:",omitempty"`
+	// When the guidance was sent to the user in a private message, see GuidanceDM.
+	GuidanceDMAt time.Time `json:",omitempty"`
+	// The variant of the warning assigned to the user, see WarnVariants.
+	WarnVariant string `json:",omitempty"`
 }
 
 type ChatData struct {
 	Title    string
 	UserData map[UserID]*UserData
+	// IDs of the most recent messages, used to link the context of a message in admin reports.
+	RecentMessageIDs []int `json:",omitempty"`
+	// When each admin was last active in the chat.
+	AdminActivity map[UserID]time.Time `json:",omitempty"`
+	// When the last message was posted in the chat. Chats without messages for a long time are
+	// marked dormant.
+	LastMessageAt time.Time `json:",omitempty"`
+	Dormant       bool      `json:",omitempty"`
+	// When the bot first saw the chat. Zero for chats first seen before this was recorded.
+	FirstSeenAt time.Time `json:",omitempty"`
+	// Number of members when last checked, to detect joins missed during a downtime.
+	MemberCount int `json:",omitempty"`
+	// Statistics of the detectors running in shadow mode, by detector.
+	ShadowStats map[string]*ShadowStats `json:",omitempty"`
+	// Daily scores of the scanned messages of the chat.
+	Risk []*RiskSample `json:",omitempty"`
+	// When the last warning was sent to the chat, see WarningCooldown.
+	LastWarningAt time.Time `json:",omitempty"`
+	// The most recent scheduled reminder, see Reminder.
+	Reminder *PostedReminder `json:",omitempty"`
+	// Statistics of the warning variants, by name, see WarnVariants.
+	VariantStats map[string]*VariantStats `json:",omitempty"`
+	// The anti-scam notice pinned by the bot, see PinnedNotice.
+	PinnedNotice *PostedNotice `json:",omitempty"`
+	// Warnings held back during the quiet hours, and the number of those beyond
+	// quietWarningsLimit, see QuietHours.
+	HeldWarnings        []*HeldWarning `json:",omitempty"`
+	HeldWarningsDropped int            `json:",omitempty"`
 }
 
 type Data struct {
-	ChatData map[ChatID]*ChatData
-	changed  bool
-	lock     sync.Mutex
+	ChatData   map[ChatID]*ChatData
+	Users      map[UserID]*UserInfo
+	UserStates map[UserID][]*UserState
+	// Usernames reported as scammers, lowercased.
+	ReportedNames map[string]*ReportedName
+	// Phone numbers mentioned in scam messages, normalized by normalizePhone.
+	ReportedPhones map[string]*ReportedName `json:",omitempty"`
+	// Users banned from all chats as soon as they appear.
+	Blocklist map[UserID]*BlockEntry
+	// The runtime-mutable settings, initialized from the config file on the first start.
+	Settings *Settings `json:",omitempty"`
+	// Bot-level roles assigned via /role.
+	Roles map[UserID]Role `json:",omitempty"`
+	// Records of the most recent automated actions, explaining why they were taken.
+	Actions      []*ActionRecord `json:",omitempty"`
+	NextActionID int             `json:",omitempty"`
+	// Changes made by moderators and API clients, by area (e.g. "settings").
+	AuditLog map[string][]*AuditEntry `json:",omitempty"`
+	// Messages of the bot to be deleted, e.g. warnings after WarningDeleteAfter.
+	PendingDeletions []*PendingDeletion `json:",omitempty"`
+	// New members who did not verify yet.
+	PendingVerifications []*PendingVerification `json:",omitempty"`
+	// Unknown chats the admins were asked to approve.
+	PendingChats map[ChatID]*PendingChat `json:",omitempty"`
+	// Open votes of the moderators on borderline cases, by vote ID.
+	Votes      map[string]*Vote `json:",omitempty"`
+	NextVoteID int              `json:",omitempty"`
+	// First messages of users held for approval, by ID.
+	Quarantine       map[string]*QuarantinedMessage `json:",omitempty"`
+	NextQuarantineID int                            `json:",omitempty"`
+	// Users who received flagged replies, and whether they are protected.
+	TargetedUsers map[UserID]*TargetProfile `json:",omitempty"`
+	// Users who wrote to the bot in private.
+	DMContacts map[UserID]*DMContact `json:",omitempty"`
+	// Messages labeled by decided votes, and the decisions counted per detector.
+	LabeledCases     []*LabeledCase               `json:",omitempty"`
+	DetectorFeedback map[string]*DetectorFeedback `json:",omitempty"`
+	// Persistent tier of the cache of external lookups, by lookup key.
+	Lookups map[string]*CachedLookup `json:",omitempty"`
+	// When the bot was last known to be running, to detect downtimes.
+	LastAliveAt time.Time `json:",omitempty"`
+	// Start of the last week summarized in the weekly digest.
+	LastDigest time.Time `json:",omitempty"`
+	// Opaque markers of the users who opted out of tracking, with when they did, the key the
+	// markers are derived with, and the log of all decisions.
+	OptOuts    map[string]time.Time `json:",omitempty"`
+	OptOutKey  string               `json:",omitempty"`
+	ConsentLog []*ConsentRecord     `json:",omitempty"`
+	// The last release the owners were notified about.
+	NotifiedRelease string `json:",omitempty"`
+	// Set if the state changed in a way only saving the whole state stores, see markChanged.
+	changed bool
+	// The rows which changed since the last save, see writebehind.go.
+	delta *stateDelta
+	// The rows which changed and whether the state changed otherwise since the changes were last
+	// streamed to the standbys, see replication.go. replicaDelta is nil while no standby is
+	// connected.
+	replicaDelta   *stateDelta
+	replicaChanged bool
+	// When the warnings being sent were decided, see warnburst.go.
+	warningsInFlight map[chatUser]time.Time
+	lock             sync.Mutex
+	// Held while saving, so that the changes are written in order.
+	saveLock sync.Mutex
+	storage  Storage
 }
 
+// initialize creates the maps missing in data loaded from an older cache file.
+func (d *Data) initialize() {
+	if d.ChatData == nil {
+		d.ChatData = map[ChatID]*ChatData{}
+	}
+	if d.Users == nil {
+		d.Users = map[UserID]*UserInfo{}
+	}
+	if d.UserStates == nil {
+		d.UserStates = map[UserID][]*UserState{}
+	}
+	if d.ReportedNames == nil {
+		d.ReportedNames = map[string]*ReportedName{}
+	}
+	if d.ReportedPhones == nil {
+		d.ReportedPhones = map[string]*ReportedName{}
+	}
+	if d.Blocklist == nil {
+		d.Blocklist = map[UserID]*BlockEntry{}
+	}
+	if d.Roles == nil {
+		d.Roles = map[UserID]Role{}
+	}
+	if d.AuditLog == nil {
+		d.AuditLog = map[string][]*AuditEntry{}
+	}
+}
+
+// user returns the data of the given user, creating it if it does not exist yet. Must be called
+// with the data lock held.
+func (c *ChatData) user(userID UserID) *UserData {
+	if _, ok := c.UserData[userID]; !ok {
+		c.UserData[userID] = &UserData{FirstSeenAt: time.Now()}
+	}
+	return c.UserData[userID]
+}
+
+// chat returns the data of the given chat, creating it if it does not exist yet. Must be called
+// with d.lock held.
+func (d *Data) chat(chatID ChatID) *ChatData {
+	if _, ok := d.ChatData[chatID]; !ok {
+		d.ChatData[chatID] = &ChatData{
+			UserData:    map[UserID]*UserData{},
+			FirstSeenAt: time.Now(),
+		}
+	}
+	return d.ChatData[chatID]
+}
+
+// save stores the state if it changed. If the storage is unavailable, the state stays marked as
+// changed so it is saved on the next attempt.
 func (d *Data) save() {
+	d.saveErr()
+}
+
+// saveErr is save returning the error, for the commands which must fail if the state could not be
+// stored.
+func (d *Data) saveErr() error {
+	if _, unloaded := storageDegraded(); unloaded {
+		if err := d.recoverStoredState(); err != nil {
+			markDegraded("could not load the stored state: "+err.Error(), true)
+			return err
+		}
+	}
+
+	d.saveLock.Lock()
+	defer d.saveLock.Unlock()
+	var saved bool
+	var err error
+	if writer, ok := d.storage.(rowWriter); ok {
+		saved, err = d.saveRows(writer)
+	} else {
+		saved, err = d.saveComplete()
+	}
+	if err != nil {
+		slog.Error("could not save data", "err", err)
+		metricCacheSaveErrors.inc()
+		markDegraded("could not save the state: "+err.Error(), false)
+		return err
+	}
+	if !saved {
+		slog.Debug("periodicSave: nothing to do")
+		return nil
+	}
+	markHealthy()
+	slog.Debug("cache saved")
+	return nil
+}
+
+// saveComplete saves the whole state if it changed, for storages which do not write rows. Returns
+// false if there was nothing to save.
+func (d *Data) saveComplete() (bool, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if !d.changed && d.delta == nil {
+		return false, nil
+	}
+	if err := d.storage.Save(d); err != nil {
+		return false, err
+	}
+	d.changed = false
+	d.delta = nil
+	return true, nil
+}
 
-	if !d.changed {
-		log.Println("periodicSave: nothing to do")
-		return
+// storageSpec returns the storage given by -storage, defaulting to the JSON file given by -cache.
+func storageSpec() string {
+	if *storageFlag != "" {
+		return *storageFlag
 	}
+	return "json:" + *cacheFilename
+}
 
-	jsonBytes, err := json.Marshal(d)
-	d.changed = false
+// loadData loads the persistent cache. A missing or unreadable cache results in empty data.
+func loadData() *Data {
+	storage, err := openStorage(storageSpec())
 	if err != nil {
-		log.Println("could not serialize data")
-		return
+		fatal("could not open storage", "err", err)
 	}
-	if err := ioutil.WriteFile(*cacheFilename, jsonBytes, 0600); err != nil {
-		log.Println("could not save data")
-		return
+	data, err := storage.Load()
+	if err != nil {
+		slog.Error("could not load cache; starting with an empty state", "err", err)
+		data = &Data{}
+		data.initialize()
+		markDegraded("could not load the stored state: "+err.Error(), true)
+	} else {
+		slog.Info("cache loaded", "storage", storageSpec())
 	}
-	log.Println("cache saved")
+	data.storage = storage
+	return data
 }
 
-func (d *Data) periodicSave() {
+// How often the state is saved, unless the storage backend asks for a different interval.
+const saveIntervalDefault = 10 * time.Minute
+
+func (d *Data) periodicSave(ctx context.Context) {
+	interval := saveIntervalDefault
+	if storage, ok := d.storage.(interface{ saveInterval() time.Duration }); ok {
+		interval = storage.saveInterval()
+	}
 	for {
-		time.Sleep(10 * time.Minute)
+		wait := interval
+		if degraded, _ := storageDegraded(); degraded && interval > degradedRetryInterval {
+			wait = degradedRetryInterval
+		}
+		if !sleepContext(ctx, wait) {
+			return
+		}
 		d.save()
 	}
 }
 
 func process(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
-	if msg == nil || msg.Chat == nil {
+	if msg == nil || msg.Chat == nil || msg.From == nil {
+		return
+	}
+	if handleChatMigration(config, data, bot, msg) {
 		return
 	}
 
-	switch msg.Chat.Title {
-	case "Warntest", groupTitleBitBoxEn, groupTitleBitBoxDE:
-	default:
-		_, err := bot.LeaveChat(tgbotapi.ChatConfig{ChatID: msg.Chat.ID})
-		if err != nil {
-			log.Printf("error leaving chat: %v", err)
-			return
+	if config.AdminChatID != 0 && msg.Chat.ID == config.AdminChatID {
+		recordAdminActivity(config, data, bot, msg)
+		handleCommand(config, data, bot, msg)
+		return
+	}
+
+	if msg.Chat.IsPrivate() {
+		handlePrivateMessage(config, data, bot, msg)
+		return
+	}
+
+	group := config.allowedGroup(msg.Chat)
+	if group == nil {
+		leaveUnknownChat(config, data, bot, msg.Chat)
+		return
+	}
+	if group.ChatID == 0 {
+		bindGroup(data, msg.Chat)
+	}
+
+	data.lock.Lock()
+	if data.chat(ChatID(msg.Chat.ID)).recordChatActivity(time.Now()) {
+		chatLogger(ChatID(msg.Chat.ID), 0).Info("chat is active again", "chat_title", msg.Chat.Title)
+	}
+	data.chat(ChatID(msg.Chat.ID)).recordMessage(msg.MessageID, config.ReportContextMessages)
+	if msg.NewChatMembers != nil {
+		for i := range *msg.NewChatMembers {
+			resetRejoinedMember(data, ChatID(msg.Chat.ID), &(*msg.NewChatMembers)[i])
+		}
+	}
+	data.chat(ChatID(msg.Chat.ID)).user(UserID(msg.From.ID))
+	previousProfile, renamed := data.updateUser(msg.From)
+	data.chatChanged(ChatID(msg.Chat.ID))
+	data.userChanged(ChatID(msg.Chat.ID), UserID(msg.From.ID))
+	optedOut := data.optedOut(UserID(msg.From.ID))
+	data.lock.Unlock()
+	if optedOut {
+		defer data.forgetTrackedUser(UserID(msg.From.ID))
+	}
+
+	recordAdminActivity(config, data, bot, msg)
+	if config.botOff(ChatID(msg.Chat.ID)) {
+		if !handleCommand(config, data, bot, msg) {
+			// Users posting while the bot is off are not warned once it is on again.
+			data.lock.Lock()
+			data.chat(ChatID(msg.Chat.ID)).user(UserID(msg.From.ID)).LastMessageAt = time.Now()
+			data.lock.Unlock()
 		}
-		log.Printf("left group %v (%v)", msg.Chat.ID, msg.Chat.Title)
+		return
+	}
+	watchReportedName(config, data, bot, msg.From)
+	if renamed {
+		checkNameChange(config, data, bot, msg, previousProfile)
+	}
+	if enforceBlocklist(config, data, bot, msg) {
+		return
+	}
+	restrictNewMembers(config, data, bot, msg)
+	challengeNewMembers(config, data, bot, msg)
+	verifyNewMembers(config, data, bot, msg)
+	probateNewMembers(config, data, bot, msg)
+	welcomeNewMembers(config, data, bot, msg)
+	if msg.LeftChatMember != nil {
+		forgetLeftMember(data, ChatID(msg.Chat.ID), msg.LeftChatMember)
+	}
+	shareRemoval(config, data, bot, msg)
+
+	if handleCommand(config, data, bot, msg) {
 		return
 	}
 
 	// Bots do not need warnings.
 	if msg.From.IsBot {
-		log.Println("ignoring msg from bot")
+		messageLogger(msg).Debug("ignoring message from bot")
+		return
+	}
+
+	chatID := ChatID(msg.Chat.ID)
+	userID := UserID(msg.From.ID)
+	logger := chatLogger(chatID, userID)
+
+	if data.hasState(userID, stateTrusted, chatID) {
+		logger.Debug("not warning user: trusted")
+		return
+	}
+	if checkFlood(config, data, bot, msg) {
+		return
+	}
+	if checkDuplicate(config, data, bot, msg) {
+		return
+	}
+	if quarantineFirstMessage(config, data, bot, msg) {
+		return
+	}
+	if enforceLockdown(config, data, bot, msg) {
+		return
+	}
+	if data.hasState(userID, stateWatched, chatID) {
+		forwardToAdmins(config, bot, msg)
+	}
+	if guardProtectedQuestion(config, data, bot, msg) {
 		return
 	}
+	if guardTargetedUser(config, data, bot, msg) {
+		return
+	}
+	findings := detectAll(config, data, bot, msg)
+	handleFindings(config, data, bot, msg, findings)
+	handleProfileRisk(config, data, bot, msg)
+	forwardBotMention(config, data, bot, msg)
+	answerFAQ(config, bot, msg)
 
 	// Filter messages we do not want to respond to.
 	if msg.NewChatMembers != nil || msg.LeftChatMember != nil || msg.Location != nil || msg.Contact != nil {
-		log.Println("ignoring msg: NewChatMembers,LeftChatMember,Location,Contact")
+		logger.Debug("not warning user: message without text")
 		return
 	}
 
-	// Do not warn users who wrote a response to a message, to reduce the noise. For now we
-	// assume the primary target of attackers are users who ask a question, which are usually
-	// top-level messages.
-	if msg.ReplyToMessage != nil {
+	warnPolicy := config.warnPolicy(chatID)
+	if !warnPolicy.considers(msg) {
+		logger.Debug("not warning user: message not considered by the warning policy")
+		return
+	}
+	threadID := messageThread(msg)
+	if topic := config.topic(chatID, threadID); topic != nil && topic.NoWarnings {
+		logger.Debug("not warning user: no warnings in the topic", "thread_id", threadID)
 		return
 	}
 
-	chatID := ChatID(msg.Chat.ID)
-	userID := UserID(msg.From.ID)
-
-	log.Printf("update: ChatID=%v, ChatTitle=%v, UserID=%d\n",
-		chatID, msg.Chat.Title, userID)
+	exempt := exemptFromWarnings(config, data, bot, chatID, userID)
+	// Fetched before locking the data, as it may take a request to Telegram.
+	pinnedButton := config.pinnedMessageButton(bot, msg.Chat, config.warningLanguage(chatID, msg.From.LanguageCode))
 
 	data.lock.Lock()
 	defer data.lock.Unlock()
 
-	if _, ok := data.ChatData[chatID]; !ok {
-		data.ChatData[chatID] = &ChatData{
-			UserData: map[UserID]*UserData{},
-		}
-	}
-
-	data.ChatData[chatID].Title = msg.Chat.Title
-
-	if _, ok := data.ChatData[chatID].UserData[userID]; !ok {
-		data.ChatData[chatID].UserData[userID] = &UserData{}
+	chatData := data.chat(chatID)
+	chatData.Title = msg.Chat.Title
+	userData := chatData.user(userID)
+	knownUserWarning := data.knownUserWarning(config, userID, chatID)
+	decision := warnSkipExempt
+	if !exempt {
+		decision = decideWarning(config, data, msg, time.Now())
 	}
-	userData := data.ChatData[chatID].UserData[userID]
-	if time.Since(userData.LastMessageAt) > config.WarnAfter.Duration {
-		// If the user hasn't posted in this group in over a month, send a warning message
-		warnMessage := config.WarnMessageEn
-		if msg.Chat.Title == groupTitleBitBoxDE {
-			warnMessage = config.WarnMessageDe
+	switch decision {
+	case warnNotDue:
+		logger.Debug("not warning user: not due", "last_message_at", userData.LastMessageAt)
+	case warnSkipExempt:
+		logger.Debug("not warning user: exempt")
+	case warnSkipCooldown:
+		logger.Info("not warning user: "+string(decision), "last_warning_at", chatData.LastWarningAt)
+		metricThrottled.inc()
+	case warnSkipBurst:
+		logger.Debug("not warning user: " + string(decision))
+	case warnSkipKnownUser, warnSkipRepeat, warnSkipLearning:
+		logger.Info("not warning user: " + string(decision))
+	case warnDue:
+		// Recorded right away, as the warning is sent asynchronously.
+		chatData.LastWarningAt = time.Now()
+		data.startWarning(chatID, userID, time.Now())
+		rewarn := config.rewarn(userData)
+		guidance := config.GuidanceDM && data.firstWarningEver(userID)
+		if warnings := config.recordUserWarning(userData, time.Now()); warnings > 0 {
+			logger.Info("user warned repeatedly", "warnings", warnings)
+			notifyAdmins(config, bot, repeatWarningReport(config, data, chatID, userID, warnings))
 		}
-		reply := tgbotapi.NewMessage(int64(chatID), warnMessage)
-		reply.ReplyToMessageID = msg.MessageID
-		_, err := bot.Send(reply)
-		if err != nil {
-			log.Printf("error warning user: %v", err)
+		if quiet := config.quietHours(chatID, time.Now()); quiet != nil {
+			logger.Info("not posting warning: quiet hours", "digest", quiet.Digest)
+			data.holdWarning(quiet, msg, time.Now())
+			break
+		}
+		// By default, warn users who haven't posted in this group for WarnAfter (a month).
+		lang := config.warningLanguage(chatID, msg.From.LanguageCode)
+		warnMessage := config.warnMessage(chatID, threadID, lang)
+		variant := config.warnVariant(chatID, threadID, lang, userData)
+		if variant != nil {
+			warnMessage = variant.Message
+		}
+		shortMessage := config.message(lang, "warning.short")
+		if knownUserWarning == knownUserWarningShort || rewarn == knownUserWarningShort {
+			warnMessage = shortMessage
+			variant = nil
+		}
+		if userData.LastMessageAt.IsZero() && isQuestion(messageText(msg)) {
+			note := "\n\n" + config.firstQuestionNote(lang)
+			warnMessage += note
+			shortMessage += note
+			protectQuestion(config, msg)
+		}
+		warn := func(warnMessage string, variant *WarnVariant) {
+			reply := tgbotapi.NewMessage(int64(chatID), config.renderWarning(warnMessage, msg.Chat, msg.From))
+			reply.ReplyToMessageID = msg.MessageID
+			reply.ReplyMarkup = config.warningKeyboard(chatID, lang, userID)
+			config.formatWarning(&reply, pinnedButton)
+			sendWarning(config, data, bot, msg, threadID, reply, func(sent tgbotapi.Message, err error) {
+				data.finishWarning(chatID, userID)
+				logAction(logger, "warn", err)
+				if err != nil {
+					metricTelegramErrors.inc("sendMessage")
+				} else {
+					metricWarnings.inc()
+					observeLatency("warn", chatID, msg.MessageID)
+					data.recordWarning(chatID, time.Now())
+					if variant != nil {
+						data.recordVariantWarning(chatID, variant.Name)
+					}
+					if config.WarningDeleteAfter.Duration > 0 {
+						data.scheduleDeletion(chatID, sent.MessageID, config.WarningDeleteAfter.Duration)
+					}
+				}
+			})
+		}
+		if guidance {
+			// The warning in the chat is only short if the user got the details.
+			sendGuidanceDM(config, data, bot, msg, lang, func(sent bool) {
+				if sent {
+					warn(shortMessage, nil)
+				} else {
+					warn(warnMessage, variant)
+				}
+			})
 		} else {
-			log.Println("warned user")
+			warn(warnMessage, variant)
 		}
-	} else {
-		log.Println("didn't warn user; already warned before")
 	}
 
 	// Update the last post time for the user in this group
 	userData.LastMessageAt = time.Now()
-	data.changed = true
+	data.chatChanged(chatID)
+	data.userChanged(chatID, userID)
 }
 
 func main() {
@@ -208,77 +585,171 @@ func main() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Build commit: %v\n", buildCommit)
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
 		flag.PrintDefaults()
+		printSubcommandUsage()
 	}
 	flag.Parse()
+	if err := setupLogging(); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(2)
+	}
 
-	configBytes, err := ioutil.ReadFile(*configFilename)
-	if err != nil {
-		log.Fatal(err)
+	if flag.NArg() > 0 {
+		if err := runSubcommand(flag.Args()); err != nil {
+			fatal("subcommand failed", "err", err)
+		}
+		return
 	}
-	var config Config
-	if err := json.Unmarshal(configBytes, &config); err != nil {
-		log.Fatal(err)
+
+	config, err := loadConfig(*configFilename)
+	if err != nil {
+		fatal("could not load config", "err", err)
 	}
-	if config.WarnMessageEn == "" {
-		config.WarnMessageEn = warnMessageDefaultEn
+	configureMetrics(config.Metrics)
+	if err := configureErrorReporting(config.ErrorReporting); err != nil {
+		fatal("could not configure error reporting", "err", err)
 	}
-	if config.WarnMessageDe == "" {
-		config.WarnMessageDe = warnMessageDefaultDe
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := activatedListener()
+	if err != nil {
+		fatal("could not use the activated socket", "err", err)
 	}
-	if config.WarnAfter.Duration == 0 {
-		config.WarnAfter.Duration = warnAfterDefault
+	daemon, err := startDaemon()
+	if err != nil {
+		fatal("could not start daemon", "err", err)
 	}
+	defer daemon.close()
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	done := make(chan bool, 1)
-	go func() {
-		<-sigs
-		done <- true
-	}()
+	if *readOnly {
+		if err := runReadReplica(ctx, config); err != nil {
+			fatal("read replica failed", "err", err)
+		}
+		return
+	}
+	if *standbyOf != "" {
+		if err := runStandby(ctx, config, *standbyOf); err != nil {
+			fatal("standby failed", "err", err)
+		}
+		return
+	}
+	// Replicas sharing the state in Redis wait for the leader lock before connecting to Telegram.
+	leader, err := acquireLeaderLock(ctx, storageSpec())
+	if err != nil {
+		fatal("could not acquire the leader lock", "err", err)
+	}
+	if ctx.Err() != nil {
+		return
+	}
 
 	bot, err := tgbotapi.NewBotAPI(config.BotToken)
 	if err != nil {
-		log.Fatal(err)
+		fatal("could not connect to Telegram", "err", err)
+	}
+	instrumentClient(bot)
+	if *dryRun {
+		enableDryRun(bot.Client)
 	}
 
 	// Set up a channel to receive updates
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-
-	updates, err := bot.GetUpdatesChan(u)
-	if err != nil {
-		log.Fatal(err)
+	var updates <-chan Update
+	var webhook *webhookReceiver
+	if *webhookURL != "" {
+		if *listenAddress == "" && listener == nil {
+			fatal("-webhook-url requires -listen or socket activation")
+		}
+		webhook, err = startWebhook(config, bot, *webhookURL)
+		if err != nil {
+			fatal("could not register webhook", "err", err)
+		}
+		updates = webhook.updates
+	} else {
+		// Long polling does not work while a webhook is registered.
+		if _, err := bot.RemoveWebhook(); err != nil {
+			fatal("could not remove webhook", "err", err)
+		}
+		poller := newUpdatePoller(bot)
+		poller.start(ctx)
+		runningPoller.Store(poller)
+		go poller.watchdog(ctx)
+		updates = poller.updates
 	}
 
 	// Keep track of the last time the user posted in each group
-	data := &Data{}
-
-	jsonBytes, err := ioutil.ReadFile(*cacheFilename)
-	if err == nil {
-		if err := json.Unmarshal(jsonBytes, data); err != nil {
-			log.Println("could not load cache.json; ignoring")
-			data = &Data{}
-		} else {
-			log.Println("cache loaded from file")
-		}
+	data := loadData()
+	if err := rememberFileSettings(&config.Settings); err != nil {
+		fatal("invalid settings", "err", err)
 	}
-
-	if data.ChatData == nil {
-		data.ChatData = map[ChatID]*ChatData{}
+	if err := activateSettings(config, data); err != nil {
+		fatal("invalid settings", "err", err)
+	}
+	if len(currentConfig().Groups) == 0 {
+		slog.Warn("no Groups configured, the bot will leave every group it is added to")
 	}
 
-	go data.periodicSave()
+	warmCaches(data, bot)
+	reconcileAfterDowntime(config, data, bot)
+
+	var workers workers
+	workers.start(func() { data.periodicSave(ctx) })
+	workers.start(func() { recordActionAudits(ctx, data) })
+	workers.start(func() { periodicRecordAlive(ctx, data) })
+	workers.start(func() { periodicExpireStates(ctx, data, bot) })
+	workers.start(func() { periodicBanReview(ctx, data, bot) })
+	workers.start(func() { periodicCheckDormantChats(ctx, data, bot) })
+	workers.start(func() { periodicEvictUsers(ctx, data) })
+	workers.start(func() { periodicWeeklyDigest(ctx, data, bot) })
+	workers.start(func() { periodicPostReminders(ctx, data, bot) })
+	workers.start(func() { periodicRefreshPinnedNotices(ctx, data, bot) })
+	workers.start(func() { periodicSendHeldWarnings(ctx, data, bot) })
+	workers.start(func() { periodicExpireLookups(ctx, data) })
+	workers.start(func() { periodicDeleteMessages(ctx, data, bot) })
+	workers.start(func() { periodicCloseVotes(ctx, data, bot) })
+	workers.start(func() { periodicKickTimedOutMembers(ctx, data, bot) })
+	workers.start(func() { periodicRefreshThreatFeed(ctx) })
+	workers.start(func() { periodicReplicate(ctx, data) })
+	workers.start(func() { dumpStateOnSignal(ctx, data) })
+	workers.start(func() { watchConfig(ctx, data, bot) })
+	if *listenAddress != "" || listener != nil {
+		workers.start(func() { serveHTTP(ctx, data, bot, webhook, listener) })
+	}
+	workers.start(func() { daemon.ready(ctx) })
+	if !config.UpdateCheck.Disabled && len(config.Owners) > 0 {
+		workers.start(func() { periodicCheckForUpdate(ctx, data, bot) })
+	}
 
-	log.Printf("running; warnAfter=%v\n", config.WarnAfter)
-	for {
+	pool := newUpdatePool(*updateWorkers)
+	slog.Info("running", "warn_after", config.WarnAfter.Duration)
+	for running := true; running; {
 		select {
 		case update := <-updates:
-			process(&config, data, bot, update.Message)
-		case <-done:
-			fmt.Println("exiting")
-			data.save()
-			return
+			metricUpdates.inc()
+			metricLastUpdate.set(float64(time.Now().Unix()))
+			lastUpdateAt.Store(time.Now().UnixNano())
+			latencies.receive(update.Message)
+			latencies.receive(update.EditedMessage)
+			pool.submit(updateChat(update), func() { routeUpdate(currentConfig(), data, bot, update) })
+		case <-ctx.Done():
+			running = false
 		}
 	}
+
+	slog.Info("shutting down")
+	daemon.stopping()
+	if !pool.wait(shutdownTimeout) {
+		slog.Warn("timed out processing the received updates")
+	}
+	if !workers.wait(shutdownTimeout) {
+		slog.Warn("timed out waiting for the workers")
+	}
+	if !flushSendQueues(shutdownTimeout) {
+		slog.Warn("timed out sending the queued messages")
+	}
+	data.save()
+	if err := data.storage.Close(); err != nil {
+		slog.Error("could not close storage", "err", err)
+	}
+	leader.release()
+	slog.Info("exiting")
 }
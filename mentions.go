@@ -0,0 +1,81 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const mentionForwardIntervalDefault = 10 * time.Minute
+
+// mentionLimiter limits how often messages addressed to the bot are forwarded to the admins per
+// user, so a single user cannot flood the admin chat.
+var mentionLimiter = struct {
+	lastForwardAt map[UserID]time.Time
+	lock          sync.Mutex
+}{lastForwardAt: map[UserID]time.Time{}}
+
+// addressesBot returns true if the message mentions the bot or replies to one of its messages.
+func addressesBot(bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	if msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil && msg.ReplyToMessage.From.ID == bot.Self.ID {
+		return true
+	}
+	if msg.Entities == nil {
+		return false
+	}
+	for _, entity := range *msg.Entities {
+		switch entity.Type {
+		case "mention":
+			if strings.EqualFold(entityText(msg.Text, entity), "@"+bot.Self.UserName) {
+				return true
+			}
+		case "text_mention":
+			if entity.User != nil && entity.User.ID == bot.Self.ID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardBotMention reports messages addressed to the bot to the admins, so genuine questions
+// about the warnings get a human answer.
+func forwardBotMention(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	if !addressesBot(bot, msg) {
+		return
+	}
+	userID := UserID(msg.From.ID)
+	now := time.Now()
+	mentionLimiter.lock.Lock()
+	if now.Sub(mentionLimiter.lastForwardAt[userID]) < config.MentionForwardInterval.Duration {
+		mentionLimiter.lock.Unlock()
+		messageLogger(msg).Info("not forwarding bot mention: rate limited")
+		return
+	}
+	for id, at := range mentionLimiter.lastForwardAt {
+		if now.Sub(at) >= config.MentionForwardInterval.Duration {
+			delete(mentionLimiter.lastForwardAt, id)
+		}
+	}
+	mentionLimiter.lastForwardAt[userID] = now
+	mentionLimiter.lock.Unlock()
+
+	reportToAdmins(config, data, bot, msg, fmt.Sprintf("A user addressed the bot:\n%s", messageText(msg)))
+}
@@ -0,0 +1,152 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers do not always impersonate the admins with their own account: they post "DM
+// @BitBox_Supp0rt for help" and wait for the victims to write to the fake account. The mention
+// detector checks the @-mentions and text mentions in messages against the protected handles,
+// i.e. the configured official accounts, the admins listed on the verification page and the
+// admins of the chat, with the same lookalike matching as the impersonation detector. Mentions
+// of the genuine accounts are fine.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// mentionPattern matches @-mentions, also in captions, which have no entities in the Bot API
+// version used.
+var mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_.])@([A-Za-z0-9_]{4,32})\b`)
+
+// MentionDetector scores messages mentioning accounts which mimic official accounts.
+type MentionDetector struct {
+	// Usernames of the official accounts, without @. The admins of the chat and the admins on the
+	// verification page are protected as well.
+	Handles []string `json:",omitempty"`
+	// Score of a message mentioning a lookalike account. Defaults to DeleteScore, or FlagScore if
+	// deletion is disabled.
+	Score float64 `json:",omitempty"`
+}
+
+func (m *MentionDetector) setDefaults(flagScore, deleteScore float64) {
+	if m.Score == 0 {
+		m.Score = deleteScore
+	}
+	if m.Score == 0 {
+		m.Score = flagScore
+	}
+}
+
+// protectedHandles returns the lowercased usernames of the official accounts of a chat.
+func protectedHandles(config *Config, bot *tgbotapi.BotAPI, chatID ChatID) map[string]bool {
+	handles := map[string]bool{}
+	for _, handle := range config.Mentions.Handles {
+		handles[strings.ToLower(strings.TrimPrefix(handle, "@"))] = true
+	}
+	if config.VerificationPage != nil {
+		for _, community := range config.VerificationPage.Communities {
+			for _, admin := range community.Admins {
+				handles[strings.ToLower(admin)] = true
+			}
+		}
+	}
+	admins, err := chatAdmins.users(bot, chatID)
+	if err != nil {
+		chatLogger(chatID, 0).Error("could not fetch chat admins", "err", err)
+	}
+	for _, admin := range admins {
+		if admin.UserName != "" && !admin.IsBot {
+			handles[strings.ToLower(admin.UserName)] = true
+		}
+	}
+	return handles
+}
+
+// mentionedNames returns the accounts mentioned in a message: the usernames of @-mentions and
+// the users of text mentions.
+func mentionedNames(msg *tgbotapi.Message) (usernames []string, users []*tgbotapi.User) {
+	for _, match := range mentionPattern.FindAllStringSubmatch(messageText(msg), -1) {
+		usernames = append(usernames, match[1])
+	}
+	if msg.Entities != nil {
+		for _, entity := range *msg.Entities {
+			if entity.Type == "text_mention" && entity.User != nil {
+				users = append(users, entity.User)
+			}
+		}
+	}
+	return usernames, users
+}
+
+// lookalikeHandle returns the protected handle a mentioned username mimics, or "" if it mimics
+// none or is the protected account itself.
+func lookalikeHandle(username string, handles map[string]bool) string {
+	if handles[strings.ToLower(username)] {
+		return ""
+	}
+	name := normalizeName(username)
+	if len([]rune(name)) < impersonationMinNameLength {
+		return ""
+	}
+	for handle := range handles {
+		protected := normalizeName(handle)
+		if len([]rune(protected)) >= impersonationMinNameLength && mimics(name, protected) {
+			return handle
+		}
+	}
+	return ""
+}
+
+// detectMentions finds messages mentioning accounts which mimic official accounts.
+func detectMentions(config *Config, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) []Finding {
+	detector := config.Mentions
+	if detector == nil {
+		return nil
+	}
+	usernames, users := mentionedNames(msg)
+	if len(usernames) == 0 && len(users) == 0 {
+		return nil
+	}
+	chatID := ChatID(msg.Chat.ID)
+	handles := protectedHandles(config, bot, chatID)
+	finding := func(mentioned, handle string) []Finding {
+		return []Finding{{
+			Detector: "mention",
+			Score:    detector.Score,
+			Reason:   fmt.Sprintf("mentions %s, which mimics @%s", mentioned, handle),
+			Category: "impersonation",
+			Shadow:   config.isShadow(chatID, "mention"),
+		}}
+	}
+	for _, username := range usernames {
+		if handle := lookalikeHandle(username, handles); handle != "" {
+			return finding("@"+username, handle)
+		}
+	}
+	for _, user := range users {
+		if user.UserName != "" && handles[strings.ToLower(user.UserName)] {
+			continue
+		}
+		for _, name := range []string{user.UserName, strings.TrimSpace(user.FirstName + " " + user.LastName)} {
+			if handle := lookalikeHandle(name, handles); name != "" && handle != "" {
+				return finding(user.String(), handle)
+			}
+		}
+	}
+	return nil
+}
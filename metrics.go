@@ -0,0 +1,271 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// A minimal metrics registry rendering the Prometheus text exposition format, so we do not need
+// to pull in the Prometheus client library for a handful of counters.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default of MetricsConfig.MaxSeries.
+const metricsMaxSeriesDefault = 1000
+
+// Label value of the series into which the label values beyond MetricsConfig.MaxSeries are
+// aggregated, and of the labels aggregated with MetricsConfig.AggregateLabels.
+const (
+	labelValueOther = "other"
+	labelValueAll   = "all"
+)
+
+// MetricsConfig limits the number of series per metric, so that labels with many values, e.g.
+// per detector, do not overload the metrics backend of large deployments.
+type MetricsConfig struct {
+	// Maximum number of series per metric. Series with further label values are aggregated into
+	// one with all labels "other". Defaults to 1000; negative for no limit.
+	MaxSeries int `json:",omitempty"`
+	// Labels which are aggregated across all their values, e.g. ["detector"]. Their value is
+	// always "all".
+	AggregateLabels []string `json:",omitempty"`
+}
+
+var metricsLimits atomic.Pointer[MetricsConfig]
+
+// configureMetrics applies the limits of the metrics. Series which exist already are kept.
+func configureMetrics(config *MetricsConfig) {
+	limits := MetricsConfig{MaxSeries: metricsMaxSeriesDefault}
+	if config != nil {
+		limits = *config
+		if limits.MaxSeries == 0 {
+			limits.MaxSeries = metricsMaxSeriesDefault
+		}
+	}
+	metricsLimits.Store(&limits)
+}
+
+var metricSeriesOverflow = newCounter("scamwarnbot_metric_series_overflow_total",
+	"Updates of series aggregated into \"other\" because a metric reached MaxSeries.", "metric")
+
+type metric struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	// Values by label values, joined with labelSeparator.
+	values map[string]float64
+	lock   sync.Mutex
+}
+
+const labelSeparator = "\xff"
+
+// metricsRegistry holds the metrics and histograms in the order they are written.
+var metricsRegistry []interface{ write(io.Writer) }
+
+func newMetric(kind, name, help string, labelNames ...string) *metric {
+	m := &metric{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		values:     map[string]float64{},
+	}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+func newCounter(name, help string, labelNames ...string) *metric {
+	return newMetric("counter", name, help, labelNames...)
+}
+
+func newGauge(name, help string, labelNames ...string) *metric {
+	return newMetric("gauge", name, help, labelNames...)
+}
+
+// seriesKey returns the key of the series with the given label values, applying the limits.
+// Must be called with m.lock held.
+func (m *metric) seriesKey(labelValues []string) string {
+	limits := metricsLimits.Load()
+	if limits == nil || len(m.labelNames) == 0 {
+		return strings.Join(labelValues, labelSeparator)
+	}
+	values := append([]string(nil), labelValues...)
+	for i, name := range m.labelNames {
+		for _, aggregated := range limits.AggregateLabels {
+			if name == aggregated && i < len(values) {
+				values[i] = labelValueAll
+			}
+		}
+	}
+	key := strings.Join(values, labelSeparator)
+	if _, ok := m.values[key]; ok || limits.MaxSeries < 0 || len(m.values) < limits.MaxSeries {
+		return key
+	}
+	if m != metricSeriesOverflow {
+		metricSeriesOverflow.inc(m.name)
+	}
+	for i := range values {
+		values[i] = labelValueOther
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+func (m *metric) add(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[m.seriesKey(labelValues)] += value
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) set(value float64, labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[m.seriesKey(labelValues)] = value
+}
+
+func (m *metric) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		labels := ""
+		if len(m.labelNames) > 0 {
+			values := strings.Split(key, labelSeparator)
+			pairs := make([]string, len(m.labelNames))
+			for i, name := range m.labelNames {
+				pairs[i] = fmt.Sprintf("%s=%q", name, values[i])
+			}
+			labels = "{" + strings.Join(pairs, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s%s %v\n", m.name, labels, m.values[key])
+	}
+}
+
+// histogram counts observations in cumulative buckets, rendered as a Prometheus histogram.
+type histogram struct {
+	name       string
+	help       string
+	labelNames []string
+	// Upper bounds of the buckets, ascending.
+	buckets []float64
+
+	// Bucket counts, sum and count by label values, joined with labelSeparator.
+	series map[string]*histogramSeries
+	lock   sync.Mutex
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labelNames ...string) *histogram {
+	h := &histogram{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     map[string]*histogramSeries{},
+	}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+func (h *histogram) observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := strings.Join(labelValues, labelSeparator)
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var pairs []string
+		if len(h.labelNames) > 0 {
+			values := strings.Split(key, labelSeparator)
+			for i, name := range h.labelNames {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+			}
+		}
+		labels := func(extra ...string) string {
+			all := append(append([]string(nil), pairs...), extra...)
+			if len(all) == 0 {
+				return ""
+			}
+			return "{" + strings.Join(all, ",") + "}"
+		}
+		series := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(fmt.Sprintf("le=%q", fmt.Sprint(bound))), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(`le="+Inf"`), series.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, labels(), series.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels(), series.count)
+	}
+}
+
+func writeMetrics(w io.Writer) {
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
+
+var (
+	metricUpdates         = newCounter("scamwarnbot_updates_total", "Updates received from Telegram.")
+	metricLastUpdate      = newGauge("scamwarnbot_last_update_timestamp_seconds", "Time the last update was received.")
+	metricWarnings        = newCounter("scamwarnbot_warnings_total", "Warnings sent to users.")
+	metricThrottled       = newCounter("scamwarnbot_throttled_warnings_total", "Warnings skipped due to the WarningCooldown of the chat.")
+	metricFlagged         = newCounter("scamwarnbot_flagged_messages_total", "Messages reported to the admins by the detectors.")
+	metricDeleted         = newCounter("scamwarnbot_deleted_messages_total", "Messages deleted by the bot.")
+	metricBans            = newCounter("scamwarnbot_bans_total", "Users banned by the bot.")
+	metricTelegramErrors  = newCounter("scamwarnbot_telegram_errors_total", "Failed Telegram API calls.", "method")
+	metricCacheSaveErrors = newCounter("scamwarnbot_cache_save_errors_total", "Failed attempts to save the cache.")
+	metricRelayedAlerts   = newCounter("scamwarnbot_relayed_alerts_total", "Alertmanager alerts relayed to the admin chat.")
+	metricShadowFindings  = newCounter("scamwarnbot_shadow_findings_total", "Findings of detectors in shadow mode.", "detector")
+)
@@ -0,0 +1,235 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// runMigrate copies the state from one storage backend to another and verifies the copy by
+// reading it back and comparing it to the source, including the number of chats, members,
+// warnings and so on. The source is validated first, so a damaged cache is not migrated.
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "Source storage, e.g. json:cache.json")
+	to := flags.String("to", "", "Destination storage")
+	force := flags.Bool("force", false, "Overwrite a destination which already contains data")
+	dryRun := flags.Bool("dry-run", false, "Only validate and convert the source, without writing the destination")
+	flags.Parse(args)
+	if *from == "" || *to == "" || flags.NArg() != 0 {
+		return errors.New("usage: migrate -from <backend:location> -to <backend:location> [-force] [-dry-run]")
+	}
+
+	source, err := openStorage(*from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if empty, err := source.Empty(); err != nil {
+		return err
+	} else if empty {
+		return fmt.Errorf("%s contains no data", *from)
+	}
+	data, err := loadMigrationSource(source)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", *from, err)
+	}
+	if err := validateState(data); err != nil {
+		return fmt.Errorf("%s is invalid: %w", *from, err)
+	}
+	// Converting the state to rows is what every backend stores.
+	if _, err := sqliteRows(data); err != nil {
+		return fmt.Errorf("converting %s: %w", *from, err)
+	}
+	if *dryRun {
+		writeMigrationCounts(os.Stderr, migrationCounts(data), nil)
+		slog.Info("validated, nothing written (-dry-run)", "from", *from)
+		return nil
+	}
+
+	destination, err := openStorage(*to)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+
+	empty, err := destination.Empty()
+	if err != nil {
+		return err
+	}
+	if !empty && !*force {
+		return fmt.Errorf("%s already contains data; use -force to overwrite it", *to)
+	}
+
+	data.lock.Lock()
+	err = replaceState(destination, data)
+	data.lock.Unlock()
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", *to, err)
+	}
+
+	copied, err := destination.Load()
+	if err != nil {
+		return fmt.Errorf("verifying %s: %w", *to, err)
+	}
+	want, got := migrationCounts(data), migrationCounts(copied)
+	mismatches := writeMigrationCounts(os.Stderr, want, got)
+	if diffSnapshots(os.Stderr, data, copied, false) != 0 || mismatches != 0 {
+		return fmt.Errorf("verification failed: %s differs from %s (see above)", *to, *from)
+	}
+	slog.Info("migrated", "chats", len(data.ChatData), "users", len(data.Users), "user_states", len(data.UserStates),
+		"blocklist", len(data.Blocklist), "from", *from, "to", *to)
+	return nil
+}
+
+// loadMigrationSource loads the state to migrate. Unlike the bot, the migration does not fall
+// back to a backup of a JSON cache which cannot be read, as that would silently lose the changes
+// since the backup.
+func loadMigrationSource(source Storage) (*Data, error) {
+	if s, ok := source.(*jsonStorage); ok {
+		return loadJSONFile(s.filename)
+	}
+	return source.Load()
+}
+
+// validateState checks the state for entries the bot cannot have written, e.g. after the cache
+// was edited by hand.
+func validateState(data *Data) error {
+	var problems []string
+	for _, chatID := range sortedKeys(data.ChatData) {
+		chatData := data.ChatData[chatID]
+		switch {
+		case chatID == 0:
+			problems = append(problems, "chat with ID 0")
+		case chatData == nil:
+			problems = append(problems, fmt.Sprintf("chat %d: empty entry", chatID))
+		}
+		if chatData == nil {
+			continue
+		}
+		for _, userID := range sortedKeys(chatData.UserData) {
+			switch {
+			case userID == 0:
+				problems = append(problems, fmt.Sprintf("chat %d: member with ID 0", chatID))
+			case chatData.UserData[userID] == nil:
+				problems = append(problems, fmt.Sprintf("chat %d: member %d: empty entry", chatID, userID))
+			}
+		}
+	}
+	for _, userID := range sortedKeys(data.Users) {
+		if data.Users[userID] == nil {
+			problems = append(problems, fmt.Sprintf("user %d: empty entry", userID))
+		}
+	}
+	for _, userID := range sortedKeys(data.UserStates) {
+		for _, state := range data.UserStates[userID] {
+			if state == nil {
+				problems = append(problems, fmt.Sprintf("user %d: empty state", userID))
+			}
+		}
+	}
+	for _, userID := range sortedKeys(data.Blocklist) {
+		if data.Blocklist[userID] == nil {
+			problems = append(problems, fmt.Sprintf("blocklist %d: empty entry", userID))
+		}
+	}
+	if data.Settings != nil {
+		settings, err := cloneSettings(data.Settings)
+		if err != nil {
+			return err
+		}
+		settings.setDefaults()
+		if err := settings.compile(); err != nil {
+			problems = append(problems, fmt.Sprintf("settings: %v", err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// migrationCount is the number of entries of a kind in the state.
+type migrationCount struct {
+	name  string
+	count int
+}
+
+// migrationCounts counts the entries of the state which must survive a migration, in particular
+// the warning state of the chat members.
+func migrationCounts(data *Data) []migrationCount {
+	var members, warnedMembers, warnings, states, audits int
+	for _, chatData := range data.ChatData {
+		for _, userData := range chatData.UserData {
+			members++
+			if userData.Warnings > 0 {
+				warnedMembers++
+			}
+			warnings += userData.Warnings
+		}
+	}
+	for _, userStates := range data.UserStates {
+		states += len(userStates)
+	}
+	for _, entries := range data.AuditLog {
+		audits += len(entries)
+	}
+	return []migrationCount{
+		{"chats", len(data.ChatData)},
+		{"chat members", members},
+		{"warned chat members", warnedMembers},
+		{"warnings", warnings},
+		{"users", len(data.Users)},
+		{"user states", states},
+		{"blocklist", len(data.Blocklist)},
+		{"reported names", len(data.ReportedNames)},
+		{"roles", len(data.Roles)},
+		{"actions", len(data.Actions)},
+		{"audit entries", audits},
+	}
+}
+
+// writeMigrationCounts writes the counts of the source and, unless got is nil, of the copy side
+// by side. Returns the number of counts which differ.
+func writeMigrationCounts(w io.Writer, want, got []migrationCount) int {
+	mismatches := 0
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if got == nil {
+		fmt.Fprintln(table, "\tsource")
+	} else {
+		fmt.Fprintln(table, "\tsource\tdestination\t")
+	}
+	for i, count := range want {
+		if got == nil {
+			fmt.Fprintf(table, "%s\t%d\n", count.name, count.count)
+			continue
+		}
+		mark := ""
+		if got[i].count != count.count {
+			mark = "MISMATCH"
+			mismatches++
+		}
+		fmt.Fprintf(table, "%s\t%d\t%d\t%s\n", count.name, count.count, got[i].count, mark)
+	}
+	table.Flush()
+	return mismatches
+}
@@ -0,0 +1,108 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Account takeovers look exactly like this: an account which has been around for a while suddenly
+// renames itself to "Support" or to the name of an admin, and starts DMing members who trust it.
+// The profiles of users are tracked anyway (see updateUser), so renames of established members to
+// admin-like or support-like names are reported to the admins.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var nameChangeKeywordsDefault = []string{"admin", "support", "moderator", "helpdesk", "official", "customer service", "customer care"}
+
+// NameChangeDetector reports established members who rename themselves to admin-like names.
+type NameChangeDetector struct {
+	// Names containing one of these words are support-like. Compared after normalizeName, so
+	// lookalike characters and spacing do not matter. Defaults to nameChangeKeywordsDefault.
+	Keywords []string `json:",omitempty"`
+	// Members first seen at least this long ago are established. Defaults to NewMemberAge.
+	MinAccountAge jsonDuration
+}
+
+func (n *NameChangeDetector) setDefaults(newMemberAge time.Duration) {
+	if len(n.Keywords) == 0 {
+		n.Keywords = nameChangeKeywordsDefault
+	}
+	if n.MinAccountAge.Duration == 0 {
+		n.MinAccountAge.Duration = newMemberAge
+	}
+}
+
+var metricSuspiciousRenames = newCounter("scamwarnbot_suspicious_renames_total",
+	"Established members who renamed themselves to an admin-like or support-like name.")
+
+// adminLike returns why the names look like those of an admin of the chat, or "".
+func (n *NameChangeDetector) adminLike(names []string, admins []tgbotapi.User, userID int) string {
+	for _, name := range names {
+		for _, keyword := range n.Keywords {
+			if normalized := normalizeName(keyword); normalized != "" && strings.Contains(name, normalized) {
+				return fmt.Sprintf("contains %q", keyword)
+			}
+		}
+		for i := range admins {
+			if admins[i].ID == userID || admins[i].IsBot {
+				continue
+			}
+			for _, adminName := range namesOf(&admins[i]) {
+				if mimics(name, adminName) {
+					return "mimics admin " + admins[i].String()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// checkNameChange reports an established member who renamed to an admin-like name. previous is
+// the profile of the user before the rename.
+func checkNameChange(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, previous Alias) {
+	detector := config.NameChanges
+	if detector == nil {
+		return
+	}
+	chatID := ChatID(msg.Chat.ID)
+	userID := UserID(msg.From.ID)
+	data.lock.Lock()
+	firstSeenAt := data.chat(chatID).user(userID).FirstSeenAt
+	data.lock.Unlock()
+	if firstSeenAt.IsZero() || time.Since(firstSeenAt) < detector.MinAccountAge.Duration {
+		return
+	}
+	admins, err := chatAdmins.users(bot, chatID)
+	if err != nil {
+		chatLogger(chatID, 0).Error("could not fetch chat admins", "err", err)
+	}
+	reason := detector.adminLike(namesOf(msg.From), admins, msg.From.ID)
+	before := &tgbotapi.User{FirstName: previous.FirstName, LastName: previous.LastName, UserName: previous.UserName}
+	// Only report names which became admin-like.
+	if reason == "" || detector.adminLike(namesOf(before), admins, msg.From.ID) != "" {
+		return
+	}
+	if userRole(config, data, bot, chatID, userID) >= roleModerator {
+		return
+	}
+	metricSuspiciousRenames.inc()
+	messageLogger(msg).Info("established member renamed to an admin-like name", "previous", before.String(), "reason", reason)
+	notifyAdmins(config, bot, fmt.Sprintf(
+		"%s, a member of %s since %s, renamed from %s to an admin-like name (%s). This may be a taken over account.",
+		msg.From.String(), msg.Chat.Title, firstSeenAt.UTC().Format("2006-01-02"), before.String(), reason))
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "time"
+
+// Values of Settings.KnownUserWarning.
+const (
+	knownUserWarningFull  = "full"
+	knownUserWarningShort = "short"
+	knownUserWarningSkip  = "skip"
+)
+
+// activeElsewhere returns true if the user posted in another chat within the given time. Must be
+// called with d.lock held.
+func (d *Data) activeElsewhere(userID UserID, chatID ChatID, within time.Duration) bool {
+	for otherID, chatData := range d.ChatData {
+		if otherID == chatID {
+			continue
+		}
+		if userData, ok := chatData.UserData[userID]; ok && time.Since(userData.LastMessageAt) <= within {
+			return true
+		}
+	}
+	return false
+}
+
+// knownUserWarning returns how a user active in another chat within the WarnAfter of the chat is
+// warned and greeted in the chat: knownUserWarningFull, knownUserWarningShort or
+// knownUserWarningSkip. Must be called with d.lock held.
+func (d *Data) knownUserWarning(config *Config, userID UserID, chatID ChatID) string {
+	if config.KnownUserWarning == "" || config.KnownUserWarning == knownUserWarningFull ||
+		!d.activeElsewhere(userID, chatID, config.warnAfter(chatID)) {
+		return knownUserWarningFull
+	}
+	return config.KnownUserWarning
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Users can opt out of the long-term tracking of their activity by sending /optout to the bot in a
+// private chat, and opt in again with /optin. The activity and profile of users who opted out are
+// forgotten after each of their messages. Only an opaque marker derived from their user ID is kept
+// to recognize them, and every decision is logged for compliance. Without a history, the bot cannot
+// tell how long they have been around: they are warned as if they were new and checked with the
+// stricter thresholds for new members, which they are told when opting out. Moderation decisions,
+// i.e. user states, strikes and action records, are kept.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// ConsentRecord is a decision of a user to opt out of or back into tracking.
+type ConsentRecord struct {
+	// The opaque marker of the user, see optOutMarker.
+	Marker string
+	OptOut bool
+	At     time.Time
+}
+
+var metricOptOuts = newCounter("scamwarnbot_opt_outs_total", "Decisions of users to opt out of tracking (true) or back in (false).", "opt_out")
+
+// optOutMarker returns the opaque marker of a user, a keyed hash of the user ID. Must be called
+// with d.lock held.
+func (d *Data) optOutMarker(userID UserID) string {
+	if d.OptOutKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+		d.OptOutKey = hex.EncodeToString(key)
+		d.markChanged()
+	}
+	mac := hmac.New(sha256.New, []byte(d.OptOutKey))
+	mac.Write([]byte(strconv.FormatInt(int64(userID), 10)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// optedOut returns true if the user opted out of tracking. Must be called with d.lock held.
+func (d *Data) optedOut(userID UserID) bool {
+	if len(d.OptOuts) == 0 {
+		return false
+	}
+	_, ok := d.OptOuts[d.optOutMarker(userID)]
+	return ok
+}
+
+// setOptOut records the decision of a user to opt out of or back into tracking. Returns false if
+// the decision does not change anything. Must be called with d.lock held.
+func (d *Data) setOptOut(userID UserID, optOut bool, now time.Time) bool {
+	if d.optedOut(userID) == optOut {
+		return false
+	}
+	marker := d.optOutMarker(userID)
+	if optOut {
+		if d.OptOuts == nil {
+			d.OptOuts = map[string]time.Time{}
+		}
+		d.OptOuts[marker] = now
+	} else {
+		delete(d.OptOuts, marker)
+	}
+	d.ConsentLog = append(d.ConsentLog, &ConsentRecord{Marker: marker, OptOut: optOut, At: now})
+	d.markChanged()
+	return true
+}
+
+// forgetTrackedUser forgets the activity and profile of a user. The strikes of the user are kept.
+func (d *Data) forgetTrackedUser(userID UserID) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, chatData := range d.ChatData {
+		userData, ok := chatData.UserData[userID]
+		if !ok {
+			continue
+		}
+		if len(userData.Strikes) > 0 {
+			chatData.UserData[userID] = &UserData{Strikes: userData.Strikes}
+		} else {
+			delete(chatData.UserData, userID)
+		}
+	}
+	delete(d.Users, userID)
+	d.markChanged()
+}
+
+// handleOptOut opts the user out of tracking or back in: `/optout` or `/optin` in a private chat.
+func handleOptOut(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, optOut bool) {
+	lang := config.resolveLanguage(msg.From.LanguageCode, "en", "de")
+	userID := UserID(msg.From.ID)
+	data.lock.Lock()
+	changed := data.setOptOut(userID, optOut, time.Now())
+	data.lock.Unlock()
+	if changed {
+		metricOptOuts.inc(strconv.FormatBool(optOut))
+	}
+	var text string
+	switch {
+	case optOut:
+		if changed {
+			data.forgetTrackedUser(userID)
+		}
+		text = config.translate(lang, "You opted out of tracking. Your activity in the chats is no longer "+
+			"recorded, and what was recorded is deleted. Please note that this weakens your protection: the "+
+			"bot cannot tell how long you have been around, so you are warned about scammers as if you were "+
+			"new and your messages are checked as strictly as those of new members. Moderation decisions "+
+			"such as bans are kept. Send /optin to be tracked again.")
+	case changed:
+		text = config.translate(lang, "You opted in to tracking again. Send /optout to opt out.")
+	default:
+		text = config.translate(lang, "You did not opt out of tracking. Send /optout to opt out.")
+	}
+	// The user ID is not logged, to not link the decision to the user.
+	slog.Info("recorded consent", "opt_out", optOut, "changed", changed)
+	sendText(bot, msg.Chat.ID, text)
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers post invoices (often via inline bots), invoice links and requests to send them
+// Telegram Stars or gifts, which the text rules do not catch. Nobody but the admins has a reason
+// to ask for payments in our groups.
+
+import (
+	"fmt"
+	"regexp"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// PaymentRequestDetector scores invoices and requests for payments, Telegram Stars and gifts
+// posted by users who are not admins of the chat.
+type PaymentRequestDetector struct {
+	// Defaults to DeleteScore, so payment requests are deleted, or to FlagScore if deletion is
+	// disabled.
+	Score float64
+}
+
+func (p *PaymentRequestDetector) setDefaults(flagScore, deleteScore float64) {
+	if p.Score == 0 {
+		p.Score = deleteScore
+	}
+	if p.Score == 0 {
+		p.Score = flagScore
+	}
+}
+
+var (
+	// Invoice links: t.me/$<slug> and t.me/invoice/<slug>.
+	invoiceLinkPattern = regexp.MustCompile(`(?i)\b(t|telegram)\.me/(\$|invoice/)[\w-]+`)
+	// Requests to send or gift Telegram Stars, gifts or premium.
+	starsRequestPattern = regexp.MustCompile(`(?i)\b(send|gift|donate|tip|transfer)\b.{0,30}(\b(telegram )?(stars|gifts?|premium)\b|⭐)`)
+)
+
+// detectPaymentRequests finds invoices, invoice links and solicitations of Telegram Stars by
+// users who are not admins of the chat.
+func detectPaymentRequests(config *Config, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) []Finding {
+	detector := config.PaymentRequests
+	if detector == nil {
+		return nil
+	}
+	text := messageText(msg)
+	var reason string
+	switch {
+	case msg.Invoice != nil:
+		reason = fmt.Sprintf("invoice %q", msg.Invoice.Title)
+	case invoiceLinkPattern.MatchString(text):
+		reason = fmt.Sprintf("invoice link %q", invoiceLinkPattern.FindString(text))
+	case starsRequestPattern.MatchString(text):
+		reason = fmt.Sprintf("asks for %q", starsRequestPattern.FindString(text))
+	default:
+		return nil
+	}
+	chatID := ChatID(msg.Chat.ID)
+	if isChatAdmin(config, bot, chatID, UserID(msg.From.ID)) {
+		return nil
+	}
+	return []Finding{{
+		Detector: "payment-request",
+		Score:    detector.Score,
+		Reason:   reason,
+		Category: "payment-request",
+		Shadow:   config.isShadow(chatID, "payment-request"),
+	}}
+}
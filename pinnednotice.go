@@ -0,0 +1,183 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Members look at the pinned message first, so the bot can keep an anti-scam notice pinned in a
+// chat. The notice is posted and pinned once, edited when its text changes, and pinned again if
+// someone unpinned it or pinned another message over it. The posted notice is stored per chat.
+// Changing the pins requires the bot to be allowed to pin messages.
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const pinnedNoticeInterval = 5 * time.Minute
+
+// PinnedNotice is an anti-scam notice kept pinned in a chat.
+type PinnedNotice struct {
+	// Defaults to the "reminder" message in the chat language.
+	Text string `json:",omitempty"`
+	// Notify the members when the notice is pinned.
+	Notify bool `json:",omitempty"`
+}
+
+// PostedNotice is the notice posted to a chat.
+type PostedNotice struct {
+	MessageID int
+	// The text as posted, to detect changes.
+	Text     string
+	PostedAt time.Time
+}
+
+// noticeText returns the text of the pinned notice of a chat.
+func (s *Settings) noticeText(chatID ChatID, notice *PinnedNotice) string {
+	if notice.Text != "" {
+		return notice.Text
+	}
+	return s.message(s.chatLanguage(chatID), "reminder")
+}
+
+// pinMessage pins a message of a chat.
+func pinMessage(bot *tgbotapi.BotAPI, chatID ChatID, messageID int, notify bool) error {
+	_, err := bot.PinChatMessage(tgbotapi.PinChatMessageConfig{
+		ChatID: int64(chatID), MessageID: messageID, DisableNotification: !notify})
+	return err
+}
+
+// unpinMessage unpins a single message of a chat.
+func unpinMessage(bot *tgbotapi.BotAPI, chatID ChatID, messageID int) error {
+	v := url.Values{}
+	v.Add("chat_id", strconv.FormatInt(int64(chatID), 10))
+	v.Add("message_id", strconv.Itoa(messageID))
+	_, err := bot.MakeRequest("unpinChatMessage", v)
+	return err
+}
+
+// postNotice posts and pins the notice of a chat. Returns nil if posting failed.
+func postNotice(bot *tgbotapi.BotAPI, chatID ChatID, notice *PinnedNotice, text string) *PostedNotice {
+	logger := chatLogger(chatID, 0)
+	sent, err := send(bot, chatID, tgbotapi.NewMessage(int64(chatID), text))
+	logAction(logger, "post notice", err)
+	if err != nil {
+		metricTelegramErrors.inc("sendMessage")
+		return nil
+	}
+	err = pinMessage(bot, chatID, sent.MessageID, notice.Notify)
+	logAction(logger, "pin notice", err, "message_id", sent.MessageID)
+	if err != nil {
+		metricTelegramErrors.inc("pinChatMessage")
+	}
+	return &PostedNotice{MessageID: sent.MessageID, Text: text, PostedAt: time.Now()}
+}
+
+// missingMessage returns true if an error means that the message is gone, e.g. deleted by an
+// admin.
+func missingMessage(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "not found")
+}
+
+// refreshNotice keeps the notice of a chat pinned and up to date. Returns the notice as posted now,
+// and whether it changed.
+func refreshNotice(config *Config, bot *tgbotapi.BotAPI, chatID ChatID, notice *PinnedNotice, posted *PostedNotice) (*PostedNotice, bool) {
+	text := config.noticeText(chatID, notice)
+	if posted == nil {
+		posted = postNotice(bot, chatID, notice, text)
+		return posted, posted != nil
+	}
+	logger := chatLogger(chatID, 0)
+	changed := false
+	if posted.Text != text {
+		_, err := bot.Send(tgbotapi.NewEditMessageText(int64(chatID), posted.MessageID, text))
+		logAction(logger, "update notice", err, "message_id", posted.MessageID)
+		switch {
+		case missingMessage(err):
+			if reposted := postNotice(bot, chatID, notice, text); reposted != nil {
+				return reposted, true
+			}
+			return posted, false
+		case err != nil:
+			metricTelegramErrors.inc("editMessageText")
+			return posted, false
+		}
+		posted = &PostedNotice{MessageID: posted.MessageID, Text: text, PostedAt: posted.PostedAt}
+		changed = true
+	}
+	details, err := getChatDetails(bot, chatID)
+	if err != nil {
+		logger.Warn("could not fetch the pinned message", "err", err)
+		return posted, changed
+	}
+	if details.PinnedMessage != nil && details.PinnedMessage.MessageID == posted.MessageID {
+		return posted, changed
+	}
+	err = pinMessage(bot, chatID, posted.MessageID, notice.Notify)
+	logAction(logger, "pin notice again", err, "message_id", posted.MessageID)
+	if missingMessage(err) {
+		if reposted := postNotice(bot, chatID, notice, text); reposted != nil {
+			return reposted, true
+		}
+	} else if err != nil {
+		metricTelegramErrors.inc("pinChatMessage")
+	}
+	return posted, changed
+}
+
+// refreshPinnedNotices keeps the notices of all chats pinned and up to date, and unpins the
+// notices of chats which do not have one anymore.
+func refreshPinnedNotices(config *Config, data *Data, bot *tgbotapi.BotAPI) {
+	for _, group := range config.Groups {
+		chatID := group.ChatID
+		if chatID == 0 || config.botOff(chatID) {
+			continue
+		}
+		data.lock.Lock()
+		posted := data.chat(chatID).PinnedNotice
+		data.lock.Unlock()
+		if group.PinnedNotice == nil && posted == nil {
+			continue
+		}
+
+		var updated *PostedNotice
+		if group.PinnedNotice == nil {
+			err := unpinMessage(bot, chatID, posted.MessageID)
+			logAction(chatLogger(chatID, 0), "unpin notice", err, "message_id", posted.MessageID)
+			if err != nil && !missingMessage(err) {
+				metricTelegramErrors.inc("unpinChatMessage")
+				continue
+			}
+		} else {
+			var changed bool
+			if updated, changed = refreshNotice(config, bot, chatID, group.PinnedNotice, posted); !changed {
+				continue
+			}
+		}
+		data.lock.Lock()
+		data.chat(chatID).PinnedNotice = updated
+		data.chatChanged(chatID)
+		data.lock.Unlock()
+	}
+}
+
+func periodicRefreshPinnedNotices(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for sleepContext(ctx, pinnedNoticeInterval) {
+		refreshPinnedNotices(currentConfig(), data, bot)
+	}
+}
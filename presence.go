@@ -0,0 +1,97 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const unattendedAfterDefault = 2 * time.Hour
+
+// recordAdminActivity remembers that an admin was active in a chat. Activity in the admin chat
+// counts for all chats.
+func recordAdminActivity(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	chatID, userID := ChatID(msg.Chat.ID), UserID(msg.From.ID)
+	if !isChatAdmin(config, bot, chatID, userID) {
+		return
+	}
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	chatData := data.chat(chatID)
+	if chatData.AdminActivity == nil {
+		chatData.AdminActivity = map[UserID]time.Time{}
+	}
+	chatData.AdminActivity[userID] = time.Now()
+	data.chatChanged(chatID)
+}
+
+// lastAdminActivity returns when an admin was last active in the chat or the admin chat. Must be
+// called with d.lock held.
+func (d *Data) lastAdminActivity(config *Config, chatID ChatID) time.Time {
+	var last time.Time
+	for _, id := range []ChatID{chatID, ChatID(config.AdminChatID)} {
+		if chatData, ok := d.ChatData[id]; ok {
+			for _, at := range chatData.AdminActivity {
+				if at.After(last) {
+					last = at
+				}
+			}
+		}
+	}
+	return last
+}
+
+// isUnattended returns true if no moderator has been active recently, so automated enforcement
+// cannot count on a human to review flagged messages soon.
+func isUnattended(config *Config, data *Data, chatID ChatID) bool {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	return time.Since(data.lastAdminActivity(config, chatID)) > config.UnattendedAfter.Duration
+}
+
+// cmdPresence lists when the admins of the chat were last active.
+func cmdPresence(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	chatID := ChatID(msg.Chat.ID)
+	unattended := isUnattended(config, data, chatID)
+
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	type activity struct {
+		userID UserID
+		at     time.Time
+	}
+	var activities []activity
+	if chatData, ok := data.ChatData[chatID]; ok {
+		for userID, at := range chatData.AdminActivity {
+			activities = append(activities, activity{userID, at})
+		}
+	}
+	sort.Slice(activities, func(i, j int) bool { return activities[i].at.After(activities[j].at) })
+
+	var text strings.Builder
+	if unattended {
+		text.WriteString(tr(config, msg, "Unattended: no moderator active within %s.\n", config.UnattendedAfter))
+	} else {
+		text.WriteString(tr(config, msg, "Attended.\n"))
+	}
+	for _, a := range activities {
+		text.WriteString(tr(config, msg, "%s: %s ago\n", data.describeUser(a.userID), time.Since(a.at).Round(time.Minute)))
+	}
+	return text.String()
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// sendText sends a plain text message to a chat.
+func sendText(bot *tgbotapi.BotAPI, chatID int64, text string) {
+	if _, err := send(bot, ChatID(chatID), tgbotapi.NewMessage(chatID, text)); err != nil {
+		chatLogger(ChatID(chatID), 0).Error("could not send message", "err", err)
+	}
+}
+
+// handlePrivateMessage handles messages users send to the bot in a private chat.
+func handlePrivateMessage(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	if msg.IsCommand() {
+		switch {
+		case msg.Command() == "start" && msg.CommandArguments() == gotDMStartParameter,
+			msg.Command() == "gotdm":
+			startGotDMFlow(bot, msg)
+		case msg.Command() == "optout":
+			handleOptOut(config, data, bot, msg, true)
+		case msg.Command() == "optin":
+			handleOptOut(config, data, bot, msg, false)
+		case msg.Command() == "forgetme":
+			handleForgetMe(config, data, bot, msg)
+		case msg.Command() == "start":
+			respondToDM(config, data, bot, msg)
+		}
+		return
+	}
+	if !continueGotDMFlow(config, data, bot, msg) {
+		respondToDM(config, data, bot, msg)
+	}
+}
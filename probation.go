@@ -0,0 +1,116 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers usually strike right after joining, before anyone had a chance to notice them. Chats
+// can put new members on probation: for a while after joining, they may only send text messages
+// (no media, stickers or link previews), or may not post at all. The restriction is a regular
+// restricted state, so it is listed with the other states and lifted by periodicExpireStates once
+// the probation ends. Members who verify or solve the captcha are put on probation afterwards.
+
+import (
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Probation modes.
+const (
+	probationTextOnly = "text-only"
+	probationReadOnly = "read-only"
+)
+
+// The reason of the restriction of members on probation.
+const probationReason = "new member probation"
+
+// Probation configures the restriction of new members of a chat.
+type Probation struct {
+	// How long new members are restricted after joining.
+	Duration jsonDuration
+	// "text-only" (the default) or "read-only".
+	Mode string `json:",omitempty"`
+}
+
+// compile validates the probation settings.
+func (p *Probation) compile() error {
+	if p.Duration.Duration <= 0 {
+		return fieldErrorf("Duration", "must be positive")
+	}
+	if p.Mode != "" && p.Mode != probationTextOnly && p.Mode != probationReadOnly {
+		return fieldErrorf("Mode", "must be %q or %q", probationTextOnly, probationReadOnly)
+	}
+	return nil
+}
+
+var metricProbations = newCounter("scamwarnbot_probations_total", "New members put on probation, by mode.", "mode")
+
+// startProbation restricts a new member of a chat with probation for the rest of the probation
+// period. Members who are restricted already, e.g. until they verify, and members who joined
+// before the probation period are skipped.
+func startProbation(config *Config, data *Data, bot *tgbotapi.BotAPI, chatID ChatID, userID UserID) {
+	group := config.group(chatID)
+	if group == nil || group.Probation == nil {
+		return
+	}
+	probation := group.Probation
+	logger := chatLogger(chatID, userID)
+	now := time.Now()
+	data.lock.Lock()
+	restricted := data.hasStateLocked(userID, stateRestricted, chatID)
+	joinedAt := now
+	if userData, ok := data.chat(chatID).UserData[userID]; ok && !userData.FirstSeenAt.IsZero() {
+		joinedAt = userData.FirstSeenAt
+	}
+	data.lock.Unlock()
+	until := joinedAt.Add(probation.Duration.Duration)
+	if restricted || !until.After(now) {
+		logger.Debug("not putting member on probation", "restricted", restricted, "joined_at", joinedAt)
+		return
+	}
+
+	mode := probation.Mode
+	if mode == "" {
+		mode = probationTextOnly
+	}
+	state := &UserState{
+		Kind:     stateRestricted,
+		ChatID:   chatID,
+		Until:    until,
+		Reason:   probationReason,
+		TextOnly: mode == probationTextOnly,
+	}
+	err := applyState(bot, userID, state, true)
+	logAction(logger, "restrict", err, "reason", probationReason, "mode", mode, "until", until)
+	if err != nil {
+		metricTelegramErrors.inc("restrictChatMember")
+		return
+	}
+	metricProbations.inc(mode)
+	data.lock.Lock()
+	data.setState(userID, state)
+	data.lock.Unlock()
+}
+
+// probateNewMembers puts the users joining a chat with probation on probation.
+func probateNewMembers(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	if msg.NewChatMembers == nil {
+		return
+	}
+	for _, member := range *msg.NewChatMembers {
+		if !member.IsBot {
+			startProbation(config, data, bot, ChatID(msg.Chat.ID), UserID(member.ID))
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scam waves use fresh throwaway accounts, which look alike: no username, no profile photo, a name
+// like "Premium Support 💎" and a link in the very first message. The profile risk combines such
+// signals of a user into a score when they post their first message in a chat. Depending on the
+// thresholds the score reaches, the chat is warned about the message, the admins are notified or
+// the user is muted, independently of the scoring of the message itself.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const profilePhotoCacheFor = 24 * time.Hour
+
+var profileNamePatternsDefault = []string{
+	`(?i)\b(premium|vip|official|support|helpdesk|admin|airdrop)\b`,
+	`(?i)bot$`,
+	`\d{4,}$`,
+	`[💎⭐✨✅🔥💰🚀]`,
+}
+
+var metricProfileRisk = newCounter("scamwarnbot_profile_risk_total",
+	"First messages of users by the highest profile risk threshold reached: none, warn, flag or restrict.", "outcome")
+
+// ProfileRisk scores the profiles of users posting their first message in a chat. Each signal
+// adds its weight to the score; a weight of zero takes the default.
+type ProfileRisk struct {
+	// Weights of the signals. Default 1 for NoUsername, NoProfilePhoto and JoinedRecently, and
+	// 1.5 for NamePattern and FirstMessageLink.
+	NoUsername       float64 `json:",omitempty"`
+	NoProfilePhoto   float64 `json:",omitempty"`
+	NamePattern      float64 `json:",omitempty"`
+	FirstMessageLink float64 `json:",omitempty"`
+	// The user was first seen in the chat within NewMemberAge.
+	JoinedRecently float64 `json:",omitempty"`
+	// Regular expressions matching the names of throwaway accounts. Defaults to names with words
+	// like "premium" or "support", ending in "bot" or in digits, or containing emojis like 💎.
+	NamePatterns []string `json:",omitempty"`
+	// Scores at which the chat is warned about the message, the admins are notified, and the user
+	// is muted for RestrictDuration and the admins are notified. Default 2, 3 and 4.5; a negative
+	// score disables the threshold.
+	WarnScore     float64 `json:",omitempty"`
+	FlagScore     float64 `json:",omitempty"`
+	RestrictScore float64 `json:",omitempty"`
+
+	namePatterns []*regexp.Regexp
+}
+
+func (p *ProfileRisk) setDefaults() {
+	for _, weight := range []struct {
+		value        *float64
+		defaultValue float64
+	}{
+		{&p.NoUsername, 1}, {&p.NoProfilePhoto, 1}, {&p.NamePattern, 1.5}, {&p.FirstMessageLink, 1.5},
+		{&p.JoinedRecently, 1}, {&p.WarnScore, 2}, {&p.FlagScore, 3}, {&p.RestrictScore, 4.5},
+	} {
+		if *weight.value == 0 {
+			*weight.value = weight.defaultValue
+		}
+	}
+	if len(p.NamePatterns) == 0 {
+		p.NamePatterns = profileNamePatternsDefault
+	}
+}
+
+func (p *ProfileRisk) compile() error {
+	if p.NoUsername < 0 || p.NoProfilePhoto < 0 || p.NamePattern < 0 || p.FirstMessageLink < 0 || p.JoinedRecently < 0 {
+		return errors.New("weights must not be negative")
+	}
+	p.namePatterns = nil
+	for i, pattern := range p.NamePatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fieldErrorf(fmt.Sprintf("NamePatterns[%d]", i), "%w", err)
+		}
+		p.namePatterns = append(p.namePatterns, re)
+	}
+	return nil
+}
+
+// hasProfilePhoto returns whether a user has a profile photo, cached for a day.
+func hasProfilePhoto(data *Data, bot *tgbotapi.BotAPI, userID UserID) (bool, error) {
+	key := lookupKey("photo", fmt.Sprint(userID))
+	return cachedLookup(data, "photo", key, profilePhotoCacheFor, false, func() (bool, error) {
+		photos, err := bot.GetUserProfilePhotos(tgbotapi.UserProfilePhotosConfig{UserID: int(userID), Limit: 1})
+		return photos.TotalCount > 0, err
+	})
+}
+
+// profileScore returns the profile risk of the author of a message and the signals found.
+func (p *ProfileRisk) profileScore(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message,
+	firstSeenAt time.Time) (float64, []string) {
+	var score float64
+	var signals []string
+	add := func(weight float64, signal string) {
+		score += weight
+		signals = append(signals, signal)
+	}
+	if msg.From.UserName == "" {
+		add(p.NoUsername, "no username")
+	}
+	if hasPhoto, err := hasProfilePhoto(data, bot, UserID(msg.From.ID)); err != nil {
+		messageLogger(msg).Warn("could not get the profile photos", "err", err)
+	} else if !hasPhoto {
+		add(p.NoProfilePhoto, "no profile photo")
+	}
+	name := strings.TrimSpace(msg.From.FirstName + " " + msg.From.LastName)
+	for _, re := range p.namePatterns {
+		if re.MatchString(name) {
+			add(p.NamePattern, fmt.Sprintf("name %q matches %s", name, re))
+			break
+		}
+	}
+	if len(messageLinks(msg)) > 0 {
+		add(p.FirstMessageLink, "link in the first message")
+	}
+	if !firstSeenAt.IsZero() && time.Since(firstSeenAt) <= config.NewMemberAge.Duration {
+		add(p.JoinedRecently, "joined recently")
+	}
+	return score, signals
+}
+
+// profilePipeline returns the actions for a profile risk score and the threshold it reached.
+func (p *ProfileRisk) profilePipeline(score float64) ([]string, string) {
+	switch {
+	case p.RestrictScore >= 0 && score >= p.RestrictScore:
+		return []string{actionMute, actionNotify}, "restrict"
+	case p.FlagScore >= 0 && score >= p.FlagScore:
+		return []string{actionNotify}, "flag"
+	case p.WarnScore >= 0 && score >= p.WarnScore:
+		return []string{actionWarn}, "warn"
+	}
+	return nil, "none"
+}
+
+// handleProfileRisk scores the profile of users posting their first message in a chat, and acts
+// according to the thresholds reached. Admins of the chat are not scored.
+func handleProfileRisk(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	risk := config.ProfileRisk
+	if risk == nil || msg.From.IsBot || msg.NewChatMembers != nil || msg.LeftChatMember != nil {
+		return
+	}
+	chatID, userID := ChatID(msg.Chat.ID), UserID(msg.From.ID)
+	data.lock.Lock()
+	userData := data.chat(chatID).user(userID)
+	first, firstSeenAt := userData.LastMessageAt.IsZero(), userData.FirstSeenAt
+	data.lock.Unlock()
+	if !first || isChatAdmin(config, bot, chatID, userID) {
+		return
+	}
+
+	score, signals := risk.profileScore(config, data, bot, msg, firstSeenAt)
+	pipeline, outcome := risk.profilePipeline(score)
+	metricProfileRisk.inc(outcome)
+	if pipeline == nil {
+		return
+	}
+	findings := []Finding{{Detector: "profile", Score: score, Reason: strings.Join(signals, ", ")}}
+	messageLogger(msg).Info("risky profile", "score", score, "outcome", outcome, "signals", signals)
+	var reason strings.Builder
+	fmt.Fprintf(&reason, "Risky profile (score %.2f): %s\n", score, strings.Join(signals, ", "))
+	fmt.Fprintf(&reason, "Text: %s\n", messageText(msg))
+	actions, notify := runActions(config, data, bot, msg, pipeline, findings, score, &reason)
+	if len(actions) > 0 {
+		id := data.recordAction(&ActionRecord{
+			At:              time.Now(),
+			ChatID:          chatID,
+			UserID:          userID,
+			MessageID:       msg.MessageID,
+			Text:            messageText(msg),
+			Actions:         actions,
+			Findings:        findings,
+			Score:           score,
+			Thresholds:      ActionThresholds{Flag: risk.FlagScore, Factor: 1},
+			SettingsVersion: config.Version,
+		})
+		fmt.Fprintf(&reason, "Details: /why %s\n", id)
+	}
+	if notify {
+		reportToAdmins(config, data, bot, msg, reason.String())
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+const memoryMetricsInterval = 30 * time.Second
+
+var (
+	metricHeapAlloc  = newGauge("scamwarnbot_heap_alloc_bytes", "Bytes of allocated heap objects.")
+	metricHeapInuse  = newGauge("scamwarnbot_heap_inuse_bytes", "Bytes in in-use heap spans.")
+	metricMemorySys  = newGauge("scamwarnbot_memory_sys_bytes", "Bytes of memory obtained from the OS.")
+	metricGoroutines = newGauge("scamwarnbot_goroutines", "Number of goroutines.")
+	metricGCCycles   = newGauge("scamwarnbot_gc_cycles", "Number of completed GC cycles.")
+)
+
+// registerProfiling serves the pprof profiles under /debug/pprof/, only to admin API clients.
+func registerProfiling(mux *http.ServeMux) {
+	mux.Handle("/debug/pprof/", requireAPIToken(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", requireAPIToken(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", requireAPIToken(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", requireAPIToken(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", requireAPIToken(http.HandlerFunc(pprof.Trace)))
+}
+
+// updateMemoryMetrics records the memory usage and the number of goroutines.
+func updateMemoryMetrics() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	metricHeapAlloc.set(float64(stats.HeapAlloc))
+	metricHeapInuse.set(float64(stats.HeapInuse))
+	metricMemorySys.set(float64(stats.Sys))
+	metricGCCycles.set(float64(stats.NumGC))
+	metricGoroutines.set(float64(runtime.NumGoroutine()))
+}
+
+func periodicMemoryMetrics(ctx context.Context) {
+	for {
+		updateMemoryMetrics()
+		if !sleepContext(ctx, memoryMetricsInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers flock to the chats when something is announced, e.g. a firmware release. Admins can
+// schedule protection windows around announcements, during which the detection thresholds are
+// lowered and users joining are muted for a while.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	protectionThresholdFactorDefault = 0.5
+	protectionRestrictDefault        = time.Hour
+)
+
+// ProtectionPolicy configures the protection windows of all chats.
+type ProtectionPolicy struct {
+	// Detection thresholds are multiplied by this factor during a protection window.
+	ThresholdFactor float64
+	// Users joining during a protection window are muted for this long. Disabled if negative.
+	RestrictNewMembers jsonDuration
+}
+
+func (p *ProtectionPolicy) setDefaults() {
+	if p.ThresholdFactor == 0 {
+		p.ThresholdFactor = protectionThresholdFactorDefault
+	}
+	if p.RestrictNewMembers.Duration == 0 {
+		p.RestrictNewMembers.Duration = protectionRestrictDefault
+	}
+}
+
+// ProtectionWindow is a period of stricter enforcement in a chat.
+type ProtectionWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+// activeProtection returns the protection window of the chat active at the given time, or nil.
+func (s *Settings) activeProtection(chatID ChatID, now time.Time) *ProtectionWindow {
+	group := s.group(chatID)
+	if group == nil {
+		return nil
+	}
+	for _, window := range group.ProtectionWindows {
+		if !now.Before(window.Start) && now.Before(window.End) {
+			return window
+		}
+	}
+	return nil
+}
+
+// protectionFactor returns the threshold factor for the chat at the given time.
+func protectionFactor(config *Config, chatID ChatID, now time.Time) float64 {
+	if config.activeProtection(chatID, now) == nil {
+		return 1
+	}
+	return config.Protection.ThresholdFactor
+}
+
+// restrictNewMembers mutes the users joining a chat during a protection window.
+func restrictNewMembers(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	if msg.NewChatMembers == nil || config.Protection.RestrictNewMembers.Duration < 0 {
+		return
+	}
+	chatID := ChatID(msg.Chat.ID)
+	now := time.Now()
+	window := config.activeProtection(chatID, now)
+	if window == nil {
+		return
+	}
+	for _, member := range *msg.NewChatMembers {
+		if member.IsBot {
+			continue
+		}
+		state := &UserState{
+			Kind:   stateRestricted,
+			ChatID: chatID,
+			Until:  now.Add(config.Protection.RestrictNewMembers.Duration),
+			Reason: "joined during a protection window",
+		}
+		err := applyState(bot, UserID(member.ID), state, true)
+		logAction(chatLogger(chatID, UserID(member.ID)), "restrict", err, "reason", state.Reason)
+		if err != nil {
+			metricTelegramErrors.inc("restrictChatMember")
+			continue
+		}
+		data.lock.Lock()
+		data.setState(UserID(member.ID), state)
+		data.lock.Unlock()
+	}
+}
+
+// cmdProtect lists, schedules and clears the protection windows of the chat:
+// `/protect [<YYYY-MM-DD HH:MM>|now <duration>|clear]`. Times are in the time zone of the admin
+// locale.
+func cmdProtect(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	chatID := ChatID(msg.Chat.ID)
+	if int64(chatID) == config.AdminChatID {
+		return tr(config, msg, "Protection windows are set per chat. Use this command in the group.")
+	}
+	location := config.AdminLocale.location
+	if location == nil {
+		location = time.UTC
+	}
+	args := strings.Fields(msg.CommandArguments())
+	now := time.Now()
+	if len(args) == 0 {
+		group := config.group(chatID)
+		var text strings.Builder
+		if group != nil {
+			for _, window := range group.ProtectionWindows {
+				if window.End.After(now) {
+					text.WriteString(tr(config, msg, "Protected from %s to %s\n",
+						window.Start.In(location).Format("2006-01-02 15:04"), window.End.In(location).Format("2006-01-02 15:04 MST")))
+				}
+			}
+		}
+		if text.Len() == 0 {
+			return tr(config, msg, "No protection windows scheduled.")
+		}
+		return text.String()
+	}
+	usage := tr(config, msg, "Usage: /protect [<YYYY-MM-DD HH:MM>|now <duration>|clear]")
+	var start time.Time
+	var duration time.Duration
+	switch {
+	case len(args) == 1 && args[0] == "clear":
+	case len(args) == 2 && args[0] == "now":
+		start = now
+	case len(args) == 3:
+		var err error
+		start, err = time.ParseInLocation("2006-01-02 15:04", args[0]+" "+args[1], location)
+		if err != nil {
+			return usage
+		}
+	default:
+		return usage
+	}
+	if !start.IsZero() {
+		var err error
+		duration, err = parseDuration(args[len(args)-1])
+		if err != nil || duration <= 0 {
+			return usage
+		}
+	}
+
+	version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+		group := settings.group(chatID)
+		if group == nil {
+			group = &GroupConfig{ChatID: chatID}
+			settings.Groups = append(settings.Groups, group)
+		}
+		var windows []*ProtectionWindow
+		if !start.IsZero() {
+			for _, window := range group.ProtectionWindows {
+				if window.End.After(now) {
+					windows = append(windows, window)
+				}
+			}
+			windows = append(windows, &ProtectionWindow{Start: start, End: start.Add(duration)})
+		}
+		group.ProtectionWindows = windows
+		return nil
+	})
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+	if start.IsZero() {
+		data.audit(auditAreaSettings, telegramActor(msg.From), version,
+			fmt.Sprintf("cleared protection windows in chat %s", msg.Chat.Title))
+		return tr(config, msg, "Protection windows cleared.")
+	}
+	data.audit(auditAreaSettings, telegramActor(msg.From), version,
+		fmt.Sprintf("scheduled protection window in chat %s from %s for %s", msg.Chat.Title, start.UTC().Format(time.RFC3339), duration))
+	return tr(config, msg, "Protected from %s to %s\n",
+		start.In(location).Format("2006-01-02 15:04"), start.Add(duration).In(location).Format("2006-01-02 15:04 MST"))
+}
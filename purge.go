@@ -0,0 +1,48 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Maximum number of messages deleted by a single /purge.
+const purgeMaxMessages = 200
+
+// cmdPurge deletes all messages from the message replied to up to the command itself. Messages
+// which cannot be deleted (e.g. because they are older than 48 hours) are skipped.
+func cmdPurge(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	if msg.ReplyToMessage == nil {
+		return tr(config, msg, "Reply to the first message to delete with /purge.")
+	}
+	first := msg.ReplyToMessage.MessageID
+	if msg.MessageID-first >= purgeMaxMessages {
+		return tr(config, msg, "At most %d messages can be purged at once.", purgeMaxMessages)
+	}
+	deleted := 0
+	for id := first; id <= msg.MessageID; id++ {
+		_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: msg.Chat.ID, MessageID: id})
+		if err == nil {
+			deleted++
+		}
+	}
+	messageLogger(msg).Info("purged messages", "action", "purge", "deleted", deleted)
+	notifyAdmins(config, bot, fmt.Sprintf("%s purged %d messages in %s.",
+		telegramActor(msg.From), deleted, msg.Chat.Title))
+	// The command itself was deleted, so there is nothing to reply to.
+	return ""
+}
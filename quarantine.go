@@ -0,0 +1,182 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Drive-by scammers join with a fresh account, post once and leave, often before anyone reacts.
+// In chats with QuarantineFirstMessage, the first message of a user is held for approval: it is
+// forwarded to the admin chat and deleted in the group. Once a moderator approves it, the
+// forwarded copy is forwarded back into the group, attributed to its author, and the user posts
+// freely from then on. Further messages posted while the first one is pending are held as well.
+// Users who opted out of tracking are exempt, as all their messages would be held.
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// How long the notice that a message is held stays in the group.
+const quarantineNoticeTTL = time.Minute
+
+// QuarantinedMessage is a first message of a user held for approval.
+type QuarantinedMessage struct {
+	ID     string
+	ChatID ChatID
+	UserID UserID
+	At     time.Time
+	// The copy of the message forwarded to the admin chat, forwarded into the group on approval.
+	CopyMessageID int
+	// The message in the admin chat carrying the buttons.
+	AdminMessageID int    `json:",omitempty"`
+	AdminText      string `json:",omitempty"`
+}
+
+var metricQuarantined = newCounter("scamwarnbot_quarantined_messages_total",
+	"First messages of users held for approval (held), and approved or rejected by moderators.", "result")
+
+// quarantineFirstMessage holds the message for approval if it is the first message of the user in
+// a chat with QuarantineFirstMessage. Returns true if the message was held.
+func quarantineFirstMessage(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	chatID := ChatID(msg.Chat.ID)
+	userID := UserID(msg.From.ID)
+	group := config.group(chatID)
+	if group == nil || !group.QuarantineFirstMessage || msg.NewChatMembers != nil || msg.LeftChatMember != nil {
+		return false
+	}
+	data.lock.Lock()
+	first := data.chat(chatID).user(userID).LastMessageAt.IsZero() && !data.optedOut(userID)
+	data.lock.Unlock()
+	if !first || userRole(config, data, bot, chatID, userID) >= roleModerator {
+		return false
+	}
+	logger := chatLogger(chatID, userID)
+	if config.AdminChatID == 0 {
+		logger.Warn("not holding first message: no admin chat")
+		return false
+	}
+
+	forward := tgbotapi.NewForward(config.AdminChatID, int64(chatID), msg.MessageID)
+	enqueueSend(bot, ChatID(config.AdminChatID), forward, func(copied tgbotapi.Message, err error) {
+		if err != nil {
+			// Rather let the message through than lose it.
+			logAction(logger, "hold first message", err)
+			metricTelegramErrors.inc("forwardMessage")
+			return
+		}
+		_, err = bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(chatID), MessageID: msg.MessageID})
+		logAction(logger, "delete first message", err)
+		if err != nil {
+			metricTelegramErrors.inc("deleteMessage")
+		}
+		metricQuarantined.inc("held")
+
+		data.lock.Lock()
+		data.NextQuarantineID++
+		held := &QuarantinedMessage{
+			ID:            fmt.Sprintf("Q%d", data.NextQuarantineID),
+			ChatID:        chatID,
+			UserID:        userID,
+			At:            time.Now(),
+			CopyMessageID: copied.MessageID,
+			AdminText: fmt.Sprintf("First message of %s in %s, held for approval.",
+				msg.From.String(), msg.Chat.Title),
+		}
+		if data.Quarantine == nil {
+			data.Quarantine = map[string]*QuarantinedMessage{}
+		}
+		data.Quarantine[held.ID] = held
+		data.markChanged()
+		data.lock.Unlock()
+
+		message := tgbotapi.NewMessage(config.AdminChatID, held.AdminText)
+		message.ReplyToMessageID = copied.MessageID
+		message.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Approve", callbackData("quarantine", held.ID, "approve")),
+			tgbotapi.NewInlineKeyboardButtonData("Reject", callbackData("quarantine", held.ID, "reject")),
+		))
+		enqueueSend(bot, ChatID(config.AdminChatID), message, func(sent tgbotapi.Message, err error) {
+			if err != nil {
+				slog.Error("could not post held message", "err", err)
+				metricTelegramErrors.inc("sendMessage")
+				return
+			}
+			data.lock.Lock()
+			held.AdminMessageID = sent.MessageID
+			data.markChanged()
+			data.lock.Unlock()
+		})
+
+		lang := config.warningLanguage(chatID, msg.From.LanguageCode)
+		notice := tgbotapi.NewMessage(int64(chatID), config.translate(lang,
+			"%s, your first message here is shown once an admin approved it.", msg.From.String()))
+		enqueueSend(bot, chatID, notice, func(sent tgbotapi.Message, err error) {
+			logAction(logger, "send quarantine notice", err)
+			if err == nil {
+				data.scheduleDeletion(chatID, sent.MessageID, quarantineNoticeTTL)
+			}
+		})
+	})
+	logger.Info("holding first message for approval")
+	return true
+}
+
+// quarantineCallback approves or rejects a held message: `quarantine:<ID>:approve|reject`.
+func quarantineCallback(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args []string) string {
+	if len(args) != 2 || (args[1] != "approve" && args[1] != "reject") {
+		return "Invalid decision."
+	}
+	approve := args[1] == "approve"
+	data.lock.Lock()
+	held, ok := data.Quarantine[args[0]]
+	if ok {
+		delete(data.Quarantine, held.ID)
+		if approve {
+			data.chat(held.ChatID).user(held.UserID).LastMessageAt = time.Now()
+		}
+		data.markChanged()
+	}
+	data.lock.Unlock()
+	if !ok {
+		return "The message was decided already."
+	}
+
+	logger := chatLogger(held.ChatID, held.UserID)
+	result := fmt.Sprintf("Rejected by %s.", query.From.String())
+	if approve {
+		forward := tgbotapi.NewForward(int64(held.ChatID), config.AdminChatID, held.CopyMessageID)
+		_, err := send(bot, held.ChatID, forward)
+		logAction(logger, "repost approved message", err, "quarantine", held.ID)
+		if err != nil {
+			metricTelegramErrors.inc("forwardMessage")
+			result = fmt.Sprintf("Approved by %s, but the message could not be reposted: %v", query.From.String(), err)
+		} else {
+			result = fmt.Sprintf("Approved by %s and reposted.", query.From.String())
+		}
+		metricQuarantined.inc("approved")
+	} else {
+		logger.Info("rejected held message", "quarantine", held.ID)
+		metricQuarantined.inc("rejected")
+	}
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, held.AdminText+"\n"+result)
+	if _, err := send(bot, ChatID(query.Message.Chat.ID), edit); err != nil {
+		slog.Error("could not update held message", "err", err)
+	}
+	if approve {
+		return "Approved."
+	}
+	return "Rejected."
+}
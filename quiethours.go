@@ -0,0 +1,140 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Replies of the bot at night wake up the members of a chat. During the quiet hours of a chat,
+// warnings are not posted to it. The warning is still recorded for the user as if it was sent, so
+// they are not warned again in the morning, and optionally it is held back and sent to the admin
+// chat together with the other warnings held back in the chat once the quiet hours end.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// quietWarningsLimit is the number of warnings held back per chat beyond which only the number
+// of warnings is kept.
+const quietWarningsLimit = 100
+
+var metricQuietWarnings = newCounter("scamwarnbot_quiet_warnings_total",
+	"Warnings not posted during the quiet hours of the chat.")
+
+// QuietHours is a daily window, e.g. from "22:00" to "07:00" in "Europe/Berlin", during which no
+// warnings are posted to a chat.
+type QuietHours struct {
+	Schedule
+	// Send the warnings held back to the admin chat as a single digest once the quiet hours end,
+	// instead of dropping them.
+	Digest bool `json:",omitempty"`
+}
+
+// HeldWarning is a warning held back during the quiet hours of a chat.
+type HeldWarning struct {
+	At     time.Time
+	UserID UserID
+	// Link to the message which was not replied to, empty in basic groups.
+	Link string `json:",omitempty"`
+}
+
+// quietHours returns the quiet hours of a chat if they are active at the given time, nil
+// otherwise.
+func (s *Settings) quietHours(chatID ChatID, now time.Time) *QuietHours {
+	group := s.group(chatID)
+	if group == nil || group.QuietHours == nil || !group.QuietHours.active(now) {
+		return nil
+	}
+	return group.QuietHours
+}
+
+// holdWarning records a warning which is not posted to a chat during its quiet hours. Must be
+// called with d.lock held, instead of sending the warning.
+func (d *Data) holdWarning(quiet *QuietHours, msg *tgbotapi.Message, now time.Time) {
+	chatID, userID := ChatID(msg.Chat.ID), UserID(msg.From.ID)
+	delete(d.warningsInFlight, chatUser{chatID, userID})
+	metricQuietWarnings.inc()
+	if !quiet.Digest {
+		return
+	}
+	chatData := d.chat(chatID)
+	if len(chatData.HeldWarnings) < quietWarningsLimit {
+		chatData.HeldWarnings = append(chatData.HeldWarnings, &HeldWarning{
+			At:     now,
+			UserID: userID,
+			Link:   messageLink(msg.Chat, msg.MessageID),
+		})
+	} else {
+		chatData.HeldWarningsDropped++
+	}
+	d.chatChanged(chatID)
+}
+
+// heldWarningsDigest returns the digest of the warnings held back in a chat. Must be called with
+// d.lock held.
+func (d *Data) heldWarningsDigest(chatID ChatID, location *time.Location) string {
+	chatData := d.chat(chatID)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Warnings held back during the quiet hours in %s: %d",
+		d.chatTitle(chatID), len(chatData.HeldWarnings)+chatData.HeldWarningsDropped)
+	for _, held := range chatData.HeldWarnings {
+		fmt.Fprintf(&b, "\n%s %s", held.At.In(location).Format("15:04"), d.describeUser(held.UserID))
+		if held.Link != "" {
+			b.WriteString(" " + held.Link)
+		}
+	}
+	if chatData.HeldWarningsDropped > 0 {
+		fmt.Fprintf(&b, "\n… and %d more.", chatData.HeldWarningsDropped)
+	}
+	return b.String()
+}
+
+// sendHeldWarnings sends the digests of the warnings held back in the chats whose quiet hours
+// ended, or which no longer have quiet hours.
+func sendHeldWarnings(config *Config, data *Data, bot *tgbotapi.BotAPI, now time.Time) {
+	var digests []string
+	data.lock.Lock()
+	for _, chatID := range sortedKeys(data.ChatData) {
+		chatData := data.ChatData[chatID]
+		if len(chatData.HeldWarnings) == 0 && chatData.HeldWarningsDropped == 0 {
+			continue
+		}
+		location := time.UTC
+		if group := config.group(chatID); group != nil && group.QuietHours != nil {
+			if group.QuietHours.active(now) {
+				continue
+			}
+			if group.QuietHours.location != nil {
+				location = group.QuietHours.location
+			}
+		}
+		digests = append(digests, data.heldWarningsDigest(chatID, location))
+		chatData.HeldWarnings = nil
+		chatData.HeldWarningsDropped = 0
+		data.chatChanged(chatID)
+	}
+	data.lock.Unlock()
+	for _, digest := range digests {
+		notifyAdmins(config, bot, digest)
+	}
+}
+
+func periodicSendHeldWarnings(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for sleepContext(ctx, time.Minute) {
+		sendHeldWarnings(currentConfig(), data, bot, time.Now())
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Updates sent while the bot is offline for longer than Telegram keeps them are lost, including
+// joins of scammers who then DM members unnoticed. After such a downtime, the bot reports how many
+// members joined in the meantime and treats users it sees for the first time conservatively for a
+// grace period.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const downtimeThresholdDefault = 30 * time.Minute
+const downtimeGracePeriodDefault = 24 * time.Hour
+const downtimeThresholdFactorDefault = 0.5
+
+// downtimeGrace is the grace period after a downtime. It is set once at startup, before updates
+// are processed.
+var downtimeGrace struct {
+	// Users first seen after this time are treated conservatively until the grace period ends.
+	since time.Time
+	until time.Time
+}
+
+// recordAlive records that the bot is running, to measure downtimes on the next start.
+func (d *Data) recordAlive(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.LastAliveAt = now
+	d.markChanged()
+}
+
+// reconcileAfterDowntime compares the member counts of the active chats with the counts stored
+// before the downtime and starts the grace period if the bot was offline for longer than
+// DowntimeThreshold. The admins of the chats are refreshed by warmCaches.
+func reconcileAfterDowntime(config *Config, data *Data, bot *tgbotapi.BotAPI) {
+	now := time.Now()
+	data.lock.Lock()
+	lastAlive := data.LastAliveAt
+	chatIDs := data.activeChats()
+	data.lock.Unlock()
+
+	var changes []string
+	for _, chatID := range chatIDs {
+		count, err := getChatMemberCount(bot, chatID)
+		if err != nil {
+			chatLogger(chatID, 0).Error("could not fetch member count", "err", err)
+			continue
+		}
+		data.lock.Lock()
+		chatData := data.chat(chatID)
+		previous := chatData.MemberCount
+		chatData.MemberCount = count
+		data.markChanged()
+		title := chatData.Title
+		data.lock.Unlock()
+		if previous != 0 && count != previous {
+			changes = append(changes, fmt.Sprintf("%s: %d → %d members", title, previous, count))
+		}
+	}
+	data.recordAlive(now)
+
+	if lastAlive.IsZero() || now.Sub(lastAlive) < config.DowntimeThreshold.Duration {
+		return
+	}
+	downtime := now.Sub(lastAlive).Round(time.Minute)
+	downtimeGrace.since = now
+	downtimeGrace.until = now.Add(config.DowntimeGracePeriod.Duration)
+	slog.Warn("bot was offline; stricter thresholds for new users", "downtime", downtime, "until", downtimeGrace.until)
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "The bot was offline for %s (since %s); updates sent meanwhile may be lost.\n",
+		downtime, config.AdminLocale.formatDateTime(lastAlive))
+	if len(changes) > 0 {
+		text.WriteString("Member counts changed meanwhile:\n")
+		for _, change := range changes {
+			text.WriteString("- " + change + "\n")
+		}
+	}
+	fmt.Fprintf(&text, "Users seen for the first time are checked with stricter thresholds (factor %.2f) until %s.",
+		config.DowntimeThresholdFactor, config.AdminLocale.formatDateTime(downtimeGrace.until))
+	notifyAdmins(config, bot, text.String())
+}
+
+// downtimeFactor returns the threshold factor for a user first seen at firstSeenAt.
+func downtimeFactor(config *Config, firstSeenAt time.Time, now time.Time) float64 {
+	if downtimeGrace.since.IsZero() || now.After(downtimeGrace.until) || firstSeenAt.Before(downtimeGrace.since) {
+		return 1
+	}
+	return config.DowntimeThresholdFactor
+}
+
+func periodicRecordAlive(ctx context.Context, data *Data) {
+	for {
+		if !sleepContext(ctx, time.Minute) {
+			return
+		}
+		data.recordAlive(time.Now())
+	}
+}
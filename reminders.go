@@ -0,0 +1,249 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Members forget the warnings they got when they joined, so the bot can post a reminder to a chat
+// on a schedule, e.g. every Monday morning. The previous reminder is deleted first, so only the
+// most recent one stays in the chat. Schedules are cron expressions, see parseCron.
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Reminder is a reminder posted to a chat on a schedule.
+type Reminder struct {
+	// A cron expression "<minute> <hour> <day of month> <month> <day of week>", e.g. "0 10 * * 1"
+	// for Mondays at 10:00, or one of @hourly, @daily, @weekly and @monthly.
+	Schedule string
+	// Time zone of the schedule, e.g. "Europe/Zurich". Defaults to UTC.
+	TimeZone string `json:",omitempty"`
+	// Defaults to the "reminder" message in the chat language.
+	Text string `json:",omitempty"`
+
+	cron     *cronSchedule
+	location *time.Location
+}
+
+// PostedReminder is the most recent reminder posted to a chat.
+type PostedReminder struct {
+	// Zero if posting failed or the message cannot be deleted anymore.
+	MessageID int `json:",omitempty"`
+	PostedAt  time.Time
+}
+
+// cronSchedule is a parsed cron expression, with the allowed values of each field as bit sets.
+type cronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// As in cron, a day matches either field if both day fields are restricted.
+	anyDayOfMonth, anyDayOfWeek bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseCron parses a cron expression with the fields minute, hour, day of month, month and day of
+// week (0 or 7 is Sunday). Fields are "*", values, ranges ("1-5") and steps ("*/15", "0-30/10"),
+// separated by commas.
+func parseCron(expr string) (*cronSchedule, error) {
+	if alias, ok := cronAliases[expr]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: expected 5 fields", expr)
+	}
+	schedule := &cronSchedule{anyDayOfMonth: fields[2] == "*", anyDayOfWeek: fields[4] == "*"}
+	for i, field := range []struct {
+		name     string
+		min, max int
+		bits     *uint64
+	}{
+		{"minute", 0, 59, &schedule.minute},
+		{"hour", 0, 23, &schedule.hour},
+		{"day of month", 1, 31, &schedule.dayOfMonth},
+		{"month", 1, 12, &schedule.month},
+		{"day of week", 0, 7, &schedule.dayOfWeek},
+	} {
+		bits, err := parseCronField(fields[i], field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s in schedule %q: %w", field.name, expr, err)
+		}
+		*field.bits = bits
+	}
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+	return schedule, nil
+}
+
+// parseCronField returns the values allowed by a field of a cron expression as a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			part = part[:i]
+		}
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dayOfMonth := c.dayOfMonth&(1<<t.Day()) != 0
+	dayOfWeek := c.dayOfWeek&(1<<t.Weekday()) != 0
+	if c.anyDayOfMonth || c.anyDayOfWeek {
+		return dayOfMonth && dayOfWeek
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// next returns the first time matching the schedule after t, in the location of t, or the zero
+// time if there is none within five years, e.g. for February 30.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// compile validates the reminder and prepares it for use.
+func (r *Reminder) compile() error {
+	var err error
+	if r.cron, err = parseCron(r.Schedule); err != nil {
+		return inField("Schedule", err)
+	}
+	r.location = time.UTC
+	if r.TimeZone != "" {
+		if r.location, err = time.LoadLocation(r.TimeZone); err != nil {
+			return inField("TimeZone", err)
+		}
+	}
+	if r.cron.next(time.Now().In(r.location)).IsZero() {
+		return fieldErrorf("Schedule", "%q never matches", r.Schedule)
+	}
+	return nil
+}
+
+// due returns true if the schedule matched between since and now.
+func (r *Reminder) due(since, now time.Time) bool {
+	next := r.cron.next(since.In(r.location))
+	return !next.IsZero() && !next.After(now)
+}
+
+// postDueReminders posts the reminders which are due, deleting the previous ones. Reminders which
+// were missed since the bot started, or since the last reminder, are posted once.
+func postDueReminders(config *Config, data *Data, bot *tgbotapi.BotAPI, started time.Time, now time.Time) {
+	for _, group := range config.Groups {
+		chatID := group.ChatID
+		if group.Reminder == nil || chatID == 0 || config.botOff(chatID) {
+			continue
+		}
+		data.lock.Lock()
+		chatData := data.chat(chatID)
+		since := started
+		var previous int
+		if posted := chatData.Reminder; posted != nil {
+			since, previous = posted.PostedAt, posted.MessageID
+		}
+		if !group.Reminder.due(since, now) {
+			data.lock.Unlock()
+			continue
+		}
+		// Recorded before posting, so failures are not retried until the next time it is due.
+		posted := &PostedReminder{PostedAt: now}
+		chatData.Reminder = posted
+		data.markChanged()
+		data.lock.Unlock()
+
+		logger := chatLogger(chatID, 0)
+		if previous != 0 {
+			_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(chatID), MessageID: previous})
+			logAction(logger, "delete previous reminder", err, "message_id", previous)
+			if err != nil {
+				metricTelegramErrors.inc("deleteMessage")
+			}
+		}
+		text := group.Reminder.Text
+		if text == "" {
+			text = config.message(config.chatLanguage(chatID), "reminder")
+		}
+		sent, err := send(bot, chatID, tgbotapi.NewMessage(int64(chatID), text))
+		logAction(logger, "post reminder", err)
+		if err != nil {
+			metricTelegramErrors.inc("sendMessage")
+			continue
+		}
+		data.lock.Lock()
+		posted.MessageID = sent.MessageID
+		data.markChanged()
+		data.lock.Unlock()
+	}
+}
+
+func periodicPostReminders(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	started := time.Now()
+	for sleepContext(ctx, time.Minute) {
+		postDueReminders(currentConfig(), data, bot, started, time.Now())
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"time"
+)
+
+// How often a read replica reloads the state written by the live bot.
+const replicaReloadInterval = time.Minute
+
+// reload replaces the state with the state currently in the storage.
+func (d *Data) reload() error {
+	fresh, err := d.storage.Load()
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.copyPersisted(fresh)
+	d.changed = false
+	d.delta = nil
+	return nil
+}
+
+// copyPersisted copies all persisted (exported) fields of fresh, keeping the lock and the
+// storage. Must be called with d.lock held.
+func (d *Data) copyPersisted(fresh *Data) {
+	dst, src := reflect.ValueOf(d).Elem(), reflect.ValueOf(fresh).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if dst.Type().Field(i).IsExported() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// runReadReplica runs the bot as a read replica: it does not connect to Telegram and never
+// writes to the storage, but serves the read-only parts of the HTTP API from the state written by
+// the live bot, reloading it periodically. Heavy analytics queries can be directed to a replica
+// without affecting the latency of the live bot. Returns once ctx is cancelled.
+func runReadReplica(ctx context.Context, config *Config) error {
+	if *listenAddress == "" {
+		return errors.New("-readonly requires -listen")
+	}
+	data := loadData()
+	activate := func() error {
+		replicaConfig := *config
+		return activateSettings(&replicaConfig, data)
+	}
+	if err := activate(); err != nil {
+		return err
+	}
+	go func() {
+		for sleepContext(ctx, replicaReloadInterval) {
+			if err := data.reload(); err != nil {
+				slog.Error("could not reload state", "err", err)
+				markDegraded("could not reload the state: "+err.Error(), false)
+				continue
+			}
+			markHealthy()
+			if err := activate(); err != nil {
+				slog.Error("could not activate reloaded settings", "err", err)
+			}
+		}
+	}()
+	slog.Info("running as read replica")
+	serveHTTP(ctx, data, nil, nil, nil)
+	return nil
+}
@@ -0,0 +1,477 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// A warm standby follows the state of the live bot closely, so that a failover loses seconds of
+// state instead of everything since the last save, which may be minutes old. The live bot streams
+// the rows of the state (see sqliteRows) which changed to standbys on /api/replication every few
+// seconds: all rows when a standby connects, and then the rows recorded as changed by the hot
+// path like for the write-behind saves (see writebehind.go). Only after changes to other parts of
+// the state (see markChanged) are all rows serialized again, and compared to checksums of the rows
+// as last streamed. A standby, started with -standby, does not connect to Telegram: it applies the
+// changes to its state and writes the changed rows to its own storage right away. To fail over,
+// start the standby without -standby.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the changes of the state are streamed to standbys. Also a heartbeat: batches are
+// streamed even if nothing changed.
+const replicationInterval = 2 * time.Second
+
+// A standby reconnects if it received nothing from the live bot for this long.
+const replicationTimeout = 30 * time.Second
+
+// ReplicationBatch are rows of the state which changed, streamed to standbys as one JSON object
+// per line. Deleted rows have an empty value.
+type ReplicationBatch struct {
+	// Set in the first batch of a stream, which contains all rows.
+	Full bool `json:",omitempty"`
+	Rows map[string]string
+}
+
+var metricReplicationBatches = newCounter("scamwarnbot_replication_batches_total",
+	"Batches of state changes streamed to (sent) or applied by (applied) standbys.", "direction")
+
+// replicationHub computes the changes of the state once for all connected standbys.
+type replicationHub struct {
+	lock sync.Mutex
+	// Checksums of the rows as last streamed, by row key, nil if no standby is connected.
+	sums map[string]uint64
+	// Channels of the connected standbys, mapped to whether they still need the full state.
+	subscribers map[chan *ReplicationBatch]bool
+}
+
+func rowSum(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	return hash.Sum64()
+}
+
+// record records rows as streamed and returns those which differ from the rows last streamed.
+// Deleted rows have an empty value. If complete, rows are all rows and the rows missing in it
+// were deleted.
+func (h *replicationHub) record(rows map[string]string, complete bool) map[string]string {
+	changes := map[string]string{}
+	for key, value := range rows {
+		sum, ok := h.sums[key]
+		switch {
+		case value == "" && ok:
+			delete(h.sums, key)
+			changes[key] = ""
+		case value != "" && (!ok || sum != rowSum(value)):
+			h.sums[key] = rowSum(value)
+			changes[key] = value
+		}
+	}
+	if complete {
+		for key := range h.sums {
+			if _, ok := rows[key]; !ok {
+				delete(h.sums, key)
+				changes[key] = ""
+			}
+		}
+	}
+	return changes
+}
+
+var replication = &replicationHub{subscribers: map[chan *ReplicationBatch]bool{}}
+
+func (h *replicationHub) subscribe() chan *ReplicationBatch {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ch := make(chan *ReplicationBatch, 16)
+	h.subscribers[ch] = true
+	return ch
+}
+
+func (h *replicationHub) unsubscribe(ch chan *ReplicationBatch) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// stream sends the rows which changed since the last call to the connected standbys, and all
+// rows to those which just connected. Standbys which do not keep up are disconnected.
+func (h *replicationHub) stream(data *Data) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.subscribers) == 0 {
+		if h.sums != nil {
+			h.sums = nil
+			data.lock.Lock()
+			data.replicaDelta = nil
+			data.lock.Unlock()
+		}
+		return
+	}
+	connected := false
+	for _, full := range h.subscribers {
+		connected = connected || full
+	}
+	changes, rows, err := h.changes(data, connected)
+	if err != nil {
+		slog.Error("could not replicate the state", "err", err)
+		return
+	}
+	for ch, full := range h.subscribers {
+		batch := &ReplicationBatch{Rows: changes}
+		if full {
+			batch = &ReplicationBatch{Full: true, Rows: rows}
+			h.subscribers[ch] = false
+		}
+		select {
+		case ch <- batch:
+			metricReplicationBatches.inc("sent")
+		default:
+			slog.Warn("disconnecting standby which does not keep up")
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// changes returns the rows which changed since the last call, and all rows if a standby just
+// connected.
+func (h *replicationHub) changes(data *Data, connected bool) (changes, rows map[string]string, err error) {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	switch {
+	case h.sums == nil:
+		// The first standby connected.
+		if rows, err = sqliteRows(data); err != nil {
+			return nil, nil, err
+		}
+		h.sums = map[string]uint64{}
+		changes = h.record(rows, true)
+	case data.replicaChanged:
+		if rows, err = sqliteRows(data); err != nil {
+			return nil, nil, err
+		}
+		changes = h.record(rows, true)
+	default:
+		if changes, err = data.rowsOf(data.replicaDelta); err != nil {
+			return nil, nil, err
+		}
+		changes = h.record(changes, false)
+		if connected {
+			if rows, err = sqliteRows(data); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	data.replicaDelta = newStateDelta()
+	data.replicaChanged = false
+	return changes, rows, nil
+}
+
+// closeAll disconnects all standbys.
+func (h *replicationHub) closeAll() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// periodicReplicate streams the changes of the state to the connected standbys until ctx is
+// cancelled.
+func periodicReplicate(ctx context.Context, data *Data) {
+	defer replication.closeAll()
+	for sleepContext(ctx, replicationInterval) {
+		replication.stream(data)
+	}
+}
+
+// isLiveBot returns false for read replicas and standbys, which must not change the state.
+func isLiveBot() bool {
+	return !*readOnly && *standbyOf == ""
+}
+
+// replicationAPIHandler streams the changes of the state to a standby.
+func replicationAPIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isLiveBot() {
+			http.Error(w, "not the live bot", http.StatusForbidden)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		holder, _ := apiTokenHolder(r)
+		logger := slog.With("token_holder", holder, "remote", r.RemoteAddr)
+		logger.Info("standby connected")
+		ch := replication.subscribe()
+		defer replication.unsubscribe(ch)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				logger.Info("standby disconnected")
+				return
+			case batch, ok := <-ch:
+				if !ok {
+					return
+				}
+				if err := encoder.Encode(batch); err != nil {
+					logger.Info("standby disconnected", "err", err)
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+// applyReplicatedRows applies rows streamed by the live bot to the state. Rows with an empty
+// value were deleted. Must be called with d.lock held.
+func (d *Data) applyReplicatedRows(rows map[string]string) error {
+	state := false
+	for key, value := range rows {
+		field, ok := strings.CutPrefix(key, "state/")
+		if !ok {
+			continue
+		}
+		target := reflect.ValueOf(d).Elem().FieldByName(field)
+		if !target.IsValid() || !target.CanSet() {
+			continue
+		}
+		target.Set(reflect.Zero(target.Type()))
+		if value != "" {
+			if err := json.Unmarshal([]byte(value), target.Addr().Interface()); err != nil {
+				return fmt.Errorf("state %s: %w", field, err)
+			}
+		}
+		state = true
+	}
+	if state {
+		d.initialize()
+	}
+	for key, value := range rows {
+		var chatID ChatID
+		if _, err := fmt.Sscanf(key, "chat/%d", &chatID); err != nil {
+			continue
+		}
+		if value == "" {
+			delete(d.ChatData, chatID)
+			continue
+		}
+		chatData := &ChatData{}
+		if err := json.Unmarshal([]byte(value), chatData); err != nil {
+			return fmt.Errorf("chat %d: %w", chatID, err)
+		}
+		chatData.UserData = map[UserID]*UserData{}
+		if old, ok := d.ChatData[chatID]; ok {
+			chatData.UserData = old.UserData
+		}
+		d.ChatData[chatID] = chatData
+	}
+	for key, value := range rows {
+		var chatID ChatID
+		var userID UserID
+		if _, err := fmt.Sscanf(key, "user/%d/%d", &chatID, &userID); err != nil {
+			continue
+		}
+		if value == "" {
+			if chatData, ok := d.ChatData[chatID]; ok {
+				delete(chatData.UserData, userID)
+			}
+			continue
+		}
+		userData := &UserData{}
+		if err := json.Unmarshal([]byte(value), userData); err != nil {
+			return fmt.Errorf("user %d in chat %d: %w", userID, chatID, err)
+		}
+		d.chat(chatID).UserData[userID] = userData
+	}
+	for key, value := range rows {
+		var userID UserID
+		if _, err := fmt.Sscanf(key, "profile/%d", &userID); err != nil {
+			continue
+		}
+		if value == "" {
+			delete(d.Users, userID)
+			continue
+		}
+		profile := &UserInfo{}
+		if err := json.Unmarshal([]byte(value), profile); err != nil {
+			return fmt.Errorf("profile of user %d: %w", userID, err)
+		}
+		d.Users[userID] = profile
+	}
+	return nil
+}
+
+// saveReplicatedRows writes rows streamed by the live bot to the storage. Storages which do not
+// write rows save the whole state.
+func (d *Data) saveReplicatedRows(rows map[string]string, complete bool) {
+	writer, ok := d.storage.(rowWriter)
+	if ok {
+		d.saveLock.Lock()
+		err := writer.writeRows(rows, complete)
+		d.saveLock.Unlock()
+		if err == nil {
+			markHealthy()
+			return
+		}
+		slog.Error("could not save replicated rows", "err", err)
+	}
+	d.lock.Lock()
+	d.changed = true
+	d.lock.Unlock()
+	d.save()
+}
+
+// followLeader applies the changes of the state streamed by the live bot at leaderURL, writing
+// the changed rows to the storage after every batch. Returns once the stream ends or ctx is
+// cancelled.
+func followLeader(ctx context.Context, config *Config, data *Data, leaderURL string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, leaderURL+"/api/replication", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.StandbyToken)
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("live bot responded with %s", response.Status)
+	}
+
+	// Cancel the request if nothing arrives in time, e.g. because the live bot hangs.
+	received := make(chan struct{}, 1)
+	go func() {
+		timer := time.NewTimer(replicationTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-received:
+				timer.Reset(replicationTimeout)
+			case <-timer.C:
+				slog.Warn("no state changes received from the live bot in time")
+				cancel()
+				return
+			}
+		}
+	}()
+
+	started := false
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(nil, 256<<20)
+	for scanner.Scan() {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		var batch ReplicationBatch
+		if err := json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+			return err
+		}
+		if batch.Full {
+			fresh, err := dataFromRows(batch.Rows)
+			if err != nil {
+				return err
+			}
+			data.lock.Lock()
+			data.copyPersisted(fresh)
+			data.lock.Unlock()
+			started = true
+		} else if !started {
+			return errors.New("stream did not start with the full state")
+		} else if len(batch.Rows) == 0 {
+			markHealthy()
+			continue
+		} else {
+			data.lock.Lock()
+			err := data.applyReplicatedRows(batch.Rows)
+			data.lock.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		data.saveReplicatedRows(batch.Rows, batch.Full)
+		if _, ok := batch.Rows[stateRowKey("Settings")]; ok || batch.Full {
+			standbyConfig := *config
+			if err := activateSettings(&standbyConfig, data); err != nil {
+				slog.Error("could not activate replicated settings", "err", err)
+			}
+		}
+		metricReplicationBatches.inc("applied")
+		slog.Debug("applied state changes", "rows", len(batch.Rows), "full", batch.Full)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("live bot closed the stream")
+}
+
+// runStandby runs the bot as a warm standby of the live bot at leaderURL, keeping its storage up
+// to date. Serves the read-only parts of the HTTP API if -listen is set. Returns once ctx is
+// cancelled.
+func runStandby(ctx context.Context, config *Config, leaderURL string) error {
+	if config.StandbyToken == "" {
+		return errors.New("-standby requires StandbyToken in the config")
+	}
+	data := loadData()
+	standbyConfig := *config
+	if err := activateSettings(&standbyConfig, data); err != nil {
+		return err
+	}
+	if *listenAddress != "" {
+		go serveHTTP(ctx, data, nil, nil, nil)
+	}
+	slog.Info("running as standby", "leader", leaderURL)
+	for {
+		err := followLeader(ctx, config, data, leaderURL)
+		if ctx.Err() != nil {
+			data.save()
+			return nil
+		}
+		slog.Error("lost the live bot", "err", err)
+		markDegraded("lost the live bot: "+err.Error(), false)
+		if !sleepContext(ctx, 5*time.Second) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The classic scam in support chats happens in the replies: a user asks a question, and an account
+// without any history in the chat replies with an offer to "contact support" or a t.me link to a
+// fake helpdesk. Such replies of new accounts to questions of others are scored, so they are
+// reported or deleted depending on FlagScore and DeleteScore.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var replyScamPhrasesDefault = []string{
+	"contact support", "contact the support", "support team", "customer care", "help desk", "helpdesk",
+	"live agent", "technical team", "file a ticket", "raise a ticket", "submit a ticket", "write to support",
+	"message the admin", "dm the admin", "reach out to", "kontaktiere den support", "support kontaktieren",
+}
+
+// telegramLinkPattern matches links to Telegram accounts and chats.
+var telegramLinkPattern = regexp.MustCompile(`(?i)\b(t\.me|telegram\.me)/`)
+
+// ReplyScamDetector scores replies of new accounts to the questions of others which offer support
+// or link to a Telegram account.
+type ReplyScamDetector struct {
+	// Phrases offering support, matched case-insensitively. Defaults to a list of common phrases.
+	Phrases []string `json:",omitempty"`
+	// Replies of accounts first seen in the chat within this time are checked. Defaults to
+	// NewMemberAge.
+	MaxAccountAge jsonDuration `json:",omitempty"`
+	// Score of a reply offering support. Defaults to DeleteScore, or FlagScore if deletion is
+	// disabled.
+	PhraseScore float64 `json:",omitempty"`
+	// Score of a reply with a Telegram link. Defaults to FlagScore. Adds up with PhraseScore.
+	LinkScore float64 `json:",omitempty"`
+}
+
+func (r *ReplyScamDetector) setDefaults(newMemberAge time.Duration, flagScore, deleteScore float64) {
+	if len(r.Phrases) == 0 {
+		r.Phrases = replyScamPhrasesDefault
+	}
+	if r.MaxAccountAge.Duration == 0 {
+		r.MaxAccountAge.Duration = newMemberAge
+	}
+	if r.PhraseScore == 0 {
+		r.PhraseScore = deleteScore
+	}
+	if r.PhraseScore == 0 {
+		r.PhraseScore = flagScore
+	}
+	if r.LinkScore == 0 {
+		r.LinkScore = flagScore
+	}
+}
+
+// hasTelegramLink returns true if the message links to Telegram, in the text or in a text link.
+func hasTelegramLink(msg *tgbotapi.Message) bool {
+	if telegramLinkPattern.MatchString(messageText(msg)) {
+		return true
+	}
+	if msg.Entities != nil {
+		for _, entity := range *msg.Entities {
+			if entity.Type == "text_link" && telegramLinkPattern.MatchString(entity.URL) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detectReplyScams scores replies of new accounts to the questions of others offering support or
+// linking to Telegram.
+func detectReplyScams(config *Config, data *Data, msg *tgbotapi.Message) []Finding {
+	detector := config.ReplyScams
+	question := msg.ReplyToMessage
+	if detector == nil || question == nil || question.From == nil || question.From.ID == msg.From.ID || question.From.IsBot {
+		return nil
+	}
+	questionText := messageText(question)
+	if !isQuestion(questionText) && !questionPattern.MatchString(questionText) {
+		return nil
+	}
+	chatID := ChatID(msg.Chat.ID)
+	data.lock.Lock()
+	firstSeenAt := data.chat(chatID).user(UserID(msg.From.ID)).FirstSeenAt
+	data.lock.Unlock()
+	if firstSeenAt.IsZero() || time.Since(firstSeenAt) > detector.MaxAccountAge.Duration {
+		return nil
+	}
+
+	var findings []Finding
+	text := strings.ToLower(messageText(msg))
+	for _, phrase := range detector.Phrases {
+		if strings.Contains(text, strings.ToLower(phrase)) {
+			findings = append(findings, Finding{
+				Detector: "reply-scam",
+				Score:    detector.PhraseScore,
+				Reason:   fmt.Sprintf("new account replied to a question of %s with %q", question.From.String(), phrase),
+				Category: "fake-support",
+				Shadow:   config.isShadow(chatID, "reply-scam"),
+			})
+			break
+		}
+	}
+	if hasTelegramLink(msg) {
+		findings = append(findings, Finding{
+			Detector: "reply-scam-link",
+			Score:    detector.LinkScore,
+			Reason:   fmt.Sprintf("new account replied to a question of %s with a Telegram link", question.From.String()),
+			Category: "fake-support",
+			Shadow:   config.isShadow(chatID, "reply-scam-link"),
+		})
+	}
+	return findings
+}
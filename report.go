@@ -0,0 +1,124 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const reportContextMessagesDefault = 5
+
+// Supergroup and channel IDs are -100 followed by the internal ID used in t.me/c/ links.
+const supergroupIDOffset = -1000000000000
+
+// recordMessage remembers the ID of a message posted in a chat so that admin reports can link to
+// the keep messages preceding an offending message. Must be called with data.lock held.
+func (c *ChatData) recordMessage(messageID int, keep int) {
+	c.RecentMessageIDs = append(c.RecentMessageIDs, messageID)
+	// The offending message itself is recorded too, before it is reported.
+	if len(c.RecentMessageIDs) > keep+1 {
+		c.RecentMessageIDs = c.RecentMessageIDs[len(c.RecentMessageIDs)-keep-1:]
+	}
+}
+
+// messagesBefore returns up to n message IDs recorded before the given message, oldest first.
+// Must be called with data.lock held.
+func (c *ChatData) messagesBefore(messageID int, n int) []int {
+	var result []int
+	for _, id := range c.RecentMessageIDs {
+		if id < messageID {
+			result = append(result, id)
+		}
+	}
+	if len(result) > n {
+		result = result[len(result)-n:]
+	}
+	return result
+}
+
+// messageLink returns a t.me deep link to a message, or an empty string if the chat type does not
+// support links (basic groups).
+func messageLink(chat *tgbotapi.Chat, messageID int) string {
+	if chat.UserName != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", chat.UserName, messageID)
+	}
+	if chat.IsSuperGroup() || chat.IsChannel() {
+		return fmt.Sprintf("https://t.me/c/%d/%d", supergroupIDOffset-chat.ID, messageID)
+	}
+	return ""
+}
+
+// notifyAdmins sends a message to the admin chat in the background, so a busy admin chat does
+// not hold up the processing of updates.
+func notifyAdmins(config *Config, bot *tgbotapi.BotAPI, text string) {
+	if config.AdminChatID == 0 {
+		return
+	}
+	notification := tgbotapi.NewMessage(config.AdminChatID, text)
+	notification.DisableWebPagePreview = true
+	enqueueSend(bot, ChatID(config.AdminChatID), notification, func(_ tgbotapi.Message, err error) {
+		if err != nil {
+			slog.Error("could not notify admins", "err", err)
+		}
+	})
+}
+
+// notifyOwners sends a private message to each owner of the bot.
+func notifyOwners(config *Config, bot *tgbotapi.BotAPI, text string) {
+	for _, owner := range config.Owners {
+		sendText(bot, int64(owner), text)
+	}
+}
+
+// reportToAdmins sends a report about a message to the admin chat, including a deep link to the
+// message and to the messages that preceded it, so moderators can jump straight to the context.
+func reportToAdmins(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, reason string) {
+	if config.AdminChatID == 0 {
+		return
+	}
+	notifyAdmins(config, bot, reportText(config, data, msg, reason))
+}
+
+// reportText renders a report about a message for the admin chat.
+func reportText(config *Config, data *Data, msg *tgbotapi.Message, reason string) string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "%s\n\nChat: %s (%d)\n", reason, msg.Chat.Title, msg.Chat.ID)
+	if msg.From != nil {
+		fmt.Fprintf(&text, "User: %s (%d)\n", msg.From.String(), msg.From.ID)
+	}
+
+	if link := messageLink(msg.Chat, msg.MessageID); link != "" {
+		fmt.Fprintf(&text, "Message: %s\n", link)
+
+		data.lock.Lock()
+		var contextIDs []int
+		if chatData, ok := data.ChatData[ChatID(msg.Chat.ID)]; ok {
+			contextIDs = chatData.messagesBefore(msg.MessageID, config.ReportContextMessages)
+		}
+		data.lock.Unlock()
+
+		if len(contextIDs) > 0 {
+			text.WriteString("Context:\n")
+			for _, id := range contextIDs {
+				fmt.Fprintf(&text, "- %s\n", messageLink(msg.Chat, id))
+			}
+		}
+	}
+	return text.String()
+}
@@ -0,0 +1,45 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestReportContextMessages(t *testing.T) {
+	config := &Config{}
+	config.ReportContextMessages = 3
+	data := newLoadData(t)
+	chat := &tgbotapi.Chat{ID: -1004, Type: "supergroup", Title: "Report test", UserName: "reporttest"}
+	msg := &tgbotapi.Message{MessageID: 10, Chat: chat, From: &tgbotapi.User{ID: 42, FirstName: "Scammer"}}
+	for id := 1; id <= msg.MessageID; id++ {
+		data.chat(ChatID(chat.ID)).recordMessage(id, config.ReportContextMessages)
+	}
+
+	text := reportText(config, data, msg, "Flagged")
+	var links []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "- ") {
+			links = append(links, strings.TrimPrefix(line, "- "))
+		}
+	}
+	want := []string{"https://t.me/reporttest/7", "https://t.me/reporttest/8", "https://t.me/reporttest/9"}
+	if strings.Join(links, " ") != strings.Join(want, " ") {
+		t.Errorf("got context links %q, want %q", links, want)
+	}
+}
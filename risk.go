@@ -0,0 +1,239 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// To see whether new protections pay off, the dashboard charts the risk the communities are
+// exposed to over time. The scores of the scanned messages are summed up per day, per chat and
+// per user, and served by /api/risk with rolling means.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Days of risk samples kept.
+	riskTrendDays = 90
+	// Days over which /api/risk averages the scores by default.
+	riskRollingDaysDefault = 7
+)
+
+// RiskSample sums up the scores of the messages of one day.
+type RiskSample struct {
+	// The day in UTC, formatted as 2006-01-02.
+	Day      string
+	Messages int
+	// Sum and maximum of the scores of the messages.
+	Score   float64
+	Max     float64 `json:",omitempty"`
+	Flagged int     `json:",omitempty"`
+	// Warnings sent in a chat. Always zero for users.
+	Warnings int `json:",omitempty"`
+}
+
+// daySample returns the sample of the day of the given time, adding it to the samples if needed
+// and dropping samples older than riskTrendDays.
+func daySample(samples []*RiskSample, at time.Time) ([]*RiskSample, *RiskSample) {
+	day := at.UTC().Format("2006-01-02")
+	if len(samples) == 0 || samples[len(samples)-1].Day != day {
+		samples = append(samples, &RiskSample{Day: day})
+		cutoff := at.UTC().AddDate(0, 0, -riskTrendDays).Format("2006-01-02")
+		for len(samples) > 0 && samples[0].Day <= cutoff {
+			samples = samples[1:]
+		}
+	}
+	return samples, samples[len(samples)-1]
+}
+
+// addRiskSample adds the score of a message to the samples.
+func addRiskSample(samples []*RiskSample, at time.Time, score float64, flagged bool) []*RiskSample {
+	samples, sample := daySample(samples, at)
+	sample.Messages++
+	sample.Score += score
+	if score > sample.Max {
+		sample.Max = score
+	}
+	if flagged {
+		sample.Flagged++
+	}
+	return samples
+}
+
+// recordRisk records the score of a scanned message. Users get samples from their first message
+// with a positive score on, so users who never looked suspicious cost nothing.
+func (d *Data) recordRisk(chatID ChatID, userID UserID, at time.Time, score float64, flagged bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	chatData := d.chat(chatID)
+	chatData.Risk = addRiskSample(chatData.Risk, at, score, flagged)
+	userData := chatData.user(userID)
+	if score > 0 || len(userData.Risk) > 0 {
+		userData.Risk = addRiskSample(userData.Risk, at, score, flagged)
+	}
+	d.chatChanged(chatID)
+	d.userChanged(chatID, userID)
+}
+
+// recordWarning counts a warning sent in a chat.
+func (d *Data) recordWarning(chatID ChatID, at time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	chatData := d.chat(chatID)
+	var sample *RiskSample
+	chatData.Risk, sample = daySample(chatData.Risk, at)
+	sample.Warnings++
+	d.chatChanged(chatID)
+}
+
+// sumSamples returns the messages and warnings of the samples of the days from since on.
+func sumSamples(samples []*RiskSample, since time.Time) (messages int, warnings int) {
+	day := since.UTC().Format("2006-01-02")
+	for _, sample := range samples {
+		if sample.Day >= day {
+			messages += sample.Messages
+			warnings += sample.Warnings
+		}
+	}
+	return messages, warnings
+}
+
+// RiskPoint is a day of a risk trend.
+type RiskPoint struct {
+	RiskSample
+	// Mean score per message over the rolling window ending with the day.
+	Rolling float64
+}
+
+// RiskTrend is the risk trend of a chat or a user, served by /api/risk.
+type RiskTrend struct {
+	ChatID ChatID `json:",omitempty"`
+	UserID UserID `json:",omitempty"`
+	Title  string `json:",omitempty"`
+	Points []RiskPoint
+}
+
+// riskTrend computes the points of a trend from samples sorted by day, averaging over the given
+// number of days.
+func riskTrend(samples []*RiskSample, rollingDays int) []RiskPoint {
+	points := []RiskPoint{}
+	for i, sample := range samples {
+		day, err := time.Parse("2006-01-02", sample.Day)
+		if err != nil {
+			continue
+		}
+		windowStart := day.AddDate(0, 0, 1-rollingDays).Format("2006-01-02")
+		messages, score := 0, 0.0
+		for j := i; j >= 0 && samples[j].Day >= windowStart; j-- {
+			messages += samples[j].Messages
+			score += samples[j].Score
+		}
+		point := RiskPoint{RiskSample: *sample}
+		if messages > 0 {
+			point.Rolling = score / float64(messages)
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// userRiskSamples merges the samples of a user in all chats. Must be called with d.lock held.
+func (d *Data) userRiskSamples(userID UserID) []*RiskSample {
+	byDay := map[string]*RiskSample{}
+	for _, chatData := range d.ChatData {
+		userData, ok := chatData.UserData[userID]
+		if !ok {
+			continue
+		}
+		for _, sample := range userData.Risk {
+			merged, ok := byDay[sample.Day]
+			if !ok {
+				merged = &RiskSample{Day: sample.Day}
+				byDay[sample.Day] = merged
+			}
+			merged.Messages += sample.Messages
+			merged.Score += sample.Score
+			merged.Flagged += sample.Flagged
+			if sample.Max > merged.Max {
+				merged.Max = sample.Max
+			}
+		}
+	}
+	var samples []*RiskSample
+	for _, day := range sortedKeys(byDay) {
+		samples = append(samples, byDay[day])
+	}
+	return samples
+}
+
+// riskAPIHandler serves the risk trends of all chats, or of the chat or the user given by the
+// "chat" or "user" parameter. The "rolling" parameter sets the days of the rolling mean.
+func riskAPIHandler(data *Data) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		rollingDays := riskRollingDaysDefault
+		if rolling := query.Get("rolling"); rolling != "" {
+			days, err := strconv.Atoi(rolling)
+			if err != nil || days < 1 || days > riskTrendDays {
+				http.Error(w, "invalid rolling", http.StatusBadRequest)
+				return
+			}
+			rollingDays = days
+		}
+
+		var trends []RiskTrend
+		data.lock.Lock()
+		switch {
+		case query.Get("user") != "":
+			userID, err := strconv.Atoi(query.Get("user"))
+			if err != nil {
+				data.lock.Unlock()
+				http.Error(w, "invalid user", http.StatusBadRequest)
+				return
+			}
+			trends = append(trends, RiskTrend{
+				UserID: UserID(userID),
+				Title:  data.describeUser(UserID(userID)),
+				Points: riskTrend(data.userRiskSamples(UserID(userID)), rollingDays),
+			})
+		default:
+			chatIDs := sortedKeys(data.ChatData)
+			if query.Get("chat") != "" {
+				chatID, err := strconv.ParseInt(query.Get("chat"), 10, 64)
+				if err != nil {
+					data.lock.Unlock()
+					http.Error(w, "invalid chat", http.StatusBadRequest)
+					return
+				}
+				chatIDs = []ChatID{ChatID(chatID)}
+			}
+			for _, chatID := range chatIDs {
+				trend := RiskTrend{ChatID: chatID, Title: data.chatTitle(chatID), Points: []RiskPoint{}}
+				if chatData, ok := data.ChatData[chatID]; ok {
+					trend.Points = riskTrend(chatData.Risk, rollingDays)
+				}
+				trends = append(trends, trend)
+			}
+		}
+		data.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(trends)
+	})
+}
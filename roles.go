@@ -0,0 +1,153 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Role is the bot-level permission level of a user. Each role includes the permissions of the
+// roles below it.
+type Role int
+
+const (
+	roleNone Role = iota
+	// May run read-only commands such as /whois and /audit.
+	roleViewer
+	// May moderate users: /watch, /restrict, /ban, /strike, ...
+	roleModerator
+	// May change the settings and run destructive commands such as /purge and /broadcast.
+	roleAdmin
+	// May assign the admin and owner roles. The Owners of the config file are always owners.
+	roleOwner
+)
+
+var roleNames = []string{"none", "viewer", "moderator", "admin", "owner"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+func parseRole(s string) (Role, error) {
+	for i, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return Role(i), nil
+		}
+	}
+	return roleNone, fmt.Errorf("unknown role %q; known roles: %s", s, strings.Join(roleNames, ", "))
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	var err error
+	*r, err = parseRole(string(text))
+	return err
+}
+
+// isOwner returns true if the user is one of the Owners of the config file.
+func (c *Config) isOwner(userID UserID) bool {
+	for _, owner := range c.Owners {
+		if owner == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// userRole returns the role of a user in a chat: the highest of the role assigned via /role, the
+// owner role of the config file and TelegramAdminRole if the user is an admin of the chat.
+func userRole(config *Config, data *Data, bot *tgbotapi.BotAPI, chatID ChatID, userID UserID) Role {
+	if config.isOwner(userID) {
+		return roleOwner
+	}
+	data.lock.Lock()
+	role := data.Roles[userID]
+	data.lock.Unlock()
+	if role < config.telegramAdminRole && isChatAdmin(config, bot, chatID, userID) {
+		role = config.telegramAdminRole
+	}
+	return role
+}
+
+// hasRole returns true if the author of a message has at least the given role in the chat.
+func hasRole(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, role Role) bool {
+	return userRole(config, data, bot, ChatID(msg.Chat.ID), UserID(msg.From.ID)) >= role
+}
+
+// cmdRole lists the assigned roles or assigns a role: `/role` or `/role @user <role>`. Only
+// owners may assign or revoke the admin and owner roles.
+func cmdRole(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	if strings.TrimSpace(msg.CommandArguments()) == "" && msg.ReplyToMessage == nil {
+		data.lock.Lock()
+		defer data.lock.Unlock()
+		var lines []string
+		for _, owner := range config.Owners {
+			lines = append(lines, fmt.Sprintf("%s: owner (config file)", data.describeUser(owner)))
+		}
+		for userID, role := range data.Roles {
+			lines = append(lines, fmt.Sprintf("%s: %s", data.describeUser(userID), role))
+		}
+		if len(lines) == 0 {
+			return tr(config, msg, "No roles assigned. Telegram chat admins are %s.", config.telegramAdminRole)
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	}
+
+	userID, args, err := resolveTarget(data, msg)
+	if err != nil {
+		return err.Error()
+	}
+	if len(args) != 1 {
+		return tr(config, msg, "Usage: /role @user <%s>", strings.Join(roleNames, "|"))
+	}
+	role, err := parseRole(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	if config.isOwner(userID) {
+		return tr(config, msg, "Owners of the config file cannot be changed here.")
+	}
+	actorRole := userRole(config, data, bot, ChatID(msg.Chat.ID), UserID(msg.From.ID))
+
+	data.lock.Lock()
+	previous := data.Roles[userID]
+	if (role >= roleAdmin || previous >= roleAdmin) && actorRole < roleOwner {
+		data.lock.Unlock()
+		return tr(config, msg, "Only owners can assign or revoke the admin and owner roles.")
+	}
+	if role == roleNone {
+		delete(data.Roles, userID)
+	} else {
+		data.Roles[userID] = role
+	}
+	data.markChanged()
+	description := data.describeUser(userID)
+	data.lock.Unlock()
+
+	data.audit(auditAreaRoles, telegramActor(msg.From), 0,
+		fmt.Sprintf("changed role of %s from %s to %s", description, previous, role))
+	return tr(config, msg, "%s is now %s.", description, role)
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// RulePack is a built-in set of rules against a common scam playbook. Packs are shipped with the
+// binary, so chats which enabled a pack get its improvements with every update. The version is
+// increased whenever the rules of a pack change.
+type RulePack struct {
+	Name        string
+	Version     int
+	Description string
+	Rules       []*Rule
+	// If set, the scores of the pack's findings are multiplied by this factor if the message
+	// contains a link or its author is a new member (see NewMemberAge), as the pattern is far more
+	// likely a scam in this context.
+	ContextFactor float64
+}
+
+var rulePacks = []*RulePack{
+	{
+		Name:        "fake-support",
+		Version:     1,
+		Description: "Scammers posing as support staff, asking users to contact them privately",
+		Rules: []*Rule{
+			{Name: "contact-support", Category: "fake-support", Score: 0.5,
+				Pattern: `(?i)\b(contact|message|dm|write to|reach out to)\b.{0,30}\b(support|help ?desk|customer (care|service)|admins?)\b`},
+			{Name: "support-handle", Category: "fake-support", Score: 1,
+				Pattern: `(?i)\b(official|technical|live|customer)\s+support\b.{0,40}(@\w{5,}|t\.me/)`},
+			{Name: "open-ticket", Category: "fake-support", Score: 0.5,
+				Pattern: `(?i)\b(open|file|raise|submit)\s+(a\s+)?(support\s+)?ticket\b`},
+		},
+	},
+	{
+		Name:        "giveaway",
+		Version:     1,
+		Description: "Fake giveaways and airdrops promising to multiply coins sent to the scammer",
+		Rules: []*Rule{
+			{Name: "giveaway", Category: "giveaway", Score: 0.5,
+				Pattern: `(?i)\b(giveaway|airdrop|free (btc|bitcoin|crypto))\b`},
+			{Name: "send-to-receive", Category: "giveaway", Score: 1,
+				Pattern: `(?i)\bsend\b.{0,40}\b(get|receive)\b.{0,30}\b(back|double|2x|twice)\b`},
+			{Name: "double-your-coins", Category: "giveaway", Score: 1,
+				Pattern: `(?i)\b(double|2x|x2|triple)\s+your\s+(btc|bitcoin|eth|crypto|coins|funds)\b`},
+		},
+	},
+	{
+		Name:        "recovery-service",
+		Version:     1,
+		Description: "Fraudulent services offering to recover lost or stolen funds",
+		Rules: []*Rule{
+			{Name: "recover-funds", Category: "recovery-service", Score: 1,
+				Pattern: `(?i)\b(recover|retrieve|get back)\b.{0,30}\b(lost|stolen|scammed)\b.{0,30}\b(funds|crypto|bitcoin|btc|coins|wallet)\b`},
+			{Name: "recovery-service", Category: "recovery-service", Score: 1,
+				Pattern: `(?i)\b(funds?|crypto|asset|bitcoin)\s+recovery\s+(service|expert|agency|company)\b`},
+			{Name: "recovery-testimonial", Category: "recovery-service", Score: 0.5,
+				Pattern: `(?i)\b(hacker|expert|specialist)\b.{0,40}\b(recovered|helped me (recover|get back))\b`},
+		},
+	},
+	{
+		Name:        "wallet-validation",
+		Version:     1,
+		Description: "Requests to validate, synchronize or rectify a wallet, usually to steal the seed",
+		Rules: []*Rule{
+			{Name: "validate-wallet", Category: "wallet-validation", Score: 0.5,
+				Pattern: `(?i)\b(validate|synchroni[sz]e|rectify|whitelist|re-?activate)\b.{0,30}\b(wallet|device|bitbox|account)\b`},
+			{Name: "seed-request", Category: "wallet-validation", Score: 1,
+				Pattern: `(?i)\b(enter|share|send|type|import)\b.{0,30}\b(seed|recovery|secret|backup)\s*(phrase|words)\b`},
+		},
+	},
+	{
+		Name:    "giveaway-announcement",
+		Version: 1,
+		Description: "Announcements of fake giveaways with prize amounts and urgency, weighing heavier " +
+			"with links or from new members",
+		Rules: []*Rule{
+			{Name: "prize-amount", Category: "giveaway", Score: 0.4,
+				Pattern: `(?i)\b(win|won|prizes?|rewards?|giv(e|ing) ?away|airdrop|distribut\w+)\b.{0,40}(\$\s?\d[\d,.]*k?|\b\d[\d,.]*k?\s?(\$|(usdt?|btc|eth|bitcoin)\b))`},
+			{Name: "countdown", Category: "giveaway", Score: 0.3,
+				Pattern: `(?i)\b(only|just|last)\s+\d+\s+(hours?|hrs|minutes?|mins|spots?|places?|slots?)\s+(left|remaining)\b|\b(ends?|closes?|expires?)\s+(in \d+|today|tonight|soon)\b|\bhurry( up)?\b`},
+			{Name: "first-n-users", Category: "giveaway", Score: 0.4,
+				Pattern: `(?i)\b(first|next)\s+\d+\s+(users?|people|members|participants|persons)\b`},
+		},
+		ContextFactor: 2,
+	},
+	{
+		Name:        "wallet-drainer",
+		Version:     1,
+		Description: "Links to phishing sites asking users to connect their wallet, which then drain it",
+		Rules: []*Rule{
+			{Name: "connect-wallet", Category: "wallet-drainer", Score: 0.5,
+				Pattern: `(?i)\b(connect|link|sync)\s+(your\s+)?wallet\b.{0,60}(https?://|www\.|\w+\.(app|xyz|io|site|online|live)\b)`},
+			{Name: "claim-link", Category: "wallet-drainer", Score: 1,
+				Pattern: `(?i)\b(claim|mint|airdrop|reward)s?\b.{0,40}\bhttps?://\S*(claim|mint|airdrop|reward|connect|dapp)`},
+			{Name: "lookalike-domain", Category: "wallet-drainer", Score: 1,
+				Pattern: `(?i)https?://\S*(bitbox|shiftcrypto|shift-crypto)\S*\.(app|xyz|site|online|live|top|click|pages\.dev|web\.app)\b`},
+		},
+	},
+}
+
+func init() {
+	for _, pack := range rulePacks {
+		for _, rule := range pack.Rules {
+			rule.re = regexp.MustCompile(rule.Pattern)
+		}
+	}
+}
+
+// rulePack returns the built-in rule pack with the given name, or nil.
+func rulePack(name string) *RulePack {
+	for _, pack := range rulePacks {
+		if strings.EqualFold(pack.Name, name) {
+			return pack
+		}
+	}
+	return nil
+}
+
+// enabledRulePacks returns the rule packs enabled in a chat.
+func (s *Settings) enabledRulePacks(chatID ChatID) []*RulePack {
+	group := s.group(chatID)
+	if group == nil {
+		return nil
+	}
+	var packs []*RulePack
+	for _, name := range group.RulePacks {
+		if pack := rulePack(name); pack != nil {
+			packs = append(packs, pack)
+		}
+	}
+	return packs
+}
+
+// cmdRulePacks lists the built-in rule packs and enables or disables them in the chat the command
+// is used in: `/rulepacks [enable|disable <name>]`.
+func cmdRulePacks(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	chatID := ChatID(msg.Chat.ID)
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		enabled := map[*RulePack]bool{}
+		for _, pack := range config.enabledRulePacks(chatID) {
+			enabled[pack] = true
+		}
+		var text strings.Builder
+		for _, pack := range rulePacks {
+			status := "disabled"
+			if enabled[pack] {
+				status = "enabled"
+			}
+			text.WriteString(tr(config, msg, "%s (version %d, %d rules, %s): %s\n",
+				pack.Name, pack.Version, len(pack.Rules), tr(config, msg, status), pack.Description))
+		}
+		return text.String()
+	}
+	if len(args) != 2 || (args[0] != "enable" && args[0] != "disable") {
+		return tr(config, msg, "Usage: /rulepacks [enable|disable <name>]")
+	}
+	if int64(chatID) == config.AdminChatID {
+		return tr(config, msg, "Rule packs are enabled per chat. Use this command in the group.")
+	}
+	if !hasRole(config, data, bot, msg, roleAdmin) {
+		return tr(config, msg, "Changing rule packs requires the admin role.")
+	}
+	pack := rulePack(args[1])
+	if pack == nil {
+		return tr(config, msg, "No rule pack %q.", args[1])
+	}
+
+	version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+		group := settings.group(chatID)
+		if group == nil {
+			group = &GroupConfig{ChatID: chatID}
+			settings.Groups = append(settings.Groups, group)
+		}
+		var names []string
+		for _, name := range group.RulePacks {
+			if !strings.EqualFold(name, pack.Name) {
+				names = append(names, name)
+			}
+		}
+		if args[0] == "enable" {
+			names = append(names, pack.Name)
+		}
+		group.RulePacks = names
+		return nil
+	})
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+	messageLogger(msg).Info("rule pack changed", "pack", pack.Name, "change", args[0])
+	data.audit(auditAreaSettings, telegramActor(msg.From), version,
+		fmt.Sprintf("%sd rule pack %s in chat %s", args[0], pack.Name, msg.Chat.Title))
+	if args[0] == "enable" {
+		return tr(config, msg, "Rule pack %s enabled.", pack.Name)
+	}
+	return tr(config, msg, "Rule pack %s disabled.", pack.Name)
+}
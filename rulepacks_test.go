@@ -0,0 +1,83 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const rulePackTestChatID = -1003
+
+func TestGiveawayAnnouncementPack(t *testing.T) {
+	config := &Config{}
+	config.Groups = []*GroupConfig{{ChatID: rulePackTestChatID, RulePacks: []string{"giveaway-announcement"}}}
+	config.setDefaults()
+	if err := config.compile(); err != nil {
+		t.Fatal(err)
+	}
+	const established, newMember = 1, 2
+	data := &Data{}
+	data.initialize()
+	data.chat(rulePackTestChatID).UserData[established] = &UserData{
+		FirstSeenAt: time.Now().Add(-2 * config.NewMemberAge.Duration),
+	}
+
+	tests := []struct {
+		name      string
+		userID    UserID
+		text      string
+		detectors []string
+		score     float64
+	}{
+		{"regular question", established, "Does the BitBox02 support Litecoin?", nil, 0},
+		{"prize amount", established, "We are giving away $5,000 in BTC to our community",
+			[]string{"prize-amount"}, 0.4},
+		{"prize amount in coins", established, "Win 0.5 BTC today!", []string{"prize-amount"}, 0.4},
+		{"countdown", established, "Hurry, only 3 hours left", []string{"countdown"}, 0.3},
+		{"first users", established, "The first 100 users get a bonus", []string{"first-n-users"}, 0.4},
+		{"announcement", established, "Airdrop of 10,000 USDT for the first 500 participants, ends today!",
+			[]string{"prize-amount", "countdown", "first-n-users"}, 1.1},
+		{"announcement with link", established, "Giveaway: $1000 for the first 50 users at https://example.xyz",
+			[]string{"prize-amount", "first-n-users"}, 1.6},
+		{"announcement by new member", newMember, "Giveaway: $1000 for the first 50 users",
+			[]string{"prize-amount", "first-n-users"}, 1.6},
+		{"context without pattern", newMember, "Release notes: https://example.com/news", nil, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := &tgbotapi.Message{
+				Chat: &tgbotapi.Chat{ID: rulePackTestChatID, Type: "supergroup"},
+				From: &tgbotapi.User{ID: int(test.userID)},
+				Text: test.text,
+			}
+			findings := detect(config, data, msg)
+			if len(findings) != len(test.detectors) {
+				t.Fatalf("got findings %v, want %v", findings, test.detectors)
+			}
+			for i, finding := range findings {
+				if want := "pack:giveaway-announcement/" + test.detectors[i]; finding.Detector != want {
+					t.Errorf("finding %d: got detector %s, want %s", i, finding.Detector, want)
+				}
+			}
+			if score := totalScore(findings); math.Abs(score-test.score) > 1e-9 {
+				t.Errorf("got score %.2f, want %.2f", score, test.score)
+			}
+		})
+	}
+}
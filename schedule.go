@@ -0,0 +1,187 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is a daily time window, e.g. from "00:00" to "07:00" in "Europe/Zurich". Windows may
+// span midnight ("22:00" to "06:00").
+type Schedule struct {
+	Start    string
+	End      string
+	TimeZone string
+
+	start, end time.Duration
+	location   *time.Location
+}
+
+// parseClock parses a time of day like "07:30" into the offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// compile validates the schedule and prepares it for use. A schedule without start and end is
+// never active.
+func (s *Schedule) compile() error {
+	if s.Start == "" && s.End == "" {
+		return nil
+	}
+	var err error
+	if s.start, err = parseClock(s.Start); err != nil {
+		return err
+	}
+	if s.end, err = parseClock(s.End); err != nil {
+		return err
+	}
+	s.location = time.UTC
+	if s.TimeZone != "" {
+		if s.location, err = time.LoadLocation(s.TimeZone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// active returns true if the given time lies within the window.
+func (s *Schedule) active(now time.Time) bool {
+	if s.location == nil {
+		return false
+	}
+	now = now.In(s.location)
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if s.start <= s.end {
+		return clock >= s.start && clock < s.end
+	}
+	return clock >= s.start || clock < s.end
+}
+
+// NightMode enforces stricter thresholds in a chat while no human moderators are online, either
+// during a fixed daily schedule or whenever the chat is unattended.
+type NightMode struct {
+	Schedule
+	// Also enforce night mode whenever no moderator has been active recently.
+	WhenUnattended bool
+	// Detection thresholds are multiplied by this factor during the night, e.g. 0.5 to ban users
+	// whose messages would otherwise only be flagged for review.
+	ThresholdFactor float64
+}
+
+// nightFactor returns the threshold factor for the chat at the given time.
+func nightFactor(config *Config, data *Data, chatID ChatID, now time.Time) float64 {
+	group := config.group(chatID)
+	if group == nil || group.NightMode == nil {
+		return 1
+	}
+	nightMode := group.NightMode
+	if nightMode.active(now) || (nightMode.WhenUnattended && isUnattended(config, data, chatID)) {
+		return nightMode.ThresholdFactor
+	}
+	return 1
+}
+
+// compileGroups validates the per-chat settings.
+func (s *Settings) compileGroups() error {
+	for i, group := range s.Groups {
+		if err := inField(fmt.Sprintf("Groups[%d]", i), s.compileGroup(group)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Settings) compileGroup(group *GroupConfig) error {
+	if group.ChatID == 0 && group.Title == "" {
+		return errors.New("groups must have a ChatID or a Title")
+	}
+	if group.Language != "" && !s.hasMessages(group.Language) {
+		return fieldErrorf("Language", "no messages in language %q or its fallbacks", group.Language)
+	}
+	if _, ok := warnPolicies[group.WarnPolicy]; group.WarnPolicy != "" && !ok {
+		return fieldErrorf("WarnPolicy", "must be one of %s", strings.Join(warnPolicyNames(), ", "))
+	}
+	if err := checkWarningTemplate("WarnMessage", group.WarnMessage); err != nil {
+		return err
+	}
+	if err := compileWarnVariants(group.WarnVariants); err != nil {
+		return err
+	}
+	if err := compileTopics(group.Topics); err != nil {
+		return err
+	}
+	if group.SupportURL != "" && !isHTTPURL(group.SupportURL) {
+		return fieldErrorf("SupportURL", "must be an http(s) URL")
+	}
+	if group.WarnAfter.Duration < 0 {
+		return fieldErrorf("WarnAfter", "must not be negative")
+	}
+	if group.WarningCooldown.Duration < 0 {
+		return fieldErrorf("WarningCooldown", "must not be negative")
+	}
+	if group.WarnAfter.Duration > s.UserRetention.Duration {
+		return fieldErrorf("WarnAfter", "must not be longer than UserRetention")
+	}
+	for i, name := range group.RulePacks {
+		if rulePack(name) == nil {
+			return fieldErrorf(fmt.Sprintf("RulePacks[%d]", i), "unknown rule pack %q", name)
+		}
+	}
+	if err := compileActions(group.Actions); err != nil {
+		return inField("Actions", err)
+	}
+	if group.WarningSticker != nil && group.WarningSticker.FileID == "" {
+		return fieldErrorf("WarningSticker.FileID", "must be set")
+	}
+	if group.Reminder != nil {
+		if err := group.Reminder.compile(); err != nil {
+			return inField("Reminder", err)
+		}
+	}
+	if group.Verification != nil {
+		if err := group.Verification.compile(); err != nil {
+			return inField("Verification", err)
+		}
+	}
+	if group.Probation != nil {
+		if err := group.Probation.compile(); err != nil {
+			return inField("Probation", err)
+		}
+	}
+	if group.NightMode != nil {
+		if err := group.NightMode.compile(); err != nil {
+			return inField("NightMode", err)
+		}
+		if group.NightMode.ThresholdFactor <= 0 {
+			return fieldErrorf("NightMode.ThresholdFactor", "must be positive")
+		}
+	}
+	if group.QuietHours != nil {
+		if err := group.QuietHours.compile(); err != nil {
+			return inField("QuietHours", err)
+		}
+		if group.QuietHours.Start == "" || group.QuietHours.End == "" {
+			return fieldErrorf("QuietHours", "must have a Start and an End")
+		}
+	}
+	return nil
+}
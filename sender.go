@@ -0,0 +1,202 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// All messages are sent through send, which keeps within Telegram's rate limits (about 30
+// messages per second overall and one per second per chat), waits as long as Telegram asks for
+// in retry_after when limited anyway, and retries transient network errors with exponential
+// backoff.
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Minimum intervals between messages, variables so tests can lift them.
+var (
+	sendIntervalGlobal  = time.Second / 30
+	sendIntervalPerChat = time.Second
+)
+
+const (
+	sendMaxAttempts    = 5
+	sendBackoffInitial = 500 * time.Millisecond
+	sendBackoffMax     = 30 * time.Second
+	// Messages queued with enqueueSend beyond this many per chat are dropped.
+	sendQueueLength = 100
+	// The goroutine serving the queue of a chat ends after the queue was empty for this long, as
+	// there is a queue for every user who got a private message.
+	sendQueueIdle = time.Minute
+	// How often the slots of the chats which may be sent to right away are dropped.
+	sendSlotsPruneInterval = time.Minute
+)
+
+// errSendQueueFull is passed to the callback of enqueueSend if the message was dropped.
+var errSendQueueFull = errors.New("send queue of the chat is full")
+
+var (
+	metricSendRetries = newCounter("scamwarnbot_send_retries_total", "Retried attempts to send a message, by reason (rate_limited, network).", "reason")
+	metricSendDropped = newCounter("scamwarnbot_send_dropped_total", "Queued messages dropped because the queue of the chat was full.")
+	metricSendQueued  = newGauge("scamwarnbot_send_queued", "Messages waiting in the send queues.")
+)
+
+// sendSlots hands out the times at which messages may be sent, globally and per chat.
+var sendSlots = struct {
+	lock   sync.Mutex
+	global time.Time
+	chats  map[ChatID]time.Time
+	pruned time.Time
+}{chats: map[ChatID]time.Time{}}
+
+// waitTurn blocks until a message may be sent to the chat. notBefore delays the chat further,
+// e.g. as requested by Telegram.
+func waitTurn(chatID ChatID, notBefore time.Time) {
+	sendSlots.lock.Lock()
+	now := time.Now()
+	slot := now
+	for _, t := range []time.Time{sendSlots.global, sendSlots.chats[chatID], notBefore} {
+		if t.After(slot) {
+			slot = t
+		}
+	}
+	sendSlots.global = slot.Add(sendIntervalGlobal)
+	sendSlots.chats[chatID] = slot.Add(sendIntervalPerChat)
+	if now.Sub(sendSlots.pruned) >= sendSlotsPruneInterval {
+		// Chats whose slot passed may be sent to right away, which is the same as not having a slot.
+		for id, t := range sendSlots.chats {
+			if !t.After(now) {
+				delete(sendSlots.chats, id)
+			}
+		}
+		sendSlots.pruned = now
+	}
+	sendSlots.lock.Unlock()
+	time.Sleep(slot.Sub(now))
+}
+
+// retryDelay returns how long to wait before retrying a failed send, or false if the error is
+// permanent.
+func retryDelay(err error, attempt int) (time.Duration, bool) {
+	if apiErr, ok := err.(tgbotapi.Error); ok {
+		if apiErr.RetryAfter > 0 {
+			metricSendRetries.inc("rate_limited")
+			return time.Duration(apiErr.RetryAfter) * time.Second, true
+		}
+		// Rejected by Telegram, e.g. because the chat or the message replied to is gone.
+		return 0, false
+	}
+	metricSendRetries.inc("network")
+	delay := sendBackoffInitial << (attempt - 1)
+	if delay > sendBackoffMax {
+		delay = sendBackoffMax
+	}
+	return delay, true
+}
+
+// send sends a message to a chat, waiting for its turn and retrying transient errors.
+func send(bot *tgbotapi.BotAPI, chatID ChatID, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var notBefore time.Time
+	for attempt := 1; ; attempt++ {
+		waitTurn(chatID, notBefore)
+		sent, err := sendChattable(bot, c)
+		if err == nil {
+			return sent, nil
+		}
+		delay, retry := retryDelay(err, attempt)
+		if !retry || attempt >= sendMaxAttempts {
+			return sent, err
+		}
+		chatLogger(chatID, 0).Warn("could not send, retrying", "attempt", attempt, "delay", delay, "err", err)
+		notBefore = time.Now().Add(delay)
+	}
+}
+
+// sendQueues holds a queue of outgoing messages per chat, each served by its own goroutine.
+var sendQueues = struct {
+	lock   sync.Mutex
+	queues map[ChatID]chan func()
+	// Counts the queued messages not sent yet.
+	pending sync.WaitGroup
+}{queues: map[ChatID]chan func(){}}
+
+// enqueueSend sends a message in the background, in order with the other messages queued for the
+// chat, and calls done with the result. Use it where the caller must not wait, e.g. while holding
+// data.lock. If the queue of the chat is full, the message is dropped and done is called with
+// errSendQueueFull, also in the background.
+func enqueueSend(bot *tgbotapi.BotAPI, chatID ChatID, c tgbotapi.Chattable, done func(tgbotapi.Message, error)) {
+	job := func() {
+		sent, err := send(bot, chatID, c)
+		done(sent, err)
+	}
+	sendQueues.pending.Add(1)
+	sendQueues.lock.Lock()
+	defer sendQueues.lock.Unlock()
+	queue, ok := sendQueues.queues[chatID]
+	if !ok {
+		queue = make(chan func(), sendQueueLength)
+		sendQueues.queues[chatID] = queue
+		go serveSendQueue(chatID, queue)
+	}
+	// Queued with the lock held, so the queue cannot be ended by serveSendQueue in the meantime.
+	select {
+	case queue <- job:
+		metricSendQueued.add(1)
+	default:
+		metricSendDropped.inc()
+		chatLogger(chatID, 0).Error("send queue is full; dropping message")
+		go func() {
+			done(tgbotapi.Message{}, errSendQueueFull)
+			sendQueues.pending.Done()
+		}()
+	}
+}
+
+// serveSendQueue sends the messages queued for a chat until the queue was idle for sendQueueIdle.
+func serveSendQueue(chatID ChatID, queue chan func()) {
+	idle := time.NewTimer(sendQueueIdle)
+	defer idle.Stop()
+	for {
+		select {
+		case job := <-queue:
+			job()
+			metricSendQueued.add(-1)
+			sendQueues.pending.Done()
+		case <-idle.C:
+			sendQueues.lock.Lock()
+			if len(queue) == 0 {
+				delete(sendQueues.queues, chatID)
+				sendQueues.lock.Unlock()
+				return
+			}
+			sendQueues.lock.Unlock()
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(sendQueueIdle)
+	}
+}
+
+// flushSendQueues waits until the queued messages are sent, up to the timeout. Returns false on
+// timeout.
+func flushSendQueues(timeout time.Duration) bool {
+	return waitTimeout(&sendQueues.pending, timeout)
+}
@@ -0,0 +1,284 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// setField sets a single field of a settings struct from its JSON value. Values which are not
+// valid JSON are taken as strings, so `/settings WarnAfter 7d` works without quotes.
+func setField(target interface{}, key string, value string) error {
+	valueJSON := []byte(value)
+	if !json.Valid(valueJSON) {
+		valueJSON, _ = json.Marshal(value)
+	}
+	keyJSON, _ := json.Marshal(key)
+	decoder := json.NewDecoder(bytes.NewReader([]byte(fmt.Sprintf("{%s:%s}", keyJSON, valueJSON))))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
+
+// fieldJSON returns the JSON value of a field of a settings struct, or "unset".
+func fieldJSON(target interface{}, key string) string {
+	targetJSON, err := json.Marshal(target)
+	if err != nil {
+		return "unset"
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(targetJSON, &fields); err != nil {
+		return "unset"
+	}
+	for name, value := range fields {
+		if strings.EqualFold(name, key) {
+			return string(value)
+		}
+	}
+	return "unset"
+}
+
+// changedFields returns the names of the top-level fields which differ between two settings
+// structs.
+func changedFields(old interface{}, new interface{}) []string {
+	var oldFields, newFields map[string]json.RawMessage
+	oldJSON, _ := json.Marshal(old)
+	newJSON, _ := json.Marshal(new)
+	json.Unmarshal(oldJSON, &oldFields)
+	json.Unmarshal(newJSON, &newFields)
+	var changed []string
+	for name, value := range newFields {
+		if name != "Version" && !bytes.Equal(oldFields[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func formatJSON(v interface{}) string {
+	formatted, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(formatted)
+}
+
+// cmdSettings shows or changes settings: `/settings [global] [<key> <value>]`. Without `global`,
+// the settings of the chat the command is used in are shown or changed.
+func cmdSettings(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	args := strings.Fields(msg.CommandArguments())
+	global := int64(msg.Chat.ID) == config.AdminChatID
+	if len(args) > 0 && args[0] == "global" {
+		global = true
+		args = args[1:]
+	}
+	chatID := ChatID(msg.Chat.ID)
+
+	if len(args) == 0 {
+		if global {
+			settings := config.Settings
+			settings.Groups = nil
+			return formatJSON(settings)
+		}
+		if group := config.group(chatID); group != nil {
+			return formatJSON(group)
+		}
+		return tr(config, msg, "This chat uses the global settings. Change them with /settings global <key> <value>, "+
+			"or override them for this chat with /settings <key> <value>.")
+	}
+	if len(args) < 2 {
+		return tr(config, msg, "Usage: /settings [global] <key> <value>")
+	}
+	if !hasRole(config, data, bot, msg, roleAdmin) {
+		return tr(config, msg, "Changing settings requires the admin role.")
+	}
+	key, value := args[0], strings.Join(args[1:], " ")
+	if strings.EqualFold(key, "Version") {
+		return tr(config, msg, "The version cannot be changed.")
+	}
+
+	var previous string
+	// Setting a single field is applied to the latest settings, so it cannot overwrite other
+	// changes. The previous value is shown to make overwriting a concurrent change of the same
+	// field visible.
+	version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+		if global {
+			if strings.EqualFold(key, "Groups") {
+				return fmt.Errorf("change the settings of a chat in that chat")
+			}
+			previous = fieldJSON(settings, key)
+			return setField(settings, key, value)
+		}
+		group := settings.group(chatID)
+		if group == nil {
+			group = &GroupConfig{ChatID: chatID}
+			settings.Groups = append(settings.Groups, group)
+		}
+		if strings.EqualFold(key, "ChatID") {
+			return fmt.Errorf("the chat ID cannot be changed")
+		}
+		previous = fieldJSON(group, key)
+		return setField(group, key, value)
+	})
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+	messageLogger(msg).Info("setting changed", "setting", key, "global", global)
+	scope := "global"
+	if !global {
+		scope = fmt.Sprintf("chat %s", msg.Chat.Title)
+	}
+	data.audit(auditAreaSettings, telegramActor(msg.From), version,
+		fmt.Sprintf("set %s (%s) from %s to %s", key, scope, previous, value))
+	return tr(config, msg, "%s set to %s (previously %s). Settings version %d.", key, value, previous, version)
+}
+
+// cmdRules lists and edits the detection rules: `/rules`, `/rules add <name> <score> <pattern>`,
+// `/rules keywords <name> <score> <keyword>, <keyword>, ...` and `/rules remove <name>`.
+func cmdRules(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		if len(config.Rules) == 0 {
+			return tr(config, msg, "No rules.")
+		}
+		var text strings.Builder
+		for _, rule := range config.Rules {
+			text.WriteString(tr(config, msg, "%s (score %v): %s\n", rule.Name, rule.Score, rule.expression()))
+		}
+		return text.String()
+	}
+
+	if !hasRole(config, data, bot, msg, roleAdmin) {
+		return tr(config, msg, "Changing rules requires the admin role.")
+	}
+	var version int
+	var err error
+	switch {
+	case (args[0] == "add" || args[0] == "keywords") && len(args) >= 4:
+		score, parseErr := strconv.ParseFloat(args[2], 64)
+		if parseErr != nil {
+			return tr(config, msg, "Invalid score %q", args[2])
+		}
+		// Keep the whitespace of the pattern as typed.
+		pattern := strings.TrimSpace(msg.CommandArguments())
+		for _, arg := range args[:3] {
+			pattern = strings.TrimSpace(strings.TrimPrefix(pattern, arg))
+		}
+		newRule := &Rule{Name: args[1], Score: score, Pattern: pattern}
+		if args[0] == "keywords" {
+			newRule.Pattern = ""
+			for _, keyword := range strings.Split(pattern, ",") {
+				if keyword = strings.TrimSpace(keyword); keyword != "" {
+					newRule.Keywords = append(newRule.Keywords, keyword)
+				}
+			}
+		}
+		version, err = updateSettings(data, anyVersion, func(settings *Settings) error {
+			for _, rule := range settings.Rules {
+				if rule.Name == args[1] {
+					return fmt.Errorf("rule %q exists already", args[1])
+				}
+			}
+			settings.Rules = append(settings.Rules, newRule)
+			return nil
+		})
+	case args[0] == "remove" && len(args) == 2:
+		version, err = updateSettings(data, anyVersion, func(settings *Settings) error {
+			for i, rule := range settings.Rules {
+				if rule.Name == args[1] {
+					settings.Rules = append(settings.Rules[:i], settings.Rules[i+1:]...)
+					return nil
+				}
+			}
+			return fmt.Errorf("no rule %q", args[1])
+		})
+	default:
+		return tr(config, msg, "Usage: /rules, /rules add <name> <score> <pattern>, /rules keywords <name> <score> <keyword>, <keyword>, ... or /rules remove <name>")
+	}
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+	messageLogger(msg).Info("rules changed", "change", args[0])
+	data.audit(auditAreaSettings, telegramActor(msg.From), version, "rules "+strings.TrimSpace(msg.CommandArguments()))
+	return tr(config, msg, "Rules updated.")
+}
+
+// settingsAPIHandler serves the settings on GET and replaces them on PUT. The version of the
+// settings is sent as ETag. A PUT must name the version it is based on in the If-Match header (or
+// the Version field), and is rejected with 409 Conflict if the settings changed since.
+func settingsAPIHandler(data *Data) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			settings := currentConfig().Settings
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", strconv.Quote(strconv.Itoa(settings.Version)))
+			json.NewEncoder(w).Encode(settings)
+		case http.MethodPut:
+			if !isLiveBot() {
+				http.Error(w, "not the live bot; change the settings on the live bot", http.StatusForbidden)
+				return
+			}
+			var settings Settings
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&settings); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			baseVersion := settings.Version
+			if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+				unquoted, err := strconv.Unquote(ifMatch)
+				if err != nil {
+					unquoted = ifMatch
+				}
+				if baseVersion, err = strconv.Atoi(unquoted); err != nil {
+					http.Error(w, "invalid If-Match header", http.StatusBadRequest)
+					return
+				}
+			}
+			var changed []string
+			version, err := updateSettings(data, baseVersion, func(s *Settings) error {
+				changed = changedFields(s, &settings)
+				*s = settings
+				return nil
+			})
+			if err == errSettingsConflict {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			holder, _ := apiTokenHolder(r)
+			slog.Info("settings replaced via API", "by", holder)
+			data.audit(auditAreaSettings, apiActor(holder), version,
+				"replaced all settings, changing "+strings.Join(changed, ", "))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
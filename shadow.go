@@ -0,0 +1,153 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// ShadowStats counts the findings of a detector running in shadow mode in a chat, to judge its
+// accuracy before enforcing it.
+type ShadowStats struct {
+	Since time.Time
+	// Messages the detector hit.
+	Hits int
+	// Hits on messages which were flagged by the enforced detectors as well.
+	Concurred int
+}
+
+// detectorMatches returns true if a detector is selected by a name such as "rule:foo" or
+// "pack:giveaway", which selects all rules of the pack.
+func detectorMatches(name string, detector string) bool {
+	return strings.EqualFold(name, detector) || strings.HasPrefix(strings.ToLower(detector), strings.ToLower(name)+"/")
+}
+
+// isShadow returns true if a detector runs in shadow mode in a chat: its findings are logged and
+// counted, but not included in the score the action thresholds apply to.
+func (s *Settings) isShadow(chatID ChatID, detector string) bool {
+	group := s.group(chatID)
+	if group == nil {
+		return false
+	}
+	for _, name := range group.ShadowDetectors {
+		if detectorMatches(name, detector) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordShadowFindings counts the shadow findings of a message. flagged tells whether the enforced
+// detectors flagged the message.
+func recordShadowFindings(data *Data, chatID ChatID, findings []Finding, flagged bool) {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	for _, finding := range findings {
+		if !finding.Shadow {
+			continue
+		}
+		metricShadowFindings.inc(finding.Detector)
+		chatData := data.chat(chatID)
+		if chatData.ShadowStats == nil {
+			chatData.ShadowStats = map[string]*ShadowStats{}
+		}
+		stats, ok := chatData.ShadowStats[finding.Detector]
+		if !ok {
+			stats = &ShadowStats{Since: time.Now()}
+			chatData.ShadowStats[finding.Detector] = stats
+		}
+		stats.Hits++
+		if flagged {
+			stats.Concurred++
+		}
+		data.chatChanged(chatID)
+	}
+}
+
+// cmdShadow shows the shadow detectors of the chat and their statistics, or adds and removes
+// shadow detectors: `/shadow [add|remove <detector>]`.
+func cmdShadow(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	chatID := ChatID(msg.Chat.ID)
+	if int64(chatID) == config.AdminChatID {
+		return tr(config, msg, "Shadow mode is set per chat. Use this command in the group.")
+	}
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) == 0 {
+		var text strings.Builder
+		if group := config.group(chatID); group != nil && len(group.ShadowDetectors) > 0 {
+			text.WriteString(tr(config, msg, "Shadow detectors: %s\n", strings.Join(group.ShadowDetectors, ", ")))
+		} else {
+			text.WriteString(tr(config, msg, "No shadow detectors.\n"))
+		}
+		data.lock.Lock()
+		defer data.lock.Unlock()
+		var detectors []string
+		if chatData, ok := data.ChatData[chatID]; ok {
+			for detector := range chatData.ShadowStats {
+				detectors = append(detectors, detector)
+			}
+		}
+		sort.Strings(detectors)
+		for _, detector := range detectors {
+			stats := data.ChatData[chatID].ShadowStats[detector]
+			text.WriteString(tr(config, msg, "%s: %d hits since %s, %d also flagged by enforced detectors\n",
+				detector, stats.Hits, stats.Since.UTC().Format("2006-01-02"), stats.Concurred))
+		}
+		return text.String()
+	}
+	if len(args) != 2 || (args[0] != "add" && args[0] != "remove") {
+		return tr(config, msg, "Usage: /shadow [add|remove <detector>], e.g. /shadow add pack:giveaway")
+	}
+	if !hasRole(config, data, bot, msg, roleAdmin) {
+		return tr(config, msg, "Changing shadow detectors requires the admin role.")
+	}
+	name := args[1]
+	version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+		group := settings.group(chatID)
+		if group == nil {
+			group = &GroupConfig{ChatID: chatID}
+			settings.Groups = append(settings.Groups, group)
+		}
+		var names []string
+		for _, existing := range group.ShadowDetectors {
+			if !strings.EqualFold(existing, name) {
+				names = append(names, existing)
+			}
+		}
+		if len(names) == len(group.ShadowDetectors) && args[0] == "remove" {
+			return fmt.Errorf("%s is not in shadow mode", name)
+		}
+		if args[0] == "add" {
+			names = append(names, name)
+		}
+		group.ShadowDetectors = names
+		return nil
+	})
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+	messageLogger(msg).Info("shadow detector changed", "detector", name, "change", args[0])
+	data.audit(auditAreaSettings, telegramActor(msg.From), version,
+		fmt.Sprintf("shadow detector %s: %s in chat %s", args[0], name, msg.Chat.Title))
+	if args[0] == "add" {
+		return tr(config, msg, "%s runs in shadow mode now.", name)
+	}
+	return tr(config, msg, "%s is enforced now.", name)
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers banned in one group move on to the other groups within minutes. With ShareBans, a
+// permanent ban in one group is shared right away: the user is added to the blocklist and banned
+// in all other groups in which the bot is on. Bans by the bot are shared from banUser. Bans by
+// admins are detected from the service message Telegram posts when a member is removed, as the
+// Bot API client used does not receive chat member updates; they are only shared if the member
+// is still banned afterwards, i.e. was not just kicked.
+
+import (
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Source of blocklist entries added by shared bans.
+const blockSourceSharedBan = "shared ban"
+
+var metricSharedBans = newCounter("scamwarnbot_shared_bans_total",
+	"Permanent bans shared with the other groups, by who banned: the bot or an admin.", "by")
+
+// shareBan blocklists a user permanently banned in a chat and bans them in the other allowed
+// chats. Does nothing if ShareBans is off or the user is blocklisted already, e.g. because the
+// ban itself was shared.
+func shareBan(config *Config, data *Data, bot *tgbotapi.BotAPI, chatID ChatID, userID UserID, bannedBy UserID, reason string, by string) {
+	if !config.ShareBans {
+		return
+	}
+	data.lock.Lock()
+	if _, ok := data.Blocklist[userID]; ok {
+		data.lock.Unlock()
+		return
+	}
+	title := data.chatTitle(chatID)
+	sharedReason := fmt.Sprintf("banned in %s", title)
+	if reason != "" {
+		sharedReason += ": " + reason
+	}
+	// The ban by the bot was posted to the ban sync already, the removal by an admin was not.
+	data.Blocklist[userID] = &BlockEntry{Reason: sharedReason, Source: blockSourceSharedBan, AddedAt: time.Now(), Synced: by == "bot"}
+	data.markChanged()
+	description := data.describeUser(userID)
+	data.lock.Unlock()
+	metricSharedBans.inc(by)
+
+	var chats, banned int
+	for _, otherID := range config.allowedChats() {
+		if otherID == chatID || config.botOff(otherID) {
+			continue
+		}
+		chats++
+		err := banUser(data, bot, otherID, userID, 0, bannedBy, sharedReason)
+		logAction(chatLogger(otherID, userID), "ban", err, "reason", "shared ban", "from_chat_id", chatID)
+		if err == nil {
+			banned++
+		}
+	}
+	notifyAdmins(config, bot, fmt.Sprintf("Shared the ban of %s in %s: banned in %d of %d other chats and blocklisted.",
+		description, title, banned, chats))
+}
+
+// shareRemoval shares the ban of a member removed from the chat by an admin.
+func shareRemoval(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	removed := msg.LeftChatMember
+	if !config.ShareBans || removed == nil || removed.ID == msg.From.ID || msg.From.ID == bot.Self.ID {
+		return
+	}
+	chatID, userID := ChatID(msg.Chat.ID), UserID(removed.ID)
+	member, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: int64(chatID), UserID: removed.ID})
+	if err != nil {
+		metricTelegramErrors.inc("getChatMember")
+		chatLogger(chatID, userID).Warn("could not check whether removed member is banned", "err", err)
+		return
+	}
+	// Kicks and temporary bans are not shared.
+	if !member.WasKicked() || member.UntilDate != 0 {
+		return
+	}
+	data.lock.Lock()
+	data.updateUser(removed)
+	data.lock.Unlock()
+	go shareBan(config, data, bot, chatID, userID, UserID(msg.From.ID), "", "admin")
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// On SIGINT or SIGTERM, the context of the bot is cancelled: the background workers return at
+// their next wait, the HTTP server stops accepting requests, and the bot waits for them, flushes
+// the queued outgoing messages and saves the state before exiting.
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How long the shutdown waits for the workers and for the queued messages, each.
+const shutdownTimeout = 30 * time.Second
+
+// sleepContext waits for the given duration. Returns false if the context was cancelled before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// waitTimeout waits for the wait group, up to the timeout. Returns false on timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// workers are the background goroutines of the bot, waited for on shutdown.
+type workers struct {
+	wg sync.WaitGroup
+}
+
+// start runs fn in a worker goroutine. fn must return once the context of the bot is cancelled.
+func (w *workers) start(fn func()) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		fn()
+	}()
+}
+
+// wait waits for all workers to return, up to the timeout. Returns false on timeout.
+func (w *workers) wait(timeout time.Duration) bool {
+	return waitTimeout(&w.wg, timeout)
+}
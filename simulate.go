@@ -0,0 +1,176 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// The user ID of the simulated first-time poster. Telegram user IDs are positive, so it never
+// collides with a real user.
+const simulatedUserID UserID = -1
+
+// simulationScenarios are canned messages for `/simulate <scenario>`, returning the name of the
+// simulated user and the text, or an error if the scenario cannot be simulated in the chat.
+var simulationScenarios = map[string]func(bot *tgbotapi.BotAPI, chatID ChatID) (string, string, error){
+	"new_user": func(*tgbotapi.BotAPI, ChatID) (string, string, error) {
+		return "New User", "Hi everyone, how do I update the firmware of my device?", nil
+	},
+	"keyword_hit": func(*tgbotapi.BotAPI, ChatID) (string, string, error) {
+		return "Wallet Support", "Hello, I am from the support team. Send me your recovery words in a DM and I will validate your wallet.", nil
+	},
+	"impersonator": func(bot *tgbotapi.BotAPI, chatID ChatID) (string, string, error) {
+		admins, err := chatAdmins.users(bot, chatID)
+		if err != nil {
+			return "", "", err
+		}
+		for _, admin := range admins {
+			if !admin.IsBot {
+				name := strings.TrimSpace(admin.FirstName + " " + admin.LastName)
+				return name, "Hi, I am an admin of this group. DM me if you have any problem with your wallet.", nil
+			}
+		}
+		return "", "", errors.New("the chat has no admins to impersonate")
+	},
+}
+
+// cmdSimulate runs the pipeline on a message as if it was posted by a first-time poster, without
+// acting on it, and reports the decision of every stage: `/simulate <chat id> [<name> |] <text>`,
+// or `/simulate <chat id> <scenario>` for a canned message, see simulationScenarios. In a group,
+// the chat ID is omitted.
+func cmdSimulate(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	usage := tr(config, msg, "Usage: /simulate <chat id> [<name> |] <text>, or /simulate <chat id> <scenario> with scenario %s",
+		strings.Join(sortedKeys(simulationScenarios), ", "))
+	args := strings.TrimSpace(msg.CommandArguments())
+	chat := msg.Chat
+	if msg.Chat.ID == config.AdminChatID {
+		fields := strings.SplitN(args, " ", 2)
+		if len(fields) != 2 {
+			return usage
+		}
+		chatID, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return usage
+		}
+		data.lock.Lock()
+		title := data.chatTitle(ChatID(chatID))
+		data.lock.Unlock()
+		chat = &tgbotapi.Chat{ID: chatID, Type: "supergroup", Title: title}
+		args = strings.TrimSpace(fields[1])
+	}
+	chatID := ChatID(chat.ID)
+	name := "Test User"
+	scenario, isScenario := simulationScenarios[args]
+	if isScenario {
+		var err error
+		if name, args, err = scenario(bot, chatID); err != nil {
+			return tr(config, msg, "Could not simulate the scenario: %v", err)
+		}
+	} else if before, after, ok := strings.Cut(args, "|"); ok {
+		name, args = strings.TrimSpace(before), strings.TrimSpace(after)
+	}
+	if args == "" {
+		return usage
+	}
+	simulated := &tgbotapi.Message{
+		Chat: chat,
+		From: &tgbotapi.User{ID: int(simulatedUserID), FirstName: name},
+		Date: int(time.Now().Unix()),
+		Text: args,
+	}
+	// The detectors record the simulated user like any other.
+	defer func() {
+		data.lock.Lock()
+		if chatData, ok := data.ChatData[chatID]; ok {
+			delete(chatData.UserData, simulatedUserID)
+		}
+		data.lock.Unlock()
+	}()
+
+	var text strings.Builder
+	if isScenario {
+		text.WriteString(tr(config, msg, "Message by %s: %s\n", name, args))
+	}
+	if config.allowedGroup(chat) == nil {
+		text.WriteString(tr(config, msg, "Chat: %s is not allowed, the bot would leave it.\n", chat.Title))
+		return text.String()
+	}
+	text.WriteString(tr(config, msg, "Chat: %s is allowed.\n", chat.Title))
+	if config.WelcomeNewMembers {
+		text.WriteString(tr(config, msg, "Join: the user would be greeted.\n"))
+	} else {
+		text.WriteString(tr(config, msg, "Join: greetings are disabled.\n"))
+	}
+
+	findings := detectAll(config, data, bot, simulated)
+	if len(findings) == 0 {
+		text.WriteString(tr(config, msg, "Detectors: no findings.\n"))
+	}
+	for _, finding := range findings {
+		if finding.Shadow {
+			text.WriteString(tr(config, msg, "Detector %s (shadow mode, not scored): %s\n", finding.Detector, finding.Reason))
+		} else {
+			text.WriteString(tr(config, msg, "Detector %s (score %.2f): %s\n", finding.Detector, finding.Score, finding.Reason))
+		}
+	}
+	now := time.Now()
+	factor := nightFactor(config, data, chatID, now) * protectionFactor(config, chatID, now) *
+		downtimeFactor(config, now, now)
+	score := totalScore(findings)
+	decision := "none"
+	switch {
+	case config.BanScore > 0 && score >= config.BanScore*factor:
+		decision = "report, delete and ban"
+	case config.DeleteScore > 0 && score >= config.DeleteScore*factor:
+		decision = "report and delete"
+	case score >= config.FlagScore*factor:
+		decision = "report"
+	}
+	text.WriteString(tr(config, msg, "Score %.2f (thresholds: flag %.2f, delete %.2f, ban %.2f, factor %.2f): %s.\n",
+		score, config.FlagScore, config.DeleteScore, config.BanScore, factor, tr(config, msg, decision)))
+	if decision != "none" && decision != "report" {
+		return text.String()
+	}
+
+	faq := "none"
+	for _, entry := range config.FAQ {
+		if entry.re.MatchString(args) {
+			faq = entry.Name
+			break
+		}
+	}
+	text.WriteString(tr(config, msg, "FAQ: %s.\n", faq))
+
+	if !config.warnPolicy(chatID).due(simulated, time.Now(), time.Time{}, config.warnAfter(chatID)) {
+		text.WriteString(tr(config, msg, "Warning: none, due to the warning policy of the chat.\n"))
+		return text.String()
+	}
+	lang := config.warningLanguage(chatID, msg.From.LanguageCode)
+	warning := config.warnMessage(chatID, 0, lang)
+	if isQuestion(args) {
+		warning += "\n\n" + config.firstQuestionNote(lang)
+		if config.ProtectFirstQuestions.Duration > 0 {
+			text.WriteString(tr(config, msg, "Question: replies of new members would be deleted for %s.\n",
+				config.ProtectFirstQuestions.Duration))
+		}
+	}
+	text.WriteString(tr(config, msg, "Warning:\n%s\n", config.renderWarning(warning, simulated.Chat, simulated.From)))
+	return text.String()
+}
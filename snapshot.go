@@ -0,0 +1,262 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Number of IDs listed per difference unless -all is given.
+const snapshotDiffListLimit = 20
+
+type ordered interface {
+	~int | ~int64 | ~string
+}
+
+// sortedKeys returns the keys of a map in ascending order.
+func sortedKeys[K ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// diffKeys returns the keys only present in the new map and the keys only present in the old map.
+func diffKeys[K ordered, V1 any, V2 any](old map[K]V1, new map[K]V2) (gained []K, lost []K) {
+	for _, key := range sortedKeys(new) {
+		if _, ok := old[key]; !ok {
+			gained = append(gained, key)
+		}
+	}
+	for _, key := range sortedKeys(old) {
+		if _, ok := new[key]; !ok {
+			lost = append(lost, key)
+		}
+	}
+	return gained, lost
+}
+
+// readSnapshot reads a state snapshot (a cache file). Unlike loadData, invalid and missing files
+// are an error.
+func readSnapshot(filename string) (*Data, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	return (&jsonStorage{filename: filename}).Load()
+}
+
+// writeSnapshot writes the data as indented JSON. The output is deterministic, as map keys are
+// sorted when encoding.
+func writeSnapshot(w io.Writer, data *Data) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+// stateKey identifies a user state in a snapshot diff.
+func stateKey(userID UserID, state *UserState) string {
+	return fmt.Sprintf("%d/%s/%d", userID, state.Kind, state.ChatID)
+}
+
+// stateKeys returns the states of all users, by stateKey.
+func stateKeys(data *Data) map[string]*UserState {
+	keys := map[string]*UserState{}
+	for userID, states := range data.UserStates {
+		for _, state := range states {
+			keys[stateKey(userID, state)] = state
+		}
+	}
+	return keys
+}
+
+type snapshotDiff struct {
+	w     io.Writer
+	all   bool
+	count int
+}
+
+// list prints a difference of the two snapshots.
+func list[K any](d *snapshotDiff, what string, keys []K) {
+	if len(keys) == 0 {
+		return
+	}
+	d.count++
+	shown := keys
+	if !d.all && len(shown) > snapshotDiffListLimit {
+		shown = shown[:snapshotDiffListLimit]
+	}
+	items := make([]string, len(shown))
+	for i, key := range shown {
+		items[i] = fmt.Sprint(key)
+	}
+	more := ""
+	if len(shown) < len(keys) {
+		more = fmt.Sprintf(", ... (%d more)", len(keys)-len(shown))
+	}
+	fmt.Fprintf(d.w, "%s: %d: %s%s\n", what, len(keys), strings.Join(items, ", "), more)
+}
+
+// diffSnapshots prints the differences between two snapshots and returns how many were found.
+func diffSnapshots(w io.Writer, old *Data, new *Data, all bool) int {
+	d := &snapshotDiff{w: w, all: all}
+
+	gained, lost := diffKeys(old.Users, new.Users)
+	list(d, "users gained", gained)
+	list(d, "users lost", lost)
+
+	gainedChats, lostChats := diffKeys(old.ChatData, new.ChatData)
+	list(d, "chats gained", gainedChats)
+	list(d, "chats lost", lostChats)
+	for _, chatID := range sortedKeys(new.ChatData) {
+		oldChat, ok := old.ChatData[chatID]
+		if !ok {
+			continue
+		}
+		newChat := new.ChatData[chatID]
+		gained, lost := diffKeys(oldChat.UserData, newChat.UserData)
+		list(d, fmt.Sprintf("chat %d: users gained", chatID), gained)
+		list(d, fmt.Sprintf("chat %d: users lost", chatID), lost)
+		var warned, rewound []UserID
+		for _, userID := range sortedKeys(newChat.UserData) {
+			oldUser, ok := oldChat.UserData[userID]
+			if !ok {
+				continue
+			}
+			newUser := newChat.UserData[userID]
+			switch {
+			case newUser.LastMessageAt.After(oldUser.LastMessageAt):
+				warned = append(warned, userID)
+			case newUser.LastMessageAt.Before(oldUser.LastMessageAt):
+				// The time of the last message (and thus of the last warning) never moves
+				// backwards unless the state was corrupted or restored from an older backup.
+				rewound = append(rewound, userID)
+			}
+		}
+		list(d, fmt.Sprintf("chat %d: users with newer last message (possibly warned)", chatID), warned)
+		list(d, fmt.Sprintf("chat %d: users with OLDER last message", chatID), rewound)
+	}
+
+	oldStates, newStates := stateKeys(old), stateKeys(new)
+	gainedStates, lostStates := diffKeys(oldStates, newStates)
+	for _, kind := range []UserStateKind{stateBanned, stateRestricted, stateWatched, stateTrusted} {
+		filter := func(keys []string) []string {
+			var result []string
+			for _, key := range keys {
+				if strings.Contains(key, "/"+string(kind)+"/") {
+					result = append(result, key)
+				}
+			}
+			return result
+		}
+		list(d, fmt.Sprintf("%s gained (user/state/chat)", kind), filter(gainedStates))
+		list(d, fmt.Sprintf("%s lost (user/state/chat)", kind), filter(lostStates))
+	}
+
+	gainedBlocks, lostBlocks := diffKeys(old.Blocklist, new.Blocklist)
+	list(d, "blocklist gained", gainedBlocks)
+	list(d, "blocklist lost", lostBlocks)
+
+	gainedNames, lostNames := diffKeys(old.ReportedNames, new.ReportedNames)
+	list(d, "reported names gained", gainedNames)
+	list(d, "reported names lost", lostNames)
+
+	var changedRoles []string
+	for _, userID := range sortedKeys(new.Roles) {
+		if old.Roles[userID] != new.Roles[userID] {
+			changedRoles = append(changedRoles, fmt.Sprintf("%d: %s -> %s", userID, old.Roles[userID], new.Roles[userID]))
+		}
+	}
+	for _, userID := range sortedKeys(old.Roles) {
+		if _, ok := new.Roles[userID]; !ok {
+			changedRoles = append(changedRoles, fmt.Sprintf("%d: %s -> none", userID, old.Roles[userID]))
+		}
+	}
+	list(d, "roles changed", changedRoles)
+
+	switch {
+	case old.Settings == nil && new.Settings != nil:
+		list(d, "settings", []string{"added"})
+	case old.Settings != nil && new.Settings == nil:
+		list(d, "settings", []string{"removed"})
+	case old.Settings != nil && new.Settings != nil:
+		if fields := changedFields(old.Settings, new.Settings); len(fields) > 0 {
+			list(d, fmt.Sprintf("settings changed (version %d -> %d)", old.Settings.Version, new.Settings.Version), fields)
+		} else if old.Settings.Version != new.Settings.Version {
+			list(d, "settings version changed", []string{fmt.Sprintf("%d -> %d", old.Settings.Version, new.Settings.Version)})
+		}
+	}
+	return d.count
+}
+
+// runSnapshot implements `snapshot save <file>` and `snapshot diff [-all] <old> <new>`.
+func runSnapshot(args []string) error {
+	usage := errors.New("usage: snapshot save <file> | snapshot diff [-all] <old.json> <new.json>")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "save":
+		if len(args) != 2 {
+			return usage
+		}
+		storage, err := openStorage(storageSpec())
+		if err != nil {
+			return err
+		}
+		defer storage.Close()
+		data, err := storage.Load()
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(args[1], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if err := writeSnapshot(file, data); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	case "diff":
+		flags := flag.NewFlagSet("snapshot diff", flag.ExitOnError)
+		all := flags.Bool("all", false, "List all differing IDs instead of the first few")
+		flags.Parse(args[1:])
+		if flags.NArg() != 2 {
+			return usage
+		}
+		old, err := readSnapshot(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		new, err := readSnapshot(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		if diffSnapshots(os.Stdout, old, new, *all) == 0 {
+			fmt.Println("no differences")
+		}
+		return nil
+	}
+	return usage
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// For live debugging without attaching a debugger, sending SIGUSR1 to the bot dumps a snapshot of
+// its internals: the depths of the send queues, counters per chat, the sizes of the caches and
+// the goroutines. The dump is sanitized: it contains IDs and counts, but no message texts, names
+// or secrets. A summary is logged, and the full dump is written to a file in -dump-dir if set.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"time"
+)
+
+// StateDump is a sanitized snapshot of the internals of the bot.
+type StateDump struct {
+	At         time.Time
+	Uptime     string
+	Goroutines int
+	HeapAlloc  uint64
+	NumGC      uint32
+	// Messages waiting per chat, only for chats with a non-empty queue.
+	SendQueues map[ChatID]int
+	Chats      map[ChatID]*ChatDump
+	// Number of entries per cache and state collection.
+	Sizes map[string]int
+	// The goroutines grouped by stack, as in the goroutine profile of pprof. Only in dump files.
+	GoroutineStacks string `json:",omitempty"`
+}
+
+// ChatDump are the counters of a chat in a StateDump.
+type ChatDump struct {
+	Members        int
+	RecentMessages int
+	Admins         int
+	Dormant        bool `json:",omitempty"`
+}
+
+// dumpState takes a snapshot of the internals of the bot.
+func dumpState(data *Data) *StateDump {
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	dump := &StateDump{
+		At:         time.Now(),
+		Uptime:     time.Since(startedAt).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  memory.HeapAlloc,
+		NumGC:      memory.NumGC,
+		SendQueues: map[ChatID]int{},
+		Chats:      map[ChatID]*ChatDump{},
+		Sizes:      map[string]int{},
+	}
+
+	sendQueues.lock.Lock()
+	for chatID, queue := range sendQueues.queues {
+		if len(queue) > 0 {
+			dump.SendQueues[chatID] = len(queue)
+		}
+	}
+	sendQueues.lock.Unlock()
+
+	data.lock.Lock()
+	for chatID, chatData := range data.ChatData {
+		dump.Chats[chatID] = &ChatDump{
+			Members:        len(chatData.UserData),
+			RecentMessages: len(chatData.RecentMessageIDs),
+			Admins:         len(chatData.AdminActivity),
+			Dormant:        chatData.Dormant,
+		}
+	}
+	states := 0
+	for _, userStates := range data.UserStates {
+		states += len(userStates)
+	}
+	for name, size := range map[string]int{
+		"users":                 len(data.Users),
+		"user_states":           states,
+		"blocklist":             len(data.Blocklist),
+		"reported_names":        len(data.ReportedNames),
+		"reported_phones":       len(data.ReportedPhones),
+		"actions":               len(data.Actions),
+		"pending_deletions":     len(data.PendingDeletions),
+		"pending_verifications": len(data.PendingVerifications),
+		"votes":                 len(data.Votes),
+		"quarantine":            len(data.Quarantine),
+		"persistent_lookups":    len(data.Lookups),
+	} {
+		dump.Sizes[name] = size
+	}
+	data.lock.Unlock()
+
+	lookups.lock.Lock()
+	dump.Sizes["lookups"] = len(lookups.entries)
+	lookups.lock.Unlock()
+	chatAdmins.lock.Lock()
+	dump.Sizes["chat_admins"] = len(chatAdmins.entries)
+	chatAdmins.lock.Unlock()
+	chatInfo.lock.Lock()
+	dump.Sizes["chat_details"] = len(chatInfo.entries)
+	chatInfo.lock.Unlock()
+	return dump
+}
+
+// writeStateDump logs a summary of the dump and writes it in full to a file in -dump-dir, if set.
+func writeStateDump(data *Data) {
+	dump := dumpState(data)
+	queued := 0
+	for _, depth := range dump.SendQueues {
+		queued += depth
+	}
+	args := []any{"goroutines", dump.Goroutines, "heap_alloc", dump.HeapAlloc, "chats", len(dump.Chats),
+		"queued_messages", queued, "busy_send_queues", len(dump.SendQueues)}
+	names := make([]string, 0, len(dump.Sizes))
+	for name := range dump.Sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "size_"+name, dump.Sizes[name])
+	}
+	if *dumpDir == "" {
+		slog.Info("state dump", args...)
+		return
+	}
+
+	var stacks bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&stacks, 1); err == nil {
+		dump.GoroutineStacks = stacks.String()
+	}
+	dumpJSON, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		slog.Error("could not dump the state", "err", err)
+		return
+	}
+	filename := filepath.Join(*dumpDir, fmt.Sprintf("scamwarnbot-dump-%s.json", dump.At.UTC().Format("20060102T150405")))
+	if err := os.WriteFile(filename, dumpJSON, 0o600); err != nil {
+		slog.Error("could not write the state dump", "err", err)
+		return
+	}
+	slog.Info("state dump", append(args, "file", filename)...)
+}
+
+// dumpStateOnSignal dumps the state whenever the bot receives SIGUSR1, until ctx is cancelled.
+func dumpStateOnSignal(ctx context.Context, data *Data) {
+	if dumpSignal == nil {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, dumpSignal)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			writeStateDump(data)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const restrictDurationDefault = 24 * time.Hour
+
+type UserStateKind string
+
+const (
+	// Trusted users are neither warned nor checked by the detectors.
+	stateTrusted UserStateKind = "trusted"
+	// All messages of watched users are forwarded to the admin chat and detectors use lowered
+	// thresholds for them.
+	stateWatched UserStateKind = "watched"
+	// Restricted users are muted in a chat.
+	stateRestricted UserStateKind = "restricted"
+	// Banned users are removed from a chat and cannot rejoin.
+	stateBanned UserStateKind = "banned"
+)
+
+// UserState is a moderation decision about a user. Expired states are removed by
+// periodicExpireStates, so temporary decisions do not silently become permanent.
+type UserState struct {
+	Kind UserStateKind
+	// The chat the state applies to, or zero for all chats.
+	ChatID ChatID `json:",omitempty"`
+	// The state never expires if zero.
+	Until time.Time
+	// The admin who put the user into this state, or zero if the bot did it automatically.
+	AddedBy UserID
+	Reason  string `json:",omitempty"`
+	// When the user was put into the state. Zero for states recorded before this was introduced.
+	Since time.Time `json:",omitempty"`
+	// For automated bans: whether an admin confirmed the ban, and when it was posted for review.
+	Reviewed          bool      `json:",omitempty"`
+	ReviewRequestedAt time.Time `json:",omitempty"`
+	// For restrictions: whether the user may still send text messages.
+	TextOnly bool `json:",omitempty"`
+}
+
+func (s *UserState) expired(now time.Time) bool {
+	return !s.Until.IsZero() && now.After(s.Until)
+}
+
+func (s *UserState) describeUntil(settings *Settings, lang string) string {
+	if s.Until.IsZero() {
+		return settings.translate(lang, "permanently")
+	}
+	return settings.translate(lang, "until %s", s.Until.Format(time.RFC1123))
+}
+
+// describeRemaining returns how long the state is still active.
+func (s *UserState) describeRemaining(settings *Settings, lang string) string {
+	if s.Until.IsZero() {
+		return settings.translate(lang, "permanently")
+	}
+	return settings.translate(lang, "for another %s", time.Until(s.Until).Round(time.Minute))
+}
+
+// hasState returns true if the user is in an unexpired state of the given kind in the chat.
+func (d *Data) hasState(userID UserID, kind UserStateKind, chatID ChatID) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.hasStateLocked(userID, kind, chatID)
+}
+
+// hasStateLocked is like hasState, but must be called with d.lock held.
+func (d *Data) hasStateLocked(userID UserID, kind UserStateKind, chatID ChatID) bool {
+	now := time.Now()
+	for _, state := range d.UserStates[userID] {
+		if state.Kind == kind && (state.ChatID == 0 || state.ChatID == chatID) && !state.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// setState adds a state to a user, replacing the existing state of the same kind in the same
+// chat. Must be called with d.lock held.
+func (d *Data) setState(userID UserID, newState *UserState) {
+	if newState.Since.IsZero() {
+		newState.Since = time.Now()
+	}
+	d.removeState(userID, newState.Kind, newState.ChatID)
+	d.UserStates[userID] = append(d.UserStates[userID], newState)
+	d.markChanged()
+}
+
+// removeState removes the state of the given kind in the chat from a user. Returns false if the
+// user was not in that state. Must be called with d.lock held.
+func (d *Data) removeState(userID UserID, kind UserStateKind, chatID ChatID) bool {
+	states := d.UserStates[userID]
+	for i, state := range states {
+		if state.Kind == kind && state.ChatID == chatID {
+			states = append(states[:i], states[i+1:]...)
+			if len(states) == 0 {
+				delete(d.UserStates, userID)
+			} else {
+				d.UserStates[userID] = states
+			}
+			d.markChanged()
+			return true
+		}
+	}
+	return false
+}
+
+// applyState performs the Telegram side of entering (active=true) or leaving a state.
+func applyState(bot *tgbotapi.BotAPI, userID UserID, state *UserState, active bool) error {
+	switch state.Kind {
+	case stateRestricted:
+		if active && state.TextOnly {
+			return restrictMember(bot, state.ChatID, userID, permissionsTextOnly, state.Until)
+		}
+		if active {
+			return restrictMember(bot, state.ChatID, userID, permissionsMuted, state.Until)
+		}
+		return restrictMember(bot, state.ChatID, userID, permissionsDefault, time.Time{})
+	case stateBanned:
+		if active {
+			return banMember(bot, state.ChatID, userID, state.Until)
+		}
+		return unbanMember(bot, state.ChatID, userID)
+	}
+	return nil
+}
+
+// expireStates removes all expired states. States whose Telegram side cannot be reverted (e.g.
+// lifting a restriction fails) are kept and retried on the next run.
+func expireStates(config *Config, data *Data, bot *tgbotapi.BotAPI) {
+	type expiredState struct {
+		userID UserID
+		state  *UserState
+	}
+	var expired []expiredState
+	now := time.Now()
+	data.lock.Lock()
+	for userID, states := range data.UserStates {
+		for _, state := range states {
+			if state.expired(now) {
+				expired = append(expired, expiredState{userID, state})
+			}
+		}
+	}
+	data.lock.Unlock()
+
+	for _, e := range expired {
+		err := applyState(bot, e.userID, e.state, false)
+		logAction(chatLogger(e.state.ChatID, e.userID), "expire "+string(e.state.Kind), err)
+		if err != nil {
+			continue
+		}
+		data.lock.Lock()
+		data.removeState(e.userID, e.state.Kind, e.state.ChatID)
+		description := data.describeUser(e.userID)
+		data.lock.Unlock()
+		// Probations end all the time, which is not news to the admins.
+		if e.state.Reason == probationReason {
+			continue
+		}
+		notifyAdmins(config, bot, fmt.Sprintf("%s is no longer %s (expired).", description, e.state.Kind))
+	}
+}
+
+func periodicExpireStates(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for {
+		if !sleepContext(ctx, time.Minute) {
+			return
+		}
+		expireStates(currentConfig(), data, bot)
+	}
+}
+
+// stateCommand returns a handler for a command putting a user into a state:
+// `/<cmd> @user [duration]`. perChat states apply to the chat the command is used in.
+func stateCommand(kind UserStateKind, perChat bool, defaultDuration func(config *Config) time.Duration) commandHandler {
+	return func(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+		userID, args, err := resolveTarget(data, msg)
+		if err != nil {
+			return err.Error()
+		}
+		duration := defaultDuration(config)
+		if len(args) > 0 {
+			duration, err = parseDuration(args[0])
+			if err != nil {
+				return err.Error()
+			}
+		}
+		state := &UserState{Kind: kind, AddedBy: UserID(msg.From.ID)}
+		if duration > 0 {
+			state.Until = time.Now().Add(duration)
+		}
+		if perChat {
+			if int64(msg.Chat.ID) == config.AdminChatID {
+				return tr(config, msg, "This command must be used in the group.")
+			}
+			state.ChatID = ChatID(msg.Chat.ID)
+		}
+		if err := applyState(bot, userID, state, true); err != nil {
+			return tr(config, msg, "Error: %v", err)
+		}
+
+		data.lock.Lock()
+		defer data.lock.Unlock()
+		data.setState(userID, state)
+		return tr(config, msg, "%s is %s %s.", data.describeUser(userID), tr(config, msg, string(kind)),
+			state.describeUntil(&config.Settings, config.chatLanguage(ChatID(msg.Chat.ID))))
+	}
+}
+
+// removeStateCommand returns a handler for a command taking a user out of a state: `/<cmd> @user`.
+func removeStateCommand(kind UserStateKind, perChat bool) commandHandler {
+	return func(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+		userID, _, err := resolveTarget(data, msg)
+		if err != nil {
+			return err.Error()
+		}
+		state := &UserState{Kind: kind}
+		if perChat {
+			state.ChatID = ChatID(msg.Chat.ID)
+		}
+		if err := applyState(bot, userID, state, false); err != nil {
+			return tr(config, msg, "Error: %v", err)
+		}
+
+		data.lock.Lock()
+		defer data.lock.Unlock()
+		if !data.removeState(userID, kind, state.ChatID) {
+			return tr(config, msg, "%s is not %s.", data.describeUser(userID), tr(config, msg, string(kind)))
+		}
+		if kind == stateBanned {
+			// postBanEvent takes the lock itself.
+			defer postBanEvent(config, data, BanEvent{Type: banEventUnban, UserID: userID, ChatID: state.ChatID, BannedBy: UserID(msg.From.ID)})
+		}
+		return tr(config, msg, "%s is no longer %s.", data.describeUser(userID), tr(config, msg, string(kind)))
+	}
+}
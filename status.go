@@ -0,0 +1,163 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var startedAt = time.Now()
+
+// cmdStatus shows the uptime of the bot and the size of its caches: `/status`.
+func cmdStatus(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	var text strings.Builder
+	current := version
+	if current == "" {
+		current = "commit " + buildCommit
+	}
+	fmt.Fprintf(&text, "scamwarnbot %s, up for %s\n", current, time.Since(startedAt).Round(time.Second))
+	fmt.Fprintf(&text, "Settings version %d, %d allowed groups\n", config.Version, len(config.Groups))
+
+	data.lock.Lock()
+	users := 0
+	for _, chatData := range data.ChatData {
+		users += len(chatData.UserData)
+	}
+	states := 0
+	for _, userStates := range data.UserStates {
+		states += len(userStates)
+	}
+	fmt.Fprintf(&text, "Cache: %d chats (%d active), %d chat members, %d users, %d user states, %d blocklist entries, %d reported names, %d recorded actions\n",
+		len(data.ChatData), len(data.activeChats()), users, len(data.Users), states, len(data.Blocklist),
+		len(data.ReportedNames), len(data.Actions))
+	if config.AdaptiveWarnAfter != nil {
+		chatIDs := []ChatID{ChatID(msg.Chat.ID)}
+		if msg.Chat.ID == config.AdminChatID {
+			chatIDs = sortedKeys(data.ChatData)
+		}
+		now := time.Now()
+		for _, chatID := range chatIDs {
+			chatData, ok := data.ChatData[chatID]
+			if !ok || config.group(chatID) == nil {
+				continue
+			}
+			rate, _ := chatData.messagesPerDay(config.AdaptiveWarnAfter.Days, now)
+			fmt.Fprintf(&text, "Warn interval in %s: %s (%.0f messages per day)\n", data.chatTitle(chatID),
+				config.effectiveWarnAfter(chatID, chatData, now).Round(time.Hour), rate)
+		}
+	}
+	data.lock.Unlock()
+
+	chatAdmins.lock.Lock()
+	admins := len(chatAdmins.entries)
+	chatAdmins.lock.Unlock()
+	chatInfo.lock.Lock()
+	details := len(chatInfo.entries)
+	chatInfo.lock.Unlock()
+	fmt.Fprintf(&text, "Telegram caches: admins of %d chats, details of %d chats", admins, details)
+	return text.String()
+}
+
+// cmdSetWarn changes the warning sent to users. In a group it sets the warning of that group; in
+// the admin chat, the global warning of a language: `/setwarn [<language>] <text>`.
+func cmdSetWarn(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	text := strings.TrimSpace(msg.CommandArguments())
+	chatID := ChatID(msg.Chat.ID)
+	inGroup := config.AdminChatID == 0 || int64(chatID) != config.AdminChatID
+	lang := ""
+	if !inGroup {
+		fields := strings.SplitN(text, " ", 2)
+		if len(fields) < 2 {
+			return tr(config, msg, "Usage in the admin chat: /setwarn <language> <text>")
+		}
+		lang, text = fields[0], strings.TrimSpace(fields[1])
+	}
+	if text == "" {
+		return tr(config, msg, "Usage: /setwarn <text>")
+	}
+	version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+		switch {
+		case inGroup:
+			group := settings.group(chatID)
+			if group == nil {
+				group = &GroupConfig{ChatID: chatID}
+				settings.Groups = append(settings.Groups, group)
+			}
+			group.WarnMessage = text
+		case lang == "de":
+			settings.WarnMessageDe = text
+		case lang == "en":
+			settings.WarnMessageEn = text
+		default:
+			if settings.Messages == nil {
+				settings.Messages = map[string]map[string]string{}
+			}
+			if settings.Messages[lang] == nil {
+				settings.Messages[lang] = map[string]string{}
+			}
+			settings.Messages[lang]["warning"] = text
+		}
+		return nil
+	})
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+	change := "set the warning of " + lang
+	if inGroup {
+		change = fmt.Sprintf("set the warning of chat %d", chatID)
+	}
+	data.audit(auditAreaSettings, telegramActor(msg.From), version, change)
+	return tr(config, msg, "Warning updated. Settings version %d.", version)
+}
+
+// reloadConfig re-reads the config file and makes it live. The settings are kept, as the settings
+// stored in the cache take precedence over the config file, except for those which changed in the
+// file, see applyFileSettings. Returns the names of these.
+func reloadConfig(data *Data) ([]string, error) {
+	config, err := loadConfig(*configFilename)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := applyFileSettings(data, &config.Settings)
+	if err != nil {
+		return nil, err
+	}
+	configureMetrics(config.Metrics)
+	settingsUpdateLock.Lock()
+	defer settingsUpdateLock.Unlock()
+	config.Settings = currentConfig().Settings
+	data.lock.Lock()
+	data.Settings = &config.Settings
+	data.lock.Unlock()
+	liveConfig.Store(config)
+	return changed, nil
+}
+
+// cmdReload re-reads the config file: `/reload`.
+func cmdReload(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	changed, err := reloadConfig(data)
+	logAction(messageLogger(msg), "reload config", err, "changed_settings", changed)
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+	if len(changed) > 0 {
+		return tr(config, msg, "Config reloaded. Settings changed in the file: %s. All other settings are kept.", strings.Join(changed, ", "))
+	}
+	return tr(config, msg, "Config reloaded. Settings are kept; change them with /settings.")
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Some moderators find a sticker less disruptive and more noticeable than a wall of text, so the
+// warning can be a sticker in a chat, set by replying to it with /warnsticker. Stickers are sent
+// by their file ID, which is only valid for this bot; if the sticker cannot be sent, e.g. because
+// the bot token changed, the text warning is sent instead.
+
+import (
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// WarningSticker replaces the text warning in a chat with a sticker.
+type WarningSticker struct {
+	// File ID of the sticker.
+	FileID string
+	// Short text sent along with the sticker, e.g. "Beware of DMs!".
+	Caption string `json:",omitempty"`
+}
+
+var metricStickerFallbacks = newCounter("scamwarnbot_warning_sticker_fallbacks_total",
+	"Warnings sent as text because the warning sticker could not be sent.")
+
+// warningSticker returns the sticker warning in the chat, or nil if the warning is text.
+func (s *Settings) warningSticker(chatID ChatID) *WarningSticker {
+	if group := s.group(chatID); group != nil {
+		return group.WarningSticker
+	}
+	return nil
+}
+
+// sendWarning sends a warning replying to a message: the sticker of the chat if it has one, else
+// or if the sticker cannot be sent, the text warning, in the topic threadID. done is called with
+// the sent warning. The caption of the sticker is deleted along with the warning.
+func sendWarning(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, threadID int, text tgbotapi.MessageConfig, done func(tgbotapi.Message, error)) {
+	chatID := ChatID(msg.Chat.ID)
+	sticker := config.warningSticker(chatID)
+	if sticker == nil {
+		sendFormattedWarning(config, bot, chatID, threadID, text, done)
+		return
+	}
+	stickerConfig := tgbotapi.NewStickerShare(int64(chatID), sticker.FileID)
+	stickerConfig.ReplyToMessageID = msg.MessageID
+	stickerConfig.ReplyMarkup = text.ReplyMarkup
+	enqueueSend(bot, chatID, inTopic(stickerConfig, threadID), func(sent tgbotapi.Message, err error) {
+		if err != nil {
+			chatLogger(chatID, UserID(msg.From.ID)).Warn("could not send warning sticker, sending text", "err", err)
+			metricStickerFallbacks.inc()
+			sendFormattedWarning(config, bot, chatID, threadID, text, done)
+			return
+		}
+		done(sent, nil)
+		if sticker.Caption == "" {
+			return
+		}
+		caption := tgbotapi.NewMessage(int64(chatID), sticker.Caption)
+		caption.ReplyToMessageID = msg.MessageID
+		enqueueSend(bot, chatID, inTopic(caption, threadID), func(sent tgbotapi.Message, err error) {
+			logAction(chatLogger(chatID, UserID(msg.From.ID)), "send sticker caption", err)
+			if err == nil && config.WarningDeleteAfter.Duration > 0 {
+				data.scheduleDeletion(chatID, sent.MessageID, config.WarningDeleteAfter.Duration)
+			}
+		})
+	})
+}
+
+// cmdWarnSticker shows or sets the warning sticker of the chat: `/warnsticker [caption]` in reply
+// to a sticker sets it, `/warnsticker off` restores the text warning.
+func cmdWarnSticker(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	chatID := ChatID(msg.Chat.ID)
+	if int64(chatID) == config.AdminChatID {
+		return tr(config, msg, "This command must be used in the group.")
+	}
+	args := strings.TrimSpace(msg.CommandArguments())
+	var sticker *WarningSticker
+	switch {
+	case msg.ReplyToMessage != nil && msg.ReplyToMessage.Sticker != nil:
+		sticker = &WarningSticker{FileID: msg.ReplyToMessage.Sticker.FileID, Caption: args}
+	case args == "off":
+	case args == "":
+		if current := config.warningSticker(chatID); current != nil {
+			return tr(config, msg, "The warning is a sticker. Use /warnsticker off to warn with text again.")
+		}
+		return tr(config, msg, "The warning is text. Reply to a sticker with /warnsticker [caption] to warn with it instead.")
+	default:
+		return tr(config, msg, "Usage: reply to a sticker with /warnsticker [caption], or /warnsticker off")
+	}
+
+	version, err := updateSettings(data, anyVersion, func(settings *Settings) error {
+		group := settings.group(chatID)
+		if group == nil {
+			group = &GroupConfig{ChatID: chatID}
+			settings.Groups = append(settings.Groups, group)
+		}
+		group.WarningSticker = sticker
+		return nil
+	})
+	if err != nil {
+		return tr(config, msg, "Error: %v", err)
+	}
+	data.lock.Lock()
+	title := data.chatTitle(chatID)
+	data.lock.Unlock()
+	change := "set the warning sticker of"
+	if sticker == nil {
+		change = "removed the warning sticker of"
+	}
+	data.audit(auditAreaSettings, telegramActor(msg.From), version, change+" "+title)
+	messageLogger(msg).Info(change, "chat_title", title)
+	if sticker == nil {
+		return tr(config, msg, "The warning is text again.")
+	}
+	return tr(config, msg, "New users are now warned with this sticker.")
+}
@@ -0,0 +1,276 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Storage persists the state of the bot.
+type Storage interface {
+	// Load returns the stored state. If nothing was stored yet, the returned data is empty.
+	Load() (*Data, error)
+	// Save stores the complete state. Must be called with data.lock held.
+	Save(data *Data) error
+	// Empty returns true if nothing was stored yet.
+	Empty() (bool, error)
+	Close() error
+}
+
+// replaceState stores data in place of everything stored so far. Save only deletes the rows the
+// storage loaded or saved before, so the rows stored so far are loaded first; otherwise rows only
+// the storage has would survive, mixing the old state into the new one. A JSON file is always
+// rewritten as a whole. Must be called with data.lock held.
+func replaceState(storage Storage, data *Data) error {
+	if _, ok := storage.(*jsonStorage); ok {
+		return storage.Save(data)
+	}
+	if empty, err := storage.Empty(); err != nil {
+		return err
+	} else if !empty {
+		if _, err := storage.Load(); err != nil {
+			return fmt.Errorf("reading the state to replace: %w", err)
+		}
+	}
+	return storage.Save(data)
+}
+
+// storageBackends opens a storage backend given the location part of a storage spec.
+var storageBackends = map[string]func(location string) (Storage, error){
+	"json":   func(location string) (Storage, error) { return &jsonStorage{filename: location}, nil },
+	"sqlite": openSQLiteStorage,
+	"redis":  openRedisStorage,
+}
+
+// openStorage opens the storage given by a spec of the form "<backend>:<location>", e.g.
+// "json:cache.json". A spec without a backend is the filename of a JSON cache.
+func openStorage(spec string) (Storage, error) {
+	backend, location := "json", spec
+	if i := strings.Index(spec, ":"); i >= 0 {
+		backend, location = spec[:i], spec[i+1:]
+	}
+	open, ok := storageBackends[backend]
+	if !ok {
+		var names []string
+		for name := range storageBackends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown storage backend %q; known backends: %s", backend, strings.Join(names, ", "))
+	}
+	return open(location)
+}
+
+// jsonStorage stores the whole state in a single JSON file. The previous versions of the file are
+// kept as backups named <file>.1 (the most recent) to <file>.<jsonBackups>.
+type jsonStorage struct {
+	filename string
+	// The rows of the state as last loaded or saved, which the file is assembled from.
+	rows map[string]string
+}
+
+func (s *jsonStorage) backupFilename(n int) string {
+	return fmt.Sprintf("%s.%d", s.filename, n)
+}
+
+func (s *jsonStorage) Load() (*Data, error) {
+	data, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if s.rows, err = sqliteRows(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *jsonStorage) load() (*Data, error) {
+	data, err := loadJSONFile(s.filename)
+	if err == nil || os.IsNotExist(err) {
+		if data == nil {
+			data = &Data{}
+			data.initialize()
+		}
+		return data, nil
+	}
+	// Fall back to the most recent backup which can be loaded.
+	for n := 1; n <= *jsonBackups; n++ {
+		backup, backupErr := loadJSONFile(s.backupFilename(n))
+		if backupErr == nil {
+			slog.Error("could not load the cache, loaded a backup instead", "err", err, "backup", s.backupFilename(n))
+			return backup, nil
+		}
+	}
+	return nil, err
+}
+
+// loadJSONFile loads the state from a JSON file.
+func loadJSONFile(filename string) (*Data, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	data := &Data{}
+	if err := json.Unmarshal(content, data); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	data.initialize()
+	return data, nil
+}
+
+func (s *jsonStorage) Save(data *Data) error {
+	rows, err := sqliteRows(data)
+	if err != nil {
+		return err
+	}
+	return s.writeRows(rows, true)
+}
+
+// writeRows applies the rows to the rows of the state and writes the file assembled from them.
+func (s *jsonStorage) writeRows(rows map[string]string, complete bool) error {
+	if !complete && s.rows == nil {
+		return errNoCompleteState
+	}
+	s.rows = applyRows(s.rows, rows, complete)
+	content, err := jsonFromRows(s.rows)
+	if err != nil {
+		return err
+	}
+	return s.writeFile(content)
+}
+
+// jsonFromRows assembles the JSON of the state from its rows, see sqliteRows.
+func jsonFromRows(rows map[string]string) ([]byte, error) {
+	fields := map[string]json.RawMessage{}
+	chats := map[string]map[string]json.RawMessage{}
+	members := map[string]map[string]json.RawMessage{}
+	profiles := map[string]json.RawMessage{}
+	for key, value := range rows {
+		parts := strings.Split(key, "/")
+		switch {
+		case parts[0] == "state" && len(parts) == 2:
+			fields[parts[1]] = json.RawMessage(value)
+		case parts[0] == "chat" && len(parts) == 2:
+			var chatFields map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(value), &chatFields); err != nil {
+				return nil, fmt.Errorf("chat %s: %w", parts[1], err)
+			}
+			chats[parts[1]] = chatFields
+		case parts[0] == "user" && len(parts) == 3:
+			if members[parts[1]] == nil {
+				members[parts[1]] = map[string]json.RawMessage{}
+			}
+			members[parts[1]][parts[2]] = json.RawMessage(value)
+		case parts[0] == "profile" && len(parts) == 2:
+			profiles[parts[1]] = json.RawMessage(value)
+		default:
+			return nil, fmt.Errorf("invalid row key %q", key)
+		}
+	}
+	for chatID, users := range members {
+		if chats[chatID] == nil {
+			chats[chatID] = map[string]json.RawMessage{}
+		}
+		usersJSON, err := json.Marshal(users)
+		if err != nil {
+			return nil, err
+		}
+		chats[chatID]["UserData"] = usersJSON
+	}
+	for _, field := range []struct {
+		name  string
+		value interface{}
+	}{{"ChatData", chats}, {"Users", profiles}} {
+		valueJSON, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		fields[field.name] = valueJSON
+	}
+	return json.Marshal(fields)
+}
+
+// writeFile writes the state to a temporary file first and checks that it was written completely,
+// so a crash or a full disk while saving does not leave a truncated cache behind. Only then the
+// current file is rotated into the backups and replaced.
+func (s *jsonStorage) writeFile(content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	written, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+	if !json.Valid(written) {
+		return fmt.Errorf("%s: written cache does not parse", tmp.Name())
+	}
+	if err := s.rotateBackups(); err != nil {
+		slog.Warn("could not rotate the cache backups", "err", err)
+	}
+	return os.Rename(tmp.Name(), s.filename)
+}
+
+// rotateBackups shifts the backups by one and links the current file as the most recent backup.
+// The current file stays in place, so there is no moment without a cache.
+func (s *jsonStorage) rotateBackups() error {
+	if *jsonBackups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(s.filename); os.IsNotExist(err) {
+		return nil
+	}
+	for n := *jsonBackups; n > 1; n-- {
+		err := os.Rename(s.backupFilename(n-1), s.backupFilename(n))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(s.backupFilename(1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(s.filename, s.backupFilename(1))
+}
+
+func (s *jsonStorage) Empty() (bool, error) {
+	_, err := os.Stat(s.filename)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return false, err
+}
+
+func (s *jsonStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,531 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The Redis backend lets several replicas of the bot share the state, e.g. to replace one replica
+// by another without downtime. The state is stored as one key per row (see sqliteRows), and the
+// keys of chat members expire after UserRetention, so Redis evicts them like the bot does.
+//
+// Only one replica may receive updates and send warnings. The replica holding the leader lock, a
+// Redis key which expires unless it is renewed, does; the others wait for the lock and load the
+// shared state once they get it. A replica which loses the lock exits right away, without saving,
+// to not overwrite the state of the new leader. Redis is spoken to with the minimal client below.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of all keys written by the bot.
+const redisKeyPrefix = "scamwarnbot/"
+
+// Key of the leader lock.
+const redisLeaderKey = redisKeyPrefix + "leader"
+
+// The leader lock expires if it is not renewed for this long, and is renewed six times as often.
+const redisLeaderLockTTL = 30 * time.Second
+
+// Allowance for the latency of Redis and for clock drift when the leader decides whether its lease
+// may have run out.
+const redisLeaderLockMargin = 2 * time.Second
+
+// Like the SQLite backend, only the changed rows are written.
+const redisSaveInterval = 15 * time.Second
+
+// Timeout of a single command or pipeline.
+const redisTimeout = 10 * time.Second
+
+// redisClient is a minimal client for the Redis protocol (RESP2), connecting on first use and
+// reconnecting after errors. Safe for concurrent use, commands are sent one at a time.
+type redisClient struct {
+	address  string
+	password string
+	db       int
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisError is an error reply of Redis.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// newRedisClient returns a client for a location of the form "[password@]host:port[/db]".
+func newRedisClient(location string) (*redisClient, error) {
+	client := &redisClient{}
+	if i := strings.LastIndex(location, "@"); i >= 0 {
+		client.password, location = location[:i], location[i+1:]
+	}
+	if i := strings.Index(location, "/"); i >= 0 {
+		db, err := strconv.Atoi(location[i+1:])
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("invalid Redis database %q", location[i+1:])
+		}
+		client.db, location = db, location[:i]
+	}
+	if _, _, err := net.SplitHostPort(location); err != nil {
+		return nil, fmt.Errorf("invalid Redis address %q, expected [password@]host:port[/db]", location)
+	}
+	client.address = location
+	return client, nil
+}
+
+// connect opens the connection if needed. Must be called with c.lock held.
+func (c *redisClient) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", c.address, redisTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := c.roundTrip(setup); err != nil {
+			c.closeConn()
+			return err
+		}
+	}
+	return nil
+}
+
+// closeConn closes the connection. Must be called with c.lock held.
+func (c *redisClient) closeConn() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.reader = nil, nil
+	}
+}
+
+// pipeline sends the commands at once and returns their replies. Error replies are returned as
+// redisErrors in the replies; the returned error is set if any command failed.
+func (c *redisClient) pipeline(commands [][]string) ([]interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	replies, err := c.roundTrip(commands)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is in an unknown state.
+		c.closeConn()
+	}
+	return replies, err
+}
+
+// do sends a single command and returns its reply.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	replies, err := c.pipeline([][]string{args})
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// roundTrip writes the commands and reads their replies. Must be called with c.lock held.
+func (c *redisClient) roundTrip(commands [][]string) ([]interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	writer := bufio.NewWriter(c.conn)
+	for _, args := range commands {
+		fmt.Fprintf(writer, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(writer, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	var firstErr error
+	for i := range commands {
+		reply, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if replyErr, ok := reply.(redisError); ok && firstErr == nil {
+			firstErr = replyErr
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+// readReply reads a reply: a string for simple strings and bulk strings, an int64 for integers,
+// a []interface{} for arrays, a redisError for errors, and nil for null replies.
+func (c *redisClient) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(c.reader, value); err != nil {
+			return nil, err
+		}
+		return string(value[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		elements := make([]interface{}, length)
+		for i := range elements {
+			if elements[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (c *redisClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closeConn()
+	return nil
+}
+
+// keys returns all keys with the prefix, without the prefix.
+func (c *redisClient) keys(prefix string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %v", reply)
+		}
+		cursor, _ = parts[0].(string)
+		batch, _ := parts[1].([]interface{})
+		for _, key := range batch {
+			if key, ok := key.(string); ok {
+				keys = append(keys, strings.TrimPrefix(key, prefix))
+			}
+		}
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// redisStorage stores the state in Redis, one key per row, see sqliteRows.
+type redisStorage struct {
+	client *redisClient
+	// The rows as last loaded or saved, by row key, to only write the rows which changed.
+	saved map[string]string
+	// UserRetention of the state as last loaded or saved, after which the keys of chat members
+	// expire.
+	retention time.Duration
+}
+
+func openRedisStorage(location string) (Storage, error) {
+	client, err := newRedisClient(location)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.do("PING"); err != nil {
+		return nil, fmt.Errorf("%s: %w", client.address, err)
+	}
+	return &redisStorage{client: client, saved: map[string]string{}}, nil
+}
+
+// isRowKey returns true for the keys holding rows of the state, as opposed to the leader lock.
+func isRowKey(key string) bool {
+	return strings.HasPrefix(key, "state/") || strings.HasPrefix(key, "chat/") || strings.HasPrefix(key, "user/") ||
+		strings.HasPrefix(key, "profile/")
+}
+
+func (s *redisStorage) Load() (*Data, error) {
+	keys, err := s.client.keys(redisKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string]string{}
+	const batchSize = 500
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		args := []string{"MGET"}
+		var batch []string
+		for _, key := range keys[start:end] {
+			if isRowKey(key) {
+				args = append(args, redisKeyPrefix+key)
+				batch = append(batch, key)
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		reply, err := s.client.do(args...)
+		if err != nil {
+			return nil, err
+		}
+		values, _ := reply.([]interface{})
+		if len(values) != len(batch) {
+			return nil, fmt.Errorf("redis: unexpected MGET reply of length %d", len(values))
+		}
+		for i, value := range values {
+			// Keys of chat members may have expired since they were listed.
+			if value, ok := value.(string); ok {
+				loaded[batch[i]] = value
+			}
+		}
+	}
+	data, err := dataFromRows(loaded)
+	if err != nil {
+		return nil, err
+	}
+	s.saved = loaded
+	s.retention = storedRetention(data)
+	return data, nil
+}
+
+// Save writes the rows which changed since the last load or save in a single transaction. The
+// keys of chat members are set to expire after UserRetention.
+func (s *redisStorage) Save(data *Data) error {
+	rows, err := sqliteRows(data)
+	if err != nil {
+		return err
+	}
+	s.retention = storedRetention(data)
+	return s.writeRows(rows, true)
+}
+
+// storedRetention returns the UserRetention of the stored settings, zero if there are none.
+func storedRetention(data *Data) time.Duration {
+	if data.Settings == nil {
+		return 0
+	}
+	return data.Settings.UserRetention.Duration
+}
+
+func (s *redisStorage) writeRows(rows map[string]string, complete bool) error {
+	retention := strconv.FormatInt(s.retention.Milliseconds(), 10)
+	commands := [][]string{{"MULTI"}}
+	for _, key := range sortedKeys(rows) {
+		switch {
+		case s.saved[key] == rows[key]:
+			continue
+		case rows[key] == "":
+			commands = append(commands, []string{"DEL", redisKeyPrefix + key})
+			continue
+		}
+		command := []string{"SET", redisKeyPrefix + key, rows[key]}
+		if strings.HasPrefix(key, "user/") && retention != "0" {
+			command = append(command, "PX", retention)
+		}
+		commands = append(commands, command)
+	}
+	if complete {
+		for _, key := range sortedKeys(s.saved) {
+			if _, ok := rows[key]; !ok {
+				commands = append(commands, []string{"DEL", redisKeyPrefix + key})
+			}
+		}
+	}
+	if len(commands) == 1 {
+		return nil
+	}
+	commands = append(commands, []string{"EXEC"})
+	replies, err := s.client.pipeline(commands)
+	if err != nil {
+		// Commands rejected while queueing abort the transaction.
+		s.client.do("DISCARD")
+		return err
+	}
+	// Commands failing while executing do not abort the transaction.
+	results, _ := replies[len(replies)-1].([]interface{})
+	if results == nil {
+		return errors.New("redis: transaction aborted")
+	}
+	for _, result := range results {
+		if err, ok := result.(redisError); ok {
+			return err
+		}
+	}
+	s.saved = applyRows(s.saved, rows, complete)
+	return nil
+}
+
+func (s *redisStorage) Empty() (bool, error) {
+	keys, err := s.client.keys(redisKeyPrefix + "state/")
+	return len(keys) == 0, err
+}
+
+func (s *redisStorage) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisStorage) saveInterval() time.Duration {
+	return redisSaveInterval
+}
+
+// Scripts changing the leader lock only if it is held by the given replica.
+const (
+	redisRenewScript   = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+	redisReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
+)
+
+// leaderLock is the leader lock held by this replica.
+type leaderLock struct {
+	client *redisClient
+	// Identifies this replica as the holder of the lock.
+	id string
+	// When the command acquiring the lock was sent, before its lease started.
+	acquiredAt time.Time
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// acquireLeaderLock waits until this replica holds the leader lock if the state is stored in
+// Redis, and keeps renewing it until it is released. Returns nil without waiting for other
+// backends, and if ctx is cancelled while waiting.
+func acquireLeaderLock(ctx context.Context, spec string) (*leaderLock, error) {
+	location, ok := strings.CutPrefix(spec, "redis:")
+	if !ok {
+		return nil, nil
+	}
+	client, err := newRedisClient(location)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	lock := &leaderLock{
+		client: client,
+		id:     fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), hex.EncodeToString(random)),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	ttl := strconv.FormatInt(redisLeaderLockTTL.Milliseconds(), 10)
+	for waiting := false; ; waiting = true {
+		lock.acquiredAt = time.Now()
+		reply, err := client.do("SET", redisLeaderKey, lock.id, "NX", "PX", ttl)
+		if err != nil {
+			slog.Error("could not acquire the leader lock", "err", err)
+		} else if reply != nil {
+			break
+		} else if !waiting {
+			holder, _ := client.do("GET", redisLeaderKey)
+			slog.Info("waiting for the leader lock", "holder", holder)
+		}
+		if !sleepContext(ctx, redisLeaderLockTTL/3) {
+			client.Close()
+			return nil, nil
+		}
+	}
+	slog.Info("acquired the leader lock", "id", lock.id)
+	go lock.renew()
+	return lock, nil
+}
+
+// renew renews the lock until it is released. Exits the bot if the lock was lost, as another
+// replica may have taken over already, and before the lease may run out if it cannot be renewed:
+// the lease runs from when a renewal was sent at the earliest, and a renewal may block for
+// redisTimeout, so no renewal is sent later than that before the lease ends.
+func (l *leaderLock) renew() {
+	defer close(l.done)
+	ttl := strconv.FormatInt(redisLeaderLockTTL.Milliseconds(), 10)
+	renewed := l.acquiredAt
+	stepDown := func() time.Time { return renewed.Add(redisLeaderLockTTL - redisTimeout - redisLeaderLockMargin) }
+	ticker := time.NewTicker(redisLeaderLockTTL / 6)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		if !time.Now().Before(stepDown()) {
+			fatal("could not renew the leader lock before the lease may run out", "renewed_at", renewed)
+		}
+		sent := time.Now()
+		reply, err := l.client.do("EVAL", redisRenewScript, "1", redisLeaderKey, l.id, ttl)
+		switch {
+		case err == nil && reply == int64(1):
+			renewed = sent
+		case err == nil:
+			fatal("lost the leader lock to another replica")
+		case !time.Now().Before(stepDown()):
+			fatal("could not renew the leader lock before the lease may run out", "err", err)
+		default:
+			slog.Warn("could not renew the leader lock", "err", err)
+		}
+	}
+}
+
+// release stops renewing the lock and releases it, so another replica can take over right away.
+// Does nothing if l is nil.
+func (l *leaderLock) release() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	if _, err := l.client.do("EVAL", redisReleaseScript, "1", redisLeaderKey, l.id); err != nil {
+		slog.Error("could not release the leader lock", "err", err)
+	} else {
+		slog.Info("released the leader lock")
+	}
+	l.client.Close()
+}
@@ -0,0 +1,368 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the database/sql driver used by the SQLite backend. The driver is only linked into
+// builds with the "sqlite" build tag (see sqlite_driver.go), as it requires cgo.
+const sqliteDriver = "sqlite3"
+
+// The SQLite backend only writes changed rows, so it can save much more often than the JSON
+// cache, which rewrites the whole file.
+const sqliteSaveInterval = 15 * time.Second
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS state (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS chats (chat_id INTEGER PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS chat_users (
+	chat_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (chat_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS chat_users_user_id ON chat_users (user_id);
+CREATE TABLE IF NOT EXISTS profiles (user_id INTEGER PRIMARY KEY, value TEXT NOT NULL);
+`
+
+// sqliteStorage stores the state in a SQLite database: one row per chat member in chat_users, one
+// row per chat (without its members) in chats, one row per user profile in profiles, and one row
+// per remaining field of Data in state.
+// Rows are stored as JSON, so new fields need no schema migrations.
+type sqliteStorage struct {
+	db *sql.DB
+	// The rows as last loaded or saved, by row key, to only write the rows which changed.
+	saved map[string]string
+}
+
+func openSQLiteStorage(location string) (Storage, error) {
+	if !hasSQLDriver(sqliteDriver) {
+		return nil, errors.New("this binary was built without SQLite support; rebuild with -tags sqlite")
+	}
+	db, err := sql.Open(sqliteDriver, location)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite does not support concurrent writers.
+	db.SetMaxOpenConns(1)
+	for _, statement := range []string{"PRAGMA journal_mode=WAL", "PRAGMA synchronous=NORMAL", sqliteSchema} {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", location, err)
+		}
+	}
+	return &sqliteStorage{db: db, saved: map[string]string{}}, nil
+}
+
+func hasSQLDriver(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Row keys, identifying a row across the tables.
+func stateRowKey(key string) string {
+	return "state/" + key
+}
+
+func chatRowKey(chatID ChatID) string {
+	return fmt.Sprintf("chat/%d", chatID)
+}
+
+func userRowKey(chatID ChatID, userID UserID) string {
+	return fmt.Sprintf("user/%d/%d", chatID, userID)
+}
+
+func profileRowKey(userID UserID) string {
+	return fmt.Sprintf("profile/%d", userID)
+}
+
+// marshalWithout marshals a struct to a JSON object, leaving out the given field.
+func marshalWithout(value interface{}, field string) (map[string]json.RawMessage, error) {
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(valueJSON, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, field)
+	return fields, nil
+}
+
+// chatRow returns the row of a chat, without its members.
+func chatRow(chatData *ChatData) (string, error) {
+	chatFields, err := marshalWithout(chatData, "UserData")
+	if err != nil {
+		return "", err
+	}
+	chatJSON, err := json.Marshal(chatFields)
+	return string(chatJSON), err
+}
+
+// sqliteRows returns the rows representing the state, by row key.
+func sqliteRows(data *Data) (map[string]string, error) {
+	rows := map[string]string{}
+	fields, err := marshalWithout(data, "ChatData")
+	if err != nil {
+		return nil, err
+	}
+	delete(fields, "Users")
+	for key, value := range fields {
+		rows[stateRowKey(key)] = string(value)
+	}
+	for userID, profile := range data.Users {
+		profileJSON, err := json.Marshal(profile)
+		if err != nil {
+			return nil, err
+		}
+		rows[profileRowKey(userID)] = string(profileJSON)
+	}
+	for chatID, chatData := range data.ChatData {
+		chatJSON, err := chatRow(chatData)
+		if err != nil {
+			return nil, err
+		}
+		rows[chatRowKey(chatID)] = chatJSON
+		for userID, userData := range chatData.UserData {
+			userJSON, err := json.Marshal(userData)
+			if err != nil {
+				return nil, err
+			}
+			rows[userRowKey(chatID, userID)] = string(userJSON)
+		}
+	}
+	return rows, nil
+}
+
+// dataFromRows builds the state from its rows, see sqliteRows.
+func dataFromRows(rows map[string]string) (*Data, error) {
+	fields := map[string]json.RawMessage{}
+	for key, value := range rows {
+		if field, ok := strings.CutPrefix(key, "state/"); ok {
+			fields[field] = json.RawMessage(value)
+		}
+	}
+	fieldsJSON, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	data := &Data{}
+	if err := json.Unmarshal(fieldsJSON, data); err != nil {
+		return nil, fmt.Errorf("state: %w", err)
+	}
+	data.initialize()
+
+	for key, value := range rows {
+		var chatID ChatID
+		if _, err := fmt.Sscanf(key, "chat/%d", &chatID); err != nil {
+			continue
+		}
+		chatData := &ChatData{}
+		if err := json.Unmarshal([]byte(value), chatData); err != nil {
+			return nil, fmt.Errorf("chat %d: %w", chatID, err)
+		}
+		chatData.UserData = map[UserID]*UserData{}
+		data.ChatData[chatID] = chatData
+	}
+	for key, value := range rows {
+		var chatID ChatID
+		var userID UserID
+		if _, err := fmt.Sscanf(key, "user/%d/%d", &chatID, &userID); err != nil {
+			continue
+		}
+		userData := &UserData{}
+		if err := json.Unmarshal([]byte(value), userData); err != nil {
+			return nil, fmt.Errorf("user %d in chat %d: %w", userID, chatID, err)
+		}
+		data.chat(chatID).UserData[userID] = userData
+	}
+	// Profiles were stored in the Users row of state before, which they take precedence over.
+	for key, value := range rows {
+		var userID UserID
+		if _, err := fmt.Sscanf(key, "profile/%d", &userID); err != nil {
+			continue
+		}
+		profile := &UserInfo{}
+		if err := json.Unmarshal([]byte(value), profile); err != nil {
+			return nil, fmt.Errorf("profile of user %d: %w", userID, err)
+		}
+		data.Users[userID] = profile
+	}
+	return data, nil
+}
+
+func (s *sqliteStorage) Load() (*Data, error) {
+	loaded := map[string]string{}
+	for _, query := range []struct {
+		sql string
+		key func(*sql.Rows) (string, string, error)
+	}{
+		{"SELECT key, value FROM state", func(rows *sql.Rows) (string, string, error) {
+			var key, value string
+			err := rows.Scan(&key, &value)
+			return stateRowKey(key), value, err
+		}},
+		{"SELECT chat_id, value FROM chats", func(rows *sql.Rows) (string, string, error) {
+			var chatID ChatID
+			var value string
+			err := rows.Scan(&chatID, &value)
+			return chatRowKey(chatID), value, err
+		}},
+		{"SELECT chat_id, user_id, value FROM chat_users", func(rows *sql.Rows) (string, string, error) {
+			var chatID ChatID
+			var userID UserID
+			var value string
+			err := rows.Scan(&chatID, &userID, &value)
+			return userRowKey(chatID, userID), value, err
+		}},
+		{"SELECT user_id, value FROM profiles", func(rows *sql.Rows) (string, string, error) {
+			var userID UserID
+			var value string
+			err := rows.Scan(&userID, &value)
+			return profileRowKey(userID), value, err
+		}},
+	} {
+		rows, err := s.db.Query(query.sql)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			key, value, err := query.key(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			loaded[key] = value
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	data, err := dataFromRows(loaded)
+	if err != nil {
+		return nil, err
+	}
+	s.saved = loaded
+	return data, nil
+}
+
+// Save writes the rows which changed since the last load or save in a single transaction, so a
+// crash never leaves a partially written state behind.
+func (s *sqliteStorage) Save(data *Data) error {
+	rows, err := sqliteRows(data)
+	if err != nil {
+		return err
+	}
+	return s.writeRows(rows, true)
+}
+
+func (s *sqliteStorage) writeRows(rows map[string]string, complete bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, key := range sortedKeys(rows) {
+		if s.saved[key] == rows[key] {
+			continue
+		}
+		if err := execRow(tx, key, rows[key]); err != nil {
+			return err
+		}
+	}
+	if complete {
+		for _, key := range sortedKeys(s.saved) {
+			if _, ok := rows[key]; !ok {
+				if err := execRow(tx, key, ""); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.saved = applyRows(s.saved, rows, complete)
+	return nil
+}
+
+// execRow writes a row given by its row key, or deletes it if value is empty.
+func execRow(tx *sql.Tx, key string, value string) error {
+	parts := strings.Split(key, "/")
+	ids := make([]interface{}, 0, 2)
+	for _, part := range parts[1:] {
+		if parts[0] == "state" {
+			ids = append(ids, part)
+			continue
+		}
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid row key %q", key)
+		}
+		ids = append(ids, id)
+	}
+	var err error
+	switch {
+	case parts[0] == "state" && value != "":
+		_, err = tx.Exec("INSERT OR REPLACE INTO state (key, value) VALUES (?, ?)", ids[0], value)
+	case parts[0] == "state":
+		_, err = tx.Exec("DELETE FROM state WHERE key = ?", ids[0])
+	case parts[0] == "chat" && value != "":
+		_, err = tx.Exec("INSERT OR REPLACE INTO chats (chat_id, value) VALUES (?, ?)", ids[0], value)
+	case parts[0] == "chat":
+		_, err = tx.Exec("DELETE FROM chats WHERE chat_id = ?", ids[0])
+	case parts[0] == "user" && value != "":
+		_, err = tx.Exec("INSERT OR REPLACE INTO chat_users (chat_id, user_id, value) VALUES (?, ?, ?)",
+			ids[0], ids[1], value)
+	case parts[0] == "user":
+		_, err = tx.Exec("DELETE FROM chat_users WHERE chat_id = ? AND user_id = ?", ids[0], ids[1])
+	case parts[0] == "profile" && value != "":
+		_, err = tx.Exec("INSERT OR REPLACE INTO profiles (user_id, value) VALUES (?, ?)", ids[0], value)
+	case parts[0] == "profile":
+		_, err = tx.Exec("DELETE FROM profiles WHERE user_id = ?", ids[0])
+	default:
+		return fmt.Errorf("invalid row key %q", key)
+	}
+	return err
+}
+
+func (s *sqliteStorage) Empty() (bool, error) {
+	var count int
+	err := s.db.QueryRow("SELECT (SELECT COUNT(*) FROM state) + (SELECT COUNT(*) FROM chats)").Scan(&count)
+	return count == 0, err
+}
+
+func (s *sqliteStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteStorage) saveInterval() time.Duration {
+	return sqliteSaveInterval
+}
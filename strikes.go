@@ -0,0 +1,172 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const strikeHalfLifeDefault = 30 * 24 * time.Hour
+
+// Strikes below this weight are dropped.
+const strikeMinWeight = 0.01
+
+// Strike is a confirmed violation of a user.
+type Strike struct {
+	At     time.Time
+	Weight float64
+	Reason string `json:",omitempty"`
+}
+
+// StrikeThreshold is an action taken when the strikes of a user reach a number.
+type StrikeThreshold struct {
+	Strikes float64
+	// One of "mute", "kick" or "ban".
+	Action string
+	// Duration of a mute or ban. Permanent if zero.
+	Duration jsonDuration
+}
+
+// StrikePolicy defines how strikes decay and what happens when they accumulate.
+type StrikePolicy struct {
+	// Strikes lose half of their weight after this time.
+	HalfLife jsonDuration
+	// Strikes added when the bot deletes a message.
+	DeletionWeight float64
+	Thresholds     []StrikeThreshold
+}
+
+// strikePolicy returns the strike policy of a chat, or nil if strikes are disabled.
+func (s *Settings) strikePolicy(chatID ChatID) *StrikePolicy {
+	if group := s.group(chatID); group != nil && group.Strikes != nil {
+		return group.Strikes
+	}
+	return s.Strikes
+}
+
+func (p *StrikePolicy) halfLife() time.Duration {
+	if p.HalfLife.Duration == 0 {
+		return strikeHalfLifeDefault
+	}
+	return p.HalfLife.Duration
+}
+
+// currentStrikes returns the decayed sum of the strikes of a user.
+func (u *UserData) currentStrikes(policy *StrikePolicy, now time.Time) float64 {
+	var total float64
+	for _, strike := range u.Strikes {
+		age := now.Sub(strike.At)
+		total += strike.Weight * math.Pow(0.5, float64(age)/float64(policy.halfLife()))
+	}
+	return total
+}
+
+// addStrike records a violation of a user and applies the highest threshold of the chat's policy
+// that the user newly reached. Returns a description of what happened.
+func addStrike(config *Config, data *Data, bot *tgbotapi.BotAPI, chatID ChatID, userID UserID, weight float64, reason string) string {
+	policy := config.strikePolicy(chatID)
+	if policy == nil {
+		return ""
+	}
+	now := time.Now()
+
+	data.lock.Lock()
+	userData := data.chat(chatID).user(userID)
+	before := userData.currentStrikes(policy, now)
+	// Forget strikes which have decayed to nothing.
+	strikes := userData.Strikes[:0]
+	for _, strike := range userData.Strikes {
+		if strike.Weight*math.Pow(0.5, float64(now.Sub(strike.At))/float64(policy.halfLife())) >= strikeMinWeight {
+			strikes = append(strikes, strike)
+		}
+	}
+	userData.Strikes = append(strikes, Strike{At: now, Weight: weight, Reason: reason})
+	after := userData.currentStrikes(policy, now)
+	data.markChanged()
+	description := data.describeUser(userID)
+	data.lock.Unlock()
+
+	result := fmt.Sprintf("%s has %.1f strikes.", description, after)
+	var reached *StrikeThreshold
+	for i, threshold := range policy.Thresholds {
+		if before < threshold.Strikes && after >= threshold.Strikes &&
+			(reached == nil || threshold.Strikes > reached.Strikes) {
+			reached = &policy.Thresholds[i]
+		}
+	}
+	if reached == nil {
+		return result
+	}
+	err := applyStrikeAction(data, bot, chatID, userID, reached, reason)
+	logAction(chatLogger(chatID, userID), string(reached.Action), err, "strikes", reached.Strikes)
+	if err != nil {
+		return result + fmt.Sprintf(" Error applying %s: %v", reached.Action, err)
+	}
+	return result + fmt.Sprintf(" Threshold %.1f reached: %s.", reached.Strikes, reached.Action)
+}
+
+func applyStrikeAction(data *Data, bot *tgbotapi.BotAPI, chatID ChatID, userID UserID, threshold *StrikeThreshold, reason string) error {
+	reason = "strikes: " + reason
+	switch threshold.Action {
+	case "mute":
+		state := &UserState{Kind: stateRestricted, ChatID: chatID, Reason: reason}
+		if threshold.Duration.Duration > 0 {
+			state.Until = time.Now().Add(threshold.Duration.Duration)
+		}
+		if err := applyState(bot, userID, state, true); err != nil {
+			return err
+		}
+		data.lock.Lock()
+		defer data.lock.Unlock()
+		data.setState(userID, state)
+		return nil
+	case "kick":
+		if err := banMember(bot, chatID, userID, time.Time{}); err != nil {
+			return err
+		}
+		return unbanMember(bot, chatID, userID)
+	case "ban":
+		return banUser(data, bot, chatID, userID, threshold.Duration.Duration, 0, reason)
+	}
+	return fmt.Errorf("unknown action %q", threshold.Action)
+}
+
+// cmdStrike records a confirmed violation: `/strike @user [weight] [reason]`.
+func cmdStrike(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	if int64(msg.Chat.ID) == config.AdminChatID {
+		return tr(config, msg, "This command must be used in the group.")
+	}
+	if config.strikePolicy(ChatID(msg.Chat.ID)) == nil {
+		return tr(config, msg, "Strikes are not enabled in this chat.")
+	}
+	userID, args, err := resolveTarget(data, msg)
+	if err != nil {
+		return err.Error()
+	}
+	weight := 1.0
+	if len(args) > 0 {
+		if w, err := strconv.ParseFloat(args[0], 64); err == nil {
+			weight = w
+			args = args[1:]
+		}
+	}
+	return addStrike(config, data, bot, ChatID(msg.Chat.ID), userID, weight, strings.Join(args, " "))
+}
@@ -0,0 +1,137 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Helpers for Bot API methods that the telegram-bot-api library does not support (or only
+// supports with outdated parameters).
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// chatPermissions mirrors the ChatPermissions object of the Bot API.
+type chatPermissions struct {
+	CanSendMessages       bool `json:"can_send_messages"`
+	CanSendMediaMessages  bool `json:"can_send_media_messages"`
+	CanSendPolls          bool `json:"can_send_polls"`
+	CanSendOtherMessages  bool `json:"can_send_other_messages"`
+	CanAddWebPagePreviews bool `json:"can_add_web_page_previews"`
+	CanInviteUsers        bool `json:"can_invite_users"`
+}
+
+var permissionsMuted = chatPermissions{}
+
+var permissionsTextOnly = chatPermissions{CanSendMessages: true}
+
+var permissionsDefault = chatPermissions{
+	CanSendMessages:       true,
+	CanSendMediaMessages:  true,
+	CanSendPolls:          true,
+	CanSendOtherMessages:  true,
+	CanAddWebPagePreviews: true,
+	CanInviteUsers:        true,
+}
+
+// restrictMember sets the permissions of a chat member until the given time. A zero time restricts
+// forever.
+func restrictMember(bot *tgbotapi.BotAPI, chatID ChatID, userID UserID, permissions chatPermissions, until time.Time) error {
+	permissionsJSON, err := json.Marshal(permissions)
+	if err != nil {
+		return err
+	}
+	v := url.Values{}
+	v.Add("chat_id", strconv.FormatInt(int64(chatID), 10))
+	v.Add("user_id", strconv.Itoa(int(userID)))
+	v.Add("permissions", string(permissionsJSON))
+	if !until.IsZero() {
+		v.Add("until_date", strconv.FormatInt(until.Unix(), 10))
+	}
+	_, err = bot.MakeRequest("restrictChatMember", v)
+	return err
+}
+
+// banMember bans a user from a chat until the given time. A zero time bans forever.
+func banMember(bot *tgbotapi.BotAPI, chatID ChatID, userID UserID, until time.Time) error {
+	v := url.Values{}
+	v.Add("chat_id", strconv.FormatInt(int64(chatID), 10))
+	v.Add("user_id", strconv.Itoa(int(userID)))
+	if !until.IsZero() {
+		v.Add("until_date", strconv.FormatInt(until.Unix(), 10))
+	}
+	_, err := bot.MakeRequest("banChatMember", v)
+	return err
+}
+
+// unbanMember lifts the ban of a user. Users who are not banned are left untouched.
+func unbanMember(bot *tgbotapi.BotAPI, chatID ChatID, userID UserID) error {
+	v := url.Values{}
+	v.Add("chat_id", strconv.FormatInt(int64(chatID), 10))
+	v.Add("user_id", strconv.Itoa(int(userID)))
+	v.Add("only_if_banned", "true")
+	_, err := bot.MakeRequest("unbanChatMember", v)
+	return err
+}
+
+// chatDetails is the result of getChat, including the fields missing in tgbotapi.Chat.
+type chatDetails struct {
+	tgbotapi.Chat
+	PinnedMessage *tgbotapi.Message `json:"pinned_message"`
+}
+
+// getChatDetails fetches up-to-date information about a chat, including its pinned message.
+func getChatDetails(bot *tgbotapi.BotAPI, chatID ChatID) (*chatDetails, error) {
+	v := url.Values{}
+	v.Add("chat_id", strconv.FormatInt(int64(chatID), 10))
+	resp, err := bot.MakeRequest("getChat", v)
+	if err != nil {
+		return nil, err
+	}
+	var details chatDetails
+	if err := json.Unmarshal(resp.Result, &details); err != nil {
+		return nil, err
+	}
+	return &details, nil
+}
+
+// entityText returns the part of the text an entity refers to. Entity offsets are measured in
+// UTF-16 code units.
+func entityText(text string, entity tgbotapi.MessageEntity) string {
+	encoded := utf16.Encode([]rune(text))
+	if entity.Offset < 0 || entity.Length < 0 || entity.Offset+entity.Length > len(encoded) {
+		return ""
+	}
+	return string(utf16.Decode(encoded[entity.Offset : entity.Offset+entity.Length]))
+}
+
+// getChatMemberCount returns the number of members of a chat.
+func getChatMemberCount(bot *tgbotapi.BotAPI, chatID ChatID) (int, error) {
+	v := url.Values{}
+	v.Add("chat_id", strconv.FormatInt(int64(chatID), 10))
+	resp, err := bot.MakeRequest("getChatMemberCount", v)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	if err := json.Unmarshal(resp.Result, &count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
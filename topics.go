@@ -0,0 +1,241 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// In forum supergroups, messages are posted in topics. A message sent without the topic lands in
+// General, so warnings are sent to the topic of the message they reply to. The library knows
+// neither the topic of a message nor how to send to one: Update decodes the topics, which are
+// remembered for a while by message, and topicMessage sends messages, photos and stickers to a
+// topic with the Bot API directly.
+//
+// Topics can be configured in GroupConfig.Topics, e.g. to not warn in an announcements topic or
+// to warn with a message of its own in a support topic.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// The ID of the General topic. Messages in General have no topic.
+const generalTopicID = 1
+
+// Topics of messages are forgotten after this long.
+const topicTrackingTimeout = time.Hour
+
+// TopicConfig are the settings of a topic of a forum supergroup.
+type TopicConfig struct {
+	// ID of the topic, as in the links to its messages (t.me/c/<chat>/<topic>/<message>). 1 for
+	// General.
+	ThreadID int
+	// For readability of the config only.
+	Name string `json:",omitempty"`
+	// If set, users are not warned in the topic. Their messages are still scanned.
+	NoWarnings bool `json:",omitempty"`
+	// Overrides the warning in the chat language in the topic.
+	WarnMessage string `json:",omitempty"`
+}
+
+// messageTopic is the part of a message the library does not decode.
+type messageTopic struct {
+	MessageThreadID int  `json:"message_thread_id"`
+	IsTopicMessage  bool `json:"is_topic_message"`
+}
+
+// threadID returns the topic of a message, zero for General and for messages outside of forum
+// supergroups. Messages replying to a message outside of forums have the ID of the reply thread.
+func (t *messageTopic) threadID() int {
+	if t == nil || !t.IsTopicMessage {
+		return 0
+	}
+	return t.MessageThreadID
+}
+
+// UnmarshalJSON decodes an update including the topics of its messages.
+func (u *Update) UnmarshalJSON(b []byte) error {
+	type plainUpdate Update
+	if err := json.Unmarshal(b, (*plainUpdate)(u)); err != nil {
+		return err
+	}
+	var topics struct {
+		Message       *messageTopic `json:"message"`
+		EditedMessage *messageTopic `json:"edited_message"`
+	}
+	if err := json.Unmarshal(b, &topics); err != nil {
+		return err
+	}
+	u.MessageThreadID = topics.Message.threadID()
+	u.EditedMessageThreadID = topics.EditedMessage.threadID()
+	return nil
+}
+
+// topicTracker remembers the topics of the recent messages.
+type topicTracker struct {
+	lock     sync.Mutex
+	topics   map[messageKey]trackedTopic
+	prunedAt time.Time
+}
+
+type trackedTopic struct {
+	threadID   int
+	receivedAt time.Time
+}
+
+var topics = &topicTracker{topics: map[messageKey]trackedTopic{}}
+
+// receive records the topic of a message. Messages outside of topics are not recorded.
+func (t *topicTracker) receive(msg *tgbotapi.Message, threadID int) {
+	if msg == nil || msg.Chat == nil || threadID == 0 {
+		return
+	}
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.topics[messageKey{ChatID(msg.Chat.ID), msg.MessageID}] = trackedTopic{threadID, now}
+	if now.Sub(t.prunedAt) < topicTrackingTimeout {
+		return
+	}
+	for key, topic := range t.topics {
+		if now.Sub(topic.receivedAt) > topicTrackingTimeout {
+			delete(t.topics, key)
+		}
+	}
+	t.prunedAt = now
+}
+
+// messageThread returns the topic of a recent message, zero if it is not in a topic.
+func messageThread(msg *tgbotapi.Message) int {
+	topics.lock.Lock()
+	defer topics.lock.Unlock()
+	return topics.topics[messageKey{ChatID(msg.Chat.ID), msg.MessageID}].threadID
+}
+
+// topic returns the settings of a topic of a chat, or nil if it has none.
+func (s *Settings) topic(chatID ChatID, threadID int) *TopicConfig {
+	group := s.group(chatID)
+	if group == nil {
+		return nil
+	}
+	if threadID == 0 {
+		threadID = generalTopicID
+	}
+	for _, topic := range group.Topics {
+		if topic.ThreadID == threadID {
+			return topic
+		}
+	}
+	return nil
+}
+
+// compileTopics validates the topics of a chat.
+func compileTopics(topics []*TopicConfig) error {
+	seen := map[int]bool{}
+	for i, topic := range topics {
+		path := fmt.Sprintf("Topics[%d]", i)
+		if topic.ThreadID < generalTopicID {
+			return fieldErrorf(path+".ThreadID", "must be set")
+		}
+		if seen[topic.ThreadID] {
+			return fieldErrorf(path+".ThreadID", "duplicate topic %d", topic.ThreadID)
+		}
+		seen[topic.ThreadID] = true
+		if err := checkWarningTemplate(path+".WarnMessage", topic.WarnMessage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topicMessage is a message, photo or sticker to a topic.
+type topicMessage struct {
+	tgbotapi.Chattable
+	threadID int
+}
+
+// inTopic returns c sent to a topic, or c itself for General and chats without topics.
+func inTopic(c tgbotapi.Chattable, threadID int) tgbotapi.Chattable {
+	if threadID == 0 {
+		return c
+	}
+	return topicMessage{c, threadID}
+}
+
+// sendChattable sends c, to its topic if it is a topicMessage.
+func sendChattable(bot *tgbotapi.BotAPI, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	m, ok := c.(topicMessage)
+	if !ok {
+		return bot.Send(c)
+	}
+	v := url.Values{}
+	var method string
+	var base tgbotapi.BaseChat
+	switch c := m.Chattable.(type) {
+	case tgbotapi.MessageConfig:
+		method, base = "sendMessage", c.BaseChat
+		v.Add("text", c.Text)
+		v.Add("disable_web_page_preview", strconv.FormatBool(c.DisableWebPagePreview))
+		if c.ParseMode != "" {
+			v.Add("parse_mode", c.ParseMode)
+		}
+	case tgbotapi.PhotoConfig:
+		if !c.UseExisting {
+			return bot.Send(c)
+		}
+		method, base = "sendPhoto", c.BaseChat
+		v.Add("photo", c.FileID)
+		if c.Caption != "" {
+			v.Add("caption", c.Caption)
+		}
+		if c.ParseMode != "" {
+			v.Add("parse_mode", c.ParseMode)
+		}
+	case tgbotapi.StickerConfig:
+		if !c.UseExisting {
+			return bot.Send(c)
+		}
+		method, base = "sendSticker", c.BaseChat
+		v.Add("sticker", c.FileID)
+	default:
+		// Sent to General rather than not at all.
+		return bot.Send(c)
+	}
+	v.Add("chat_id", strconv.FormatInt(base.ChatID, 10))
+	v.Add("message_thread_id", strconv.Itoa(m.threadID))
+	if base.ReplyToMessageID != 0 {
+		v.Add("reply_to_message_id", strconv.Itoa(base.ReplyToMessageID))
+	}
+	if base.DisableNotification {
+		v.Add("disable_notification", "true")
+	}
+	if base.ReplyMarkup != nil {
+		markup, err := json.Marshal(base.ReplyMarkup)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		v.Add("reply_markup", string(markup))
+	}
+	resp, err := bot.MakeRequest(method, v)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	var sent tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &sent)
+	return sent, err
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// version is the released version of this build, set with -ldflags "-X main.version=v1.2.3".
+var version = ""
+
+const updateCheckRepositoryDefault = "digitalbitbox/scamwarnbot"
+const updateCheckIntervalDefault = 24 * time.Hour
+const changelogExcerptLength = 800
+
+// How long the latest release is cached, so restarts and frequent checks do not use up the GitHub
+// API rate limit.
+const releaseCacheTTL = time.Hour
+
+// UpdateCheckConfig configures the periodic check for new releases.
+type UpdateCheckConfig struct {
+	Disabled   bool
+	Repository string
+	Interval   jsonDuration
+	// If set, only releases whose notes mention security are announced.
+	OnlySecurity bool
+}
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Body    string `json:"body"`
+	HTMLURL string `json:"html_url"`
+}
+
+// parseVersion parses "v1.2.3" into its numeric components.
+func parseVersion(s string) ([]int, bool) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	result := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		result[i] = n
+	}
+	return result, true
+}
+
+// isNewerVersion returns true if release is newer than current. Unparsable versions are always
+// considered outdated.
+func isNewerVersion(release, current string) bool {
+	r, ok1 := parseVersion(release)
+	c, ok2 := parseVersion(current)
+	if !ok1 || !ok2 {
+		return true
+	}
+	for i := 0; i < len(r) && i < len(c); i++ {
+		if r[i] != c[i] {
+			return r[i] > c[i]
+		}
+	}
+	return len(r) > len(c)
+}
+
+var githubBreaker = newCircuitBreaker("github")
+
+func fetchLatestRelease(repository string) (*githubRelease, error) {
+	var release githubRelease
+	err := githubBreaker.call(func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			"https://api.github.com/repos/"+repository+"/releases/latest", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(&release)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &release, nil
+}
+
+// checkForUpdate notifies the owners in a private message about a new release, once per release.
+func checkForUpdate(config *Config, data *Data, bot *tgbotapi.BotAPI) {
+	repository := config.UpdateCheck.Repository
+	release, err := cachedLookup(data, "github-release", lookupKey("github-release", repository),
+		releaseCacheTTL, true, func() (*githubRelease, error) { return fetchLatestRelease(repository) })
+	if err != nil {
+		slog.Error("could not check for updates", "err", err)
+		return
+	}
+	if version != "" && !isNewerVersion(release.TagName, version) {
+		return
+	}
+	if config.UpdateCheck.OnlySecurity && !strings.Contains(strings.ToLower(release.Body), "security") {
+		return
+	}
+	data.lock.Lock()
+	if data.NotifiedRelease == release.TagName {
+		data.lock.Unlock()
+		return
+	}
+	data.NotifiedRelease = release.TagName
+	data.markChanged()
+	data.lock.Unlock()
+
+	excerpt := release.Body
+	if len(excerpt) > changelogExcerptLength {
+		excerpt = excerpt[:changelogExcerptLength] + "…"
+	}
+	current := version
+	if current == "" {
+		current = "commit " + buildCommit
+	}
+	text := fmt.Sprintf("scamwarnbot %s is available (running %s):\n%s\n\n%s",
+		release.TagName, current, release.HTMLURL, excerpt)
+	notifyOwners(config, bot, text)
+	slog.Info("notified owners about release", "release", release.TagName)
+}
+
+func periodicCheckForUpdate(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for {
+		config := currentConfig()
+		checkForUpdate(config, data, bot)
+		if !sleepContext(ctx, config.UpdateCheck.Interval.Duration) {
+			return
+		}
+	}
+}
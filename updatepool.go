@@ -0,0 +1,131 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Updates are processed by a bounded pool of workers, so that a chat whose requests to Telegram
+// are slow does not hold up the other chats. The updates of each chat are processed one after the
+// other in the order they were received; updates of different chats run in parallel on up to
+// -update-workers workers. At most updateQueueLength updates are waiting at a time: beyond that,
+// receiving updates waits, so that Telegram keeps them instead of the bot piling them up in memory.
+
+import (
+	"sync"
+	"time"
+)
+
+// updateQueueLength is the maximum number of updates waiting to be processed.
+const updateQueueLength = 1000
+
+var (
+	metricUpdatesQueued = newGauge("scamwarnbot_update_queue_depth", "Updates received but not processed yet.")
+	metricUpdateChats   = newGauge("scamwarnbot_update_queue_chats", "Chats with updates received but not processed yet.")
+	metricUpdateWaits   = newCounter("scamwarnbot_update_queue_full_total", "Times receiving updates waited because the update queue was full.")
+)
+
+// updatePool processes the updates of each chat in order, and those of different chats in
+// parallel.
+type updatePool struct {
+	lock sync.Mutex
+	// The updates waiting per chat. A chat has an entry while a goroutine processes its updates.
+	queues map[ChatID][]func()
+	// Hold a slot while processing an update, and while an update is queued, respectively.
+	workers  chan struct{}
+	capacity chan struct{}
+	// Counts the updates not processed yet.
+	pending sync.WaitGroup
+}
+
+func newUpdatePool(workers int) *updatePool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &updatePool{
+		queues:   map[ChatID][]func(){},
+		workers:  make(chan struct{}, workers),
+		capacity: make(chan struct{}, updateQueueLength),
+	}
+}
+
+// submit queues an update of a chat, waiting while the queue is full.
+func (p *updatePool) submit(chatID ChatID, job func()) {
+	select {
+	case p.capacity <- struct{}{}:
+	default:
+		metricUpdateWaits.inc()
+		p.capacity <- struct{}{}
+	}
+	p.pending.Add(1)
+	metricUpdatesQueued.add(1)
+	p.lock.Lock()
+	queue, running := p.queues[chatID]
+	p.queues[chatID] = append(queue, job)
+	if !running {
+		metricUpdateChats.add(1)
+	}
+	p.lock.Unlock()
+	if !running {
+		go p.process(chatID)
+	}
+}
+
+// process processes the updates queued for a chat until there are none left.
+func (p *updatePool) process(chatID ChatID) {
+	for {
+		p.lock.Lock()
+		queue := p.queues[chatID]
+		if len(queue) == 0 {
+			delete(p.queues, chatID)
+			metricUpdateChats.add(-1)
+			p.lock.Unlock()
+			return
+		}
+		job := queue[0]
+		p.queues[chatID] = queue[1:]
+		p.lock.Unlock()
+
+		p.workers <- struct{}{}
+		job()
+		<-p.workers
+		<-p.capacity
+		metricUpdatesQueued.add(-1)
+		p.pending.Done()
+	}
+}
+
+// wait waits until the queued updates are processed, up to the timeout. Returns false on timeout.
+func (p *updatePool) wait(timeout time.Duration) bool {
+	return waitTimeout(&p.pending, timeout)
+}
+
+// updateChat returns the chat an update belongs to, for ordering. Updates without chat, e.g.
+// callback queries of inline messages, are ordered among themselves.
+func updateChat(update Update) ChatID {
+	var chatID int64
+	switch {
+	case update.Message != nil:
+		chatID = update.Message.Chat.ID
+	case update.EditedMessage != nil:
+		chatID = update.EditedMessage.Chat.ID
+	case update.ChannelPost != nil:
+		chatID = update.ChannelPost.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		chatID = update.CallbackQuery.Message.Chat.ID
+	case update.MyChatMember != nil:
+		chatID = update.MyChatMember.Chat.ID
+	case update.ChatMember != nil:
+		chatID = update.ChatMember.Chat.ID
+	}
+	return ChatID(chatID)
+}
@@ -0,0 +1,202 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Telegram only sends the kinds of updates a bot asks for. The bot asks for those in
+// allowedUpdates, both when polling and for the webhook, and routeUpdate dispatches each kind to
+// its handler. The library does not know the chat member updates nor topics, so updates are
+// decoded into Update, which adds them.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"runtime/debug"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// allowedUpdates are the kinds of updates the bot receives. chat_member updates are only sent to
+// bots which are admins of the chat.
+var allowedUpdates = []string{"message", "edited_message", "channel_post", "callback_query", "my_chat_member", "chat_member"}
+
+// Update is an update from Telegram, including the kinds the library does not know.
+type Update struct {
+	tgbotapi.Update
+	// The status of the bot changed in a chat.
+	MyChatMember *ChatMemberUpdated `json:"my_chat_member"`
+	// The status of a member changed in a chat.
+	ChatMember *ChatMemberUpdated `json:"chat_member"`
+	// Topics of Message and EditedMessage in forum supergroups, zero outside of topics. Decoded by
+	// UnmarshalJSON.
+	MessageThreadID       int `json:"-"`
+	EditedMessageThreadID int `json:"-"`
+}
+
+// ChatMemberUpdated is a change of the status of a member in a chat.
+type ChatMemberUpdated struct {
+	Chat          tgbotapi.Chat    `json:"chat"`
+	From          tgbotapi.User    `json:"from"`
+	Date          int              `json:"date"`
+	OldChatMember chatMemberStatus `json:"old_chat_member"`
+	NewChatMember chatMemberStatus `json:"new_chat_member"`
+}
+
+// chatMemberStatus is the status of a member: "creator", "administrator", "member",
+// "restricted", "left" or "kicked".
+type chatMemberStatus struct {
+	User   tgbotapi.User `json:"user"`
+	Status string        `json:"status"`
+}
+
+// present returns true if the status is that of a member of the chat.
+func (s chatMemberStatus) present() bool {
+	return s.Status != "left" && s.Status != "kicked"
+}
+
+var metricUpdatesByKind = newCounter("scamwarnbot_updates_by_kind_total", "Updates received from Telegram, by kind.", "kind")
+
+var metricPanics = newCounter("scamwarnbot_panics_total", "Panics recovered while handling updates, by kind of update.", "kind")
+
+// allowedUpdatesJSON returns allowedUpdates as JSON array, as expected by the Bot API.
+func allowedUpdatesJSON() string {
+	encoded, _ := json.Marshal(allowedUpdates)
+	return string(encoded)
+}
+
+// getUpdates fetches the updates starting at offset, waiting up to timeout for new ones.
+func getUpdates(bot *tgbotapi.BotAPI, offset int, timeout time.Duration) ([]Update, error) {
+	v := url.Values{}
+	v.Add("offset", fmt.Sprint(offset))
+	v.Add("timeout", fmt.Sprint(int(timeout.Seconds())))
+	v.Add("allowed_updates", allowedUpdatesJSON())
+	response, err := bot.MakeRequest("getUpdates", v)
+	if err != nil {
+		return nil, err
+	}
+	var updates []Update
+	err = json.Unmarshal(response.Result, &updates)
+	return updates, err
+}
+
+// updateKind returns the kind of an update, as named by Telegram.
+func updateKind(update Update) string {
+	switch {
+	case update.Message != nil:
+		return "message"
+	case update.EditedMessage != nil:
+		return "edited_message"
+	case update.ChannelPost != nil:
+		return "channel_post"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.MyChatMember != nil:
+		return "my_chat_member"
+	case update.ChatMember != nil:
+		return "chat_member"
+	}
+	return "other"
+}
+
+// routeUpdate dispatches an update to the handler of its kind.
+func routeUpdate(config *Config, data *Data, bot *tgbotapi.BotAPI, update Update) {
+	kind := updateKind(update)
+	metricUpdatesByKind.inc(kind)
+	// A bug triggered by one update must not take down the bot.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			metricPanics.inc(kind)
+			slog.Error("panic while handling update", "update_id", update.UpdateID, "kind", kind,
+				"panic", fmt.Sprint(recovered), "stack", string(debug.Stack()))
+		}
+	}()
+	topics.receive(update.Message, update.MessageThreadID)
+	topics.receive(update.EditedMessage, update.EditedMessageThreadID)
+	switch kind {
+	case "message":
+		process(config, data, bot, update.Message)
+	case "edited_message":
+		processEdit(config, data, bot, update.EditedMessage)
+	case "channel_post":
+		handleChannelPost(config, data, update.ChannelPost)
+	case "callback_query":
+		handleCallback(config, data, bot, update.CallbackQuery)
+	case "my_chat_member":
+		handleMyChatMember(config, data, bot, update.MyChatMember)
+	case "chat_member":
+		handleChatMember(config, data, update.ChatMember)
+	}
+}
+
+// handleMyChatMember tells the admins when the bot was removed from or demoted in an allowed chat,
+// as it cannot protect the chat anymore. Unknown chats the bot was added to are left, or the admins
+// are asked whether to stay.
+func handleMyChatMember(config *Config, data *Data, bot *tgbotapi.BotAPI, update *ChatMemberUpdated) {
+	chatID := ChatID(update.Chat.ID)
+	old, status := update.OldChatMember.Status, update.NewChatMember.Status
+	chatLogger(chatID, UserID(update.From.ID)).Info("status of the bot changed", "old_status", old, "status", status)
+	if config.allowedGroup(&update.Chat) == nil {
+		switch {
+		case !update.OldChatMember.present() && update.NewChatMember.present() && !update.Chat.IsPrivate():
+			leaveUnknownChat(config, data, bot, &update.Chat)
+		case !update.NewChatMember.present():
+			// Asked again if the bot is added again.
+			data.lock.Lock()
+			if _, ok := data.PendingChats[chatID]; ok {
+				delete(data.PendingChats, chatID)
+				data.markChanged()
+			}
+			data.lock.Unlock()
+		}
+		return
+	}
+	switch {
+	case !update.NewChatMember.present():
+		notifyAdmins(config, bot, fmt.Sprintf("%s removed the bot from %s (%d).", update.From.String(), update.Chat.Title, chatID))
+	case old == "administrator" && status != "administrator":
+		notifyAdmins(config, bot, fmt.Sprintf("%s demoted the bot in %s (%d); it can no longer delete messages or ban users there.",
+			update.From.String(), update.Chat.Title, chatID))
+	}
+}
+
+// handleChatMember records members joining an allowed chat, also if the service messages about
+// joins are hidden, and forgets members leaving and being banned.
+func handleChatMember(config *Config, data *Data, update *ChatMemberUpdated) {
+	if config.allowedGroup(&update.Chat) == nil {
+		return
+	}
+	chatID := ChatID(update.Chat.ID)
+	member := update.NewChatMember.User
+	logger := chatLogger(chatID, UserID(member.ID))
+	joined := !update.OldChatMember.present() && update.NewChatMember.present()
+	switch {
+	case joined && !member.IsBot:
+		data.lock.Lock()
+		resetRejoinedMember(data, chatID, &member)
+		data.chat(chatID).user(UserID(member.ID))
+		data.updateUser(&member)
+		data.markChanged()
+		data.lock.Unlock()
+		logger.Info("member joined")
+	case update.NewChatMember.Status == "kicked":
+		logger.Info("member banned", "by", update.From.ID)
+		forgetLeftMember(data, chatID, &member)
+	case update.OldChatMember.present() && !update.NewChatMember.present():
+		logger.Info("member left")
+		forgetLeftMember(data, chatID, &member)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const reportIntervalDefault = 10 * time.Minute
+
+// reportLimiter limits how often each user can report messages, so a single user cannot flood
+// the admin chat, see ReportInterval.
+var reportLimiter = struct {
+	lastReportAt map[UserID]time.Time
+	lock         sync.Mutex
+}{lastReportAt: map[UserID]time.Time{}}
+
+// cmdReport forwards the message replied to to the admin chat, with buttons to ban its author,
+// delete it or ignore the report: `/report` as reply.
+func cmdReport(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	reported := msg.ReplyToMessage
+	if config.AdminChatID == 0 || int64(msg.Chat.ID) == config.AdminChatID {
+		return ""
+	}
+	if reported == nil || reported.From == nil {
+		return tr(config, msg, "Reply to the message you want to report with /report.")
+	}
+	userID := UserID(msg.From.ID)
+	now := time.Now()
+	reportLimiter.lock.Lock()
+	if now.Sub(reportLimiter.lastReportAt[userID]) < config.ReportInterval.Duration {
+		reportLimiter.lock.Unlock()
+		return tr(config, msg, "You reported a message recently. Please try again later.")
+	}
+	for id, at := range reportLimiter.lastReportAt {
+		if now.Sub(at) >= config.ReportInterval.Duration {
+			delete(reportLimiter.lastReportAt, id)
+		}
+	}
+	reportLimiter.lastReportAt[userID] = now
+	reportLimiter.lock.Unlock()
+
+	forwardToAdmins(config, bot, reported)
+	reason := fmt.Sprintf("Reported by %s (%d):\n%s", msg.From.String(), msg.From.ID, messageText(reported))
+	message := tgbotapi.NewMessage(config.AdminChatID, reportText(config, data, reported, reason))
+	message.DisableWebPagePreview = true
+	args := []string{
+		strconv.FormatInt(reported.Chat.ID, 10), strconv.Itoa(reported.MessageID), strconv.Itoa(reported.From.ID),
+	}
+	message.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Ban", callbackData("report", append([]string{"ban"}, args...)...)),
+		tgbotapi.NewInlineKeyboardButtonData("Delete", callbackData("report", append([]string{"delete"}, args...)...)),
+		tgbotapi.NewInlineKeyboardButtonData("Ignore", callbackData("report", append([]string{"ignore"}, args...)...)),
+	))
+	enqueueSend(bot, ChatID(config.AdminChatID), message, func(_ tgbotapi.Message, err error) {
+		if err != nil {
+			slog.Error("could not post report", "err", err)
+			metricTelegramErrors.inc("sendMessage")
+		}
+	})
+	messageLogger(reported).Info("message reported", "message_id", reported.MessageID, "by", userID)
+	return tr(config, msg, "Thank you, the admins were notified.")
+}
+
+// reportCallback handles the buttons of a user report: `report:<ban|delete|ignore>:<chat ID>:
+// <message ID>:<user ID>`. Banning also deletes the message.
+func reportCallback(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args []string) string {
+	if len(args) != 4 {
+		return "Invalid report."
+	}
+	chatIDInt, err1 := strconv.ParseInt(args[1], 10, 64)
+	messageID, err2 := strconv.Atoi(args[2])
+	userIDInt, err3 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return "Invalid report."
+	}
+	chatID, userID := ChatID(chatIDInt), UserID(userIDInt)
+
+	var result string
+	switch args[0] {
+	case "ban", "delete":
+		if _, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(chatID), MessageID: messageID}); err != nil {
+			// Happens if the message was already deleted, which must not prevent the ban.
+			chatLogger(chatID, 0).Warn("could not delete reported message", "action", "delete", "outcome", "error", "err", err)
+			metricTelegramErrors.inc("deleteMessage")
+		}
+		result = "Message deleted"
+		if args[0] == "ban" {
+			err := banUser(data, bot, chatID, userID, 0, UserID(query.From.ID), "reported via /report")
+			if err != nil {
+				return fmt.Sprintf("Error: %v", err)
+			}
+			result = "Message deleted and user banned"
+		}
+	case "ignore":
+		result = "Report ignored"
+	default:
+		return "Invalid report."
+	}
+	chatLogger(chatID, 0).Info("report handled", "message_id", messageID, "action", args[0], "by", query.From.ID)
+
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+		fmt.Sprintf("%s\n\n%s by %s.", query.Message.Text, result, query.From.String()))
+	edit.DisableWebPagePreview = true
+	if _, err := send(bot, ChatID(query.Message.Chat.ID), edit); err != nil {
+		slog.Error("could not update report", "err", err)
+	}
+	return result + "."
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// UserInfo is what we know about a user across all chats. The bot API offers no way to look up a
+// user by username, so we remember the usernames of everyone we have seen to be able to resolve
+// command arguments like `@username`.
+type UserInfo struct {
+	UserName  string `json:",omitempty"`
+	FirstName string `json:",omitempty"`
+	LastName  string `json:",omitempty"`
+	// Previous profiles of the user, oldest first. Scammers rename constantly to dodge bans.
+	Aliases []Alias `json:",omitempty"`
+}
+
+// Alias is a previous profile of a user.
+type Alias struct {
+	UserName  string `json:",omitempty"`
+	FirstName string `json:",omitempty"`
+	LastName  string `json:",omitempty"`
+	// When the user stopped using this profile.
+	Until time.Time
+}
+
+// userNames returns the current and all previous usernames of the user.
+func (u *UserInfo) userNames() []string {
+	var names []string
+	if u.UserName != "" {
+		names = append(names, u.UserName)
+	}
+	for _, alias := range u.Aliases {
+		if alias.UserName != "" {
+			names = append(names, alias.UserName)
+		}
+	}
+	return names
+}
+
+// updateUser stores the current profile of a user, keeping the previous profile as an alias.
+// Returns the previous profile and true if a known user changed their profile. Must be called with
+// d.lock held.
+func (d *Data) updateUser(user *tgbotapi.User) (Alias, bool) {
+	existing, ok := d.Users[UserID(user.ID)]
+	var previous Alias
+	if !ok {
+		existing = &UserInfo{}
+		d.Users[UserID(user.ID)] = existing
+	} else if existing.UserName == user.UserName && existing.FirstName == user.FirstName &&
+		existing.LastName == user.LastName {
+		return previous, false
+	} else {
+		previous = Alias{
+			UserName:  existing.UserName,
+			FirstName: existing.FirstName,
+			LastName:  existing.LastName,
+			Until:     time.Now(),
+		}
+		existing.Aliases = append(existing.Aliases, previous)
+	}
+	existing.UserName = user.UserName
+	existing.FirstName = user.FirstName
+	existing.LastName = user.LastName
+	d.profileChanged(UserID(user.ID))
+	return previous, ok
+}
+
+// userByName returns the ID of the user with the given username. Users currently using the name
+// take precedence over users who used it before. Must be called with d.lock held.
+func (d *Data) userByName(userName string) (UserID, bool) {
+	userName = strings.TrimPrefix(userName, "@")
+	for userID, info := range d.Users {
+		if strings.EqualFold(info.UserName, userName) {
+			return userID, true
+		}
+	}
+	for userID, info := range d.Users {
+		for _, alias := range info.Aliases {
+			if strings.EqualFold(alias.UserName, userName) {
+				return userID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// describeUser returns a human readable description of a user. Must be called with d.lock held.
+func (d *Data) describeUser(userID UserID) string {
+	info, ok := d.Users[userID]
+	if !ok {
+		return strconv.Itoa(int(userID))
+	}
+	name := strings.TrimSpace(info.FirstName + " " + info.LastName)
+	if info.UserName != "" {
+		name += " @" + info.UserName
+	}
+	return name + " (" + strconv.Itoa(int(userID)) + ")"
+}
+
+// resolveTarget determines the user a command refers to: the author of the message replied to,
+// or the user given by `@username` or numeric ID as the first argument. The remaining arguments
+// are returned.
+func resolveTarget(data *Data, msg *tgbotapi.Message) (UserID, []string, error) {
+	args := strings.Fields(msg.CommandArguments())
+	if msg.ReplyToMessage != nil && msg.ReplyToMessage.From != nil {
+		return UserID(msg.ReplyToMessage.From.ID), args, nil
+	}
+	if len(args) == 0 {
+		return 0, nil, errors.New("reply to a message of the user or pass @username or user ID")
+	}
+	if id, err := strconv.Atoi(args[0]); err == nil {
+		return UserID(id), args[1:], nil
+	}
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	if userID, ok := data.userByName(args[0]); ok {
+		return userID, args[1:], nil
+	}
+	return 0, nil, errors.New("unknown user " + args[0])
+}
@@ -0,0 +1,300 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Many accounts join a group only to collect its members and message them privately with scams.
+// Chats with Verification mute new members until they press a button or pick the answer to a
+// simple math question. Members who fail, or do not answer within the timeout, are kicked. Unlike
+// the captcha of a lockdown, verification is always active in the chat.
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Verification modes.
+const (
+	verificationButton = "button"
+	verificationMath   = "math"
+)
+
+const verificationTimeoutDefault = 5 * time.Minute
+
+// The reason of the restriction of users who did not verify yet.
+const verificationReason = "new member verification"
+
+// How often unanswered verifications are checked for their timeout.
+const verificationCheckInterval = 10 * time.Second
+
+// Verification configures the verification of new members of a chat.
+type Verification struct {
+	// "button" (the default) or "math".
+	Mode string `json:",omitempty"`
+	// Members not verified within this time are kicked. Defaults to 5 minutes.
+	Timeout jsonDuration `json:",omitempty"`
+}
+
+// compile validates the verification settings.
+func (v *Verification) compile() error {
+	if v.Mode != "" && v.Mode != verificationButton && v.Mode != verificationMath {
+		return fieldErrorf("Mode", "must be %q or %q", verificationButton, verificationMath)
+	}
+	if v.Timeout.Duration < 0 {
+		return fieldErrorf("Timeout", "must not be negative")
+	}
+	return nil
+}
+
+func (v *Verification) timeout() time.Duration {
+	if v.Timeout.Duration == 0 {
+		return verificationTimeoutDefault
+	}
+	return v.Timeout.Duration
+}
+
+// PendingVerification is a new member who did not verify yet. Pending verifications are persisted,
+// so members are still kicked after a restart.
+type PendingVerification struct {
+	ChatID ChatID
+	UserID UserID
+	// The challenge posted in the chat, or zero until it is sent.
+	MessageID int `json:",omitempty"`
+	// The answer to the math question, zero for the button.
+	Answer   int `json:",omitempty"`
+	Deadline time.Time
+}
+
+var metricVerifications = newCounter("scamwarnbot_verifications_total",
+	"Verifications of new members by result (passed, failed, timeout).", "result")
+
+// pendingVerification returns the pending verification of a user in a chat, or nil. Must be called
+// with d.lock held.
+func (d *Data) pendingVerification(chatID ChatID, userID UserID) *PendingVerification {
+	for _, pending := range d.PendingVerifications {
+		if pending.ChatID == chatID && pending.UserID == userID {
+			return pending
+		}
+	}
+	return nil
+}
+
+// removePendingVerification removes the pending verification of a user in a chat. Returns false
+// if there is none. Must be called with d.lock held.
+func (d *Data) removePendingVerification(chatID ChatID, userID UserID) bool {
+	for i, pending := range d.PendingVerifications {
+		if pending.ChatID == chatID && pending.UserID == userID {
+			d.PendingVerifications = append(d.PendingVerifications[:i], d.PendingVerifications[i+1:]...)
+			d.markChanged()
+			return true
+		}
+	}
+	return false
+}
+
+// mathChallenge returns a simple addition, its answer and the answers offered, which include the
+// right one.
+func mathChallenge() (question string, answer int, choices []int) {
+	a, b := 1+rand.Intn(9), 1+rand.Intn(9)
+	answer = a + b
+	choices = []int{answer}
+	for len(choices) < 4 {
+		choice := 2 + rand.Intn(17)
+		duplicate := false
+		for _, c := range choices {
+			duplicate = duplicate || c == choice
+		}
+		if !duplicate {
+			choices = append(choices, choice)
+		}
+	}
+	rand.Shuffle(len(choices), func(i, j int) { choices[i], choices[j] = choices[j], choices[i] })
+	return fmt.Sprintf("%d + %d", a, b), answer, choices
+}
+
+// verifyNewMembers mutes the users joining a chat with verification until they verify. Locked down
+// chats challenge new members with their captcha instead.
+func verifyNewMembers(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	chatID := ChatID(msg.Chat.ID)
+	group := config.group(chatID)
+	if msg.NewChatMembers == nil || group == nil || group.Verification == nil || group.Lockdown != nil {
+		return
+	}
+	verification := group.Verification
+	for _, member := range *msg.NewChatMembers {
+		if member.IsBot {
+			continue
+		}
+		userID := UserID(member.ID)
+		logger := chatLogger(chatID, userID)
+		if data.hasState(userID, stateRestricted, chatID) {
+			logger.Debug("not verifying new member: already restricted")
+			continue
+		}
+		state := &UserState{Kind: stateRestricted, ChatID: chatID, Reason: verificationReason}
+		err := applyState(bot, userID, state, true)
+		logAction(logger, "restrict", err, "reason", verificationReason)
+		if err != nil {
+			metricTelegramErrors.inc("restrictChatMember")
+			continue
+		}
+
+		pending := &PendingVerification{ChatID: chatID, UserID: userID, Deadline: time.Now().Add(verification.timeout())}
+		minutes := int(verification.timeout().Round(time.Minute) / time.Minute)
+		if minutes < 1 {
+			minutes = 1
+		}
+		var challenge tgbotapi.MessageConfig
+		if verification.Mode == verificationMath {
+			question, answer, choices := mathChallenge()
+			pending.Answer = answer
+			challenge = tgbotapi.NewMessage(int64(chatID), tr(config, msg,
+				"%s, please answer within %d minutes: what is %s?", member.String(), minutes, question))
+			var row []tgbotapi.InlineKeyboardButton
+			for _, choice := range choices {
+				row = append(row, tgbotapi.NewInlineKeyboardButtonData(strconv.Itoa(choice),
+					callbackData("verify", strconv.Itoa(member.ID), strconv.Itoa(choice))))
+			}
+			challenge.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(row)
+		} else {
+			challenge = tgbotapi.NewMessage(int64(chatID), tr(config, msg,
+				"%s, please confirm within %d minutes that you are human.", member.String(), minutes))
+			challenge.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(tr(config, msg, "I am human"),
+					callbackData("verify", strconv.Itoa(member.ID), "0")),
+			))
+		}
+
+		data.lock.Lock()
+		data.setState(userID, state)
+		data.removePendingVerification(chatID, userID)
+		data.PendingVerifications = append(data.PendingVerifications, pending)
+		data.lock.Unlock()
+
+		enqueueSend(bot, chatID, challenge, func(sent tgbotapi.Message, err error) {
+			if err != nil {
+				logger.Error("could not post verification", "err", err)
+				metricTelegramErrors.inc("sendMessage")
+				return
+			}
+			data.lock.Lock()
+			pending.MessageID = sent.MessageID
+			data.markChanged()
+			data.lock.Unlock()
+		})
+	}
+}
+
+// kickUnverified removes a user who failed the verification from the chat, allowing them to join
+// again, and deletes their challenge.
+func kickUnverified(data *Data, bot *tgbotapi.BotAPI, pending *PendingVerification, result string) {
+	logger := chatLogger(pending.ChatID, pending.UserID)
+	err := banMember(bot, pending.ChatID, pending.UserID, time.Time{})
+	if err == nil {
+		err = unbanMember(bot, pending.ChatID, pending.UserID)
+	}
+	logAction(logger, "kick", err, "reason", verificationReason, "result", result)
+	if err != nil {
+		metricTelegramErrors.inc("banChatMember")
+		return
+	}
+	metricVerifications.inc(result)
+	data.lock.Lock()
+	data.removePendingVerification(pending.ChatID, pending.UserID)
+	data.removeState(pending.UserID, stateRestricted, pending.ChatID)
+	data.lock.Unlock()
+	if pending.MessageID != 0 {
+		_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(pending.ChatID), MessageID: pending.MessageID})
+		if err != nil {
+			logger.Warn("could not delete verification", "err", err)
+		}
+	}
+}
+
+// verifyCallback handles the buttons of a verification: `verify:<user ID>:<answer>`. Only the new
+// member can answer. A wrong answer kicks them.
+func verifyCallback(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args []string) string {
+	chatID := ChatID(query.Message.Chat.ID)
+	lang := config.chatLanguage(chatID)
+	if len(args) != 2 || args[0] != strconv.Itoa(query.From.ID) {
+		return config.translate(lang, "This button is not for you.")
+	}
+	userID := UserID(query.From.ID)
+	answer, err := strconv.Atoi(args[1])
+	if err != nil {
+		return ""
+	}
+	data.lock.Lock()
+	pending := data.pendingVerification(chatID, userID)
+	var copied PendingVerification
+	if pending != nil {
+		copied = *pending
+	}
+	data.lock.Unlock()
+	if pending == nil {
+		return config.translate(lang, "This verification has expired.")
+	}
+	if answer != copied.Answer {
+		kickUnverified(data, bot, &copied, "failed")
+		return config.translate(lang, "Wrong answer.")
+	}
+
+	logger := chatLogger(chatID, userID)
+	_, err = liftRestriction(data, bot, chatID, userID, verificationReason)
+	logAction(logger, "lift verification", err)
+	if err != nil {
+		return config.translate(lang, "Something went wrong, please try again.")
+	}
+	metricVerifications.inc("passed")
+	data.lock.Lock()
+	data.removePendingVerification(chatID, userID)
+	data.lock.Unlock()
+	startProbation(config, data, bot, chatID, userID)
+	_, err = bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(chatID), MessageID: query.Message.MessageID})
+	if err != nil {
+		logger.Warn("could not delete verification", "err", err)
+	}
+	return config.translate(lang, "Thank you, you can post now.")
+}
+
+// kickTimedOutMembers kicks the new members who did not verify within the timeout.
+func kickTimedOutMembers(config *Config, data *Data, bot *tgbotapi.BotAPI) {
+	now := time.Now()
+	var due []PendingVerification
+	data.lock.Lock()
+	for _, pending := range data.PendingVerifications {
+		if now.After(pending.Deadline) && !config.botOff(pending.ChatID) {
+			due = append(due, *pending)
+		}
+	}
+	data.lock.Unlock()
+
+	for i := range due {
+		kickUnverified(data, bot, &due[i], "timeout")
+	}
+}
+
+func periodicKickTimedOutMembers(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for {
+		if !sleepContext(ctx, verificationCheckInterval) {
+			return
+		}
+		kickTimedOutMembers(currentConfig(), data, bot)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers impersonate admins, and a user who is unsure whether an account is genuine has no
+// trustworthy place to check inside Telegram, where names and profile pictures can be copied. The
+// verification page is a small public web page at /public/verify listing the official admin
+// accounts and the username of the bot per community, which the warnings link to. It is part of
+// the settings, so it is changed like them or with PUT /api/verification.
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Telegram usernames have 5 to 32 characters, see handlePattern.
+var userNamePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{4,31}$`)
+
+// VerificationPage configures the public page listing the official accounts.
+type VerificationPage struct {
+	// The public URL the page is served at, i.e. ending in /public/verify, linked from the
+	// warnings.
+	URL string
+	// Shown as the heading of the page.
+	Title string `json:",omitempty"`
+	// The communities listed on the page.
+	Communities []*VerifiedCommunity
+}
+
+// VerifiedCommunity lists the official accounts of a community.
+type VerifiedCommunity struct {
+	Name string
+	// Link to the community chat, e.g. https://t.me/example.
+	ChatURL string `json:",omitempty"`
+	// Usernames of the official admin accounts, without @.
+	Admins []string
+}
+
+// compile validates the page and normalizes the usernames.
+func (p *VerificationPage) compile() error {
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fieldErrorf("URL", "must be an http(s) URL")
+	}
+	for i, community := range p.Communities {
+		path := fmt.Sprintf("Communities[%d]", i)
+		if community.Name == "" {
+			return fieldErrorf(path+".Name", "must be set")
+		}
+		if community.ChatURL != "" {
+			u, err := url.Parse(community.ChatURL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return fieldErrorf(path+".ChatURL", "must be an http(s) URL")
+			}
+		}
+		for j, admin := range community.Admins {
+			admin = strings.TrimPrefix(admin, "@")
+			if !userNamePattern.MatchString(admin) {
+				return fieldErrorf(fmt.Sprintf("%s.Admins[%d]", path, j), "invalid username %q", admin)
+			}
+			community.Admins[j] = admin
+		}
+	}
+	return nil
+}
+
+var verificationPageTemplate = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>body{font-family:sans-serif;max-width:40em;margin:2em auto;padding:0 1em}li{margin:.3em 0}</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>These are the only official accounts. Admins never message you first and never ask for your recovery words, passwords or payments. Anyone else claiming to be an admin is a scammer.</p>
+{{range .Communities}}
+<h2>{{if .ChatURL}}<a href="{{.ChatURL}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</h2>
+<ul>
+{{range .Admins}}<li><a href="https://t.me/{{.}}">@{{.}}</a> (admin)</li>
+{{end}}{{if $.Bot}}<li><a href="https://t.me/{{$.Bot}}">@{{$.Bot}}</a> (bot)</li>
+{{end}}</ul>
+{{end}}
+</body>
+</html>
+`))
+
+// verificationPageHandler serves the verification page if VerificationPage is configured. bot is
+// the username of the bot, or empty if unknown.
+func verificationPageHandler(bot string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := currentConfig().VerificationPage
+		if page == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		title := page.Title
+		if title == "" {
+			title = "Official accounts"
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		err := verificationPageTemplate.Execute(w, struct {
+			Title       string
+			Bot         string
+			Communities []*VerifiedCommunity
+		}{title, bot, page.Communities})
+		if err != nil {
+			slog.Error("could not serve the verification page", "err", err)
+		}
+	})
+}
+
+// verificationAPIHandler shows (GET) or replaces (PUT) the verification page, or removes it
+// (DELETE).
+func verificationAPIHandler(data *Data) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(currentConfig().VerificationPage)
+			return
+		case http.MethodPut, http.MethodDelete:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isLiveBot() {
+			http.Error(w, "not the live bot; change the settings on the live bot", http.StatusForbidden)
+			return
+		}
+		var page *VerificationPage
+		if r.Method == http.MethodPut {
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&page); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		version, err := updateSettings(data, anyVersion, func(s *Settings) error {
+			s.VerificationPage = page
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		holder, _ := apiTokenHolder(r)
+		change := "replaced the verification page"
+		if page == nil {
+			change = "removed the verification page"
+		}
+		slog.Info(change+" via API", "by", holder)
+		data.audit(auditAreaSettings, apiActor(holder), version, change)
+		w.Header().Set("ETag", strconv.Quote(strconv.Itoa(version)))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,172 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers often target a specific user, e.g. someone who asked for help with a lost wallet, with
+// reply after reply from fresh accounts. A user who received VictimProtection.Replies flagged
+// replies within Window gets a protection profile for Duration: the user is alerted in a private
+// chat (if they ever started the bot), replies to them from new members are deleted, and the
+// admins get a heads-up.
+
+import (
+	"fmt"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	victimRepliesDefault  = 3
+	victimWindowDefault   = 7 * 24 * time.Hour
+	victimDurationDefault = 30 * 24 * time.Hour
+)
+
+// VictimProtection configures the protection of users targeted by scammers.
+type VictimProtection struct {
+	// A user is protected after receiving this many flagged replies within Window. Default 3
+	// within 7d.
+	Replies int
+	Window  jsonDuration
+	// How long a user stays protected. Default 30d.
+	Duration jsonDuration
+}
+
+func (p *VictimProtection) setDefaults() {
+	if p.Replies == 0 {
+		p.Replies = victimRepliesDefault
+	}
+	if p.Window.Duration == 0 {
+		p.Window.Duration = victimWindowDefault
+	}
+	if p.Duration.Duration == 0 {
+		p.Duration.Duration = victimDurationDefault
+	}
+}
+
+// TargetProfile records the flagged replies a user received, and whether the user is protected.
+type TargetProfile struct {
+	// Times of the flagged replies within the window.
+	FlaggedReplies []time.Time `json:",omitempty"`
+	// The user is protected until then.
+	ProtectedUntil time.Time `json:",omitempty"`
+}
+
+var (
+	metricProtectedVictims = newCounter("scamwarnbot_protected_victims_total",
+		"Users protected after receiving many flagged replies.")
+	metricVictimRepliesDeleted = newCounter("scamwarnbot_victim_replies_deleted_total",
+		"Replies of new members to protected users deleted.")
+)
+
+// protected returns true if the user is protected. Must be called with d.lock held.
+func (d *Data) protected(userID UserID, now time.Time) bool {
+	profile, ok := d.TargetedUsers[userID]
+	return ok && now.Before(profile.ProtectedUntil)
+}
+
+// recordFlaggedReply records a flagged reply to a user. Returns true if the user is protected
+// from now on. Profiles which are no longer needed are removed. Must be called with d.lock held.
+func (d *Data) recordFlaggedReply(policy *VictimProtection, userID UserID, now time.Time) bool {
+	for id, profile := range d.TargetedUsers {
+		replies := profile.FlaggedReplies[:0]
+		for _, at := range profile.FlaggedReplies {
+			if now.Sub(at) <= policy.Window.Duration {
+				replies = append(replies, at)
+			}
+		}
+		profile.FlaggedReplies = replies
+		if len(replies) == 0 && !now.Before(profile.ProtectedUntil) {
+			delete(d.TargetedUsers, id)
+		}
+	}
+	if d.TargetedUsers == nil {
+		d.TargetedUsers = map[UserID]*TargetProfile{}
+	}
+	profile, ok := d.TargetedUsers[userID]
+	if !ok {
+		profile = &TargetProfile{}
+		d.TargetedUsers[userID] = profile
+	}
+	profile.FlaggedReplies = append(profile.FlaggedReplies, now)
+	d.markChanged()
+	if len(profile.FlaggedReplies) < policy.Replies || now.Before(profile.ProtectedUntil) {
+		return false
+	}
+	profile.ProtectedUntil = now.Add(policy.Duration.Duration)
+	return true
+}
+
+// recordTargeting records that a flagged message replied to another user, and protects that user
+// if targeted repeatedly.
+func recordTargeting(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	policy := config.VictimProtection
+	if policy == nil || msg.ReplyToMessage == nil || msg.ReplyToMessage.From == nil {
+		return
+	}
+	victim := msg.ReplyToMessage.From
+	if victim.IsBot || victim.ID == msg.From.ID {
+		return
+	}
+	data.lock.Lock()
+	protect := data.recordFlaggedReply(policy, UserID(victim.ID), time.Now())
+	data.lock.Unlock()
+	if !protect {
+		return
+	}
+
+	metricProtectedVictims.inc()
+	chatLogger(ChatID(msg.Chat.ID), UserID(victim.ID)).Info("protecting targeted user", "for", policy.Duration.Duration)
+	lang := config.resolveLanguage(victim.LanguageCode, "en", "de")
+	alert := tgbotapi.NewMessage(int64(victim.ID), config.translate(lang,
+		"Scammers are targeting you in %s: several suspicious accounts replied to you recently. "+
+			"Admins will never message you first or ask for your recovery words. For your protection, "+
+			"replies to you from new members are deleted for a while.", msg.Chat.Title))
+	enqueueSend(bot, ChatID(victim.ID), alert, func(sent tgbotapi.Message, err error) {
+		// Fails if the user never started the bot.
+		logAction(chatLogger(ChatID(victim.ID), UserID(victim.ID)), "alert targeted user", err)
+	})
+	notifyAdmins(config, bot, fmt.Sprintf(
+		"%s received %d flagged replies within %s, most recently in %s, and is protected for %s: replies from new members are deleted.",
+		victim.String(), policy.Replies, policy.Window.Duration, msg.Chat.Title, policy.Duration.Duration))
+}
+
+// guardTargetedUser deletes a reply of a new member to a protected user. Returns true if the
+// message was deleted.
+func guardTargetedUser(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) bool {
+	if config.VictimProtection == nil || msg.ReplyToMessage == nil || msg.ReplyToMessage.From == nil ||
+		msg.ReplyToMessage.From.ID == msg.From.ID {
+		return false
+	}
+	chatID := ChatID(msg.Chat.ID)
+	data.lock.Lock()
+	protected := data.protected(UserID(msg.ReplyToMessage.From.ID), time.Now())
+	firstSeenAt := data.chat(chatID).user(UserID(msg.From.ID)).FirstSeenAt
+	data.lock.Unlock()
+	if !protected || firstSeenAt.IsZero() || time.Since(firstSeenAt) > config.NewMemberAge.Duration ||
+		userRole(config, data, bot, chatID, UserID(msg.From.ID)) >= roleModerator {
+		return false
+	}
+
+	_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: msg.Chat.ID, MessageID: msg.MessageID})
+	logAction(messageLogger(msg), "delete", err, "reason", "reply of new user to protected user")
+	if err != nil {
+		metricTelegramErrors.inc("deleteMessage")
+		return false
+	}
+	metricVictimRepliesDeleted.inc()
+	reportToAdmins(config, data, bot, msg.ReplyToMessage, fmt.Sprintf(
+		"Deleted a reply of new user %s to protected user %s:\n%s", msg.From.String(), msg.ReplyToMessage.From.String(), messageText(msg)))
+	return true
+}
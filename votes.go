@@ -0,0 +1,397 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Borderline cases, flagged but below the delete score, are put to a vote of the moderators in
+// the admin chat. The decision is carried out automatically, and every decided case labels the
+// findings of the message as confirmed or rejected, so the accuracy of each detector can be
+// judged with /feedback when tuning its score.
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Options of a vote.
+const (
+	voteDelete = "delete"
+	voteBan    = "ban"
+	voteIgnore = "ignore"
+)
+
+var voteOptions = []string{voteDelete, voteBan, voteIgnore}
+
+const (
+	voteTimeoutDefault = time.Hour
+	voteVotesDefault   = 2
+	// Number of labeled cases kept.
+	labeledCasesSize = 1000
+)
+
+// VotingPolicy configures the votes on borderline cases.
+type VotingPolicy struct {
+	// When the vote ends, the option with the most votes is carried out. Nothing happens on a tie.
+	Timeout jsonDuration
+	// The vote ends early as soon as an option has this many votes.
+	Votes int
+}
+
+func (p *VotingPolicy) setDefaults() {
+	if p.Timeout.Duration == 0 {
+		p.Timeout.Duration = voteTimeoutDefault
+	}
+	if p.Votes == 0 {
+		p.Votes = voteVotesDefault
+	}
+}
+
+// Vote is an open vote of the moderators on a message.
+type Vote struct {
+	ID        string
+	ChatID    ChatID
+	UserID    UserID
+	MessageID int
+	Text      string
+	Findings  []Finding
+	Score     float64
+	Deadline  time.Time
+	// The report in the admin chat carrying the buttons.
+	AdminMessageID int    `json:",omitempty"`
+	AdminText      string `json:",omitempty"`
+	// The option chosen by each moderator.
+	Ballots map[UserID]string
+}
+
+// LabeledCase is a message labeled as scam or not by a vote of the moderators.
+type LabeledCase struct {
+	At       time.Time
+	Text     string
+	Findings []Finding
+	Decision string
+	Scam     bool
+}
+
+// DetectorFeedback counts the decided votes on messages a detector hit.
+type DetectorFeedback struct {
+	// Messages the moderators decided to delete or ban.
+	Confirmed int
+	// Messages the moderators decided to ignore.
+	Rejected int
+}
+
+// tally counts the votes by option. Must be called with data.lock held.
+func (v *Vote) tally() map[string]int {
+	counts := map[string]int{}
+	for _, option := range v.Ballots {
+		counts[option]++
+	}
+	return counts
+}
+
+// describeTally lists the number of votes for each option. Must be called with data.lock held.
+func (v *Vote) describeTally() string {
+	counts := v.tally()
+	var parts []string
+	for _, option := range voteOptions {
+		parts = append(parts, fmt.Sprintf("%s %d", option, counts[option]))
+	}
+	return "Votes: " + strings.Join(parts, ", ")
+}
+
+// decision returns the option with the most votes, or "" if there is none or a tie. Must be
+// called with data.lock held.
+func (v *Vote) decision() string {
+	counts := v.tally()
+	best, bestCount, tie := "", 0, false
+	for _, option := range voteOptions {
+		switch {
+		case counts[option] > bestCount:
+			best, bestCount, tie = option, counts[option], false
+		case counts[option] == bestCount && bestCount > 0:
+			tie = true
+		}
+	}
+	if tie {
+		return ""
+	}
+	return best
+}
+
+// decidedBy returns the lowest ID of the moderators who voted for the option. Must be called with
+// data.lock held.
+func (v *Vote) decidedBy(option string) UserID {
+	var voters []UserID
+	for userID, choice := range v.Ballots {
+		if choice == option {
+			voters = append(voters, userID)
+		}
+	}
+	if len(voters) == 0 {
+		return 0
+	}
+	sort.Slice(voters, func(i, j int) bool { return voters[i] < voters[j] })
+	return voters[0]
+}
+
+func voteKeyboard(id string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Delete", callbackData("vote", id, voteDelete)),
+		tgbotapi.NewInlineKeyboardButtonData("Ban", callbackData("vote", id, voteBan)),
+		tgbotapi.NewInlineKeyboardButtonData("Ignore", callbackData("vote", id, voteIgnore)),
+	))
+}
+
+// startVote posts a flagged message to the admin chat for the moderators to vote on.
+func startVote(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message, findings []Finding, score float64, reason string) {
+	deadline := time.Now().Add(config.Voting.Timeout.Duration)
+	adminText := fmt.Sprintf("%s\nVote until %s, decided at %d votes.",
+		reportText(config, data, msg, reason), deadline.UTC().Format("15:04 MST"), config.Voting.Votes)
+	data.lock.Lock()
+	data.NextVoteID++
+	vote := &Vote{
+		ID:        fmt.Sprintf("V%d", data.NextVoteID),
+		ChatID:    ChatID(msg.Chat.ID),
+		UserID:    UserID(msg.From.ID),
+		MessageID: msg.MessageID,
+		Text:      messageText(msg),
+		Findings:  findings,
+		Score:     score,
+		Deadline:  deadline,
+		AdminText: adminText,
+		Ballots:   map[UserID]string{},
+	}
+	if data.Votes == nil {
+		data.Votes = map[string]*Vote{}
+	}
+	data.Votes[vote.ID] = vote
+	data.markChanged()
+	data.lock.Unlock()
+
+	message := tgbotapi.NewMessage(config.AdminChatID, adminText)
+	message.DisableWebPagePreview = true
+	message.ReplyMarkup = voteKeyboard(vote.ID)
+	enqueueSend(bot, ChatID(config.AdminChatID), message, func(sent tgbotapi.Message, err error) {
+		if err != nil {
+			slog.Error("could not post vote", "err", err)
+			metricTelegramErrors.inc("sendMessage")
+			return
+		}
+		data.lock.Lock()
+		vote.AdminMessageID = sent.MessageID
+		data.markChanged()
+		data.lock.Unlock()
+	})
+}
+
+// voteCallback records the vote of a moderator: `vote:<vote ID>:<option>`.
+func voteCallback(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args []string) string {
+	if len(args) != 2 || (args[1] != voteDelete && args[1] != voteBan && args[1] != voteIgnore) {
+		return "Invalid vote."
+	}
+	data.lock.Lock()
+	vote, ok := data.Votes[args[0]]
+	if !ok {
+		data.lock.Unlock()
+		return "The vote has ended."
+	}
+	vote.Ballots[UserID(query.From.ID)] = args[1]
+	data.markChanged()
+	decided := config.Voting != nil && vote.tally()[args[1]] >= config.Voting.Votes
+	text := vote.AdminText + "\n\n" + vote.describeTally()
+	data.lock.Unlock()
+
+	if decided {
+		closeVote(config, data, bot, vote)
+		return "Vote recorded, the case is decided."
+	}
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, text)
+	keyboard := voteKeyboard(vote.ID)
+	edit.ReplyMarkup = &keyboard
+	edit.DisableWebPagePreview = true
+	if _, err := send(bot, ChatID(query.Message.Chat.ID), edit); err != nil {
+		slog.Error("could not update vote", "err", err)
+	}
+	return "Vote recorded."
+}
+
+// closeVote ends a vote, carries out its decision and labels the findings of the message.
+func closeVote(config *Config, data *Data, bot *tgbotapi.BotAPI, vote *Vote) {
+	data.lock.Lock()
+	if _, ok := data.Votes[vote.ID]; !ok {
+		// Closed concurrently.
+		data.lock.Unlock()
+		return
+	}
+	delete(data.Votes, vote.ID)
+	decision := vote.decision()
+	decidedBy := vote.decidedBy(decision)
+	text := vote.AdminText + "\n\n" + vote.describeTally()
+	adminMessageID := vote.AdminMessageID
+	if decision != "" {
+		labelCase(data, vote, decision)
+	}
+	data.markChanged()
+	data.lock.Unlock()
+
+	var result string
+	switch decision {
+	case "":
+		result = "No decision, nothing was done."
+	case voteIgnore:
+		result = "Decision: ignore."
+	default:
+		result = "Decision: " + decision + ". " + executeVote(config, data, bot, vote, decision, decidedBy)
+	}
+	chatLogger(vote.ChatID, vote.UserID).Info("vote closed", "vote", vote.ID, "decision", decision)
+	if adminMessageID == 0 {
+		notifyAdmins(config, bot, fmt.Sprintf("Vote %s: %s", vote.ID, result))
+		return
+	}
+	edit := tgbotapi.NewEditMessageText(config.AdminChatID, adminMessageID, text+"\n"+result)
+	edit.DisableWebPagePreview = true
+	if _, err := send(bot, ChatID(config.AdminChatID), edit); err != nil {
+		slog.Error("could not update vote", "err", err)
+	}
+}
+
+// executeVote deletes the message and bans its author if so decided. Returns a description of the
+// result.
+func executeVote(config *Config, data *Data, bot *tgbotapi.BotAPI, vote *Vote, decision string, decidedBy UserID) string {
+	var actions []string
+	var result strings.Builder
+	_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(vote.ChatID), MessageID: vote.MessageID})
+	logAction(chatLogger(vote.ChatID, vote.UserID), "delete", err, "vote", vote.ID)
+	if err != nil {
+		metricTelegramErrors.inc("deleteMessage")
+		fmt.Fprintf(&result, "Error deleting the message: %v. ", err)
+	} else {
+		metricDeleted.inc()
+		actions = append(actions, "delete")
+		result.WriteString("The message was deleted. ")
+	}
+	if decision == voteBan {
+		err := banUser(data, bot, vote.ChatID, vote.UserID, config.BanDuration.Duration, decidedBy,
+			"moderator vote "+vote.ID)
+		logAction(chatLogger(vote.ChatID, vote.UserID), "ban", err, "vote", vote.ID)
+		if err != nil {
+			metricTelegramErrors.inc("banChatMember")
+			fmt.Fprintf(&result, "Error banning the user: %v. ", err)
+		} else {
+			actions = append(actions, "ban")
+			result.WriteString("The user was banned. ")
+		}
+	}
+	if len(actions) > 0 {
+		id := data.recordAction(&ActionRecord{
+			At:              time.Now(),
+			ChatID:          vote.ChatID,
+			UserID:          vote.UserID,
+			MessageID:       vote.MessageID,
+			Text:            vote.Text,
+			Actions:         actions,
+			Findings:        vote.Findings,
+			Score:           vote.Score,
+			Thresholds:      ActionThresholds{Flag: config.FlagScore, Delete: config.DeleteScore, Ban: config.BanScore, Factor: 1},
+			SettingsVersion: config.Version,
+		})
+		fmt.Fprintf(&result, "Details: /why %s", id)
+	}
+	return strings.TrimSpace(result.String())
+}
+
+// labelCase records the decision on a message as labeled example and counts it for each detector
+// which hit the message. Must be called with data.lock held.
+func labelCase(data *Data, vote *Vote, decision string) {
+	scam := decision != voteIgnore
+	data.LabeledCases = append(data.LabeledCases, &LabeledCase{
+		At:       time.Now(),
+		Text:     vote.Text,
+		Findings: vote.Findings,
+		Decision: decision,
+		Scam:     scam,
+	})
+	if len(data.LabeledCases) > labeledCasesSize {
+		data.LabeledCases = data.LabeledCases[len(data.LabeledCases)-labeledCasesSize:]
+	}
+	if data.DetectorFeedback == nil {
+		data.DetectorFeedback = map[string]*DetectorFeedback{}
+	}
+	for _, finding := range vote.Findings {
+		feedback, ok := data.DetectorFeedback[finding.Detector]
+		if !ok {
+			feedback = &DetectorFeedback{}
+			data.DetectorFeedback[finding.Detector] = feedback
+		}
+		if scam {
+			feedback.Confirmed++
+		} else {
+			feedback.Rejected++
+		}
+	}
+}
+
+// closeExpiredVotes closes the votes past their deadline.
+func closeExpiredVotes(config *Config, data *Data, bot *tgbotapi.BotAPI) {
+	now := time.Now()
+	var expired []*Vote
+	data.lock.Lock()
+	for _, vote := range data.Votes {
+		if now.After(vote.Deadline) {
+			expired = append(expired, vote)
+		}
+	}
+	data.lock.Unlock()
+	for _, vote := range expired {
+		closeVote(config, data, bot, vote)
+	}
+}
+
+func periodicCloseVotes(ctx context.Context, data *Data, bot *tgbotapi.BotAPI) {
+	for {
+		if !sleepContext(ctx, time.Minute) {
+			return
+		}
+		closeExpiredVotes(currentConfig(), data, bot)
+	}
+}
+
+// cmdFeedback shows how often the moderators confirmed and rejected the findings of each detector
+// in votes.
+func cmdFeedback(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	if len(data.DetectorFeedback) == 0 {
+		return tr(config, msg, "No votes decided yet.")
+	}
+	detectors := make([]string, 0, len(data.DetectorFeedback))
+	for detector := range data.DetectorFeedback {
+		detectors = append(detectors, detector)
+	}
+	sort.Strings(detectors)
+	var text strings.Builder
+	for _, detector := range detectors {
+		feedback := data.DetectorFeedback[detector]
+		precision := float64(feedback.Confirmed) / float64(feedback.Confirmed+feedback.Rejected)
+		text.WriteString(tr(config, msg, "%s: %d confirmed, %d rejected (%.0f%% precision)\n",
+			detector, feedback.Confirmed, feedback.Rejected, 100*precision))
+	}
+	return text.String()
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVoteDecision(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		ballots map[UserID]string
+		want    string
+	}{
+		{name: "no votes", want: ""},
+		{name: "single vote", ballots: map[UserID]string{1: voteBan}, want: voteBan},
+		{
+			name:    "majority",
+			ballots: map[UserID]string{1: voteDelete, 2: voteDelete, 3: voteIgnore},
+			want:    voteDelete,
+		},
+		{name: "tie", ballots: map[UserID]string{1: voteDelete, 2: voteIgnore}, want: ""},
+		{
+			name:    "tie below the majority",
+			ballots: map[UserID]string{1: voteBan, 2: voteBan, 3: voteDelete, 4: voteIgnore},
+			want:    voteBan,
+		},
+		{
+			name:    "tie of the majority",
+			ballots: map[UserID]string{1: voteBan, 2: voteBan, 3: voteIgnore, 4: voteIgnore, 5: voteDelete},
+			want:    "",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			vote := &Vote{Ballots: test.ballots}
+			counts := vote.tally()
+			total := 0
+			for _, option := range voteOptions {
+				total += counts[option]
+			}
+			if total != len(test.ballots) {
+				t.Errorf("tally counted %d votes, want %d", total, len(test.ballots))
+			}
+			if got := vote.decision(); got != test.want {
+				t.Errorf("got decision %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCloseExpiredVotes(t *testing.T) {
+	quietLog(t)
+	for _, test := range []struct {
+		name     string
+		ballots  map[UserID]string
+		deadline time.Duration
+		// Whether the vote is closed, and the message deleted.
+		closed, deleted bool
+	}{
+		{
+			name:     "majority, expired",
+			ballots:  map[UserID]string{1: voteDelete, 2: voteDelete, 3: voteIgnore},
+			deadline: -time.Minute,
+			closed:   true,
+			deleted:  true,
+		},
+		{
+			name:     "majority to ignore, expired",
+			ballots:  map[UserID]string{1: voteIgnore},
+			deadline: -time.Minute,
+			closed:   true,
+		},
+		{
+			name:     "tie, expired",
+			ballots:  map[UserID]string{1: voteDelete, 2: voteIgnore},
+			deadline: -time.Minute,
+			closed:   true,
+		},
+		{
+			name:     "majority, open",
+			ballots:  map[UserID]string{1: voteDelete},
+			deadline: time.Minute,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bot, fake := newFakeTelegram(t)
+			config := newLoadConfig(t)
+			config.Voting = &VotingPolicy{}
+			config.Voting.setDefaults()
+			data := newLoadData(t)
+			data.Votes = map[string]*Vote{"V1": {
+				ID:        "V1",
+				ChatID:    loadChatID,
+				UserID:    warnTestUserID,
+				MessageID: 1,
+				Deadline:  time.Now().Add(test.deadline),
+				Ballots:   test.ballots,
+			}}
+
+			closeExpiredVotes(config, data, bot)
+			if !flushSendQueues(5 * time.Second) {
+				t.Fatal("timed out sending the queued messages")
+			}
+			if _, open := data.Votes["V1"]; open == test.closed {
+				t.Errorf("vote open: %v, want %v", open, !test.closed)
+			}
+			if deleted := fake.count("deleteMessage") > 0; deleted != test.deleted {
+				t.Errorf("message deleted: %v, want %v", deleted, test.deleted)
+			}
+		})
+	}
+}
+
+func TestLabelCase(t *testing.T) {
+	data := newLoadData(t)
+	vote := &Vote{Text: "DM me", Findings: []Finding{{Detector: "rule:dm"}, {Detector: "newcomer"}}}
+	labelCase(data, vote, voteDelete)
+	labelCase(data, vote, voteBan)
+	labelCase(data, &Vote{Text: "Hello", Findings: []Finding{{Detector: "rule:dm"}}}, voteIgnore)
+
+	for detector, want := range map[string]DetectorFeedback{
+		"rule:dm":  {Confirmed: 2, Rejected: 1},
+		"newcomer": {Confirmed: 2},
+	} {
+		if got := data.DetectorFeedback[detector]; got == nil || *got != want {
+			t.Errorf("feedback of %s: got %+v, want %+v", detector, got, want)
+		}
+	}
+	if len(data.LabeledCases) != 3 {
+		t.Fatalf("got %d labeled cases, want 3", len(data.LabeledCases))
+	}
+	if last := data.LabeledCases[2]; last.Decision != voteIgnore || last.Scam {
+		t.Errorf("got labeled case %+v, want an ignored case", last)
+	}
+
+	for i := 0; i < labeledCasesSize; i++ {
+		labelCase(data, vote, voteDelete)
+	}
+	if len(data.LabeledCases) != labeledCasesSize {
+		t.Errorf("got %d labeled cases, want %d", len(data.LabeledCases), labeledCasesSize)
+	}
+	for _, labeled := range data.LabeledCases {
+		if labeled.Decision != voteDelete {
+			t.Fatalf("oldest labeled cases not trimmed, found %+v", labeled)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Number of chats fetched concurrently when warming up the caches, to stay below the Telegram API
+// rate limits.
+const warmupParallelism = 4
+
+// How long chat details are cached before they are fetched again.
+const chatDetailsCacheTTL = time.Hour
+
+type chatDetailsCacheEntry struct {
+	fetchedAt time.Time
+	details   *chatDetails
+}
+
+// chatDetailsCache caches the details of each chat (description, pinned message, ...).
+type chatDetailsCache struct {
+	entries map[ChatID]chatDetailsCacheEntry
+	lock    sync.Mutex
+}
+
+var chatInfo = &chatDetailsCache{entries: map[ChatID]chatDetailsCacheEntry{}}
+
+// get returns the details of a chat, fetching them if the cached details are missing or outdated.
+func (c *chatDetailsCache) get(bot *tgbotapi.BotAPI, chatID ChatID) (*chatDetails, error) {
+	c.lock.Lock()
+	entry, ok := c.entries[chatID]
+	c.lock.Unlock()
+	if ok && time.Since(entry.fetchedAt) < chatDetailsCacheTTL {
+		return entry.details, nil
+	}
+	details, err := getChatDetails(bot, chatID)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.entries[chatID] = chatDetailsCacheEntry{fetchedAt: time.Now(), details: details}
+	c.lock.Unlock()
+	return details, nil
+}
+
+// warmCaches fetches the admins and details of all active chats, so the first messages after a
+// start are not processed with cold caches.
+func warmCaches(data *Data, bot *tgbotapi.BotAPI) {
+	start := time.Now()
+	data.lock.Lock()
+	chatIDs := data.activeChats()
+	data.lock.Unlock()
+
+	semaphore := make(chan struct{}, warmupParallelism)
+	var wg sync.WaitGroup
+	for _, chatID := range chatIDs {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(chatID ChatID) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			if _, err := chatAdmins.get(bot, chatID); err != nil {
+				chatLogger(chatID, 0).Warn("warmup: could not fetch admins", "err", err)
+			}
+			details, err := chatInfo.get(bot, chatID)
+			if err != nil {
+				chatLogger(chatID, 0).Warn("warmup: could not fetch chat", "err", err)
+				return
+			}
+			if details.Title != "" {
+				data.lock.Lock()
+				data.chat(chatID).Title = details.Title
+				data.lock.Unlock()
+			}
+		}(chatID)
+	}
+	wg.Wait()
+	slog.Info("warmed up caches", "chats", len(chatIDs), "duration", time.Since(start).Round(time.Millisecond))
+}
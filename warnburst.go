@@ -0,0 +1,62 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// A user coming back after a long time often posts several messages in quick succession. At most
+// one warning is produced per burst: while a warning to a user is being sent, and for
+// warnBurstWindow after it was decided, further messages of the user in the chat are not warned,
+// whatever the warning policy decides for them.
+
+import (
+	"time"
+)
+
+const (
+	// Messages within this long after a warning belong to the same burst.
+	warnBurstWindow = 2 * time.Minute
+	// A warning still being sent after this long is assumed lost, so that a send without callback
+	// does not suppress warnings forever.
+	warnInFlightTimeout = time.Minute
+)
+
+// startWarning records that a warning to a user in a chat is being sent. Must be called with
+// d.lock held.
+func (d *Data) startWarning(chatID ChatID, userID UserID, now time.Time) {
+	if d.warningsInFlight == nil {
+		d.warningsInFlight = map[chatUser]time.Time{}
+	}
+	d.warningsInFlight[chatUser{chatID, userID}] = now
+}
+
+// finishWarning records that the warning to a user in a chat was sent or failed.
+func (d *Data) finishWarning(chatID ChatID, userID UserID) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.warningsInFlight, chatUser{chatID, userID})
+}
+
+// inWarnBurst returns true if a user was warned in a chat within warnBurstWindow, or a warning to
+// them is still being sent. Must be called with d.lock held.
+func (d *Data) inWarnBurst(chatID ChatID, userID UserID, now time.Time) bool {
+	key := chatUser{chatID, userID}
+	if startedAt, ok := d.warningsInFlight[key]; ok {
+		if now.Sub(startedAt) < warnInFlightTimeout {
+			return true
+		}
+		delete(d.warningsInFlight, key)
+	}
+	warnedAt := d.chat(chatID).user(userID).WarnedAt
+	return len(warnedAt) > 0 && now.Sub(warnedAt[len(warnedAt)-1]) < warnBurstWindow
+}
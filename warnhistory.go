@@ -0,0 +1,101 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Every warning of a user is recorded in the chat, so users who were warned before can get the
+// short warning or none at all when they return, and users who keep getting warned, e.g. because
+// they come and go, can be brought to the attention of the admins.
+
+import (
+	"fmt"
+	"time"
+)
+
+// The number of warning times kept per user and chat.
+const warnHistoryLength = 20
+
+const repeatWarningWindowDefault = 90 * 24 * time.Hour
+
+// RepeatWarnings decides how users who were warned before in a chat are warned again.
+type RepeatWarnings struct {
+	// How users warned before are warned: "full" (the default), "short" (message key
+	// "warning.short") or "skip".
+	Rewarn string `json:",omitempty"`
+	// Users warned this many times within Window are reported to the admins. Disabled if zero.
+	ReportAfter int          `json:",omitempty"`
+	Window      jsonDuration `json:",omitempty"`
+}
+
+func (r *RepeatWarnings) setDefaults() {
+	if r.Window.Duration == 0 {
+		r.Window.Duration = repeatWarningWindowDefault
+	}
+}
+
+func (r *RepeatWarnings) compile() error {
+	switch r.Rewarn {
+	case "", knownUserWarningFull, knownUserWarningShort, knownUserWarningSkip:
+	default:
+		return fieldErrorf("Rewarn", "must be %q, %q or %q", knownUserWarningFull, knownUserWarningShort, knownUserWarningSkip)
+	}
+	if r.ReportAfter < 0 {
+		return fieldErrorf("ReportAfter", "must not be negative")
+	}
+	if r.Window.Duration < 0 {
+		return fieldErrorf("Window", "must not be negative")
+	}
+	return nil
+}
+
+// rewarn returns how a user is warned given their warnings in the chat: knownUserWarningFull,
+// knownUserWarningShort or knownUserWarningSkip.
+func (s *Settings) rewarn(userData *UserData) string {
+	if s.RepeatWarnings == nil || s.RepeatWarnings.Rewarn == "" || userData.Warnings == 0 {
+		return knownUserWarningFull
+	}
+	return s.RepeatWarnings.Rewarn
+}
+
+// recordUserWarning records a warning of a user in the chat. Returns the number of warnings of the
+// user within the Window of RepeatWarnings if it just reached ReportAfter, zero otherwise.
+func (s *Settings) recordUserWarning(userData *UserData, now time.Time) int {
+	userData.Warnings++
+	userData.WarnedAt = append(userData.WarnedAt, now)
+	if len(userData.WarnedAt) > warnHistoryLength {
+		userData.WarnedAt = userData.WarnedAt[len(userData.WarnedAt)-warnHistoryLength:]
+	}
+	r := s.RepeatWarnings
+	if r == nil || r.ReportAfter == 0 {
+		return 0
+	}
+	recent := 0
+	for _, at := range userData.WarnedAt {
+		if now.Sub(at) <= r.Window.Duration {
+			recent++
+		}
+	}
+	if recent != r.ReportAfter {
+		return 0
+	}
+	return recent
+}
+
+// repeatWarningReport describes a user warned many times for the admins. Must be called with
+// data.lock held.
+func repeatWarningReport(config *Config, data *Data, chatID ChatID, userID UserID, warnings int) string {
+	return fmt.Sprintf("%s was warned %d times within %v in %s. The account may be a scammer coming and "+
+		"going, or a regular who should be exempted (ExemptUsers).",
+		data.describeUser(userID), warnings, config.RepeatWarnings.Window.Duration, data.chatTitle(chatID))
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/url"
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// WarningButtons adds buttons to the warnings: links to the official support page and to an
+// explainer of how scammers operate, and a "Got it" button which deletes the warning.
+type WarningButtons struct {
+	SupportURL   string `json:",omitempty"`
+	ExplainerURL string `json:",omitempty"`
+}
+
+// compile validates the URLs of the buttons.
+func (w *WarningButtons) compile() error {
+	for name, link := range map[string]string{"SupportURL": w.SupportURL, "ExplainerURL": w.ExplainerURL} {
+		if link != "" && !isHTTPURL(link) {
+			return fieldErrorf(name, "must be an http(s) URL")
+		}
+	}
+	return nil
+}
+
+// isHTTPURL returns true if link is an absolute http(s) URL.
+func isHTTPURL(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// warningKeyboard returns the buttons in a language of the warning of a user of a chat, or nil if
+// warnings have none. Warnings link to the verification page if there is one.
+func (s *Settings) warningKeyboard(chatID ChatID, lang string, userID UserID) interface{} {
+	if s.WarningButtons == nil && s.VerificationPage == nil {
+		return nil
+	}
+	var rows [][]tgbotapi.InlineKeyboardButton
+	if s.VerificationPage != nil {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(
+			s.translate(lang, "Verify official admins"), s.VerificationPage.URL)))
+	}
+	if s.WarningButtons == nil {
+		// The "Got it" button belongs to WarningButtons.
+		return tgbotapi.NewInlineKeyboardMarkup(rows...)
+	}
+	if supportURL := s.supportURL(chatID); supportURL != "" {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(
+			s.translate(lang, "Verify official support"), supportURL)))
+	}
+	if s.WarningButtons.ExplainerURL != "" {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(
+			s.translate(lang, "How scammers operate"), s.WarningButtons.ExplainerURL)))
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(
+		s.translate(lang, "Got it"), callbackData("gotit", strconv.FormatInt(int64(userID), 10)))))
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// gotItCallback deletes a warning: `gotit:<user ID>`. Only the warned user and moderators can
+// dismiss it.
+func gotItCallback(config *Config, data *Data, bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, args []string) string {
+	chatID := ChatID(query.Message.Chat.ID)
+	lang := config.chatLanguage(chatID)
+	if len(args) != 1 || (args[0] != strconv.Itoa(query.From.ID) &&
+		userRole(config, data, bot, chatID, UserID(query.From.ID)) < roleModerator) {
+		return config.translate(lang, "This button is not for you.")
+	}
+	_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(chatID), MessageID: query.Message.MessageID})
+	logAction(chatLogger(chatID, UserID(query.From.ID)), "dismiss warning", err)
+	if err != nil {
+		metricTelegramErrors.inc("deleteMessage")
+		return config.translate(lang, "Something went wrong, please try again.")
+	}
+	return ""
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// A plain sentence is easily overlooked among the messages of a busy chat. WarningFormat turns the
+// warnings into cards: formatted with MarkdownV2 or HTML, with an image, and with a button linking
+// the pinned message of the chat, e.g. its rules. The fields filled into the warning templates are
+// escaped for the parse mode, so a user named "*_*" cannot break the formatting. If Telegram
+// rejects the formatting or the image, the warning is sent as plain text, as a warning which is
+// not sent does not protect anyone.
+
+import (
+	"html"
+	"strings"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Parse modes of the warnings.
+const (
+	parseModeMarkdownV2 = "MarkdownV2"
+	parseModeHTML       = "HTML"
+)
+
+// Maximum length of the caption of a photo.
+const maxCaptionLength = 1024
+
+// WarningFormat configures how the warnings are formatted.
+type WarningFormat struct {
+	// "MarkdownV2" or "HTML" to format the warnings. Plain text if empty.
+	ParseMode             string `json:",omitempty"`
+	DisableWebPagePreview bool   `json:",omitempty"`
+	// Image sent with the warning as its caption: an http(s) URL or the file ID of a photo.
+	// Warnings too long for a caption are sent as text.
+	Photo string `json:",omitempty"`
+	// Adds a button linking the pinned message of the chat.
+	PinnedMessageButton bool `json:",omitempty"`
+}
+
+// compile validates the format.
+func (f *WarningFormat) compile() error {
+	switch f.ParseMode {
+	case "", parseModeMarkdownV2, parseModeHTML:
+	default:
+		return fieldErrorf("ParseMode", "must be %q, %q or empty", parseModeMarkdownV2, parseModeHTML)
+	}
+	return nil
+}
+
+var metricWarningFormatFallbacks = newCounter("scamwarnbot_warning_format_fallbacks_total",
+	"Warnings sent as plain text because the formatting (format) or the photo (photo) was rejected.", "reason")
+
+// markdownV2Escaper escapes the characters reserved in MarkdownV2.
+var markdownV2Escaper = strings.NewReplacer(
+	"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)", "~", "\\~",
+	"`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=", "|", "\\|", "{", "\\{",
+	"}", "\\}", ".", "\\.", "!", "\\!",
+)
+
+// escapeWarningData escapes the fields filled into the warning templates for the parse mode.
+func escapeWarningData(parseMode string, data *WarningData) {
+	var escape func(string) string
+	switch parseMode {
+	case parseModeMarkdownV2:
+		escape = markdownV2Escaper.Replace
+	case parseModeHTML:
+		escape = html.EscapeString
+	default:
+		return
+	}
+	for _, field := range []*string{&data.FirstName, &data.LastName, &data.Username, &data.GroupTitle, &data.SupportURL} {
+		*field = escape(*field)
+	}
+}
+
+// warningParseMode returns the parse mode of the warnings, empty for plain text.
+func (s *Settings) warningParseMode() string {
+	if s.WarningFormat == nil {
+		return ""
+	}
+	return s.WarningFormat.ParseMode
+}
+
+// pinnedMessageButton returns the button linking the pinned message of a chat, or nil if warnings
+// have none or the chat has no pinned message.
+func (s *Settings) pinnedMessageButton(bot *tgbotapi.BotAPI, chat *tgbotapi.Chat, lang string) []tgbotapi.InlineKeyboardButton {
+	if s.WarningFormat == nil || !s.WarningFormat.PinnedMessageButton {
+		return nil
+	}
+	details, err := chatInfo.get(bot, ChatID(chat.ID))
+	if err != nil {
+		chatLogger(ChatID(chat.ID), 0).Warn("could not fetch the pinned message", "err", err)
+		return nil
+	}
+	if details.PinnedMessage == nil {
+		return nil
+	}
+	link := messageLink(chat, details.PinnedMessage.MessageID)
+	if link == "" {
+		return nil
+	}
+	return tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(s.translate(lang, "Read the pinned message"), link))
+}
+
+// formatWarning applies the format to a warning, adding the button linking the pinned message if
+// there is one.
+func (s *Settings) formatWarning(warning *tgbotapi.MessageConfig, pinnedButton []tgbotapi.InlineKeyboardButton) {
+	if s.WarningFormat == nil {
+		return
+	}
+	warning.ParseMode = s.WarningFormat.ParseMode
+	warning.DisableWebPagePreview = s.WarningFormat.DisableWebPagePreview
+	if pinnedButton == nil {
+		return
+	}
+	keyboard, _ := warning.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup)
+	keyboard.InlineKeyboard = append([][]tgbotapi.InlineKeyboardButton{pinnedButton}, keyboard.InlineKeyboard...)
+	warning.ReplyMarkup = keyboard
+}
+
+// isParseError returns true if Telegram rejected the formatting of a message.
+func isParseError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "can't parse entities")
+}
+
+// sendFormattedWarning sends a text warning with the photo of the format, if any, falling back to
+// plain text if Telegram rejects the formatting or the photo. It is sent to the topic threadID.
+func sendFormattedWarning(config *Config, bot *tgbotapi.BotAPI, chatID ChatID, threadID int, text tgbotapi.MessageConfig, done func(tgbotapi.Message, error)) {
+	logger := chatLogger(chatID, 0)
+	sendText := func(text tgbotapi.MessageConfig) {
+		enqueueSend(bot, chatID, inTopic(text, threadID), func(sent tgbotapi.Message, err error) {
+			if isParseError(err) {
+				logger.Warn("could not format warning, sending plain text", "err", err)
+				metricWarningFormatFallbacks.inc("format")
+				text.ParseMode = ""
+				enqueueSend(bot, chatID, inTopic(text, threadID), done)
+				return
+			}
+			done(sent, err)
+		})
+	}
+	format := config.WarningFormat
+	if format == nil || format.Photo == "" || utf8.RuneCountInString(text.Text) > maxCaptionLength {
+		sendText(text)
+		return
+	}
+	photo := tgbotapi.NewPhotoShare(int64(chatID), format.Photo)
+	photo.Caption = text.Text
+	photo.ParseMode = text.ParseMode
+	photo.ReplyToMessageID = text.ReplyToMessageID
+	photo.ReplyMarkup = text.ReplyMarkup
+	enqueueSend(bot, chatID, inTopic(photo, threadID), func(sent tgbotapi.Message, err error) {
+		if err != nil {
+			logger.Warn("could not send warning photo, sending text", "err", err)
+			metricWarningFormatFallbacks.inc("photo")
+			sendText(text)
+			return
+		}
+		done(sent, nil)
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const warnPolicyDefault = "top-level"
+
+// WarnPolicy decides which messages get the warning, so each chat can choose how aggressively to
+// warn.
+type WarnPolicy interface {
+	// considers returns false for messages which are ignored: they neither get the warning nor
+	// count as the last message of the user.
+	considers(msg *tgbotapi.Message) bool
+	// due returns true if a considered message posted at now gets the warning. lastMessageAt is
+	// when the user last posted a considered message in the chat, zero if never.
+	due(msg *tgbotapi.Message, now, lastMessageAt time.Time, warnAfter time.Duration) bool
+}
+
+// warnPolicies are the warning policies by name.
+var warnPolicies = map[string]WarnPolicy{
+	"always":        alwaysWarnPolicy{},
+	"top-level":     topLevelWarnPolicy{},
+	"first-message": firstMessageWarnPolicy{},
+	"question":      questionWarnPolicy{},
+}
+
+// warnPolicyNames returns the names of the warning policies, sorted.
+func warnPolicyNames() []string {
+	var names []string
+	for name := range warnPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// alwaysWarnPolicy warns users posting any message after WarnAfter.
+type alwaysWarnPolicy struct{}
+
+func (alwaysWarnPolicy) considers(msg *tgbotapi.Message) bool { return true }
+
+func (alwaysWarnPolicy) due(msg *tgbotapi.Message, now, lastMessageAt time.Time, warnAfter time.Duration) bool {
+	return now.Sub(lastMessageAt) > warnAfter
+}
+
+// topLevelWarnPolicy does not warn users who wrote a response to a message, to reduce the noise.
+// It assumes the primary target of attackers are users who ask a question, which are usually
+// top-level messages.
+type topLevelWarnPolicy struct{}
+
+func (topLevelWarnPolicy) considers(msg *tgbotapi.Message) bool { return msg.ReplyToMessage == nil }
+
+func (topLevelWarnPolicy) due(msg *tgbotapi.Message, now, lastMessageAt time.Time, warnAfter time.Duration) bool {
+	return now.Sub(lastMessageAt) > warnAfter
+}
+
+// firstMessageWarnPolicy warns users only on their first message in the chat.
+type firstMessageWarnPolicy struct{}
+
+func (firstMessageWarnPolicy) considers(msg *tgbotapi.Message) bool { return true }
+
+func (firstMessageWarnPolicy) due(msg *tgbotapi.Message, now, lastMessageAt time.Time, warnAfter time.Duration) bool {
+	return lastMessageAt.IsZero()
+}
+
+// questionPattern matches messages starting with a question word.
+var questionPattern = regexp.MustCompile(`(?i)^\s*(how|what|why|where|when|which|who|can|could|does|do|is|are|will|should|` +
+	`wie|was|warum|wieso|wo|wann|welche[rs]?|wer|kann|könnt?e|gibt|ist|sind)\b`)
+
+// questionWarnPolicy warns users asking a question after WarnAfter, as they are the primary target
+// of scammers offering help.
+type questionWarnPolicy struct{}
+
+func (questionWarnPolicy) considers(msg *tgbotapi.Message) bool { return true }
+
+func (questionWarnPolicy) due(msg *tgbotapi.Message, now, lastMessageAt time.Time, warnAfter time.Duration) bool {
+	text := messageText(msg)
+	return (isQuestion(text) || questionPattern.MatchString(text)) && now.Sub(lastMessageAt) > warnAfter
+}
+
+// warnDecision is whether a message considered by the warning policy gets the warning, or why not.
+type warnDecision string
+
+const (
+	warnDue           warnDecision = "due"
+	warnNotDue        warnDecision = "not due"
+	warnSkipKnownUser warnDecision = "active in another chat"
+	warnSkipRepeat    warnDecision = "warned before"
+	warnSkipLearning  warnDecision = "learning period"
+	warnSkipCooldown  warnDecision = "warning cooldown of the chat"
+	warnSkipExempt    warnDecision = "exempt"
+	warnSkipBurst     warnDecision = "already warned for this burst of messages"
+)
+
+// exemptFromWarnings returns true if a user is never warned in a chat, see ExemptUsers and
+// ExemptAdmins. Fetches the admins of the chat, so it must be called without data.lock held.
+func exemptFromWarnings(config *Config, data *Data, bot *tgbotapi.BotAPI, chatID ChatID, userID UserID) bool {
+	group := config.group(chatID)
+	if group == nil {
+		return false
+	}
+	for _, exempt := range group.ExemptUsers {
+		if exempt == userID {
+			return true
+		}
+	}
+	return group.ExemptAdmins && userRole(config, data, bot, chatID, userID) >= roleModerator
+}
+
+// decideWarning decides whether a message considered by the warning policy of its chat gets the
+// warning, at most once per burst of messages of a user (see warnburst.go). Must be called with
+// data.lock held, before the message is recorded as the last message of the user.
+//
+// The warning logic stays in package main instead of behind an interface over the bot:
+// decideWarning is tested directly, and process against the fake Bot API server of the tests.
+func decideWarning(config *Config, data *Data, msg *tgbotapi.Message, now time.Time) warnDecision {
+	chatID, userID := ChatID(msg.Chat.ID), UserID(msg.From.ID)
+	chatData := data.chat(chatID)
+	lastMessageAt := chatData.user(userID).LastMessageAt
+	switch {
+	case data.inWarnBurst(chatID, userID, now):
+		return warnSkipBurst
+	case !config.warnPolicy(chatID).due(msg, now, lastMessageAt, config.effectiveWarnAfter(chatID, chatData, now)):
+		return warnNotDue
+	case data.knownUserWarning(config, userID, chatID) == knownUserWarningSkip:
+		return warnSkipKnownUser
+	case config.rewarn(chatData.user(userID)) == knownUserWarningSkip:
+		return warnSkipRepeat
+	case chatData.learning(config.LearningPeriod.Duration, now):
+		return warnSkipLearning
+	case now.Sub(chatData.LastWarningAt) < config.warningCooldown(chatID):
+		return warnSkipCooldown
+	}
+	return warnDue
+}
+
+// warnPolicy returns the warning policy of a chat.
+func (s *Settings) warnPolicy(chatID ChatID) WarnPolicy {
+	name := s.WarnPolicy
+	if group := s.group(chatID); group != nil && group.WarnPolicy != "" {
+		name = group.WarnPolicy
+	}
+	if policy, ok := warnPolicies[name]; ok {
+		return policy
+	}
+	return warnPolicies[warnPolicyDefault]
+}
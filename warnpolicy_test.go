@@ -0,0 +1,310 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const warnTestUserID = 42
+
+func warnTestMessage(text string) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		MessageID: 1,
+		From:      &tgbotapi.User{ID: warnTestUserID, FirstName: "User"},
+		Chat:      &tgbotapi.Chat{ID: loadChatID, Type: "supergroup", Title: "Warn test"},
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+}
+
+func TestDecideWarning(t *testing.T) {
+	now := time.Now()
+	month := 30 * 24 * time.Hour
+	for _, test := range []struct {
+		name  string
+		text  string
+		setup func(config *Config, group *GroupConfig, data *Data)
+		// How long after now the message is decided on.
+		later time.Duration
+		want  warnDecision
+	}{
+		{
+			name: "first message",
+			want: warnDue,
+		},
+		{
+			name: "posted recently",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				data.chat(loadChatID).user(warnTestUserID).LastMessageAt = now.Add(-time.Hour)
+			},
+			want: warnNotDue,
+		},
+		{
+			name: "back after WarnAfter",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				data.chat(loadChatID).user(warnTestUserID).LastMessageAt = now.Add(-month - time.Hour)
+			},
+			want: warnDue,
+		},
+		{
+			name: "back after WarnAfter, decided later",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				data.chat(loadChatID).user(warnTestUserID).LastMessageAt = now.Add(-time.Hour)
+			},
+			later: month,
+			want:  warnDue,
+		},
+		{
+			name: "back after the WarnAfter of the group",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				group.WarnAfter.Duration = 7 * 24 * time.Hour
+				data.chat(loadChatID).user(warnTestUserID).LastMessageAt = now.Add(-8 * 24 * time.Hour)
+			},
+			want: warnDue,
+		},
+		{
+			name: "first-message policy, returning user",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				group.WarnPolicy = "first-message"
+				data.chat(loadChatID).user(warnTestUserID).LastMessageAt = now.Add(-2 * month)
+			},
+			want: warnNotDue,
+		},
+		{
+			name: "question policy, no question",
+			text: "thanks, that worked",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				group.WarnPolicy = "question"
+			},
+			want: warnNotDue,
+		},
+		{
+			name: "question policy, question",
+			text: "How do I update the firmware?",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				group.WarnPolicy = "question"
+			},
+			want: warnDue,
+		},
+		{
+			name: "active in another chat",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				config.KnownUserWarning = knownUserWarningSkip
+				data.chat(loadChatID - 1).user(warnTestUserID).LastMessageAt = now.Add(-time.Hour)
+			},
+			want: warnSkipKnownUser,
+		},
+		{
+			name: "active in another chat, warned in full",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				data.chat(loadChatID - 1).user(warnTestUserID).LastMessageAt = now.Add(-time.Hour)
+			},
+			want: warnDue,
+		},
+		{
+			name: "warned before, rewarn skipped",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				config.RepeatWarnings = &RepeatWarnings{Rewarn: knownUserWarningSkip}
+				userData := data.chat(loadChatID).user(warnTestUserID)
+				userData.LastMessageAt = now.Add(-month - time.Hour)
+				userData.Warnings = 1
+			},
+			want: warnSkipRepeat,
+		},
+		{
+			name: "learning period",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				config.LearningPeriod.Duration = 7 * 24 * time.Hour
+				data.chat(loadChatID).FirstSeenAt = now.Add(-24 * time.Hour)
+			},
+			want: warnSkipLearning,
+		},
+		{
+			name: "learning period over",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				config.LearningPeriod.Duration = 7 * 24 * time.Hour
+				data.chat(loadChatID).FirstSeenAt = now.Add(-8 * 24 * time.Hour)
+			},
+			want: warnDue,
+		},
+		{
+			name: "warning cooldown",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				group.WarningCooldown.Duration = 10 * time.Minute
+				data.chat(loadChatID).LastWarningAt = now.Add(-time.Minute)
+			},
+			want: warnSkipCooldown,
+		},
+		{
+			name: "warning cooldown over",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				group.WarningCooldown.Duration = 10 * time.Minute
+				data.chat(loadChatID).LastWarningAt = now.Add(-11 * time.Minute)
+			},
+			want: warnDue,
+		},
+		{
+			name: "warning being sent",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				data.startWarning(loadChatID, warnTestUserID, now.Add(-time.Second))
+			},
+			want: warnSkipBurst,
+		},
+		{
+			name: "warned within the burst",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				data.chat(loadChatID).user(warnTestUserID).WarnedAt = []time.Time{now.Add(-time.Minute)}
+			},
+			want: warnSkipBurst,
+		},
+		{
+			name: "warning lost",
+			setup: func(config *Config, group *GroupConfig, data *Data) {
+				data.startWarning(loadChatID, warnTestUserID, now.Add(-warnInFlightTimeout))
+			},
+			want: warnDue,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			config := newLoadConfig(t)
+			data := newLoadData(t)
+			if test.setup != nil {
+				test.setup(config, config.Groups[0], data)
+			}
+			text := test.text
+			if text == "" {
+				text = "Hello"
+			}
+			if got := decideWarning(config, data, warnTestMessage(text), now.Add(test.later)); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProcessWarnings(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// Messages posted by the same user one after the other.
+		messages []*tgbotapi.Message
+		setup    func(config *Config, data *Data)
+		warnings int
+	}{
+		{
+			name:     "warned once",
+			messages: []*tgbotapi.Message{warnTestMessage("Hello"), warnTestMessage("Anyone here?")},
+			warnings: 1,
+		},
+		{
+			name: "warned once per burst",
+			messages: []*tgbotapi.Message{warnTestMessage("Hello"), warnTestMessage("Anyone here?"),
+				warnTestMessage("My wallet does not start")},
+			setup: func(config *Config, data *Data) {
+				config.Groups[0].WarnAfter.Duration = time.Nanosecond
+			},
+			warnings: 1,
+		},
+		{
+			name: "replies ignored",
+			messages: []*tgbotapi.Message{func() *tgbotapi.Message {
+				msg := warnTestMessage("I agree")
+				msg.ReplyToMessage = warnTestMessage("Hello")
+				return msg
+			}()},
+			warnings: 0,
+		},
+		{
+			name: "bots ignored",
+			messages: []*tgbotapi.Message{func() *tgbotapi.Message {
+				msg := warnTestMessage("Hello")
+				msg.From.IsBot = true
+				return msg
+			}()},
+			warnings: 0,
+		},
+		{
+			name:     "trusted users ignored",
+			messages: []*tgbotapi.Message{warnTestMessage("Hello")},
+			setup: func(config *Config, data *Data) {
+				data.setState(warnTestUserID, &UserState{Kind: stateTrusted, ChatID: loadChatID})
+			},
+			warnings: 0,
+		},
+		{
+			name:     "exempt users ignored",
+			messages: []*tgbotapi.Message{warnTestMessage("Hello")},
+			setup: func(config *Config, data *Data) {
+				config.Groups[0].ExemptUsers = []UserID{warnTestUserID}
+			},
+			warnings: 0,
+		},
+		{
+			name:     "moderators exempt",
+			messages: []*tgbotapi.Message{warnTestMessage("Hello")},
+			setup: func(config *Config, data *Data) {
+				config.Groups[0].ExemptAdmins = true
+				data.Roles = map[UserID]Role{warnTestUserID: roleModerator}
+			},
+			warnings: 0,
+		},
+		{
+			name:     "members not exempt",
+			messages: []*tgbotapi.Message{warnTestMessage("Hello")},
+			setup: func(config *Config, data *Data) {
+				config.Groups[0].ExemptAdmins = true
+			},
+			warnings: 1,
+		},
+		{
+			name:     "no warnings during quiet hours",
+			messages: []*tgbotapi.Message{warnTestMessage("Hello")},
+			setup: func(config *Config, data *Data) {
+				now := time.Now().UTC()
+				quiet := &QuietHours{Schedule: Schedule{
+					Start: now.Add(-time.Hour).Format("15:04"),
+					End:   now.Add(time.Hour).Format("15:04"),
+				}}
+				if err := quiet.compile(); err != nil {
+					t.Fatal(err)
+				}
+				config.Groups[0].QuietHours = quiet
+			},
+			warnings: 0,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			quietLog(t)
+			bot, fake := newFakeTelegram(t)
+			config := newLoadConfig(t)
+			data := newLoadData(t)
+			if test.setup != nil {
+				test.setup(config, data)
+			}
+			for _, msg := range test.messages {
+				process(config, data, bot, msg)
+			}
+			if !flushSendQueues(5 * time.Second) {
+				t.Fatal("timed out sending the queued messages")
+			}
+			if got := fake.count("sendMessage"); got != test.warnings {
+				t.Errorf("got %d warnings, want %d", got, test.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Warnings are templates (text/template), so that they can address the user personally and link
+// the support page of the chat, e.g. "{{.FirstName}}, never respond to DMs. Support: {{.SupportURL}}".
+// The fields available are those of WarningData. Templates are checked when the settings are
+// loaded, so that a typo in a field name is reported right away instead of when the first user is
+// warned. Warnings without placeholders are sent as they are.
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// WarningData are the fields available in the templates of the warnings.
+type WarningData struct {
+	FirstName string
+	LastName  string
+	// Without the leading "@", empty if the user has none.
+	Username   string
+	GroupTitle string
+	// SupportURL of the chat, or of WarningButtons.
+	SupportURL string
+}
+
+// Checked against the templates when the settings are loaded.
+var sampleWarningData = &WarningData{
+	FirstName:  "Satoshi",
+	LastName:   "Nakamoto",
+	Username:   "satoshi",
+	GroupTitle: "BitBox",
+	SupportURL: "https://example.com/support",
+}
+
+// renderWarningTemplate renders the template of a warning.
+func renderWarningTemplate(text string, data *WarningData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("warning").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var result strings.Builder
+	if err := tmpl.Execute(&result, data); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// checkWarningTemplate returns an error if the template of a warning does not parse or uses
+// fields which do not exist.
+func checkWarningTemplate(path string, text string) error {
+	if _, err := renderWarningTemplate(text, sampleWarningData); err != nil {
+		return fieldErrorf(path, "invalid template: %v", err)
+	}
+	return nil
+}
+
+// compileWarningTemplates checks the templates of the warnings shared by all chats.
+func (s *Settings) compileWarningTemplates() error {
+	for path, text := range map[string]string{
+		"WarnMessageEn": s.WarnMessageEn, "WarnMessageDe": s.WarnMessageDe,
+		"FirstQuestionNoteEn": s.FirstQuestionNoteEn, "FirstQuestionNoteDe": s.FirstQuestionNoteDe,
+	} {
+		if err := checkWarningTemplate(path, text); err != nil {
+			return err
+		}
+	}
+	for _, lang := range sortedKeys(s.Messages) {
+		for _, key := range []string{"warning", "warning.question", "warning.short", "warning.dm"} {
+			if err := checkWarningTemplate(fmt.Sprintf("Messages.%s.%s", lang, key), s.Messages[lang][key]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// supportURL returns the URL of the support page linked in the warnings of a chat.
+func (s *Settings) supportURL(chatID ChatID) string {
+	if group := s.group(chatID); group != nil && group.SupportURL != "" {
+		return group.SupportURL
+	}
+	if s.WarningButtons != nil {
+		return s.WarningButtons.SupportURL
+	}
+	return ""
+}
+
+// renderWarning fills in the placeholders of a warning to a user in a chat. A warning which cannot
+// be rendered is sent as it is, as it is better than none.
+func (s *Settings) renderWarning(text string, chat *tgbotapi.Chat, user *tgbotapi.User) string {
+	data := &WarningData{
+		FirstName:  user.FirstName,
+		LastName:   user.LastName,
+		Username:   user.UserName,
+		GroupTitle: chat.Title,
+		SupportURL: s.supportURL(ChatID(chat.ID)),
+	}
+	escapeWarningData(s.warningParseMode(), data)
+	rendered, err := renderWarningTemplate(text, data)
+	if err != nil {
+		chatLogger(ChatID(chat.ID), UserID(user.ID)).Error("could not render warning", "err", err)
+		return text
+	}
+	return rendered
+}
@@ -0,0 +1,163 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// To find out which phrasing of the warning works best, a chat can define several variants of its
+// warning with WarnVariants. Each user is assigned a variant at random, weighted by Weight, and
+// keeps it for later warnings. /stats shows per variant how many users were warned and how many of
+// them reported a scam DM via /gotdm afterwards, i.e. recognized the scam instead of answering it.
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// WarnVariant is a variant of the warning of a chat.
+type WarnVariant struct {
+	// Shown in /stats and recorded for the users who got the variant.
+	Name string
+	// Relative weight of the variant when assigning it to users. Default 1.
+	Weight int `json:",omitempty"`
+	// The warning, in the chat language.
+	Message string
+}
+
+// VariantStats count the users warned with a warning variant in a chat.
+type VariantStats struct {
+	Warned int `json:",omitempty"`
+	// Warned users who reported a DM via /gotdm afterwards.
+	ReportedDMs int `json:",omitempty"`
+}
+
+// compileWarnVariants validates the warning variants of a chat.
+func compileWarnVariants(variants []*WarnVariant) error {
+	seen := map[string]bool{}
+	for i, variant := range variants {
+		path := fmt.Sprintf("WarnVariants[%d]", i)
+		if variant.Name == "" {
+			return fieldErrorf(path+".Name", "must be set")
+		}
+		if seen[variant.Name] {
+			return fieldErrorf(path+".Name", "duplicate variant %q", variant.Name)
+		}
+		seen[variant.Name] = true
+		if variant.Weight < 0 {
+			return fieldErrorf(path+".Weight", "must not be negative")
+		}
+		if variant.Weight == 0 {
+			variant.Weight = 1
+		}
+		if strings.TrimSpace(variant.Message) == "" {
+			return inField(path+".Message", errors.New("must be set"))
+		}
+		if err := checkWarningTemplate(path+".Message", variant.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warnVariant returns the warning variant of a user in a chat, assigning one at random if the user
+// has none yet or their variant was removed. Returns nil if the chat has no variants, or if the
+// warning is in another language than the chat's or overridden by the topic. Must be called with
+// data.lock held.
+func (s *Settings) warnVariant(chatID ChatID, threadID int, lang string, userData *UserData) *WarnVariant {
+	group := s.group(chatID)
+	if group == nil || len(group.WarnVariants) == 0 || lang != s.chatLanguage(chatID) {
+		return nil
+	}
+	if topic := s.topic(chatID, threadID); topic != nil && topic.WarnMessage != "" {
+		return nil
+	}
+	total := 0
+	for _, variant := range group.WarnVariants {
+		if variant.Name == userData.WarnVariant {
+			return variant
+		}
+		total += variant.Weight
+	}
+	pick := rand.Intn(total)
+	for _, variant := range group.WarnVariants {
+		if pick < variant.Weight {
+			userData.WarnVariant = variant.Name
+			return variant
+		}
+		pick -= variant.Weight
+	}
+	return nil
+}
+
+// variantStats returns the statistics of a warning variant in a chat, creating them if needed.
+// Must be called with d.lock held.
+func (d *Data) variantStats(chatID ChatID, name string) *VariantStats {
+	chatData := d.chat(chatID)
+	if chatData.VariantStats == nil {
+		chatData.VariantStats = map[string]*VariantStats{}
+	}
+	stats, ok := chatData.VariantStats[name]
+	if !ok {
+		stats = &VariantStats{}
+		chatData.VariantStats[name] = stats
+	}
+	return stats
+}
+
+// recordVariantWarning counts a warning sent with a variant.
+func (d *Data) recordVariantWarning(chatID ChatID, name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.variantStats(chatID, name).Warned++
+	d.chatChanged(chatID)
+}
+
+// recordVariantReport counts a DM reported via /gotdm by a user in the variant they were warned
+// with, in every chat where they were warned with a variant.
+func (d *Data) recordVariantReport(userID UserID) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for chatID, chatData := range d.ChatData {
+		userData, ok := chatData.UserData[userID]
+		if !ok || userData.WarnVariant == "" || userData.Warnings == 0 {
+			continue
+		}
+		d.variantStats(chatID, userData.WarnVariant).ReportedDMs++
+		d.chatChanged(chatID)
+	}
+}
+
+// variantReport describes the statistics of the warning variants of a chat for /stats. Must be
+// called with d.lock held.
+func (d *Data) variantReport(config *Config, chatID ChatID, lang string) string {
+	group := config.group(chatID)
+	if group == nil || len(group.WarnVariants) == 0 {
+		return ""
+	}
+	var text strings.Builder
+	for _, variant := range group.WarnVariants {
+		var stats VariantStats
+		if chatData, ok := d.ChatData[chatID]; ok && chatData.VariantStats[variant.Name] != nil {
+			stats = *chatData.VariantStats[variant.Name]
+		}
+		rate := 0.0
+		if stats.Warned > 0 {
+			rate = 100 * float64(stats.ReportedDMs) / float64(stats.Warned)
+		}
+		text.WriteString(fmt.Sprintf(config.translate(lang, "Warning %q: %d warned, %d reported a DM (%.1f%%)\n"),
+			variant.Name, stats.Warned, stats.ReportedDMs, rate))
+	}
+	return text.String()
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const watchDurationDefault = 7 * 24 * time.Hour
+
+// forwardToAdmins forwards a message to the admin chat.
+func forwardToAdmins(config *Config, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	if config.AdminChatID == 0 {
+		return
+	}
+	forward := tgbotapi.NewForward(config.AdminChatID, msg.Chat.ID, msg.MessageID)
+	if _, err := send(bot, ChatID(config.AdminChatID), forward); err != nil {
+		messageLogger(msg).Error("could not forward message to admins", "err", err)
+	}
+}
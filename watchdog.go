@@ -0,0 +1,180 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// The bot used to stall silently: the process was alive, but a long poll hung forever and no
+// updates arrived. Updates are now polled by updatePoller, whose requests time out, and a
+// watchdog starts a new poller if no poll succeeded for UpdatesStallAfter.
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	pollTimeout              = 60 * time.Second
+	updatesStallAfterDefault = 5 * time.Minute
+	// Requests to Telegram taking longer than this are aborted.
+	telegramRequestTimeout = pollTimeout + 30*time.Second
+)
+
+var metricPollerRestarts = newCounter("scamwarnbot_poller_restarts_total", "Restarts of the update poller after a stall.")
+
+// Times of the last update received and of the last successful request to Telegram, in unix
+// nanoseconds.
+var (
+	lastUpdateAt     atomic.Int64
+	lastAPISuccessAt atomic.Int64
+)
+
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// recordingTransport records the time of the last successful request to Telegram.
+type recordingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusOK {
+		lastAPISuccessAt.Store(time.Now().UnixNano())
+	}
+	return resp, err
+}
+
+// instrumentClient limits the duration of requests to Telegram, records successful ones and
+// counts failed ones against the APIErrorBudget.
+func instrumentClient(bot *tgbotapi.BotAPI) {
+	base := bot.Client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	bot.Client.Transport = &budgetTransport{base: &recordingTransport{base: base}}
+	apiBudget.lock.Lock()
+	apiBudget.bot = bot
+	apiBudget.lock.Unlock()
+	bot.Client.Timeout = telegramRequestTimeout
+}
+
+// updatePoller receives updates via long polling. Unlike GetUpdatesChan of the library, it can be
+// restarted: a new generation of the poller takes over the offset, and a stalled previous
+// generation drops whatever it receives once its request returns.
+type updatePoller struct {
+	bot     *tgbotapi.BotAPI
+	updates chan Update
+
+	lock       sync.Mutex
+	offset     int
+	generation int
+	lastPollAt time.Time
+}
+
+func newUpdatePoller(bot *tgbotapi.BotAPI) *updatePoller {
+	return &updatePoller{bot: bot, updates: make(chan Update, bot.Buffer), lastPollAt: time.Now()}
+}
+
+// start starts a new generation of the poller, superseding the running one.
+func (p *updatePoller) start(ctx context.Context) {
+	p.lock.Lock()
+	p.generation++
+	generation := p.generation
+	p.lastPollAt = time.Now()
+	p.lock.Unlock()
+	go p.poll(ctx, generation)
+}
+
+func (p *updatePoller) poll(ctx context.Context, generation int) {
+	for ctx.Err() == nil {
+		p.lock.Lock()
+		if p.generation != generation {
+			p.lock.Unlock()
+			return
+		}
+		offset := p.offset
+		p.lock.Unlock()
+
+		updates, err := getUpdates(p.bot, offset, pollTimeout)
+		if err != nil {
+			slog.Warn("could not get updates, retrying in 3 seconds", "err", err)
+			sleepContext(ctx, 3*time.Second)
+			continue
+		}
+
+		var fresh []Update
+		p.lock.Lock()
+		if p.generation != generation {
+			p.lock.Unlock()
+			return
+		}
+		p.lastPollAt = time.Now()
+		for _, update := range updates {
+			if update.UpdateID >= p.offset {
+				p.offset = update.UpdateID + 1
+				fresh = append(fresh, update)
+			}
+		}
+		p.lock.Unlock()
+		for _, update := range fresh {
+			select {
+			case p.updates <- update:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// sinceLastPoll returns how long ago the last poll succeeded.
+func (p *updatePoller) sinceLastPoll() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return time.Since(p.lastPollAt)
+}
+
+// watchdog restarts the poller if no poll succeeded within UpdatesStallAfter.
+func (p *updatePoller) watchdog(ctx context.Context) {
+	for sleepContext(ctx, pollTimeout/2) {
+		stallAfter := currentConfig().UpdatesStallAfter.Duration
+		if since := p.sinceLastPoll(); since > stallAfter {
+			slog.Warn("no updates polled; restarting the poller", "since", since.Round(time.Second))
+			metricPollerRestarts.inc()
+			p.start(ctx)
+		}
+	}
+}
+
+// runningPoller is the running poller, checked by /healthz. Nil with webhooks.
+var runningPoller atomic.Pointer[updatePoller]
+
+// updatesHealth returns "stalled" if no poll succeeded for twice UpdatesStallAfter, i.e. the
+// watchdog could not recover, and "ok" otherwise.
+func updatesHealth() string {
+	poller := runningPoller.Load()
+	if poller != nil && poller.sinceLastPoll() > 2*currentConfig().UpdatesStallAfter.Duration {
+		return "stalled"
+	}
+	return "ok"
+}
@@ -0,0 +1,90 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Header in which Telegram sends the secret token registered with the webhook.
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// webhookReceiver receives the updates Telegram posts to the webhook and feeds them into the same
+// channel as long polling would.
+type webhookReceiver struct {
+	path    string
+	secret  string
+	updates chan Update
+}
+
+// startWebhook registers webhookURL as webhook of the bot. Telegram only delivers to HTTPS URLs;
+// the URL usually points to a reverse proxy forwarding to *listenAddress. The secret token is
+// taken from the config or generated on every start.
+func startWebhook(config *Config, bot *tgbotapi.BotAPI, webhookURL string) (*webhookReceiver, error) {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "https" {
+		return nil, fmt.Errorf("webhook URL %q must use https", webhookURL)
+	}
+	secret := config.WebhookSecret
+	if secret == "" {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(random)
+	}
+	v := url.Values{}
+	v.Add("url", webhookURL)
+	v.Add("secret_token", secret)
+	v.Add("allowed_updates", allowedUpdatesJSON())
+	if _, err := bot.MakeRequest("setWebhook", v); err != nil {
+		return nil, err
+	}
+	path := parsed.Path
+	if path == "" {
+		path = "/"
+	}
+	slog.Info("webhook registered", "path", path)
+	return &webhookReceiver{path: path, secret: secret, updates: make(chan Update, 100)}, nil
+}
+
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookSecretHeader)), []byte(w.secret)) != 1 {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var update Update
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(rw, "invalid update", http.StatusBadRequest)
+		return
+	}
+	w.updates <- update
+}
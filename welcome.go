@@ -0,0 +1,112 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Scammers often DM new members right after they join, before they have written anything. The
+// bot greets them with a warning as soon as they join, and deletes the greeting after a while so
+// the chat is not flooded with greetings.
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const welcomeMessageDefaultEn = "Admins will never DM you first. Anyone offering help in a private message is a scammer: do not respond and never share your recovery words."
+const welcomeMessageDefaultDe = "Admins schreiben dir nie zuerst privat. Wer dir per privater Nachricht Hilfe anbietet, ist ein Betrüger: antworte nicht und gib niemals deine Wiederherstellungswörter preis."
+const welcomeDeleteAfterDefault = 5 * time.Minute
+
+// lastWelcome holds the ID of the most recent greeting in each chat. Only the most recent greeting
+// is kept, so a wave of joins does not flood the chat.
+var lastWelcome = struct {
+	messageIDs map[ChatID]int
+	lock       sync.Mutex
+}{messageIDs: map[ChatID]int{}}
+
+// welcomeMessage returns the warning sent to users joining a chat.
+func (s *Settings) welcomeMessage(chatID ChatID) string {
+	if group := s.group(chatID); group != nil && group.WelcomeMessage != "" {
+		return group.WelcomeMessage
+	}
+	if s.resolveLanguage(s.chatLanguage(chatID), "en", "de") == "de" {
+		return s.WelcomeMessageDe
+	}
+	return s.WelcomeMessageEn
+}
+
+// welcomeNewMembers greets the users who joined a chat with a warning, which is deleted after
+// WelcomeDeleteAfter. Members active in another chat are greeted according to KnownUserWarning.
+func welcomeNewMembers(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) {
+	if !config.WelcomeNewMembers || msg.NewChatMembers == nil {
+		return
+	}
+	chatID := ChatID(msg.Chat.ID)
+	var names []string
+	short := true
+	data.lock.Lock()
+	for _, member := range *msg.NewChatMembers {
+		if member.IsBot {
+			continue
+		}
+		switch data.knownUserWarning(config, UserID(member.ID), chatID) {
+		case knownUserWarningSkip:
+			continue
+		case knownUserWarningFull:
+			short = false
+		}
+		names = append(names, member.String())
+	}
+	data.lock.Unlock()
+	if len(names) == 0 {
+		return
+	}
+	welcome := config.welcomeMessage(chatID)
+	if short {
+		welcome = config.message(config.chatLanguage(chatID), "warning.short")
+	}
+	text := tr(config, msg, "Welcome, %s!", strings.Join(names, ", ")) + "\n\n" + welcome
+	sent, err := send(bot, chatID, tgbotapi.NewMessage(int64(chatID), text))
+	logAction(chatLogger(chatID, 0), "welcome", err, "members", len(names))
+	if err != nil {
+		metricTelegramErrors.inc("sendMessage")
+		return
+	}
+
+	lastWelcome.lock.Lock()
+	previous, ok := lastWelcome.messageIDs[chatID]
+	lastWelcome.messageIDs[chatID] = sent.MessageID
+	lastWelcome.lock.Unlock()
+	if ok {
+		deleteWelcome(bot, chatID, previous)
+	}
+	time.AfterFunc(config.WelcomeDeleteAfter.Duration, func() {
+		lastWelcome.lock.Lock()
+		if lastWelcome.messageIDs[chatID] == sent.MessageID {
+			delete(lastWelcome.messageIDs, chatID)
+		}
+		lastWelcome.lock.Unlock()
+		deleteWelcome(bot, chatID, sent.MessageID)
+	})
+}
+
+func deleteWelcome(bot *tgbotapi.BotAPI, chatID ChatID, messageID int) {
+	_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: int64(chatID), MessageID: messageID})
+	if err != nil {
+		// Happens if the greeting was already deleted, e.g. by an admin.
+		chatLogger(chatID, 0).Debug("could not delete welcome message", "err", err)
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// chatTitle returns the title of a chat for display. Must be called with d.lock held.
+func (d *Data) chatTitle(chatID ChatID) string {
+	if chatID == 0 {
+		return "all chats"
+	}
+	if chatData, ok := d.ChatData[chatID]; ok && chatData.Title != "" {
+		return chatData.Title
+	}
+	return fmt.Sprint(chatID)
+}
+
+// cmdWhois shows what the bot knows about a user: `/whois @user`.
+func cmdWhois(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	userID, _, err := resolveTarget(data, msg)
+	if err != nil {
+		return err.Error()
+	}
+
+	data.lock.Lock()
+	defer data.lock.Unlock()
+
+	var text strings.Builder
+	text.WriteString(data.describeUser(userID) + "\n")
+	if info, ok := data.Users[userID]; ok {
+		for _, alias := range info.Aliases {
+			name := strings.TrimSpace(alias.FirstName + " " + alias.LastName)
+			if alias.UserName != "" {
+				name += " @" + alias.UserName
+			}
+			text.WriteString(tr(config, msg, "Previously: %s (until %s)\n", name, alias.Until.Format(time.RFC1123)))
+		}
+	}
+	for chatID, chatData := range data.ChatData {
+		if userData, ok := chatData.UserData[userID]; ok {
+			text.WriteString(tr(config, msg, "Last message in %s: %s\n",
+				data.chatTitle(chatID), userData.LastMessageAt.Format(time.RFC1123)))
+			if policy := config.strikePolicy(chatID); policy != nil && len(userData.Strikes) > 0 {
+				text.WriteString(tr(config, msg, "Strikes in %s: %.1f\n",
+					data.chatTitle(chatID), userData.currentStrikes(policy, time.Now())))
+			}
+		}
+	}
+	now := time.Now()
+	for _, state := range data.UserStates[userID] {
+		if state.expired(now) {
+			continue
+		}
+		text.WriteString(tr(config, msg, "%s in %s %s", tr(config, msg, string(state.Kind)), data.chatTitle(state.ChatID),
+			state.describeRemaining(&config.Settings, config.chatLanguage(ChatID(msg.Chat.ID)))))
+		if state.Reason != "" {
+			fmt.Fprintf(&text, " (%s)", state.Reason)
+		}
+		text.WriteString("\n")
+	}
+	return text.String()
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Number of action records kept.
+const actionRecordsSize = 5000
+
+// ActionThresholds are the thresholds in effect when an action was taken.
+type ActionThresholds struct {
+	Flag   float64
+	Delete float64
+	Ban    float64
+	// Factor the thresholds were multiplied with (watched users, night mode).
+	Factor float64
+}
+
+// ActionRecord explains an automated action of the bot: what it did and exactly why.
+type ActionRecord struct {
+	ID        string
+	At        time.Time
+	ChatID    ChatID
+	UserID    UserID
+	MessageID int
+	Text      string
+	// The actions taken, e.g. "delete" and "ban".
+	Actions    []string
+	Findings   []Finding
+	Score      float64
+	Thresholds ActionThresholds
+	// Version of the settings in effect.
+	SettingsVersion int
+}
+
+// recordAction stores the record of an automated action, assigning it an ID. Returns the ID.
+func (d *Data) recordAction(record *ActionRecord) string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.NextActionID++
+	record.ID = fmt.Sprintf("A%d", d.NextActionID)
+	d.Actions = append(d.Actions, record)
+	if len(d.Actions) > actionRecordsSize {
+		d.Actions = d.Actions[len(d.Actions)-actionRecordsSize:]
+	}
+	d.markChanged()
+	return record.ID
+}
+
+// action returns the action record with the given ID, or nil. Must be called with d.lock held.
+func (d *Data) action(id string) *ActionRecord {
+	for _, record := range d.Actions {
+		if strings.EqualFold(record.ID, id) {
+			return record
+		}
+	}
+	return nil
+}
+
+// cmdWhy explains an automated action: `/why <action-id>`.
+func cmdWhy(config *Config, data *Data, bot *tgbotapi.BotAPI, msg *tgbotapi.Message) string {
+	args := strings.Fields(msg.CommandArguments())
+	if len(args) != 1 {
+		return tr(config, msg, "Usage: /why <action-id>")
+	}
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	record := data.action(args[0])
+	if record == nil {
+		return tr(config, msg, "No action %s. Only the last %d actions are kept.", args[0], actionRecordsSize)
+	}
+
+	var text strings.Builder
+	text.WriteString(tr(config, msg, "Action %s at %s: %s\n", record.ID,
+		record.At.UTC().Format("2006-01-02 15:04:05 UTC"), strings.Join(record.Actions, ", ")))
+	text.WriteString(tr(config, msg, "Chat: %s\nUser: %s\n", data.chatTitle(record.ChatID), data.describeUser(record.UserID)))
+	text.WriteString(tr(config, msg, "Text: %s\n\n", record.Text))
+	text.WriteString(tr(config, msg, "Score %.2f from:\n", record.Score))
+	for _, finding := range record.Findings {
+		fmt.Fprintf(&text, "- %s (%+.2f): %s", finding.Detector, finding.Score, finding.Reason)
+		if finding.Pattern != "" {
+			text.WriteString(tr(config, msg, " by %s", finding.Pattern))
+		}
+		if finding.Shadow {
+			text.WriteString(tr(config, msg, " (shadow mode, not scored)"))
+		}
+		text.WriteString("\n")
+	}
+	t := record.Thresholds
+	text.WriteString(tr(config, msg, "\nThresholds (settings version %d, factor %.2f): flag %.2f, delete %.2f, ban %.2f\n",
+		record.SettingsVersion, t.Factor, t.Flag*t.Factor, t.Delete*t.Factor, t.Ban*t.Factor))
+	return text.String()
+}
@@ -0,0 +1,208 @@
+// Copyright 2023 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// Serializing the whole state while holding data.lock blocks the processing of messages for longer
+// the larger the state grows. Most changes, however, are to a few members of a chat: each message
+// updates its author and chat. Those changes are recorded as deltas, by row (see sqliteRows), and
+// the background writer serializes only the rows which changed, while holding data.lock only for
+// that, and writes them after releasing it. Many changes to the same row between two saves are
+// written once. Changes to other parts of the state are still marked with data.changed, which
+// makes the writer serialize the whole state; they are rare compared to messages.
+//
+// The SQLite and Redis backends write only the changed rows. The JSON backend keeps the rows of the
+// state in memory, applies the changes to them and writes the file assembled from them.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// rowWriter is implemented by the storages which write the state as rows.
+type rowWriter interface {
+	// writeRows writes rows by row key. Rows with an empty value are deleted. If complete, rows is
+	// the whole state and the stored rows missing in it are deleted.
+	writeRows(rows map[string]string, complete bool) error
+}
+
+var metricSavedRows = newCounter("scamwarnbot_saved_rows_total", "Rows of the state written by the writer, by kind of save: delta or complete.", "kind")
+
+var metricSaveLockDuration = newHistogram("scamwarnbot_save_lock_seconds",
+	"Time the state was locked to serialize the changes, by kind of save: delta or complete.",
+	[]float64{0.0001, 0.001, 0.01, 0.1, 1, 10}, "kind")
+
+var errNoCompleteState = errors.New("no complete state to apply the changes to")
+
+type chatUser struct {
+	chatID ChatID
+	userID UserID
+}
+
+// stateDelta are the rows changed since the last save.
+type stateDelta struct {
+	chats    map[ChatID]bool
+	users    map[chatUser]bool
+	profiles map[UserID]bool
+}
+
+func newStateDelta() *stateDelta {
+	return &stateDelta{chats: map[ChatID]bool{}, users: map[chatUser]bool{}, profiles: map[UserID]bool{}}
+}
+
+func (d *Data) pendingDelta() *stateDelta {
+	if d.delta == nil {
+		d.delta = newStateDelta()
+	}
+	return d.delta
+}
+
+// markChanged records that the state changed in a way only saving the whole state stores. Must be
+// called with d.lock held.
+func (d *Data) markChanged() {
+	d.changed = true
+	d.replicaChanged = true
+}
+
+// chatChanged records that the data of a chat changed, except for its members. Must be called with
+// d.lock held.
+func (d *Data) chatChanged(chatID ChatID) {
+	d.pendingDelta().chats[chatID] = true
+	if d.replicaDelta != nil {
+		d.replicaDelta.chats[chatID] = true
+	}
+}
+
+// userChanged records that the data of a member of a chat changed. Must be called with d.lock
+// held.
+func (d *Data) userChanged(chatID ChatID, userID UserID) {
+	d.pendingDelta().users[chatUser{chatID, userID}] = true
+	if d.replicaDelta != nil {
+		d.replicaDelta.users[chatUser{chatID, userID}] = true
+	}
+}
+
+// profileChanged records that the profile of a user changed. Must be called with d.lock held.
+func (d *Data) profileChanged(userID UserID) {
+	d.pendingDelta().profiles[userID] = true
+	if d.replicaDelta != nil {
+		d.replicaDelta.profiles[userID] = true
+	}
+}
+
+// deltaRows serializes the rows which changed since the last save. Must be called with d.lock
+// held.
+func (d *Data) deltaRows() (map[string]string, error) {
+	return d.rowsOf(d.delta)
+}
+
+// rowsOf serializes the rows of a delta. Rows of deleted chats, members and profiles are empty.
+// Must be called with d.lock held.
+func (d *Data) rowsOf(delta *stateDelta) (map[string]string, error) {
+	rows := map[string]string{}
+	if delta == nil {
+		return rows, nil
+	}
+	for chatID := range delta.chats {
+		rows[chatRowKey(chatID)] = ""
+		if chatData, ok := d.ChatData[chatID]; ok {
+			row, err := chatRow(chatData)
+			if err != nil {
+				return nil, fmt.Errorf("chat %d: %w", chatID, err)
+			}
+			rows[chatRowKey(chatID)] = row
+		}
+	}
+	for key := range delta.users {
+		rows[userRowKey(key.chatID, key.userID)] = ""
+		if chatData, ok := d.ChatData[key.chatID]; ok {
+			if userData, ok := chatData.UserData[key.userID]; ok {
+				row, err := json.Marshal(userData)
+				if err != nil {
+					return nil, fmt.Errorf("user %d in chat %d: %w", key.userID, key.chatID, err)
+				}
+				rows[userRowKey(key.chatID, key.userID)] = string(row)
+			}
+		}
+	}
+	for userID := range delta.profiles {
+		rows[profileRowKey(userID)] = ""
+		if profile, ok := d.Users[userID]; ok {
+			row, err := json.Marshal(profile)
+			if err != nil {
+				return nil, fmt.Errorf("profile of user %d: %w", userID, err)
+			}
+			rows[profileRowKey(userID)] = string(row)
+		}
+	}
+	return rows, nil
+}
+
+// applyRows returns the stored rows after writing rows, see rowWriter. stored is changed in place.
+func applyRows(stored, rows map[string]string, complete bool) map[string]string {
+	if complete {
+		return rows
+	}
+	for key, value := range rows {
+		if value == "" {
+			delete(stored, key)
+		} else {
+			stored[key] = value
+		}
+	}
+	return stored
+}
+
+// saveRows saves the changes of the state to a storage writing rows: only the changed rows, or the
+// whole state if d.changed is set. data.lock is only held to serialize the rows. Returns false if
+// there was nothing to save. Must be called with d.saveLock held.
+func (d *Data) saveRows(writer rowWriter) (bool, error) {
+	kind := "delta"
+	start := time.Now()
+	d.lock.Lock()
+	if !d.changed && d.delta == nil {
+		d.lock.Unlock()
+		return false, nil
+	}
+	var rows map[string]string
+	var err error
+	if d.changed {
+		kind = "complete"
+		rows, err = sqliteRows(d)
+	} else {
+		rows, err = d.deltaRows()
+	}
+	complete := d.changed
+	if err == nil {
+		d.changed = false
+		d.delta = nil
+	}
+	d.lock.Unlock()
+	metricSaveLockDuration.observe(time.Since(start).Seconds(), kind)
+	if err != nil {
+		return false, err
+	}
+
+	if err := writer.writeRows(rows, complete); err != nil {
+		// The rows written before the error are unknown, so the whole state is saved next time.
+		d.lock.Lock()
+		d.changed = true
+		d.lock.Unlock()
+		return false, err
+	}
+	metricSavedRows.add(float64(len(rows)), kind)
+	return true, nil
+}